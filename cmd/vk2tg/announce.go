@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// announceFirstPost sends a one-time "now mirroring" message to the channel
+// before the first post of the group. Channels that already carry posts of
+// the group are marked as announced without a message.
+func (s *wallSyncer) announceFirstPost(ctx context.Context, ownerID int) {
+	if !s.cfg.AnnounceFirst || s.announced {
+		return
+	}
+
+	key := fmt.Sprintf("announced:%s:%d", s.cfg.ChannelID, ownerID)
+	_, done, err := s.store.GetSyncState(ctx, key)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("failed to check first post announcement")
+		return
+	}
+	if !done {
+		recent, err := s.store.RecentTelegramPosts(ctx, ownerID, s.cfg.ChannelID, 1)
+		if err != nil {
+			s.logger.Warn().Err(err).Msg("failed to check previous Telegram posts for announcement")
+			return
+		}
+		if len(recent) == 0 {
+			if _, err := s.publishTextToTelegram(ctx, s.announcement(), telegramSendOptions{}); err != nil {
+				s.logger.Warn().Err(err).Msg("failed to send first post announcement")
+				return
+			}
+			s.logger.Info().Str("channel_id", s.cfg.ChannelID).Msg("announced mirroring of the group")
+		}
+		if err := s.store.SetSyncState(ctx, key, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			s.logger.Warn().Err(err).Msg("failed to store first post announcement")
+		}
+	}
+	s.announced = true
+}
+
+func (s *wallSyncer) announcement() string {
+	group := fmt.Sprintf("https://vk.com/club%s", s.cfg.GroupID)
+	if s.groupName != "" {
+		group = fmt.Sprintf("[%s|%s]", group, s.groupName)
+	}
+	return "📢 Now mirroring posts from " + group
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -23,9 +24,12 @@ type authSuccessPayload struct {
 }
 
 const (
-	vkRefreshURL   = "https://id.vk.ru/oauth2/auth"
-	vkClientID     = "54260965"
+	vkOAuthBaseURL = "https://id.vk.ru"
+	vkClientID     = "54260965" // default VK ID app, overridden by VK_CLIENT_ID
 	maxErrorBodyKB = 4
+
+	refreshAttempts   = 3
+	refreshRetryDelay = 2 * time.Second
 )
 
 func (p authSuccessPayload) validate() error {
@@ -51,33 +55,71 @@ type tokenState struct {
 	lifetime  time.Duration
 }
 
+type tokenStatus struct {
+	HasToken           bool       `json:"has_token"`
+	Valid              bool       `json:"valid"`
+	ValidUntil         *time.Time `json:"valid_until,omitempty"`
+	UpdatedAt          *time.Time `json:"updated_at,omitempty"`
+	NextRefreshAt      *time.Time `json:"next_refresh_at,omitempty"`
+	LastRefreshAttempt *time.Time `json:"last_refresh_attempt_at,omitempty"`
+	LastRefreshFailed  bool       `json:"last_refresh_failed"`
+	LastRefreshErrorAt *time.Time `json:"last_refresh_error_at,omitempty"`
+}
+
+type refreshResult struct {
+	from    string
+	payload authSuccessPayload
+	err     error
+}
+
 type tokenManager struct {
 	logger     zerolog.Logger
 	updateCh   chan authSuccessPayload
+	refreshCh  chan refreshResult
 	requestCh  chan chan string
+	statusCh   chan chan tokenStatus
+	ensureCh   chan chan error
 	httpClient *http.Client
-	store      *storage
+	store      tokenStore
+	oauthBase  string
+	clientID   string
+	expirySkew time.Duration
+	loaded     atomic.Bool
 }
 
-func newTokenManager(logger zerolog.Logger, store *storage) *tokenManager {
+func newTokenManager(logger zerolog.Logger, store tokenStore, oauthBase, clientID string, expirySkew time.Duration) *tokenManager {
 	if store == nil {
 		panic("tokenManager requires non-nil storage")
 	}
 	m := &tokenManager{
-		logger:    logger,
-		updateCh:  make(chan authSuccessPayload),
-		requestCh: make(chan chan string),
-		store:     store,
+		logger:     logger,
+		updateCh:   make(chan authSuccessPayload),
+		refreshCh:  make(chan refreshResult, 1),
+		requestCh:  make(chan chan string),
+		statusCh:   make(chan chan tokenStatus),
+		ensureCh:   make(chan chan error),
+		store:      store,
+		oauthBase:  oauthBase,
+		clientID:   clientID,
+		expirySkew: expirySkew,
 		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout:   10 * time.Second,
+			Transport: outboundTransport,
 		},
 	}
 	go m.run()
 	return m
 }
 
-func (m *tokenManager) Update(payload authSuccessPayload) {
-	m.updateCh <- payload
+// Update hands a payload from the auth page to the manager. It gives up when
+// ctx is done instead of blocking the caller.
+func (m *tokenManager) Update(ctx context.Context, payload authSuccessPayload) error {
+	select {
+	case m.updateCh <- payload:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (m *tokenManager) AccessTokenRequests() chan<- chan string {
@@ -100,15 +142,85 @@ func (m *tokenManager) RequestAccessToken(ctx context.Context) (string, error) {
 	}
 }
 
+// EnsureToken returns once a usable access token is available, refreshing
+// the stored one first when it has expired or is within the expiry skew. It
+// serves single runs that can't wait for the background refresh.
+func (m *tokenManager) EnsureToken(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case m.ensureCh <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *tokenManager) Status(ctx context.Context) (tokenStatus, error) {
+	reply := make(chan tokenStatus, 1)
+	select {
+	case m.statusCh <- reply:
+	case <-ctx.Done():
+		return tokenStatus{}, ctx.Err()
+	}
+
+	select {
+	case status := <-reply:
+		return status, nil
+	case <-ctx.Done():
+		return tokenStatus{}, ctx.Err()
+	}
+}
+
 func (m *tokenManager) run() {
 	ticker := time.NewTicker(60 * time.Second)
 	defer ticker.Stop()
 
-	state := m.loadInitialState()
+	state, loaded := m.loadInitialState()
+	if loaded {
+		m.loaded.Store(true)
+	}
+
+	var (
+		lastRefreshAttempt time.Time
+		lastRefreshErrorAt time.Time
+		lastAuthToken      string
+		// refreshing holds the refresh token of the refresh running in the
+		// background, which retries for a while and mustn't block requests.
+		refreshing string
+		// waiting holds the EnsureToken calls answered when it finishes.
+		waiting []chan error
+	)
+	startRefresh := func() {
+		lastRefreshAttempt = time.Now()
+		refreshing = state.payload.RefreshToken
+		go func(payload authSuccessPayload) {
+			refreshed, err := m.refreshToken(payload)
+			m.refreshCh <- refreshResult{from: payload.RefreshToken, payload: refreshed, err: err}
+		}(state.payload)
+	}
+	answerWaiting := func(err error) {
+		for _, reply := range waiting {
+			reply <- err
+		}
+		waiting = nil
+	}
 
 	for {
 		select {
 		case payload := <-m.updateCh:
+			// A repeated POST from the auth page carries the token already
+			// stored, or one a refresh has since replaced; both are stale.
+			if payload.AccessToken == lastAuthToken || (state != nil && payload.AccessToken == state.payload.AccessToken) {
+				m.logger.Info().
+					Msg("ignored duplicate auth success payload")
+				continue
+			}
 			newState, err := m.persistPayload(payload)
 			if err != nil {
 				m.logger.Error().
@@ -117,18 +229,95 @@ func (m *tokenManager) run() {
 				continue
 			}
 			state = newState
+			lastAuthToken = payload.AccessToken
 			m.logger.Info().
 				Dur("lifetime", newState.lifetime).
 				Msg("received auth success payload")
 
 		case reply := <-m.requestCh:
 			token := ""
-			if state != nil && state.payload.AccessToken != "" && time.Now().Before(state.expiresAt) {
+			if state != nil && state.usable(time.Now(), m.expirySkew, refreshing != "") {
 				token = state.payload.AccessToken
 			}
 			reply <- token
 
+		case reply := <-m.statusCh:
+			status := tokenStatus{
+				LastRefreshFailed: !lastRefreshErrorAt.IsZero() && !lastRefreshErrorAt.Before(lastRefreshAttempt),
+			}
+			if state != nil && state.payload.AccessToken != "" {
+				status.HasToken = true
+				status.Valid = state.usable(time.Now(), m.expirySkew, refreshing != "")
+				status.ValidUntil = timePtr(state.expiresAt)
+				status.UpdatedAt = timePtr(state.updatedAt)
+				status.NextRefreshAt = timePtr(state.refreshEligibleAt())
+			}
+			if !lastRefreshAttempt.IsZero() {
+				status.LastRefreshAttempt = timePtr(lastRefreshAttempt)
+			}
+			if !lastRefreshErrorAt.IsZero() {
+				status.LastRefreshErrorAt = timePtr(lastRefreshErrorAt)
+			}
+			reply <- status
+
+		case reply := <-m.ensureCh:
+			switch {
+			case !loaded:
+				reply <- errors.New("stored tokens failed to load")
+			case state != nil && state.usable(time.Now(), m.expirySkew, false):
+				reply <- nil
+			case state == nil || state.payload.RefreshToken == "":
+				reply <- errors.New("no usable access token stored, authorize on the auth page")
+			default:
+				waiting = append(waiting, reply)
+				if refreshing == "" {
+					m.logger.Info().
+						Msg("access token unusable, refreshing it now")
+					startRefresh()
+				}
+			}
+
+		case result := <-m.refreshCh:
+			refreshing = ""
+			if state == nil || state.payload.RefreshToken != result.from {
+				m.logger.Info().
+					Msg("tokens replaced during refresh, discarding refresh result")
+				if state != nil && state.usable(time.Now(), m.expirySkew, false) {
+					answerWaiting(nil)
+				} else {
+					answerWaiting(errors.New("tokens replaced during refresh"))
+				}
+				continue
+			}
+			if result.err != nil {
+				lastRefreshErrorAt = time.Now()
+				m.logger.Error().
+					Err(result.err).
+					Msg("token refresh failed")
+				answerWaiting(fmt.Errorf("refresh access token: %w", result.err))
+				continue
+			}
+
+			newState, err := m.persistPayload(result.payload)
+			if err != nil {
+				lastRefreshErrorAt = time.Now()
+				m.logger.Error().
+					Err(err).
+					Msg("failed to persist refreshed token")
+				answerWaiting(fmt.Errorf("persist refreshed token: %w", err))
+				continue
+			}
+			state = newState
+			answerWaiting(nil)
+
+			m.logger.Info().
+				Dur("lifetime", newState.lifetime).
+				Msg("token refresh succeeded")
+
 		case <-ticker.C:
+			if refreshing != "" {
+				continue
+			}
 			if state == nil {
 				m.logger.Info().
 					Msg("state is null")
@@ -161,40 +350,52 @@ func (m *tokenManager) run() {
 			m.logger.Info().
 				Msg("refresh token triggered")
 
-			refreshed, err := m.refreshToken(state.payload)
-			if err != nil {
-				m.logger.Error().
-					Err(err).
-					Msg("token refresh failed")
-				continue
-			}
+			startRefresh()
+		}
+	}
+}
 
-			newState, err := m.persistPayload(refreshed)
-			if err != nil {
-				m.logger.Error().
-					Err(err).
-					Msg("failed to persist refreshed token")
-				continue
-			}
-			state = newState
+// usable reports whether the access token may be handed out. Tokens within
+// skew of expiry are withheld, since VK may already consider them expired,
+// unless a refresh is running that will replace them: the refresh retries
+// for a while, and serving the old token until its actual expiry keeps
+// syncing in the meantime.
+func (s *tokenState) usable(now time.Time, skew time.Duration, refreshRunning bool) bool {
+	if s.payload.AccessToken == "" || !now.Before(s.expiresAt) {
+		return false
+	}
+	if now.Before(s.expiresAt.Add(-skew)) {
+		return true
+	}
+	return refreshRunning && s.payload.RefreshToken != ""
+}
 
-			m.logger.Info().
-				Dur("lifetime", newState.lifetime).
-				Msg("token refresh succeeded")
-		}
+func (s *tokenState) refreshEligibleAt() time.Time {
+	if s.lifetime <= 0 {
+		return s.updatedAt
 	}
+	return s.expiresAt.Add(-time.Duration(float64(s.lifetime) * 0.15))
+}
+
+func timePtr(t time.Time) *time.Time {
+	t = t.UTC()
+	return &t
+}
+
+func (m *tokenManager) Loaded() bool {
+	return m.loaded.Load()
 }
 
-func (m *tokenManager) loadInitialState() *tokenState {
+func (m *tokenManager) loadInitialState() (*tokenState, bool) {
 	record, err := m.store.LoadTokenState(context.Background())
 	if err != nil {
 		m.logger.Error().
 			Err(err).
 			Msg("failed to load auth tokens from storage")
-		return nil
+		return nil, false
 	}
 	if record == nil {
-		return nil
+		return nil, true
 	}
 
 	lifetime := record.expiresAt.Sub(record.updatedAt)
@@ -211,7 +412,7 @@ func (m *tokenManager) loadInitialState() *tokenState {
 		updatedAt: record.updatedAt,
 		expiresAt: record.expiresAt,
 		lifetime:  lifetime,
-	}
+	}, true
 }
 
 func (m *tokenManager) persistPayload(payload authSuccessPayload) (*tokenState, error) {
@@ -242,7 +443,7 @@ func (m *tokenManager) refreshToken(payload authSuccessPayload) (authSuccessPayl
 	form := url.Values{}
 	form.Set("grant_type", "refresh_token")
 	form.Set("refresh_token", payload.RefreshToken)
-	form.Set("client_id", vkClientID)
+	form.Set("client_id", m.clientID)
 	if payload.DeviceID != "" {
 		form.Set("device_id", payload.DeviceID)
 	}
@@ -250,43 +451,69 @@ func (m *tokenManager) refreshToken(payload authSuccessPayload) (authSuccessPayl
 		form.Set("state", payload.State)
 	}
 
+	var refreshed authSuccessPayload
+	for attempt := 1; ; attempt++ {
+		var (
+			retryable bool
+			err       error
+		)
+		refreshed, retryable, err = m.postRefresh(form)
+		if err == nil {
+			break
+		}
+		if !retryable || attempt == refreshAttempts {
+			return authSuccessPayload{}, err
+		}
+		m.logger.Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Msg("token refresh request failed, retrying")
+		time.Sleep(time.Duration(attempt) * refreshRetryDelay)
+	}
+
+	if refreshed.DeviceID == "" {
+		refreshed.DeviceID = payload.DeviceID
+	}
+	if refreshed.State == "" {
+		refreshed.State = payload.State
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = payload.RefreshToken
+	}
+
+	if err := refreshed.validate(); err != nil {
+		return authSuccessPayload{}, fmt.Errorf("invalid refresh response: %w", err)
+	}
+	return refreshed, nil
+}
+
+// postRefresh makes a single refresh request. Network errors and 5xx
+// responses are reported as retryable; 4xx means the refresh token itself was
+// rejected, so retrying won't help.
+func (m *tokenManager) postRefresh(form url.Values) (authSuccessPayload, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, vkRefreshURL, strings.NewReader(form.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.oauthBase+"/oauth2/auth", strings.NewReader(form.Encode()))
 	if err != nil {
-		return authSuccessPayload{}, fmt.Errorf("build refresh request: %w", err)
+		return authSuccessPayload{}, false, fmt.Errorf("build refresh request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := m.httpClient.Do(req)
 	if err != nil {
-		return authSuccessPayload{}, fmt.Errorf("execute refresh request: %w", err)
+		return authSuccessPayload{}, true, fmt.Errorf("execute refresh request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyKB*1024))
-		return authSuccessPayload{}, fmt.Errorf("refresh request failed with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return authSuccessPayload{}, resp.StatusCode >= http.StatusInternalServerError, fmt.Errorf("refresh request failed with %s: %s", resp.Status, strings.TrimSpace(string(body)))
 	}
 
 	var refreshed authSuccessPayload
 	if err := json.NewDecoder(resp.Body).Decode(&refreshed); err != nil {
-		return authSuccessPayload{}, fmt.Errorf("decode refresh response: %w", err)
-	}
-
-	if refreshed.DeviceID == "" {
-		refreshed.DeviceID = payload.DeviceID
-	}
-	if refreshed.State == "" {
-		refreshed.State = payload.State
+		return authSuccessPayload{}, false, fmt.Errorf("decode refresh response: %w", err)
 	}
-	if refreshed.RefreshToken == "" {
-		refreshed.RefreshToken = payload.RefreshToken
-	}
-
-	if err := refreshed.validate(); err != nil {
-		return authSuccessPayload{}, fmt.Errorf("invalid refresh response: %w", err)
-	}
-	return refreshed, nil
+	return refreshed, false, nil
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRefreshToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		calls    int32
+	}{
+		{"success", []int{http.StatusOK}, false, 1},
+		{"retries server errors", []int{http.StatusBadGateway, http.StatusOK}, false, 2},
+		{"rejected refresh token", []int{http.StatusBadRequest}, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				if err := r.ParseForm(); err != nil || r.Form.Get("client_id") != "777" || r.Form.Get("refresh_token") != "refresh" {
+					t.Errorf("unexpected refresh form %v", r.Form)
+				}
+				status := tt.statuses[min(int(n), len(tt.statuses))-1]
+				if status != http.StatusOK {
+					http.Error(w, "nope", status)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]any{"access_token": "new", "expires_in": 3600})
+			}))
+			defer server.Close()
+
+			m := &tokenManager{logger: zerolog.Nop(), httpClient: server.Client(), oauthBase: server.URL, clientID: "777"}
+			refreshed, err := m.refreshToken(authSuccessPayload{AccessToken: "old", RefreshToken: "refresh", DeviceID: "device"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.calls {
+				t.Fatalf("calls = %d, want %d", got, tt.calls)
+			}
+			if err == nil && (refreshed.AccessToken != "new" || refreshed.RefreshToken != "refresh" || refreshed.DeviceID != "device") {
+				t.Fatalf("refreshed = %+v", refreshed)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenOAuthBaseURL(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "new", "expires_in": 3600})
+	}))
+	defer server.Close()
+
+	t.Setenv("VK_OAUTH_BASE_URL", server.URL+"/oauth-proxy/")
+	base, err := envBaseURL("VK_OAUTH_BASE_URL", vkOAuthBaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &tokenManager{logger: zerolog.Nop(), httpClient: server.Client(), oauthBase: base, clientID: "777"}
+	if _, err := m.refreshToken(authSuccessPayload{RefreshToken: "refresh", DeviceID: "device"}); err != nil {
+		t.Fatalf("refreshToken: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/oauth-proxy/oauth2/auth" {
+		t.Fatalf("requested paths = %q, want the overridden OAuth host", paths)
+	}
+}
+
+func TestTokenStateUsable(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	skew := 30 * time.Second
+	tests := []struct {
+		name           string
+		expiresIn      time.Duration
+		refreshToken   string
+		refreshRunning bool
+		want           bool
+	}{
+		{"outside the skew", 31 * time.Second, "", false, true},
+		{"inside the skew", 29 * time.Second, "", false, false},
+		{"inside the skew with no refresh running", 29 * time.Second, "refresh", false, false},
+		{"inside the skew with a refresh running", 29 * time.Second, "refresh", true, true},
+		{"inside the skew without a refresh token", 29 * time.Second, "", true, false},
+		{"expired with a refresh running", 0, "refresh", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &tokenState{
+				payload:   authSuccessPayload{AccessToken: "vk-token", RefreshToken: tt.refreshToken},
+				expiresAt: now.Add(tt.expiresIn),
+			}
+			if got := state.usable(now, skew, tt.refreshRunning); got != tt.want {
+				t.Fatalf("usable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenManagerWithholdsTokenInsideSkew(t *testing.T) {
+	store := newMemStore()
+	now := time.Now()
+	store.token = &tokenRecord{
+		payload:   authSuccessPayload{AccessToken: "vk-token", RefreshToken: "refresh", ExpiresIn: 3600},
+		updatedAt: now.Add(-time.Hour),
+		expiresAt: now.Add(10 * time.Second),
+	}
+	m := newTokenManager(zerolog.Nop(), store, "http://127.0.0.1:0", "1", time.Minute)
+	ctx := context.Background()
+
+	token, err := m.RequestAccessToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		t.Fatalf("access token = %q inside the skew with no refresh running, want it withheld", token)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Valid {
+		t.Fatal("status reports the token valid inside the skew with no refresh running")
+	}
+}
+
+// countingTokenStore counts the token states written to a memStore.
+type countingTokenStore struct {
+	*memStore
+	upserts atomic.Int32
+}
+
+func (c *countingTokenStore) UpsertTokenState(ctx context.Context, payload authSuccessPayload, updatedAt, expiresAt time.Time) error {
+	c.upserts.Add(1)
+	return c.memStore.UpsertTokenState(ctx, payload, updatedAt, expiresAt)
+}
+
+func TestTokenManagerIgnoresDuplicateUpdates(t *testing.T) {
+	store := &countingTokenStore{memStore: newMemStore()}
+	m := newTokenManager(zerolog.Nop(), store, "http://127.0.0.1:0", "1", time.Minute)
+	ctx := context.Background()
+
+	first := authSuccessPayload{AccessToken: "first", RefreshToken: "refresh", ExpiresIn: 3600}
+	for _, payload := range []authSuccessPayload{first, first, {AccessToken: "second", RefreshToken: "refresh", ExpiresIn: 3600}} {
+		if err := m.Update(ctx, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Requests are served by the same loop, so this waits for the updates.
+	token, err := m.RequestAccessToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "second" {
+		t.Fatalf("access token = %q, want the new one", token)
+	}
+	if n := store.upserts.Load(); n != 2 {
+		t.Fatalf("persisted token states = %d, want the duplicate skipped", n)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	emptyEditKeep   = "keep"
+	emptyEditLink   = "link"
+	emptyEditDelete = "delete"
+
+	emptyPostCacheSize = 256
+)
+
+var emptyEditPolicies = []string{emptyEditKeep, emptyEditLink, emptyEditDelete}
+
+// confirmEmptyPost reports whether the post was already empty on the previous
+// sighting. VK briefly returns empty posts while they are being edited, so a
+// post counts as emptied only when it stays empty for two cycles.
+func (s *wallSyncer) confirmEmptyPost(post vkPost) bool {
+	key := fmt.Sprintf("%d_%d", post.OwnerID, post.ID)
+	if s.emptyPosts[key] {
+		return true
+	}
+	if s.emptyPosts == nil || len(s.emptyPosts) >= emptyPostCacheSize {
+		s.emptyPosts = make(map[string]bool)
+	}
+	s.emptyPosts[key] = true
+	return false
+}
+
+func (s *wallSyncer) forgetEmptyPost(post vkPost) {
+	delete(s.emptyPosts, fmt.Sprintf("%d_%d", post.OwnerID, post.ID))
+}
+
+// applyEmptyEditPolicy handles a published post whose text and attachments
+// were all removed on VK, according to SYNC_ON_EMPTY_EDIT.
+func (s *wallSyncer) applyEmptyEditPolicy(ctx context.Context, post vkPost, rec vkPostRecord) error {
+	switch s.cfg.OnEmptyEdit {
+	case emptyEditLink:
+		if _, err := s.updateTelegramPostContent(ctx, post, s.composeText(post, "")); err != nil {
+			return err
+		}
+	case emptyEditDelete:
+		old, err := s.store.TelegramPosts(ctx, post.OwnerID, post.ID)
+		if err != nil {
+			return fmt.Errorf("lookup Telegram posts: %w", err)
+		}
+		for _, msg := range old {
+			chatID := msg.ChannelID
+			if chatID == "" {
+				chatID = s.cfg.ChannelID
+			}
+			if err := s.deleteTelegramMessage(ctx, chatID, msg.MessageID); err != nil && !isTelegramBadRequest(err) {
+				return fmt.Errorf("delete Telegram message %d: %w", msg.MessageID, err)
+			}
+			if err := s.store.DeleteTelegramPost(ctx, post.OwnerID, post.ID, msg.ChannelID, msg.MessageID); err != nil {
+				return fmt.Errorf("remove Telegram message record %d: %w", msg.MessageID, err)
+			}
+		}
+	}
+
+	if _, err := s.store.UpdateVKPostAfterEdit(ctx, rec); err != nil {
+		return fmt.Errorf("persist updated VK post hash: %w", err)
+	}
+	s.forgetEmptyPost(post)
+	s.logger.Info().
+		Int("owner_id", post.OwnerID).
+		Int("post_id", post.ID).
+		Str("policy", s.cfg.OnEmptyEdit).
+		Msg("post was emptied on VK")
+	return nil
+}
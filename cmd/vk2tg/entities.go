@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+var vkMentionPattern = regexp.MustCompile(`\[((?:id|club|public|event)\d+|https?://[^|\]\s]+)\|([^\]]+)\]`)
+
+type telegramEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+}
+
+// renderVKText replaces VK wiki links such as [id1|Name] or
+// [https://example.com|label] with their label and returns text_link
+// entities pointing at the targets. Offsets are in UTF-16 code units, as
+// Telegram expects.
+func renderVKText(text string) (string, []telegramEntity) {
+	matches := vkMentionPattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, nil
+	}
+
+	var (
+		b        strings.Builder
+		entities []telegramEntity
+		offset   int
+		last     int
+	)
+	for _, m := range matches {
+		before := text[last:m[0]]
+		b.WriteString(before)
+		offset += utf16Len(before)
+
+		target := text[m[2]:m[3]]
+		label := text[m[4]:m[5]]
+		if !strings.HasPrefix(target, "http") {
+			target = "https://vk.com/" + target
+		}
+
+		b.WriteString(label)
+		length := utf16Len(label)
+		entities = append(entities, telegramEntity{
+			Type:   "text_link",
+			Offset: offset,
+			Length: length,
+			URL:    target,
+		})
+		offset += length
+		last = m[1]
+	}
+	b.WriteString(text[last:])
+	return b.String(), entities
+}
+
+// captionLength measures text the way Telegram does: after wiki links are
+// rendered, in UTF-16 code units.
+func captionLength(text string) int {
+	plain, _ := renderVKText(text)
+	return utf16Len(plain)
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func setRenderedText(params url.Values, textKey, entitiesKey, text string) (string, error) {
+	plain, entities := renderVKText(text)
+	params.Set(textKey, plain)
+	if len(entities) > 0 {
+		payload, err := json.Marshal(entities)
+		if err != nil {
+			return "", fmt.Errorf("encode %s: %w", entitiesKey, err)
+		}
+		params.Set(entitiesKey, string(payload))
+	}
+	return plain, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSetRenderedText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		plain    string
+		entities string
+	}{
+		{"plain text", "просто текст", "просто текст", ""},
+		{"user mention", "Привет, [id1|Павел]!", "Привет, Павел!", `[{"type":"text_link","offset":8,"length":5,"url":"https://vk.com/id1"}]`},
+		{"external link", "see [https://example.com/a|this]", "see this", `[{"type":"text_link","offset":4,"length":4,"url":"https://example.com/a"}]`},
+		{"utf-16 offsets", "😀 [club5|группа] и [public7|паблик]", "😀 группа и паблик", `[{"type":"text_link","offset":3,"length":6,"url":"https://vk.com/club5"},{"type":"text_link","offset":12,"length":6,"url":"https://vk.com/public7"}]`},
+		{"not a vk link", "[notalink|label]", "[notalink|label]", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{}
+			plain, err := setRenderedText(params, "text", "entities", tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain != tt.plain || params.Get("text") != tt.plain {
+				t.Fatalf("text = %q (param %q), want %q", plain, params.Get("text"), tt.plain)
+			}
+			if got := params.Get("entities"); got != tt.entities {
+				t.Fatalf("entities = %s, want %s", got, tt.entities)
+			}
+		})
+	}
+}
+
+func TestCaptionLength(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"abc", 3},
+		{"привет", 6},
+		{"😀", 2},
+		{"[id1|Павел] 😀", 8},
+	}
+	for _, tt := range tests {
+		if got := captionLength(tt.text); got != tt.want {
+			t.Errorf("captionLength(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvBaseURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"unset", "", "https://api.example.org", false},
+		{"custom host", "http://127.0.0.1:8081", "http://127.0.0.1:8081", false},
+		{"trailing slash", " https://bot.example.com/api/ ", "https://bot.example.com/api", false},
+		{"no scheme", "bot.example.com", "", true},
+		{"no host", "https://", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_BASE_URL", tt.value)
+			got, err := envBaseURL("TEST_BASE_URL", "https://api.example.org")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("envBaseURL error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("envBaseURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"unset", "", time.Minute, false},
+		{"seconds", "30s", 30 * time.Second, false},
+		{"compound", " 1h30m ", 90 * time.Minute, false},
+		{"bare number", "30", 0, true},
+		{"garbage", "soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_DURATION", tt.value)
+			got, err := envDuration("TEST_DURATION", time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("envDuration error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("envDuration = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
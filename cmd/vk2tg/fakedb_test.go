@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is a database/sql driver that records every statement and answers
+// queries through a callback, for exercising storage without Postgres.
+type fakeDB struct {
+	mu      sync.Mutex
+	queries []fakeQuery
+	answer  func(query string, args []driver.Value) (columns []string, rows [][]driver.Value, err error)
+	// stalePrepared, when set, fails every prepared statement run.
+	stalePrepared error
+	// commits and rollbacks count finished transactions.
+	commits   int
+	rollbacks int
+}
+
+type fakeQuery struct {
+	query    string
+	args     []driver.Value
+	prepared bool
+}
+
+// newFakeStorage returns a storage backed by a fakeDB that answers queries
+// with answer; a nil answer returns no rows.
+func newFakeStorage(t *testing.T, answer func(query string, args []driver.Value) ([]string, [][]driver.Value, error)) (*storage, *fakeDB) {
+	t.Helper()
+	db := &fakeDB{answer: answer}
+	sqlDB := sql.OpenDB(db)
+	t.Cleanup(func() { sqlDB.Close() })
+	return &storage{db: sqlDB, timeout: time.Second, tables: tableNames("")}, db
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+func (db *fakeDB) record(query string, named []driver.NamedValue, prepared bool) []driver.Value {
+	args := make([]driver.Value, len(named))
+	for i, arg := range named {
+		args[i] = arg.Value
+	}
+	db.mu.Lock()
+	db.queries = append(db.queries, fakeQuery{query: query, args: args, prepared: prepared})
+	db.mu.Unlock()
+	return args
+}
+
+func (db *fakeDB) exec(query string, named []driver.NamedValue, prepared bool) (driver.Result, error) {
+	args := db.record(query, named, prepared)
+	if prepared && db.stalePrepared != nil {
+		return nil, db.stalePrepared
+	}
+	// Statements affect one row unless answer returns the affected rows.
+	affected := int64(1)
+	if db.answer != nil {
+		_, rows, err := db.answer(query, args)
+		if err != nil {
+			return nil, err
+		}
+		if rows != nil {
+			affected = int64(len(rows))
+		}
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (db *fakeDB) query(query string, named []driver.NamedValue, prepared bool) (driver.Rows, error) {
+	args := db.record(query, named, prepared)
+	if prepared && db.stalePrepared != nil {
+		return nil, db.stalePrepared
+	}
+	if db.answer == nil {
+		return &fakeRows{}, nil
+	}
+	columns, rows, err := db.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+// executed returns the recorded statements.
+func (db *fakeDB) executed() []fakeQuery {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]fakeQuery(nil), db.queries...)
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{c.db}, nil }
+
+func (c fakeConn) ExecContext(_ context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	return c.db.exec(query, named, false)
+}
+
+func (c fakeConn) QueryContext(_ context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	return c.db.query(query, named, false)
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("fakedb: use ExecContext")
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("fakedb: use QueryContext")
+}
+
+func (s fakeStmt) ExecContext(_ context.Context, named []driver.NamedValue) (driver.Result, error) {
+	return s.db.exec(s.query, named, true)
+}
+
+func (s fakeStmt) QueryContext(_ context.Context, named []driver.NamedValue) (driver.Rows, error) {
+	return s.db.query(s.query, named, true)
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.commits++
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.rollbacks++
+	return nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
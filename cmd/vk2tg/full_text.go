@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// vkTruncatedTextMinRunes is the shortest text treated as possibly cut off by
+// wall.get. Shorter texts ending with an ellipsis are left alone, since that
+// is usually the author's own punctuation.
+const (
+	vkTruncatedTextMinRunes = 500
+	fullTextCacheSize       = 256
+)
+
+func postLooksTruncated(post vkPost) bool {
+	text := strings.TrimSpace(post.Text)
+	if !strings.HasSuffix(text, "…") && !strings.HasSuffix(text, "...") {
+		return false
+	}
+	return utf8.RuneCountInString(text) >= vkTruncatedTextMinRunes
+}
+
+// restoreTruncatedTexts replaces texts that wall.get appears to have cut off
+// with the full version from wall.getById. Results are remembered per post
+// hash so a post that merely ends with an ellipsis costs one extra call.
+func (s *wallSyncer) restoreTruncatedTexts(ctx context.Context, accessToken string, posts []vkPost) {
+	if s.fullTexts == nil {
+		s.fullTexts = make(map[string]string)
+	}
+
+	var ids []string
+	for i, post := range posts {
+		if !postLooksTruncated(post) {
+			continue
+		}
+		key := fullTextKey(post)
+		if full, ok := s.fullTexts[key]; ok {
+			if full != "" {
+				posts[i].Text = full
+			}
+			continue
+		}
+		ids = append(ids, fmt.Sprintf("%d_%d", post.OwnerID, post.ID))
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	params := url.Values{}
+	params.Set("posts", strings.Join(ids, ","))
+	params.Set("extended", "1")
+
+	var result vkWallResponse
+	if err := s.callVK(ctx, "wall.getById", accessToken, params, &result); err != nil {
+		s.logger.Warn().Err(err).Int("posts", len(ids)).Msg("failed to fetch full text of truncated posts")
+		return
+	}
+	s.warnSkippedItems("wall.getById", result)
+	s.rememberOwnerNames(result.ownerNames())
+
+	full := make(map[string]string, len(result.Items))
+	for _, item := range result.Items {
+		full[fmt.Sprintf("%d_%d", item.OwnerID, item.ID)] = item.Text
+	}
+
+	if len(s.fullTexts) > fullTextCacheSize {
+		clear(s.fullTexts)
+	}
+	for i, post := range posts {
+		text, ok := full[fmt.Sprintf("%d_%d", post.OwnerID, post.ID)]
+		if !ok || !postLooksTruncated(post) {
+			continue
+		}
+		prefix := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(post.Text), "…"), "...")
+		if utf8.RuneCountInString(text) <= utf8.RuneCountInString(post.Text) || !strings.HasPrefix(text, prefix) {
+			s.fullTexts[fullTextKey(post)] = ""
+			continue
+		}
+		s.fullTexts[fullTextKey(post)] = text
+		posts[i].Text = text
+		s.logger.Info().
+			Int("owner_id", post.OwnerID).
+			Int("post_id", post.ID).
+			Int("truncated_length", utf8.RuneCountInString(post.Text)).
+			Int("full_length", utf8.RuneCountInString(text)).
+			Msg("restored full text of truncated VK post")
+	}
+}
+
+func fullTextKey(post vkPost) string {
+	return fmt.Sprintf("%d_%d:%s", post.OwnerID, post.ID, post.Hash)
+}
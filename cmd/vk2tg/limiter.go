@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// publishLimiter bounds how many syncers talk to Telegram at the same time.
+// A single limiter is shared by every wallSyncer using the same bot.
+type publishLimiter struct {
+	slots chan struct{}
+}
+
+func newPublishLimiter(concurrency int) *publishLimiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &publishLimiter{slots: make(chan struct{}, concurrency)}
+}
+
+func (l *publishLimiter) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: wait for publish slot: %w", errTelegramRateLimited, ctx.Err())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublishLimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		free        int
+	}{
+		{"single", 1, 1},
+		{"clamped", 0, 1},
+		{"several", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newPublishLimiter(tt.concurrency)
+			var releases []func()
+			for i := 0; i < tt.free; i++ {
+				release, err := l.Acquire(context.Background())
+				if err != nil {
+					t.Fatalf("acquire %d: %v", i, err)
+				}
+				releases = append(releases, release)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if _, err := l.Acquire(ctx); !errors.Is(err, errTelegramRateLimited) {
+				t.Fatalf("acquire beyond the limit = %v, want errTelegramRateLimited", err)
+			}
+
+			releases[0]()
+			release, err := l.Acquire(context.Background())
+			if err != nil {
+				t.Fatalf("acquire after release: %v", err)
+			}
+			release()
+		})
+	}
+}
+
+func TestSyncSharedLimiterSerializesGroups(t *testing.T) {
+	var (
+		nextID   atomic.Int64
+		inFlight atomic.Int32
+		peak     atomic.Int32
+	)
+	tgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"date":%d}}`, nextID.Add(1), time.Now().Unix())
+	}))
+	defer tgServer.Close()
+
+	store := newTestMemStore()
+	limiter := newPublishLimiter(1)
+	var syncers []*wallSyncer
+	for group := 1; group <= 2; group++ {
+		var posts []vkPost
+		for id := 1; id <= 3; id++ {
+			post := newTestPost(id, fmt.Sprintf("group %d post %d", group, id))
+			post.OwnerID = -group
+			posts = append(posts, post)
+		}
+		_, vkServer := newFakeVK(t, posts...)
+		s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"VK_GROUP_ID": fmt.Sprint(group)})
+		s.limiter = limiter
+		syncers = append(syncers, s)
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range syncers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.runOnce(context.Background()); err != nil {
+				t.Errorf("sync: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := nextID.Load(); got != 6 {
+		t.Fatalf("Telegram calls = %d, want 6", got)
+	}
+	if got := peak.Load(); got != 1 {
+		t.Fatalf("concurrent Telegram calls = %d, want publishes serialized", got)
+	}
+}
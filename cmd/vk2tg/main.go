@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -18,19 +24,37 @@ import (
 	"github.com/rs/zerolog/pkgerrors"
 )
 
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
 func main() {
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	zlog.Logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
 
 	addrFlag := flag.String("addr", defaultAddr(), "HTTP listen address, e.g. :8080")
 	indexFlag := flag.String("index", defaultIndexPath(), "Path to index.html to serve on GET /")
+	onceFlag := flag.Bool("once", false, "Run a single sync cycle for all configured groups and exit")
+	republishFlag := flag.Int("republish-last", 0, "Re-publish the last N published posts to -to-channel and exit")
+	toChannelFlag := flag.String("to-channel", "", "Target Telegram channel for -republish-last")
 	flag.Parse()
 
-	handler, err := newIndexHandler(*indexFlag)
+	indexOptional, err := envBool("INDEX_OPTIONAL", false)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid index configuration")
+	}
+	indexGzip, err := envBool("INDEX_GZIP", true)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid index configuration")
+	}
+
+	handler, err := loadIndexHandler(*indexFlag, indexGzip, indexOptional)
 	if err != nil {
 		zlog.Fatal().Err(err).Msg("failed to prepare index handler")
 	}
 
+	if err := configureOutboundProxy(); err != nil {
+		zlog.Fatal().Err(err).Msg("invalid proxy configuration")
+	}
+
 	ctx := context.Background()
 
 	store, err := newStorage(ctx, zlog.Logger)
@@ -39,27 +63,133 @@ func main() {
 	}
 	defer store.Close()
 
-	tokenMgr := newTokenManager(zlog.Logger, store)
+	oauthBase, err := envBaseURL("VK_OAUTH_BASE_URL", vkOAuthBaseURL)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid VK OAuth configuration")
+	}
+	expirySkew, err := envDuration("TOKEN_EXPIRY_SKEW", 30*time.Second)
+	if err == nil && expirySkew < 0 {
+		err = fmt.Errorf("invalid TOKEN_EXPIRY_SKEW %s: must not be negative", expirySkew)
+	}
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid token configuration")
+	}
+	clientID := strings.TrimSpace(os.Getenv("VK_CLIENT_ID"))
+	if clientID == "" {
+		clientID = vkClientID
+	}
+	if n, err := strconv.ParseInt(clientID, 10, 64); err != nil || n <= 0 {
+		zlog.Fatal().Str("client_id", clientID).Msg("invalid VK_CLIENT_ID: expected a numeric VK app id")
+	}
+	tokenMgr := newTokenManager(zlog.Logger, store, oauthBase, clientID, expirySkew)
+
+	syncCfg, err := loadWallSyncConfigFromEnv()
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid sync configuration")
+	}
 
-	groupID := os.Getenv("VK_GROUP_ID")
-	botToken := os.Getenv("TG_BOT_TOKEN")
-	channelID := os.Getenv("TG_CHANNEL_ID")
-	threadID := os.Getenv("TG_THREAD_ID")
+	maxConcurrency, err := envInt("SYNC_MAX_CONCURRENCY", 1)
+	if err == nil && maxConcurrency < 1 {
+		err = fmt.Errorf("invalid SYNC_MAX_CONCURRENCY %d: must be at least 1", maxConcurrency)
+	}
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid sync configuration")
+	}
+	limiter := newPublishLimiter(maxConcurrency)
 
-	if groupID == "" || botToken == "" || channelID == "" {
+	vkRate, err := envInt("VK_MAX_REQUESTS_PER_SEC", 0)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid sync configuration")
+	}
+	vkMeter := &vkCallMeter{}
+	vkMeter.SetRate(vkRate)
+	go vkMeter.Report(ctx, zlog.Logger)
+
+	configPath := os.Getenv("VK2TG_CONFIG_FILE")
+	var syncCfgs []wallSyncConfig
+	if configPath != "" {
+		if syncCfgs, err = loadSyncMappings(configPath, syncCfg); err != nil {
+			zlog.Fatal().Err(err).Str("path", configPath).Msg("invalid sync configuration")
+		}
+	} else if syncCfg.enabled() {
+		syncCfgs = []wallSyncConfig{syncCfg}
+	}
+
+	if *republishFlag > 0 {
+		if err := republishLast(ctx, tokenMgr, store, limiter, vkMeter, syncCfgs, *republishFlag, *toChannelFlag); err != nil {
+			zlog.Error().Err(err).Msg("republish failed")
+			store.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	allowChannelChange, err := envBool("TG_ALLOW_CHANNEL_CHANGE", false)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid sync configuration")
+	}
+	if err := checkChannelChange(ctx, store, syncCfgs); err != nil {
+		if !allowChannelChange {
+			zlog.Fatal().Err(err).Msg("refusing to start: set TG_ALLOW_CHANNEL_CHANGE=true if the channel change is intended")
+		}
+		zlog.Warn().Err(err).Msg("Telegram channel changed, publishing to the new channel as allowed by TG_ALLOW_CHANNEL_CHANGE")
+	}
+	rememberPrimaryChannels(ctx, store, syncCfgs)
+
+	if *onceFlag {
+		if err := syncOnce(ctx, tokenMgr, store, limiter, vkMeter, syncCfgs); err != nil {
+			zlog.Error().Err(err).Msg("sync cycle failed")
+			store.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	retention, err := envDuration("SYNC_RETENTION", 0)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("invalid sync configuration")
+	}
+	if retention > 0 {
+		go runRetention(ctx, zlog.Logger, store, retention)
+	}
+
+	supervisor := newSyncSupervisor(ctx, zlog.Logger, tokenMgr, store, limiter, vkMeter)
+	if len(syncCfgs) == 0 {
 		zlog.Warn().Msg("VK to Telegram sync disabled: missing VK_GROUP_ID, TG_BOT_TOKEN, or TG_CHANNEL_ID")
-	} else {
-		startWallSync(ctx, zlog.Logger, tokenMgr, store, wallSyncConfig{
-			GroupID:   groupID,
-			BotToken:  botToken,
-			ChannelID: channelID,
-			ThreadID:  threadID,
-		})
+	}
+	supervisor.Apply(syncCfgs)
+	if configPath != "" {
+		go supervisor.Watch(configPath, syncCfg)
+	}
+
+	triggerSecret := os.Getenv("SYNC_TRIGGER_SECRET")
+	callbackSecret := os.Getenv("VK_CALLBACK_SECRET")
+	callbackConfirmation := os.Getenv("VK_CALLBACK_CONFIRMATION")
+
+	robots := defaultRobotsTxt
+	if raw := os.Getenv("ROBOTS_TXT"); raw != "" {
+		robots = strings.ReplaceAll(raw, `\n`, "\n")
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/auth/success", authSuccessHandler(tokenMgr))
 	mux.HandleFunc("/auth", authHandler)
+	mux.HandleFunc("/auth/config", authConfigHandler(clientID))
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", readyzHandler(tokenMgr.Loaded))
+	mux.HandleFunc("/token/status", tokenStatusHandler(tokenMgr))
+	mux.HandleFunc("/status", statusHandler(supervisor, store))
+	mux.HandleFunc("/sync/pause", syncPauseHandler(supervisor, triggerSecret, true))
+	mux.HandleFunc("/sync/resume", syncPauseHandler(supervisor, triggerSecret, false))
+	mux.HandleFunc("/sync/retry", syncRetryHandler(store, triggerSecret))
+	mux.HandleFunc("/sync/manual-edit", syncManualEditHandler(store, triggerSecret))
+	mux.HandleFunc("/favicon.ico", emptyIndexHandler)
+	mux.HandleFunc("/robots.txt", robotsHandler(robots))
+	if callbackConfirmation != "" && callbackSecret == "" {
+		zlog.Warn().Msg("VK_CALLBACK_CONFIRMATION is set without VK_CALLBACK_SECRET, not registering /vk/callback")
+	} else if callbackConfirmation != "" {
+		mux.HandleFunc("/vk/callback", vkCallbackHandler(supervisor, callbackSecret, callbackConfirmation))
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
@@ -83,6 +213,72 @@ func main() {
 	}
 }
 
+func syncOnce(ctx context.Context, tokenMgr *tokenManager, store syncStore, limiter *publishLimiter, meter *vkCallMeter, cfgs []wallSyncConfig) error {
+	if len(cfgs) == 0 {
+		return errors.New("sync disabled: missing VK_GROUP_ID, TG_BOT_TOKEN, or TG_CHANNEL_ID")
+	}
+
+	if err := tokenMgr.EnsureToken(ctx); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, cfg := range cfgs {
+		logger := zlog.Logger.With().Str("mapping", cfg.workerKey()).Logger()
+		if err := newWallSyncer(logger, tokenMgr, store, limiter, meter, cfg).runOnce(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkChannelChange reports groups whose configured primary channel differs
+// from the one recorded on the previous start, which usually means
+// TG_CHANNEL_ID was changed by mistake. Before the first record exists the
+// channel of the latest published message is used, leaving out mirrors.
+// Groups mapped to several channels are skipped since any of them may be
+// the previous one.
+func checkChannelChange(ctx context.Context, store *storage, cfgs []wallSyncConfig) error {
+	byGroup := make(map[string][]wallSyncConfig)
+	for _, cfg := range cfgs {
+		byGroup[cfg.GroupID] = append(byGroup[cfg.GroupID], cfg)
+	}
+
+	var errs []error
+	for group, configured := range byGroup {
+		if len(configured) != 1 {
+			continue
+		}
+		cfg := configured[0]
+		last, ok, err := store.GetSyncState(ctx, primaryChannelKey(group))
+		if err == nil && !ok {
+			last, err = store.LatestTelegramChannel(ctx, cfg.ownerID(), cfg.MirrorChannelIDs)
+		}
+		if err != nil {
+			zlog.Warn().Err(err).Str("group_id", group).Msg("failed to check previous Telegram channel")
+			continue
+		}
+		if last != "" && last != cfg.ChannelID {
+			errs = append(errs, fmt.Errorf("group %s was last published to %s but is now configured for %s", group, last, cfg.ChannelID))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rememberPrimaryChannels records the configured primary channel of every
+// group for checkChannelChange on the next start.
+func rememberPrimaryChannels(ctx context.Context, store *storage, cfgs []wallSyncConfig) {
+	for _, cfg := range cfgs {
+		if err := store.SetSyncState(ctx, primaryChannelKey(cfg.GroupID), cfg.ChannelID); err != nil {
+			zlog.Warn().Err(err).Str("group_id", cfg.GroupID).Msg("failed to record primary Telegram channel")
+		}
+	}
+}
+
+func primaryChannelKey(groupID string) string {
+	return "primary_channel:" + groupID
+}
+
 func defaultAddr() string {
 	if port := os.Getenv("PORT"); port != "" {
 		return ":" + port
@@ -97,7 +293,7 @@ func defaultIndexPath() string {
 	return "index.html"
 }
 
-func newIndexHandler(path string) (func(http.ResponseWriter, *http.Request), error) {
+func newIndexHandler(path string, compress bool) (func(http.ResponseWriter, *http.Request), error) {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, fmt.Errorf("resolve absolute path: %w", err)
@@ -114,30 +310,138 @@ func newIndexHandler(path string) (func(http.ResponseWriter, *http.Request), err
 	modTime := info.ModTime()
 	mediaType := mime.TypeByExtension(filepath.Ext(absPath))
 	if mediaType == "" {
-		mediaType = "text/html; charset=utf-8"
+		mediaType = sniffIndexContentType(content)
 	}
 
 	contentLength := strconv.Itoa(len(content))
 
+	// The body is compressed once here; small files don't benefit.
+	var gzipped []byte
+	if compress && len(content) >= 1024 {
+		if gzipped, err = gzipBytes(content); err != nil {
+			return nil, fmt.Errorf("compress index file: %w", err)
+		}
+	}
+	gzippedLength := strconv.Itoa(len(gzipped))
+
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet && r.Method != http.MethodHead {
 			w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		body, length := content, contentLength
+		if gzipped != nil {
+			w.Header().Set("Vary", "Accept-Encoding")
+			if acceptsGzip(r) {
+				body, length = gzipped, gzippedLength
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+		}
 		w.Header().Set("Content-Type", mediaType)
 		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
-		w.Header().Set("Content-Length", contentLength)
+		w.Header().Set("Content-Length", length)
 		if r.Method == http.MethodHead {
 			return
 		}
-		if _, err := w.Write(content); err != nil {
+		if _, err := w.Write(body); err != nil {
 			zlog.Error().Err(err).Msg("error writing index response")
 		}
 	}
 	return handler, nil
 }
 
+func gzipBytes(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip, honouring an
+// explicit q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
+
+// sniffIndexContentType guesses the type of a file without a known extension.
+// Results that say nothing useful keep the historical text/html default.
+func sniffIndexContentType(content []byte) string {
+	switch detected := http.DetectContentType(content); detected {
+	case "application/octet-stream", "text/plain; charset=utf-8":
+		return "text/html; charset=utf-8"
+	default:
+		return detected
+	}
+}
+
+// loadIndexHandler serves the index file, falling back to emptyIndexHandler
+// when the file is missing and optional is set.
+func loadIndexHandler(path string, compress, optional bool) (func(http.ResponseWriter, *http.Request), error) {
+	handler, err := newIndexHandler(path, compress)
+	if err != nil {
+		if !optional || !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		zlog.Warn().
+			Err(err).
+			Str("index_path", path).
+			Msg("index file not found, serving empty responses on /")
+		return emptyIndexHandler, nil
+	}
+	return handler, nil
+}
+
+func emptyIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func robotsHandler(content string) http.HandlerFunc {
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	contentLength := strconv.Itoa(len(content))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", contentLength)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			zlog.Error().Err(err).Msg("error writing robots.txt response")
+		}
+	}
+}
+
 func authHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -193,7 +497,248 @@ func authSuccessHandler(manager *tokenManager) http.HandlerFunc {
 			return
 		}
 
-		manager.Update(payload)
+		if err := manager.Update(r.Context(), payload); err != nil {
+			zlog.Error().Err(err).Msg("auth success payload not delivered")
+			http.Error(w, "request cancelled", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusAccepted)
 	}
 }
+
+// authConfigHandler tells the auth page which VK app to log in with, so it
+// matches the client_id used for token refreshes.
+func authConfigHandler(clientID string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{"client_id": clientID}); err != nil {
+			zlog.Error().Err(err).Msg("write auth config response failed")
+		}
+	}
+}
+
+func tokenStatusHandler(manager *tokenManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		status, err := manager.Status(ctx)
+		if err != nil {
+			zlog.Error().Err(err).Msg("query token status failed")
+			http.Error(w, "token status unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			zlog.Error().Err(err).Msg("write token status response failed")
+		}
+	}
+}
+
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, "ok"); err != nil {
+		zlog.Error().Err(err).Msg("write livez response failed")
+	}
+}
+
+func readyzHandler(ready func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			if _, err := io.WriteString(w, "not ready"); err != nil {
+				zlog.Error().Err(err).Msg("write readyz response failed")
+			}
+			return
+		}
+		if _, err := io.WriteString(w, "ok"); err != nil {
+			zlog.Error().Err(err).Msg("write readyz response failed")
+		}
+	}
+}
+
+type serviceStatus struct {
+	SyncEnabled bool             `json:"sync_enabled"`
+	SyncPaused  bool             `json:"sync_paused"`
+	DeadLetters []deadLetterPost `json:"dead_letters,omitempty"`
+
+	VKRequestsTotal      int64          `json:"vk_requests_total"`
+	VKRequestsLastMinute int64          `json:"vk_requests_last_minute"`
+	LastVKError          *vkErrorRecord `json:"last_vk_error,omitempty"`
+}
+
+func statusHandler(supervisor *syncSupervisor, store *storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := serviceStatus{
+			SyncEnabled: supervisor.Enabled(),
+			SyncPaused:  supervisor.Paused(),
+		}
+		deadLetters, err := store.DeadLetteredPosts(r.Context())
+		if err != nil {
+			zlog.Error().Err(err).Msg("load dead-lettered posts failed")
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		status.DeadLetters = deadLetters
+		if status.LastVKError, err = store.GetLastVKError(r.Context()); err != nil {
+			zlog.Error().Err(err).Msg("load last VK error failed")
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		status.VKRequestsTotal, status.VKRequestsLastMinute = supervisor.vkMeter.Snapshot()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			zlog.Error().Err(err).Msg("write status response failed")
+		}
+	}
+}
+
+func syncPauseHandler(supervisor *syncSupervisor, secret string, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeTrigger(r, secret) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !supervisor.Enabled() {
+			http.Error(w, "sync disabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		supervisor.SetPaused(paused)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func syncRetryHandler(store *storage, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeTrigger(r, secret) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		ownerID, postID, ok := postRefFromQuery(w, r)
+		if !ok {
+			return
+		}
+
+		found, err := store.RetryDeadLetter(r.Context(), ownerID, postID)
+		if err != nil {
+			zlog.Error().Err(err).Int("owner_id", ownerID).Int("post_id", postID).Msg("retry dead-lettered post failed")
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "post is not dead-lettered", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// manualEditBodyLimit bounds the message text accepted by /sync/manual-edit,
+// well above the 4096 characters Telegram allows.
+const manualEditBodyLimit = 64 << 10
+
+func syncManualEditHandler(store *storage, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodPost, http.MethodDelete))
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeTrigger(r, secret) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		ownerID, postID, ok := postRefFromQuery(w, r)
+		if !ok {
+			return
+		}
+
+		var manualText string
+		if r.Method == http.MethodPost {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, manualEditBodyLimit))
+			if err != nil {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			manualText = strings.TrimSpace(string(body))
+		}
+
+		found, err := store.SetEditLock(r.Context(), ownerID, postID, r.Method == http.MethodPost)
+		if err != nil {
+			zlog.Error().Err(err).Int("owner_id", ownerID).Int("post_id", postID).Msg("update manual edit marker failed")
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "unknown post", http.StatusNotFound)
+			return
+		}
+		if manualText != "" {
+			if err := store.SetManualTelegramText(r.Context(), ownerID, postID, manualText); err != nil {
+				zlog.Error().Err(err).Int("owner_id", ownerID).Int("post_id", postID).Msg("store manual edit text failed")
+				http.Error(w, "storage error", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func postRefFromQuery(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	ownerID, err := strconv.Atoi(r.URL.Query().Get("owner_id"))
+	if err != nil {
+		http.Error(w, "owner_id must be an integer", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	postID, err := strconv.Atoi(r.URL.Query().Get("post_id"))
+	if err != nil {
+		http.Error(w, "post_id must be an integer", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return ownerID, postID, true
+}
+
+func authorizeTrigger(r *http.Request, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	provided := r.Header.Get("X-Sync-Secret")
+	if provided == "" {
+		provided = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(secret)) == 1
+}
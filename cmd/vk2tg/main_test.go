@@ -0,0 +1,482 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+)
+
+func TestMain(m *testing.M) {
+	zlog.Logger = zerolog.Nop()
+	telegramSendInterval = 0
+	os.Exit(m.Run())
+}
+
+func TestAuthConfigHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	authConfigHandler("777")(rec, httptest.NewRequest(http.MethodGet, "/auth/config", nil))
+
+	var got map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || got["client_id"] != "777" {
+		t.Fatalf("status = %d, body = %v", rec.Code, got)
+	}
+
+	rec = httptest.NewRecorder()
+	authConfigHandler("777")(rec, httptest.NewRequest(http.MethodPost, "/auth/config", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestTokenStatusHandler(t *testing.T) {
+	empty := newMemStore()
+	loaded := newTestMemStore()
+	expiresAt := loaded.token.expiresAt
+
+	tests := []struct {
+		name     string
+		store    *memStore
+		hasToken bool
+	}{
+		{"no token", empty, false},
+		{"stored token", loaded, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTokenManager(zerolog.Nop(), tt.store, "http://127.0.0.1:0", "1", time.Minute)
+			rec := httptest.NewRecorder()
+			tokenStatusHandler(manager)(rec, httptest.NewRequest(http.MethodGet, "/token/status", nil))
+
+			var got tokenStatus
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK || got.HasToken != tt.hasToken || got.Valid != tt.hasToken {
+				t.Fatalf("status = %d, body = %+v", rec.Code, got)
+			}
+			if !tt.hasToken {
+				return
+			}
+			// Refreshes become due in the last 15% of the token lifetime.
+			if got.NextRefreshAt == nil || !got.NextRefreshAt.Round(time.Second).Equal(expiresAt.Add(-9*time.Minute).UTC().Round(time.Second)) {
+				t.Fatalf("next_refresh_at = %v, want 9m before %v", got.NextRefreshAt, expiresAt)
+			}
+		})
+	}
+}
+
+func TestAuthorizeTrigger(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		value  string
+		want   bool
+	}{
+		{"sync secret header", "s3cret", "X-Sync-Secret", "s3cret", true},
+		{"bearer token", "s3cret", "Authorization", "Bearer s3cret", true},
+		{"wrong secret", "s3cret", "X-Sync-Secret", "guess", false},
+		{"missing secret", "s3cret", "", "", false},
+		{"no secret configured", "", "X-Sync-Secret", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/sync/pause", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if got := authorizeTrigger(r, tt.secret); got != tt.want {
+				t.Fatalf("authorizeTrigger = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncPauseHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newTestMemStore()
+	manager := newTokenManager(zerolog.Nop(), store, "http://127.0.0.1:0", "1", time.Minute)
+	supervisor := newSyncSupervisor(ctx, zerolog.Nop(), manager, store, newPublishLimiter(1), &vkCallMeter{})
+	supervisor.Apply([]wallSyncConfig{{GroupID: "1", ChannelID: "@test_channel", BotToken: "token", WallFilter: "owner"}})
+
+	call := func(handler http.HandlerFunc, secret string) int {
+		r := httptest.NewRequest(http.MethodPost, "/sync/pause", nil)
+		r.Header.Set("X-Sync-Secret", secret)
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec.Code
+	}
+
+	if code := call(syncPauseHandler(supervisor, "s3cret", true), "guess"); code != http.StatusForbidden || supervisor.Paused() {
+		t.Fatalf("unauthorized pause: status %d, paused %v", code, supervisor.Paused())
+	}
+	if code := call(syncPauseHandler(supervisor, "s3cret", true), "s3cret"); code != http.StatusNoContent || !supervisor.Paused() {
+		t.Fatalf("pause: status %d, paused %v", code, supervisor.Paused())
+	}
+	if code := call(syncPauseHandler(supervisor, "s3cret", false), "s3cret"); code != http.StatusNoContent || supervisor.Paused() {
+		t.Fatalf("resume: status %d, paused %v", code, supervisor.Paused())
+	}
+}
+
+func TestLoadIndexHandler(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(present, []byte("<html>hi</html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.html")
+
+	tests := []struct {
+		name     string
+		path     string
+		optional bool
+		wantErr  bool
+		wantCode int
+	}{
+		{"present", present, false, false, http.StatusOK},
+		{"present optional", present, true, false, http.StatusOK},
+		{"missing", missing, false, true, 0},
+		{"missing optional", missing, true, false, http.StatusNoContent},
+		{"directory optional", dir, true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := loadIndexHandler(tt.path, false, tt.optional)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadIndexHandler error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("GET / = %d, want %d", rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestLoadIndexHandlerContentType(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"known extension", "index.css", "body{}", "text/css; charset=utf-8"},
+		{"extensionless png", "index", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "image/png"},
+		{"extensionless html", "page", "<!DOCTYPE html><html></html>", "text/html; charset=utf-8"},
+		{"extensionless plain text", "notes", "just some words", "text/html; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			handler, err := loadIndexHandler(path, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Fatalf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexHandlerGzip(t *testing.T) {
+	content := strings.Repeat("<p>index</p>\n", 200)
+	path := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := newIndexHandler(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"gzip client", http.MethodGet, "br, gzip", true},
+		{"plain client", http.MethodGet, "", false},
+		{"gzip refused", http.MethodGet, "gzip;q=0", false},
+		{"gzip head", http.MethodHead, "gzip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Fatalf("Vary = %q, want Accept-Encoding", got)
+			}
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", rec.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			length, _ := strconv.Atoi(rec.Header().Get("Content-Length"))
+			if tt.wantGzip && (length == 0 || length >= len(content)) {
+				t.Fatalf("Content-Length = %d, want the compressed size", length)
+			}
+			if !tt.wantGzip && length != len(content) {
+				t.Fatalf("Content-Length = %d, want %d", length, len(content))
+			}
+			if tt.method == http.MethodHead {
+				if rec.Body.Len() != 0 {
+					t.Fatalf("HEAD body = %d bytes, want none", rec.Body.Len())
+				}
+				return
+			}
+
+			body := rec.Body.Bytes()
+			if tt.wantGzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != content {
+				t.Fatalf("body = %d bytes, want the index content", len(body))
+			}
+		})
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	var ready atomic.Bool
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		ready   bool
+		want    int
+	}{
+		{"livez before ready", livezHandler, false, http.StatusOK},
+		{"readyz before ready", readyzHandler(ready.Load), false, http.StatusServiceUnavailable},
+		{"livez after ready", livezHandler, true, http.StatusOK},
+		{"readyz after ready", readyzHandler(ready.Load), true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ready.Store(tt.ready)
+			rec := httptest.NewRecorder()
+			tt.handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadyzAfterTokenLoad(t *testing.T) {
+	manager := newTokenManager(zerolog.Nop(), newTestMemStore(), "http://127.0.0.1:0", "1", time.Minute)
+	handler := readyzHandler(manager.Loaded)
+	deadline := time.Now().Add(time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code == http.StatusOK {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readyz = %d after the token state loaded, want %d", rec.Code, http.StatusOK)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRobotsAndFaviconHandlers(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		method   string
+		wantCode int
+		wantBody string
+	}{
+		{"default robots", robotsHandler(defaultRobotsTxt), http.MethodGet, http.StatusOK, "User-agent: *\nDisallow: /\n"},
+		{"custom robots", robotsHandler("User-agent: *\nAllow: /"), http.MethodGet, http.StatusOK, "User-agent: *\nAllow: /\n"},
+		{"robots head", robotsHandler(defaultRobotsTxt), http.MethodHead, http.StatusOK, ""},
+		{"robots post", robotsHandler(defaultRobotsTxt), http.MethodPost, http.StatusMethodNotAllowed, "method not allowed\n"},
+		{"favicon", emptyIndexHandler, http.MethodGet, http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler(rec, httptest.NewRequest(tt.method, "/", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Fatalf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSyncRetryHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		query  string
+		dead   bool
+		want   int
+	}{
+		{"retries a dead-lettered post", "s3cret", "owner_id=-1&post_id=7", true, http.StatusNoContent},
+		{"post not dead-lettered", "s3cret", "owner_id=-1&post_id=7", false, http.StatusNotFound},
+		{"bad post id", "s3cret", "owner_id=-1&post_id=x", true, http.StatusBadRequest},
+		{"wrong secret", "guess", "owner_id=-1&post_id=7", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, db := newFakeStorage(t, func(string, []driver.Value) ([]string, [][]driver.Value, error) {
+				if tt.dead {
+					return nil, [][]driver.Value{{}}, nil
+				}
+				return nil, [][]driver.Value{}, nil
+			})
+			r := httptest.NewRequest(http.MethodPost, "/sync/retry?"+tt.query, nil)
+			r.Header.Set("X-Sync-Secret", tt.secret)
+			rec := httptest.NewRecorder()
+			syncRetryHandler(store, "s3cret")(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusNoContent {
+				executed := db.executed()
+				if len(executed) != 1 || !strings.Contains(executed[0].query, "dead_lettered_at = NULL") || fmt.Sprint(executed[0].args) != "[-1 7]" {
+					t.Fatalf("executed = %+v", executed)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    bool
+		expired bool
+		refresh int
+		wantErr bool
+	}{
+		{"cycle succeeds", false, false, 0, false},
+		{"post fails to publish", true, false, 0, true},
+		{"expired token refreshed first", false, true, http.StatusOK, false},
+		{"expired token refresh rejected", false, true, http.StatusBadRequest, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var refreshes atomic.Int32
+			oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				refreshes.Add(1)
+				if tt.refresh != http.StatusOK {
+					http.Error(w, "nope", tt.refresh)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]any{"access_token": "fresh-token", "expires_in": 3600})
+			}))
+			defer oauth.Close()
+
+			store := newTestMemStore()
+			if tt.expired {
+				store.token.payload.DeviceID = "device"
+				store.token.expiresAt = time.Now().Add(-time.Minute)
+			}
+			tg, tgServer := newFakeTelegram(t)
+			if tt.fail {
+				tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprint(w, `{"ok":false,"error_code":500,"description":"Internal Server Error"}`)
+					return true
+				}
+			}
+			vk, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+			s := newTestSyncer(t, store, tgServer, vkServer, nil)
+
+			manager := newTokenManager(zerolog.Nop(), store, oauth.URL, "1", time.Minute)
+
+			err := syncOnce(context.Background(), manager, store, newPublishLimiter(1), &vkCallMeter{}, []wallSyncConfig{s.cfg})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncOnce error = %v, want error %v", err, tt.wantErr)
+			}
+			wantRefreshes, wantCycles := int32(0), 1
+			if tt.expired {
+				wantRefreshes = 1
+				if tt.refresh != http.StatusOK {
+					wantCycles = 0
+				}
+			}
+			if n := refreshes.Load(); n != wantRefreshes {
+				t.Fatalf("refresh requests = %d, want %d", n, wantRefreshes)
+			}
+			if n := vk.calls["wall.get"]; n != wantCycles {
+				t.Fatalf("wall.get calls = %d, want %d", n, wantCycles)
+			}
+		})
+	}
+}
+
+func TestCheckChannelChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary string
+		latest  string
+		wantErr bool
+	}{
+		{"same recorded channel", "@test_channel", "", false},
+		{"changed recorded channel", "@old_channel", "", true},
+		{"changed channel before the first record", "", "@old_channel", true},
+		{"nothing published yet", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _ := newFakeStorage(t, func(query string, _ []driver.Value) ([]string, [][]driver.Value, error) {
+				switch {
+				case strings.Contains(query, "sync_state") && tt.primary != "":
+					return []string{"value"}, [][]driver.Value{{tt.primary}}, nil
+				case strings.Contains(query, "tg_post") && tt.latest != "":
+					return []string{"channel_id"}, [][]driver.Value{{tt.latest}}, nil
+				}
+				return nil, [][]driver.Value{}, nil
+			})
+			cfgs := []wallSyncConfig{{GroupID: "1", ChannelID: "@test_channel"}}
+			if err := checkChannelChange(context.Background(), store, cfgs); (err != nil) != tt.wantErr {
+				t.Fatalf("checkChannelChange error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type vkMarket struct {
+	ID         int           `json:"id"`
+	OwnerID    int           `json:"owner_id"`
+	Title      string        `json:"title"`
+	Price      vkMarketPrice `json:"price"`
+	ThumbPhoto string        `json:"thumb_photo"`
+}
+
+type vkMarketPrice struct {
+	Amount string `json:"amount"`
+	Text   string `json:"text"`
+}
+
+func (m vkMarket) link() string {
+	return fmt.Sprintf("https://vk.com/product%d_%d", m.OwnerID, m.ID)
+}
+
+func (m vkMarket) card() string {
+	title := strings.TrimSpace(m.Title)
+	if price := strings.TrimSpace(m.Price.Text); price != "" {
+		title = fmt.Sprintf("%s — %s", title, price)
+	}
+	return fmt.Sprintf("🛒 %s\n%s", title, m.link())
+}
+
+func marketCards(post vkPost) []string {
+	var cards []string
+	for _, att := range post.Attachments {
+		if att.Type == "market" && att.Market != nil {
+			cards = append(cards, att.Market.card())
+		}
+	}
+	return cards
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestMarketCards(t *testing.T) {
+	tests := []struct {
+		name   string
+		market vkMarket
+		want   string
+	}{
+		{
+			name:   "with price text",
+			market: vkMarket{ID: 5, OwnerID: -1, Title: " Кружка ", Price: vkMarketPrice{Amount: "50000", Text: "500 ₽"}},
+			want:   "🛒 Кружка — 500 ₽\nhttps://vk.com/product-1_5",
+		},
+		{
+			name:   "without price text",
+			market: vkMarket{ID: 6, OwnerID: -1, Title: "Футболка", Price: vkMarketPrice{Amount: "100000"}},
+			want:   "🛒 Футболка\nhttps://vk.com/product-1_6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			post := vkPost{Attachments: []vkAttachment{{Type: "link"}, {Type: "market", Market: &tt.market}}}
+			if got := marketCards(post); !slices.Equal(got, []string{tt.want}) {
+				t.Fatalf("marketCards = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarketPhotoIncluded(t *testing.T) {
+	post := vkPost{Attachments: []vkAttachment{
+		{Type: "photo", Photo: &vkPhoto{Sizes: []vkPhotoSize{{URL: "https://vk.example/photo.jpg", Width: 800, Height: 600}}}},
+		{Type: "market", Market: &vkMarket{ID: 5, OwnerID: -1, Title: "Кружка", ThumbPhoto: "https://vk.example/product.jpg"}},
+		{Type: "market", Market: &vkMarket{ID: 6, OwnerID: -1, Title: "Без фото"}},
+	}}
+	want := []string{"https://vk.example/photo.jpg", "https://vk.example/product.jpg"}
+	if got := photoAttachmentURLs(post, 0); !slices.Equal(got, want) {
+		t.Fatalf("photoAttachmentURLs = %q, want %q", got, want)
+	}
+}
+
+func TestComposeTextMarketCard(t *testing.T) {
+	s := newWallSyncer(zerolog.Nop(), nil, nil, nil, &vkCallMeter{}, wallSyncConfig{})
+	post := vkPost{ID: 1, OwnerID: -1, Attachments: []vkAttachment{
+		{Type: "market", Market: &vkMarket{ID: 5, OwnerID: -1, Title: "Кружка", Price: vkMarketPrice{Text: "500 ₽"}}},
+	}}
+	if got := s.composeText(post, "В продаже"); !strings.HasPrefix(got, "В продаже\n\n🛒 Кружка — 500 ₽\nhttps://vk.com/product-1_5") {
+		t.Fatalf("composeText = %q", got)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	_ syncStore  = (*memStore)(nil)
+	_ tokenStore = (*memStore)(nil)
+)
+
+type memPostKey struct {
+	ownerID, postID int
+}
+
+type memPost struct {
+	hash            string
+	text            string
+	contentHash     string
+	mediaHash       string
+	attachmentCount *int
+	photoCount      int
+	publishedAt     *time.Time
+	deadLettered    bool
+	editLocked      bool
+	failures        int
+	lastError       string
+	pendingHash     string
+	changedAt       time.Time
+}
+
+type memTelegramPost struct {
+	storedTelegramPost
+	ownerID     int
+	publishedAt time.Time
+	editedAt    time.Time
+}
+
+// memStore is an in-memory syncStore and tokenStore that follows the
+// semantics of the Postgres queries closely enough to run the sync logic.
+type memStore struct {
+	mu       sync.Mutex
+	posts    map[memPostKey]*memPost
+	messages []memTelegramPost
+	attempts map[memPostKey]time.Time
+	state    map[string]string
+	edits    []vkPostEditSummary
+	token    *tokenRecord
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		posts:    make(map[memPostKey]*memPost),
+		attempts: make(map[memPostKey]time.Time),
+		state:    make(map[string]string),
+	}
+}
+
+var errMemPostNotFound = errors.New("vk post not found")
+
+func (m *memStore) post(ownerID, postID int) (*memPost, error) {
+	post, ok := m.posts[memPostKey{ownerID, postID}]
+	if !ok {
+		return nil, errMemPostNotFound
+	}
+	return post, nil
+}
+
+func (m *memStore) EnsureVKPost(_ context.Context, rec vkPostRecord) (vkPostState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	text := strings.TrimSpace(rec.Text)
+	key := memPostKey{rec.OwnerID, rec.PostID}
+	post, ok := m.posts[key]
+	if !ok {
+		count := rec.AttachmentCount
+		m.posts[key] = &memPost{hash: rec.Hash, text: text, contentHash: rec.ContentHash, mediaHash: rec.MediaHash, attachmentCount: &count, photoCount: rec.PhotoCount}
+		return vkPostState{Hash: rec.Hash}, nil
+	}
+
+	if post.text == "" {
+		post.text = text
+	}
+	if post.contentHash == "" {
+		post.contentHash = rec.ContentHash
+	}
+	if post.mediaHash == "" {
+		post.mediaHash = rec.MediaHash
+	}
+
+	state := vkPostState{
+		Published:    post.publishedAt != nil,
+		Hash:         post.hash,
+		MediaHash:    post.mediaHash,
+		DeadLettered: post.deadLettered,
+		EditLocked:   post.editLocked,
+	}
+	if post.publishedAt != nil {
+		state.PublishedAt = *post.publishedAt
+	}
+	return state, nil
+}
+
+func (m *memStore) UpdateVKPostAfterEdit(_ context.Context, rec vkPostRecord) (vkPostEditSummary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	text := strings.TrimSpace(rec.Text)
+	summary := vkPostEditSummary{NewLen: utf8.RuneCountInString(text)}
+	post, err := m.post(rec.OwnerID, rec.PostID)
+	if err != nil {
+		return summary, nil
+	}
+
+	summary.OldLen = utf8.RuneCountInString(post.text)
+	if post.attachmentCount != nil {
+		delta := rec.AttachmentCount - *post.attachmentCount
+		summary.AttachmentDelta = &delta
+	}
+
+	count := rec.AttachmentCount
+	post.hash = rec.Hash
+	post.attachmentCount = &count
+	post.photoCount = rec.PhotoCount
+	post.pendingHash = ""
+	if text != "" {
+		post.text = text
+	}
+	if rec.ContentHash != "" {
+		post.contentHash = rec.ContentHash
+	}
+	if rec.MediaHash != "" {
+		post.mediaHash = rec.MediaHash
+	}
+	return summary, nil
+}
+
+func (m *memStore) MarkVKPostSeen(_ context.Context, ownerID, postID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if post, err := m.post(ownerID, postID); err == nil && post.publishedAt == nil {
+		now := time.Now()
+		post.publishedAt = &now
+	}
+	return nil
+}
+
+func (m *memStore) NoteVKPostChange(_ context.Context, ownerID, postID int, hash string, seenAt time.Time) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	post, err := m.post(ownerID, postID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if post.pendingHash != hash || post.changedAt.IsZero() {
+		post.changedAt = seenAt
+	}
+	post.pendingHash = hash
+	return post.changedAt, nil
+}
+
+func (m *memStore) RecordEdit(_ context.Context, _, _ int, summary vkPostEditSummary, _ time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.edits = append(m.edits, summary)
+	return nil
+}
+
+func (m *memStore) ContentHashPublished(_ context.Context, contentHash string, ownerID, postID int, channelID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, msg := range m.messages {
+		key := memPostKey{msg.ownerID, msg.PostID}
+		if key == (memPostKey{ownerID, postID}) || (msg.ChannelID != channelID && msg.ChannelID != "") {
+			continue
+		}
+		if post := m.posts[key]; post != nil && post.contentHash == contentHash && post.publishedAt != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memStore) RetentionCursor(ctx context.Context, ownerID int) (int, error) {
+	raw, ok, err := m.GetSyncState(ctx, retentionCursorKey(ownerID))
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.Atoi(raw)
+}
+
+func (m *memStore) RecordTelegramPosts(_ context.Context, ownerID, postID int, messages []telegramMessage, channelID string) error {
+	return m.recordTelegramPosts(ownerID, postID, messages, channelID, true)
+}
+
+func (m *memStore) RecordPartialTelegramPosts(_ context.Context, ownerID, postID int, messages []telegramMessage, channelID string) error {
+	return m.recordTelegramPosts(ownerID, postID, messages, channelID, false)
+}
+
+func (m *memStore) recordTelegramPosts(ownerID, postID int, messages []telegramMessage, channelID string, published bool) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, msg := range messages {
+		text := strings.TrimSpace(msg.Text)
+		idx := m.telegramPostIndex(ownerID, postID, channelID, msg.ID)
+		if idx >= 0 {
+			if !m.messages[idx].HasText {
+				m.messages[idx].HasText, m.messages[idx].Text = text != "", text
+			}
+			continue
+		}
+		m.messages = append(m.messages, memTelegramPost{
+			storedTelegramPost: storedTelegramPost{
+				MessageID: msg.ID,
+				ChannelID: channelID,
+				PostID:    postID,
+				HasText:   text != "",
+				Text:      text,
+				Step:      msg.Step,
+			},
+			ownerID:     ownerID,
+			publishedAt: msg.PublishedAt,
+		})
+	}
+
+	if published {
+		key := memPostKey{ownerID, postID}
+		post, ok := m.posts[key]
+		if !ok {
+			post = &memPost{}
+			m.posts[key] = post
+		}
+		if post.publishedAt == nil {
+			publishedAt := messages[0].PublishedAt
+			post.publishedAt = &publishedAt
+		}
+		post.failures, post.lastError = 0, ""
+	}
+	return nil
+}
+
+func (m *memStore) telegramPostIndex(ownerID, postID int, channelID string, messageID int64) int {
+	return slices.IndexFunc(m.messages, func(msg memTelegramPost) bool {
+		return msg.ownerID == ownerID && msg.PostID == postID && msg.ChannelID == channelID && msg.MessageID == messageID
+	})
+}
+
+func (m *memStore) TelegramPosts(_ context.Context, ownerID, postID int) ([]storedTelegramPost, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var posts []storedTelegramPost
+	for _, msg := range m.messages {
+		if msg.ownerID == ownerID && msg.PostID == postID {
+			posts = append(posts, msg.storedTelegramPost)
+		}
+	}
+	slices.SortFunc(posts, func(a, b storedTelegramPost) int { return int(a.MessageID - b.MessageID) })
+	return posts, nil
+}
+
+func (m *memStore) LatestTelegramPosts(ctx context.Context, ownerID, postID int) ([]storedTelegramPost, error) {
+	all, err := m.TelegramPosts(ctx, ownerID, postID)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]storedTelegramPost)
+	for _, rec := range all {
+		cur, ok := latest[rec.ChannelID]
+		if !ok || rec.HasText || !cur.HasText {
+			latest[rec.ChannelID] = rec
+		}
+	}
+
+	posts := make([]storedTelegramPost, 0, len(latest))
+	for _, rec := range latest {
+		posts = append(posts, rec)
+	}
+	slices.SortFunc(posts, func(a, b storedTelegramPost) int { return strings.Compare(a.ChannelID, b.ChannelID) })
+	return posts, nil
+}
+
+func (m *memStore) RecentTelegramPosts(_ context.Context, ownerID int, channelID string, limit int) ([]storedTelegramPost, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var recent []memTelegramPost
+	for _, msg := range m.messages {
+		if msg.ownerID == ownerID && (msg.ChannelID == channelID || msg.ChannelID == "") {
+			recent = append(recent, msg)
+		}
+	}
+	slices.SortFunc(recent, func(a, b memTelegramPost) int {
+		if c := b.publishedAt.Compare(a.publishedAt); c != 0 {
+			return c
+		}
+		return int(b.MessageID - a.MessageID)
+	})
+
+	posts := make([]storedTelegramPost, 0, min(limit, len(recent)))
+	for _, msg := range recent[:min(limit, len(recent))] {
+		posts = append(posts, msg.storedTelegramPost)
+	}
+	return posts, nil
+}
+
+func (m *memStore) MaxTelegramMessageID(_ context.Context, channelID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var maxID int64
+	for _, msg := range m.messages {
+		if msg.ChannelID == channelID || msg.ChannelID == "" {
+			maxID = max(maxID, msg.MessageID)
+		}
+	}
+	return maxID, nil
+}
+
+func (m *memStore) UpdateTelegramPostText(_ context.Context, ownerID, postID int, channelID string, messageID int64, messageText string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if idx := m.telegramPostIndex(ownerID, postID, channelID, messageID); idx >= 0 {
+		text := strings.TrimSpace(messageText)
+		m.messages[idx].HasText, m.messages[idx].Text = text != "", text
+		m.messages[idx].editedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *memStore) DeleteTelegramPost(_ context.Context, ownerID, postID int, channelID string, messageID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if idx := m.telegramPostIndex(ownerID, postID, channelID, messageID); idx >= 0 {
+		m.messages = slices.Delete(m.messages, idx, idx+1)
+	}
+	return nil
+}
+
+func (m *memStore) LastTelegramEdit(_ context.Context, ownerID, postID int) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var editedAt time.Time
+	for _, msg := range m.messages {
+		if msg.ownerID == ownerID && msg.PostID == postID && msg.editedAt.After(editedAt) {
+			editedAt = msg.editedAt
+		}
+	}
+	return editedAt, nil
+}
+
+func (m *memStore) BeginPublishAttempt(_ context.Context, ownerID, postID int, startedAt time.Time) (*time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := memPostKey{ownerID, postID}
+	if prior, ok := m.attempts[key]; ok {
+		return &prior, nil
+	}
+	m.attempts[key] = startedAt
+	return nil, nil
+}
+
+func (m *memStore) ClearPublishAttempt(_ context.Context, ownerID, postID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, memPostKey{ownerID, postID})
+	return nil
+}
+
+func (m *memStore) IncrementFailure(_ context.Context, ownerID, postID int, lastError string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	post, err := m.post(ownerID, postID)
+	if err != nil {
+		return 0, err
+	}
+	post.failures++
+	post.lastError = lastError
+	return post.failures, nil
+}
+
+func (m *memStore) MarkDeadLetter(_ context.Context, ownerID, postID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if post, err := m.post(ownerID, postID); err == nil {
+		post.deadLettered = true
+	}
+	return nil
+}
+
+func (m *memStore) SetEditLock(ownerID, postID int, locked bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if post, err := m.post(ownerID, postID); err == nil {
+		post.editLocked = locked
+	}
+}
+
+func (m *memStore) GetSyncState(_ context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.state[key]
+	return value, ok, nil
+}
+
+func (m *memStore) SetSyncState(_ context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.state[key] = value
+	return nil
+}
+
+func (m *memStore) SetLastVKError(ctx context.Context, rec *vkErrorRecord) error {
+	if rec == nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.state, syncStateLastVKError)
+		return nil
+	}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return m.SetSyncState(ctx, syncStateLastVKError, string(payload))
+}
+
+func (m *memStore) LoadTokenState(context.Context) (*tokenRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.token == nil {
+		return nil, nil
+	}
+	rec := *m.token
+	return &rec, nil
+}
+
+func (m *memStore) UpsertTokenState(_ context.Context, payload authSuccessPayload, updatedAt, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.token = &tokenRecord{payload: payload, updatedAt: updatedAt, expiresAt: expiresAt}
+	return nil
+}
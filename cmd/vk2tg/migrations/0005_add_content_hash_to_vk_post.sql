@@ -0,0 +1,12 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	ADD COLUMN IF NOT EXISTS content_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS ${DB_TABLE_PREFIX}vk_post_content_hash_idx ON ${DB_TABLE_PREFIX}vk_post (content_hash);
+
+-- +goose Down
+DROP INDEX IF EXISTS ${DB_TABLE_PREFIX}vk_post_content_hash_idx;
+
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	DROP COLUMN IF EXISTS content_hash;
@@ -0,0 +1,11 @@
+-- +goose ENVSUB ON
+-- +goose Up
+CREATE TABLE IF NOT EXISTS ${DB_TABLE_PREFIX}publish_attempt (
+	vk_owner_id BIGINT      NOT NULL,
+	vk_post_id  BIGINT      NOT NULL,
+	started_at  TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (vk_owner_id, vk_post_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS ${DB_TABLE_PREFIX}publish_attempt;
@@ -0,0 +1,25 @@
+-- +goose ENVSUB ON
+-- +goose Up
+-- attachment_count stays NULL for posts stored before it was tracked, so
+-- their first edit logs an unknown attachment delta instead of a bogus one.
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	ADD COLUMN IF NOT EXISTS attachment_count INTEGER;
+
+CREATE TABLE IF NOT EXISTS ${DB_TABLE_PREFIX}vk_post_edit_log (
+	id               BIGSERIAL    PRIMARY KEY,
+	vk_owner_id      BIGINT       NOT NULL,
+	vk_post_id       BIGINT       NOT NULL,
+	edited_at        TIMESTAMPTZ  NOT NULL,
+	old_len          INTEGER      NOT NULL,
+	new_len          INTEGER      NOT NULL,
+	attachment_delta INTEGER,
+	FOREIGN KEY (vk_owner_id, vk_post_id) REFERENCES ${DB_TABLE_PREFIX}vk_post (owner_id, id)
+);
+
+CREATE INDEX IF NOT EXISTS ${DB_TABLE_PREFIX}vk_post_edit_log_post_idx ON ${DB_TABLE_PREFIX}vk_post_edit_log (vk_owner_id, vk_post_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS ${DB_TABLE_PREFIX}vk_post_edit_log;
+
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	DROP COLUMN IF EXISTS attachment_count;
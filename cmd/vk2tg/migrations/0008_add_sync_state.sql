@@ -0,0 +1,10 @@
+-- +goose ENVSUB ON
+-- +goose Up
+CREATE TABLE IF NOT EXISTS ${DB_TABLE_PREFIX}sync_state (
+	key        TEXT        PRIMARY KEY,
+	value      TEXT        NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS ${DB_TABLE_PREFIX}sync_state;
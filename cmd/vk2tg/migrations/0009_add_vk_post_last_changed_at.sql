@@ -0,0 +1,10 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	ADD COLUMN IF NOT EXISTS pending_hash TEXT,
+	ADD COLUMN IF NOT EXISTS last_changed_at TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	DROP COLUMN IF EXISTS last_changed_at,
+	DROP COLUMN IF EXISTS pending_hash;
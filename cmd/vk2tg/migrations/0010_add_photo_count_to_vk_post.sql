@@ -0,0 +1,8 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	ADD COLUMN IF NOT EXISTS photo_count INTEGER NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	DROP COLUMN IF EXISTS photo_count;
@@ -0,0 +1,17 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	ADD COLUMN IF NOT EXISTS failure_count INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS last_error TEXT,
+	ADD COLUMN IF NOT EXISTS dead_lettered_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS ${DB_TABLE_PREFIX}vk_post_dead_lettered_idx ON ${DB_TABLE_PREFIX}vk_post (dead_lettered_at)
+	WHERE dead_lettered_at IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS ${DB_TABLE_PREFIX}vk_post_dead_lettered_idx;
+
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	DROP COLUMN IF EXISTS dead_lettered_at,
+	DROP COLUMN IF EXISTS last_error,
+	DROP COLUMN IF EXISTS failure_count;
@@ -0,0 +1,8 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	ADD COLUMN IF NOT EXISTS media_hash TEXT;
+
+-- +goose Down
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	DROP COLUMN IF EXISTS media_hash;
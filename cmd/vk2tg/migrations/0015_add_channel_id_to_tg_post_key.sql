@@ -0,0 +1,13 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	DROP CONSTRAINT IF EXISTS ${DB_TABLE_PREFIX}tg_post_pkey;
+
+CREATE UNIQUE INDEX IF NOT EXISTS ${DB_TABLE_PREFIX}tg_post_channel_message_key
+	ON ${DB_TABLE_PREFIX}tg_post (vk_owner_id, vk_post_id, (COALESCE(channel_id, '')), id);
+
+-- +goose Down
+DROP INDEX IF EXISTS ${DB_TABLE_PREFIX}tg_post_channel_message_key;
+
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	ADD PRIMARY KEY (vk_owner_id, vk_post_id, id);
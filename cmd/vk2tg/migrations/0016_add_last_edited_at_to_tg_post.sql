@@ -0,0 +1,8 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	ADD COLUMN IF NOT EXISTS last_edited_at TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	DROP COLUMN IF EXISTS last_edited_at;
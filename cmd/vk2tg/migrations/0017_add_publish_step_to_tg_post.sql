@@ -0,0 +1,8 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	ADD COLUMN IF NOT EXISTS publish_step INTEGER;
+
+-- +goose Down
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	DROP COLUMN IF EXISTS publish_step;
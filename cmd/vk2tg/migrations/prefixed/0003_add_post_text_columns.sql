@@ -0,0 +1,14 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	ADD COLUMN IF NOT EXISTS post_text TEXT;
+
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	ADD COLUMN IF NOT EXISTS post_text TEXT;
+
+-- +goose Down
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	DROP COLUMN IF EXISTS post_text;
+
+ALTER TABLE ${DB_TABLE_PREFIX}vk_post
+	DROP COLUMN IF EXISTS post_text;
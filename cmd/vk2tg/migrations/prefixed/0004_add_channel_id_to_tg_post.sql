@@ -0,0 +1,8 @@
+-- +goose ENVSUB ON
+-- +goose Up
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	ADD COLUMN IF NOT EXISTS channel_id TEXT;
+
+-- +goose Down
+ALTER TABLE ${DB_TABLE_PREFIX}tg_post
+	DROP COLUMN IF EXISTS channel_id;
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	opsAlertInterval    = 30 * time.Second
+	opsAlertDedupWindow = 10 * time.Minute
+)
+
+// opsAlertHook mirrors error-level syncer events to an ops chat. It only
+// enqueues from the logging path; delivery happens on its own goroutine and
+// reports problems through an unhooked logger so a failing send can't loop.
+type opsAlertHook struct {
+	logger     zerolog.Logger
+	endpoint   string
+	chatID     string
+	groupID    string
+	httpClient *http.Client
+	queue      chan string
+}
+
+func newOpsAlertHook(ctx context.Context, logger zerolog.Logger, cfg wallSyncConfig) *opsAlertHook {
+	h := &opsAlertHook{
+		logger:     logger,
+		endpoint:   fmt.Sprintf("%s/bot%s/sendMessage", cfg.TGAPIBase, cfg.BotToken),
+		chatID:     cfg.OpsChatID,
+		groupID:    cfg.GroupID,
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: outboundTransport},
+		queue:      make(chan string, 32),
+	}
+	go h.run(ctx)
+	return h
+}
+
+func (h *opsAlertHook) Run(_ *zerolog.Event, level zerolog.Level, msg string) {
+	if level < zerolog.ErrorLevel || msg == "" {
+		return
+	}
+	select {
+	case h.queue <- msg:
+	default:
+	}
+}
+
+func (h *opsAlertHook) run(ctx context.Context) {
+	lastSent := make(map[string]time.Time)
+	var next time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-h.queue:
+			now := time.Now()
+			if sentAt, ok := lastSent[msg]; ok && now.Sub(sentAt) < opsAlertDedupWindow {
+				continue
+			}
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+
+			lastSent[msg] = time.Now()
+			next = time.Now().Add(opsAlertInterval)
+			for key, sentAt := range lastSent {
+				if time.Since(sentAt) >= opsAlertDedupWindow {
+					delete(lastSent, key)
+				}
+			}
+
+			if err := h.send(ctx, fmt.Sprintf("vk2tg (group %s): %s", h.groupID, msg)); err != nil {
+				h.logger.Warn().Err(err).Str("ops_chat_id", h.chatID).Msg("failed to send ops alert")
+			}
+		}
+	}
+}
+
+func (h *opsAlertHook) send(ctx context.Context, text string) error {
+	params := url.Values{}
+	params.Set("chat_id", h.chatID)
+	params.Set("text", text)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return fmt.Errorf("build ops alert request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send ops alert: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("send ops alert: telegram status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestOpsAlertHook(t *testing.T) {
+	tg, tgServer := newFakeTelegram(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hook := newOpsAlertHook(ctx, zerolog.Nop(), wallSyncConfig{TGAPIBase: tgServer.URL, BotToken: "token", OpsChatID: "@ops", GroupID: "1"})
+	logger := zerolog.Nop().Level(zerolog.DebugLevel).Hook(hook)
+	logger.Info().Msg("cycle finished")
+	logger.Warn().Msg("slow response")
+	logger.Error().Msg("failed to publish post")
+	logger.Error().Msg("failed to publish post")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for tg.countCalls("sendMessage @ops") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no ops alert sent for an error event")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := tg.countCalls("sendMessage @ops"); n != 1 {
+		t.Fatalf("ops alerts = %d, want 1 for a repeated error", n)
+	}
+	if text, _ := tg.message("@ops", 1); text != "vk2tg (group 1): failed to publish post" {
+		t.Fatalf("ops alert = %q", text)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "container/list"
+
+const photoURLCacheSize = 256
+
+type photoURLCacheKey struct {
+	OwnerID int
+	PostID  int
+}
+
+type photoURLCacheEntry struct {
+	key  photoURLCacheKey
+	hash string
+	urls []string
+}
+
+type photoURLCache struct {
+	capacity int
+	order    *list.List
+	entries  map[photoURLCacheKey]*list.Element
+}
+
+func newPhotoURLCache(capacity int) *photoURLCache {
+	return &photoURLCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[photoURLCacheKey]*list.Element),
+	}
+}
+
+func (c *photoURLCache) Get(ownerID, postID int, hash string) ([]string, bool) {
+	elem, ok := c.entries[photoURLCacheKey{OwnerID: ownerID, PostID: postID}]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*photoURLCacheEntry)
+	if entry.hash != hash {
+		c.order.Remove(elem)
+		delete(c.entries, entry.key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.urls, true
+}
+
+func (c *photoURLCache) Put(ownerID, postID int, hash string, urls []string) {
+	key := photoURLCacheKey{OwnerID: ownerID, PostID: postID}
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*photoURLCacheEntry)
+		entry.hash = hash
+		entry.urls = urls
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&photoURLCacheEntry{key: key, hash: hash, urls: urls})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*photoURLCacheEntry).key)
+	}
+}
+
+func (s *wallSyncer) photoURLs(post vkPost) []string {
+	if urls, ok := s.photoCache.Get(post.OwnerID, post.ID, post.Hash); ok {
+		return urls
+	}
+	urls := photoAttachmentURLs(post, s.cfg.PhotoMaxDimension)
+	if post.Hash != "" {
+		s.photoCache.Put(post.OwnerID, post.ID, post.Hash, urls)
+	}
+	return urls
+}
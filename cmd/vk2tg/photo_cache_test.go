@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestPhotoURLCache(t *testing.T) {
+	c := newPhotoURLCache(2)
+	c.Put(-1, 1, "h1", []string{"a"})
+	c.Put(-1, 2, "h2", []string{"b"})
+
+	if urls, ok := c.Get(-1, 1, "h1"); !ok || !slices.Equal(urls, []string{"a"}) {
+		t.Fatalf("Get(1) = %q, %v, want the cached urls", urls, ok)
+	}
+	if _, ok := c.Get(-1, 2, "changed"); ok {
+		t.Fatal("Get(2) with a changed hash hit the cache")
+	}
+	if _, ok := c.Get(-1, 2, "h2"); ok {
+		t.Fatal("entry survived a hash change")
+	}
+
+	c.Put(-1, 2, "h2", []string{"b"})
+	c.Get(-1, 1, "h1")
+	c.Put(-1, 3, "h3", []string{"c"})
+	if _, ok := c.Get(-1, 2, "h2"); ok {
+		t.Fatal("least recently used entry not evicted")
+	}
+	for _, id := range []int{1, 3} {
+		if _, ok := c.Get(-1, id, map[int]string{1: "h1", 3: "h3"}[id]); !ok {
+			t.Fatalf("entry %d evicted, want it kept", id)
+		}
+	}
+}
+
+func TestPhotoURLsCachedUntilHashChanges(t *testing.T) {
+	s := newWallSyncer(zerolog.Nop(), nil, nil, nil, &vkCallMeter{}, wallSyncConfig{})
+	photo := func(url string) vkAttachment {
+		return vkAttachment{Type: "photo", Photo: &vkPhoto{Sizes: []vkPhotoSize{{URL: url, Width: 800, Height: 600}}}}
+	}
+	post := vkPost{ID: 1, OwnerID: -1, Hash: "v1", Attachments: []vkAttachment{photo("https://vk.example/1.jpg")}}
+	first := s.photoURLs(post)
+
+	same := post
+	same.Attachments = []vkAttachment{photo("https://vk.example/other.jpg")}
+	if got := s.photoURLs(same); !slices.Equal(got, first) {
+		t.Fatalf("photoURLs with an unchanged hash = %q, want the cached %q", got, first)
+	}
+
+	edited := same
+	edited.Hash = "v2"
+	if got := s.photoURLs(edited); !slices.Equal(got, []string{"https://vk.example/other.jpg"}) {
+		t.Fatalf("photoURLs after a hash change = %q, want recomputed urls", got)
+	}
+}
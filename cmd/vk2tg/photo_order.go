@@ -0,0 +1,42 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+)
+
+const (
+	photoOrderVK = "vk"
+	photoOrderID = "id"
+)
+
+// orderPhotoAttachments records each attachment's position in the VK
+// response and, with VK_PHOTO_ORDER=id, reorders the photo attachments by
+// photo id. Photo ids grow in upload order, which is how VK displays a post's
+// photos, so the Telegram album stays the same across re-syncs even when the
+// API returns attachments shuffled. Non-photo attachments keep their slots.
+func orderPhotoAttachments(posts []vkPost, order string) {
+	for _, post := range posts {
+		var slots []int
+		for i := range post.Attachments {
+			post.Attachments[i].Index = i
+			if post.Attachments[i].Type == "photo" && post.Attachments[i].Photo != nil {
+				slots = append(slots, i)
+			}
+		}
+		if order != photoOrderID || len(slots) < 2 {
+			continue
+		}
+
+		photos := make([]vkAttachment, 0, len(slots))
+		for _, i := range slots {
+			photos = append(photos, post.Attachments[i])
+		}
+		slices.SortStableFunc(photos, func(a, b vkAttachment) int {
+			return cmp.Or(cmp.Compare(a.Photo.ID, b.Photo.ID), cmp.Compare(a.Index, b.Index))
+		})
+		for n, i := range slots {
+			post.Attachments[i] = photos[n]
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	telegramPollQuestionLimit = 300
+	telegramPollOptionLimit   = 100
+	telegramPollOptionsMax    = 10
+)
+
+type vkPoll struct {
+	ID        int            `json:"id"`
+	OwnerID   int            `json:"owner_id"`
+	Question  string         `json:"question"`
+	Anonymous bool           `json:"anonymous"`
+	Multiple  bool           `json:"multiple"`
+	Answers   []vkPollAnswer `json:"answers"`
+}
+
+type vkPollAnswer struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+func (p vkPoll) card() string {
+	lines := []string{"📊 " + strings.TrimSpace(p.Question)}
+	for _, answer := range p.Answers {
+		lines = append(lines, "• "+strings.TrimSpace(answer.Text))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func postPolls(post vkPost) []vkPoll {
+	var polls []vkPoll
+	for _, att := range post.Attachments {
+		if att.Type == "poll" && att.Poll != nil {
+			polls = append(polls, *att.Poll)
+		}
+	}
+	return polls
+}
+
+// pollCards renders polls as text when they aren't sent as native polls.
+func (s *wallSyncer) pollCards(post vkPost) []string {
+	if s.cfg.NativePolls {
+		return nil
+	}
+	var cards []string
+	for _, poll := range postPolls(post) {
+		cards = append(cards, poll.card())
+	}
+	return cards
+}
+
+// pollOnly reports whether a native poll is all the post consists of. Such
+// posts aren't edited, since Telegram polls can't be changed after sending.
+func (s *wallSyncer) pollOnly(post vkPost) bool {
+	if !s.cfg.NativePolls || strings.TrimSpace(post.Text) != "" || len(post.CopyHistory) > 0 || len(post.Attachments) == 0 {
+		return false
+	}
+	for _, att := range post.Attachments {
+		if att.Type != "poll" {
+			return false
+		}
+	}
+	return true
+}
+
+func truncateRunes(s string, limit int) string {
+	runes := []rune(strings.TrimSpace(s))
+	if len(runes) <= limit {
+		return string(runes)
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+func (s *wallSyncer) publishPollToTelegram(ctx context.Context, poll vkPoll, opts telegramSendOptions) (telegramMessage, error) {
+	options := make([]map[string]string, 0, len(poll.Answers))
+	for _, answer := range poll.Answers {
+		if len(options) == telegramPollOptionsMax {
+			break
+		}
+		options = append(options, map[string]string{"text": truncateRunes(answer.Text, telegramPollOptionLimit)})
+	}
+	if len(options) < 2 {
+		return telegramMessage{}, fmt.Errorf("vk poll %d_%d has fewer than two answers", poll.OwnerID, poll.ID)
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return telegramMessage{}, fmt.Errorf("encode poll options: %w", err)
+	}
+
+	send := func(anonymous bool) (telegramMessage, error) {
+		if err := s.throttle(ctx); err != nil {
+			return telegramMessage{}, err
+		}
+		params := s.newSendParams()
+		params.Set("question", truncateRunes(poll.Question, telegramPollQuestionLimit))
+		params.Set("options", string(encoded))
+		params.Set("is_anonymous", strconv.FormatBool(anonymous))
+		params.Set("allows_multiple_answers", strconv.FormatBool(poll.Multiple))
+		if err := opts.apply(params); err != nil {
+			return telegramMessage{}, err
+		}
+		body, err := s.callTelegram(ctx, "sendPoll", params)
+		if err != nil {
+			return telegramMessage{}, err
+		}
+		return parseTelegramSendResponse(body)
+	}
+
+	msg, err := send(poll.Anonymous)
+	if err != nil && !poll.Anonymous && isTelegramBadRequest(err) {
+		// Channels only accept anonymous polls.
+		msg, err = send(true)
+	}
+	return msg, err
+}
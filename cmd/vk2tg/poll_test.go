@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestSyncSendsNativePoll(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	post := newTestPost(1, "")
+	post.Attachments = []vkAttachment{{Type: "poll", Poll: &vkPoll{
+		ID:       3,
+		OwnerID:  -1,
+		Question: "Куда поедем?",
+		Multiple: true,
+		Answers:  []vkPollAnswer{{ID: 1, Text: "Море"}, {ID: 2, Text: "Горы"}, {ID: 3, Text: "Дача"}},
+	}}}
+	vk, vkServer := newFakeVK(t, post)
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_NATIVE_POLLS": "true", "SYNC_LINK_WHEN_EMPTY": "false"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if !slices.Equal(tg.calls, []string{"sendPoll @test_channel"}) {
+		t.Fatalf("Telegram calls = %q, want only the poll", tg.calls)
+	}
+	form := tg.forms["sendPoll @test_channel"]
+	if form.Get("question") != "Куда поедем?" || form.Get("allows_multiple_answers") != "true" || form.Get("is_anonymous") != "false" {
+		t.Fatalf("sendPoll form = %v", form)
+	}
+	var options []map[string]string
+	if err := json.Unmarshal([]byte(form.Get("options")), &options); err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, option := range options {
+		texts = append(texts, option["text"])
+	}
+	if want := []string{"Море", "Горы", "Дача"}; !slices.Equal(texts, want) {
+		t.Fatalf("poll options = %q, want %q", texts, want)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v, want the poll", sent)
+	}
+
+	post.Hash = "changed"
+	vk.setPosts(post)
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if len(tg.calls) != 1 {
+		t.Fatalf("Telegram calls = %q, want the poll left unedited", tg.calls)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+type postLogKey struct{}
+
+// withPostLog tags ctx with the post being processed so every log line on its
+// way through publish, edit and record carries the same "post" field.
+func withPostLog(ctx context.Context, post vkPost) context.Context {
+	return context.WithValue(ctx, postLogKey{}, fmt.Sprintf("%d_%d", post.OwnerID, post.ID))
+}
+
+// log returns the syncer's logger, extended with the post tag from ctx.
+func (s *wallSyncer) log(ctx context.Context) *zerolog.Logger {
+	ref, ok := ctx.Value(postLogKey{}).(string)
+	if !ok {
+		return &s.logger
+	}
+	logger := s.logger.With().Str("post", ref).Logger()
+	return &logger
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// outboundTransport is shared by every client talking to VK and Telegram so
+// the proxy configuration applies to all of them.
+var outboundTransport http.RoundTripper = newOutboundTransport(nil)
+
+// configureOutboundProxy routes outbound requests through OUTBOUND_PROXY_URL
+// when set. Otherwise the standard HTTPS_PROXY/HTTP_PROXY/NO_PROXY variables
+// apply, with ALL_PROXY as a fallback. http, https, socks5 and socks5h proxy
+// URLs are supported.
+func configureOutboundProxy() error {
+	raw := strings.TrimSpace(os.Getenv("OUTBOUND_PROXY_URL"))
+	if raw == "" {
+		return nil
+	}
+	proxyURL, err := parseProxyURL(raw)
+	if err != nil {
+		return fmt.Errorf("invalid OUTBOUND_PROXY_URL: %w", err)
+	}
+	outboundTransport = newOutboundTransport(proxyURL)
+	return nil
+}
+
+func newOutboundTransport(proxyURL *url.URL) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	} else {
+		transport.Proxy = proxyFromEnvironment
+	}
+	return transport
+}
+
+func proxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil || proxyURL != nil {
+		return proxyURL, err
+	}
+	raw := os.Getenv("ALL_PROXY")
+	if raw == "" {
+		raw = os.Getenv("all_proxy")
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	return parseProxyURL(raw)
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q in %q", u.Scheme, u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing proxy host in %q", u.Redacted())
+	}
+	return u, nil
+}
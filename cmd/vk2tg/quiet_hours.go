@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// quietHours is a daily window, possibly spanning midnight, during which new
+// posts are held back. Bounds are minutes since local midnight.
+type quietHours struct {
+	start int
+	end   int
+	loc   *time.Location
+}
+
+func parseQuietHours(raw string, loc *time.Location) (*quietHours, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(raw), "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid SYNC_QUIET_HOURS %q: expected HH:MM-HH:MM", raw)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SYNC_QUIET_HOURS %q: expected HH:MM-HH:MM", raw)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SYNC_QUIET_HOURS %q: expected HH:MM-HH:MM", raw)
+	}
+	q := &quietHours{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+		loc:   loc,
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("invalid SYNC_QUIET_HOURS %q: start and end must differ", raw)
+	}
+	return q, nil
+}
+
+func (q *quietHours) Contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	t = t.In(q.loc)
+	minute := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// End returns when the window containing t closes.
+func (q *quietHours) End(t time.Time) time.Time {
+	t = t.In(q.loc)
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, q.loc)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	reconcileInterval   = 6 * time.Hour
+	reconcileSampleSize = 20
+	publishProbeWindow  = 5
+)
+
+// reconcile checks that the most recently recorded Telegram messages still
+// exist and drops the records of messages deleted in the channel, so later
+// edits don't target them. Existence is probed with editMessageReplyMarkup,
+// which changes nothing when the markup is the same.
+func (s *wallSyncer) reconcile(ctx context.Context) {
+	ownerID := s.cfg.ownerID()
+	records, err := s.store.RecentTelegramPosts(ctx, ownerID, s.cfg.ChannelID, reconcileSampleSize)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("failed to load Telegram messages for reconciliation")
+		return
+	}
+
+	removed := 0
+	for _, rec := range records {
+		// With TG_VK_BUTTON only messages carrying the text have the button;
+		// probing the others with it would add one.
+		if s.cfg.VKButton && !rec.HasText {
+			continue
+		}
+		exists, err := s.telegramMessageExists(ctx, rec, ownerID)
+		if err != nil {
+			s.logger.Debug().Err(err).Int64("telegram_message_id", rec.MessageID).Msg("failed to check Telegram message")
+			continue
+		}
+		if exists {
+			continue
+		}
+		if err := s.store.DeleteTelegramPost(ctx, ownerID, rec.PostID, rec.ChannelID, rec.MessageID); err != nil {
+			s.logger.Error().Err(err).Int64("telegram_message_id", rec.MessageID).Msg("failed to remove record of deleted Telegram message")
+			continue
+		}
+		removed++
+		s.logger.Warn().
+			Int("owner_id", ownerID).
+			Int("post_id", rec.PostID).
+			Int64("telegram_message_id", rec.MessageID).
+			Msg("Telegram message no longer exists, removed its record")
+	}
+
+	s.logger.Info().
+		Int("checked", len(records)).
+		Int("removed", removed).
+		Msg("reconciled Telegram message records")
+}
+
+// findUnrecordedDelivery looks for the message left behind by an attempt
+// that reached Telegram but failed before recording. The Bot API can't read
+// channel messages, so the ids right after the last recorded one are
+// forwarded to the admin chat, compared with the post text and deleted there
+// again. Without an admin chat, a recorded message to start from or any text
+// to compare, the post is published again: a duplicate beats a lost post.
+func (s *wallSyncer) findUnrecordedDelivery(ctx context.Context, text string) (bool, error) {
+	want, _ := renderVKText(text)
+	want = strings.TrimSpace(want)
+	if s.cfg.AdminChatID == "" || want == "" {
+		return false, nil
+	}
+	lastID, err := s.store.MaxTelegramMessageID(ctx, s.cfg.ChannelID)
+	if err != nil || lastID == 0 {
+		return false, err
+	}
+
+	for id := lastID + 1; id <= lastID+publishProbeWindow; id++ {
+		content, err := s.peekTelegramMessage(ctx, id)
+		if err != nil {
+			// Missing ids and service messages can't be forwarded.
+			if isTelegramBadRequest(err) {
+				continue
+			}
+			return false, err
+		}
+		// Long texts go out split or as a trimmed caption, so the first
+		// message with text carries a prefix of the post.
+		content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "…"))
+		if content != "" && strings.HasPrefix(want, content) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// peekTelegramMessage returns the text or caption of a channel message by
+// forwarding it silently to the admin chat and deleting the copy.
+func (s *wallSyncer) peekTelegramMessage(ctx context.Context, messageID int64) (string, error) {
+	params := url.Values{}
+	params.Set("chat_id", s.cfg.AdminChatID)
+	params.Set("from_chat_id", s.cfg.ChannelID)
+	params.Set("message_id", strconv.FormatInt(messageID, 10))
+	params.Set("disable_notification", "true")
+
+	body, err := s.callTelegram(ctx, "forwardMessage", params)
+	if err != nil {
+		return "", err
+	}
+	env, err := parseTelegramResponseEnvelope(body)
+	if err != nil {
+		return "", err
+	}
+	var forwarded struct {
+		MessageID int64  `json:"message_id"`
+		Text      string `json:"text"`
+		Caption   string `json:"caption"`
+	}
+	if err := json.Unmarshal(env.Result, &forwarded); err != nil {
+		return "", fmt.Errorf("decode forwarded Telegram message: %w", err)
+	}
+	if err := s.deleteTelegramMessage(ctx, s.cfg.AdminChatID, forwarded.MessageID); err != nil {
+		s.logger.Warn().Err(err).Int64("telegram_message_id", forwarded.MessageID).Msg("failed to delete probe copy from the admin chat")
+	}
+	return forwarded.Text + forwarded.Caption, nil
+}
+
+func (s *wallSyncer) telegramMessageExists(ctx context.Context, rec storedTelegramPost, ownerID int) (bool, error) {
+	params := url.Values{}
+	params.Set("chat_id", s.cfg.ChannelID)
+	params.Set("message_id", strconv.FormatInt(rec.MessageID, 10))
+	if s.cfg.VKButton {
+		opts := telegramSendOptions{ButtonURL: s.postURL(vkPost{ID: rec.PostID, OwnerID: ownerID})}
+		if err := opts.apply(params); err != nil {
+			return false, err
+		}
+	}
+
+	_, err := s.callTelegram(ctx, "editMessageReplyMarkup", params)
+	if err == nil || isTelegramMessageNotModified(err) {
+		return true, nil
+	}
+	var apiErr *telegramAPIError
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest && strings.Contains(apiErr.Description, "message to edit not found") {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+type publishedPostRef struct {
+	OwnerID int
+	PostID  int
+}
+
+// republish re-sends already published posts, oldest first, to the channel
+// configured on this syncer. Messages are recorded against that channel so
+// the records of the original channel stay untouched.
+func (s *wallSyncer) republish(ctx context.Context, refs []publishedPostRef) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	accessToken, err := s.manager.RequestAccessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("get access token: %w", err)
+	}
+	if accessToken == "" {
+		return errors.New("access token not available")
+	}
+
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		ids = append(ids, fmt.Sprintf("%d_%d", ref.OwnerID, ref.PostID))
+	}
+	params := url.Values{}
+	params.Set("posts", strings.Join(ids, ","))
+	params.Set("extended", "1")
+
+	var result vkWallResponse
+	if err := s.callVK(ctx, "wall.getById", accessToken, params, &result); err != nil {
+		return fmt.Errorf("fetch posts from VK: %w", err)
+	}
+	s.warnSkippedItems("wall.getById", result)
+	s.rememberOwnerNames(result.ownerNames())
+	orderPhotoAttachments(result.Items, s.cfg.PhotoOrder)
+	s.expandAlbumAttachments(ctx, accessToken, result.Items)
+	s.resolveVideoFiles(ctx, accessToken, result.Items)
+	if s.cfg.SourceFormat != "" {
+		if name, err := s.resolveGroupName(ctx, accessToken, s.cfg.GroupID); err == nil {
+			s.groupName = name
+		}
+	}
+
+	posts := make(map[string]vkPost, len(result.Items))
+	for _, post := range result.Items {
+		posts[fmt.Sprintf("%d_%d", post.OwnerID, post.ID)] = post
+	}
+
+	for _, id := range ids {
+		post, ok := posts[id]
+		if !ok {
+			s.logger.Warn().Str("post", id).Msg("post no longer available on VK, skipping")
+			continue
+		}
+		ctx := withPostLog(ctx, post)
+
+		messages, publishErr := s.publishPost(ctx, post, s.composeText(post, s.normalizePostText(post.Text)), 0)
+		if err := s.store.RecordTelegramPosts(ctx, post.OwnerID, post.ID, messages, s.cfg.ChannelID); err != nil {
+			return fmt.Errorf("record republished post %s: %w", id, err)
+		}
+		if publishErr != nil {
+			return fmt.Errorf("republish post %s: %w", id, publishErr)
+		}
+		s.log(ctx).Info().
+			Str("channel_id", s.cfg.ChannelID).
+			Int("messages", len(messages)).
+			Msg("republished post")
+	}
+	return nil
+}
+
+func republishLast(ctx context.Context, tokenMgr *tokenManager, store *storage, limiter *publishLimiter, meter *vkCallMeter, cfgs []wallSyncConfig, n int, channelID string) error {
+	channelID = strings.TrimSpace(channelID)
+	if channelID == "" {
+		return errors.New("-republish-last requires -to-channel")
+	}
+	if err := validateTelegramTarget("-to-channel", channelID, "", ""); err != nil {
+		return err
+	}
+	if len(cfgs) == 0 {
+		return errors.New("sync disabled: missing VK_GROUP_ID, TG_BOT_TOKEN, or TG_CHANNEL_ID")
+	}
+	if err := tokenMgr.EnsureToken(ctx); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if seen[cfg.GroupID] {
+			continue
+		}
+		seen[cfg.GroupID] = true
+
+		refs, err := store.RecentPublishedPosts(ctx, cfg.ownerID(), n)
+		if err != nil {
+			return err
+		}
+
+		cfg.ChannelID = channelID
+		cfg.ThreadID = ""
+		cfg.MirrorChannelIDs = nil
+		syncer := newWallSyncer(zlog.Logger.With().Str("mapping", cfg.workerKey()).Logger(), tokenMgr, store, limiter, meter, cfg)
+		if err := syncer.republish(ctx, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
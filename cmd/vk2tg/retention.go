@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const retentionInterval = time.Hour
+
+// runRetention periodically removes records of posts published longer than
+// retention ago.
+func runRetention(ctx context.Context, logger zerolog.Logger, store *storage, retention time.Duration) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		cutoff := time.Now().Add(-retention)
+		removed, err := store.CompactOlderThan(ctx, cutoff)
+		if err != nil {
+			logger.Error().Err(err).Int64("removed", removed).Msg("failed to compact old records")
+		} else if removed > 0 {
+			logger.Info().
+				Int64("removed", removed).
+				Time("cutoff", cutoff).
+				Msg("compacted old records")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,33 +2,79 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"net"
 	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/pressly/goose/v3"
 	"github.com/rs/zerolog"
 )
 
-//go:embed migrations/*.sql
+//go:embed migrations/*.sql migrations/prefixed/*.sql
 var embeddedMigrations embed.FS
 
+// migrationsFS and migrationsDir locate the goose migrations applied by
+// newStorage. Forks can point them at their own filesystem to add tables.
+var (
+	migrationsFS  fs.FS = embeddedMigrations
+	migrationsDir       = "migrations"
+)
+
+// prefixedMigrations serves the migrations that predate DB_TABLE_PREFIX from
+// migrations/prefixed, where they create prefixed tables. Databases without a
+// prefix keep running the original files.
+type prefixedMigrations struct {
+	fs.FS
+}
+
+func (m prefixedMigrations) Open(name string) (fs.File, error) {
+	if dir, file := path.Split(name); dir == migrationsDir+"/" {
+		if f, err := embeddedMigrations.Open(migrationsDir + "/prefixed/" + file); err == nil {
+			return f, nil
+		}
+	}
+	return m.FS.Open(name)
+}
+
 type dbConfig struct {
-	Host     string
-	Port     string
-	Username string
-	Password string
-	Database string
-	Schema   string
+	Host        string
+	Port        string
+	Username    string
+	Password    string
+	Database    string
+	Schema      string
+	TablePrefix string
+	PoolWarmup  int
+
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
 }
 
+// dbSSLModes lists the accepted DB_SSLMODE values. libpq's prefer and allow
+// silently fall back to plaintext and are deliberately not supported.
+var dbSSLModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
 func (c dbConfig) dsn() (string, error) {
 	if c.Host == "" || c.Port == "" || c.Username == "" || c.Password == "" || c.Database == "" {
 		return "", errors.New("incomplete database configuration")
@@ -40,12 +86,71 @@ func (c dbConfig) dsn() (string, error) {
 		Host:   fmt.Sprintf("%s:%s", c.Host, c.Port),
 		Path:   "/" + c.Database,
 	}
+	// TLS is set up by tlsConfig on the parsed connection config.
 	q := u.Query()
 	q.Set("sslmode", "disable")
 	u.RawQuery = q.Encode()
 	return u.String(), nil
 }
 
+// tlsConfig builds the TLS settings of database connections, following
+// libpq: require only encrypts unless a CA bundle is given, verify-ca checks
+// the certificate chain and verify-full the host name as well.
+func (c dbConfig) tlsConfig() (*tls.Config, error) {
+	if c.SSLMode == "" || c.SSLMode == "disable" {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+	if c.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.SSLCert, c.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("load DB_SSLCERT and DB_SSLKEY: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.SSLRootCert == "" {
+		tlsCfg.InsecureSkipVerify = true
+		return tlsCfg, nil
+	}
+
+	pem, err := os.ReadFile(c.SSLRootCert)
+	if err != nil {
+		return nil, fmt.Errorf("read DB_SSLROOTCERT: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("invalid DB_SSLROOTCERT %q: no PEM certificates found", c.SSLRootCert)
+	}
+	tlsCfg.RootCAs = roots
+	if c.SSLMode == "verify-full" {
+		return tlsCfg, nil
+	}
+
+	// Verify the chain without the host name check done by crypto/tls.
+	tlsCfg.InsecureSkipVerify = true
+	tlsCfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("database server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("parse database server certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+	return tlsCfg, nil
+}
+
 func loadDBConfigFromEnv() (dbConfig, error) {
 	cfg := dbConfig{
 		Host:     os.Getenv("DB_HOST"),
@@ -54,6 +159,13 @@ func loadDBConfigFromEnv() (dbConfig, error) {
 		Password: os.Getenv("DB_PASSWORD"),
 		Database: os.Getenv("DB_DATABASE"),
 		Schema:   os.Getenv("DB_SCHEMA"),
+
+		TablePrefix: os.Getenv("DB_TABLE_PREFIX"),
+
+		SSLMode:     strings.ToLower(strings.TrimSpace(os.Getenv("DB_SSLMODE"))),
+		SSLRootCert: strings.TrimSpace(os.Getenv("DB_SSLROOTCERT")),
+		SSLCert:     strings.TrimSpace(os.Getenv("DB_SSLCERT")),
+		SSLKey:      strings.TrimSpace(os.Getenv("DB_SSLKEY")),
 	}
 
 	var missing []string
@@ -80,24 +192,171 @@ func loadDBConfigFromEnv() (dbConfig, error) {
 		return dbConfig{}, fmt.Errorf("missing required database env vars: %s", strings.Join(missing, ", "))
 	}
 
+	var err error
+	if cfg.PoolWarmup, err = envInt("DB_POOL_WARMUP", 0); err != nil {
+		return dbConfig{}, err
+	}
+	if cfg.PoolWarmup < 0 {
+		return dbConfig{}, fmt.Errorf("invalid DB_POOL_WARMUP %d: must not be negative", cfg.PoolWarmup)
+	}
+
+	if cfg.TablePrefix != "" && !tablePrefixPattern.MatchString(cfg.TablePrefix) {
+		return dbConfig{}, fmt.Errorf("invalid DB_TABLE_PREFIX %q: expected lowercase letters, digits and underscores, starting with a letter", cfg.TablePrefix)
+	}
+
+	if err := cfg.validateTLS(); err != nil {
+		return dbConfig{}, err
+	}
+
 	return cfg, nil
 }
 
+func (c dbConfig) validateTLS() error {
+	if c.SSLMode == "" {
+		c.SSLMode = "disable"
+	}
+	if !slices.Contains(dbSSLModes, c.SSLMode) {
+		return fmt.Errorf("invalid DB_SSLMODE %q: expected one of %s", c.SSLMode, strings.Join(dbSSLModes, ", "))
+	}
+	if (c.SSLMode == "verify-ca" || c.SSLMode == "verify-full") && c.SSLRootCert == "" {
+		return fmt.Errorf("DB_SSLMODE=%s requires DB_SSLROOTCERT with the CA bundle of the database server", c.SSLMode)
+	}
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		return errors.New("DB_SSLCERT and DB_SSLKEY must be set together")
+	}
+	if c.SSLMode == "disable" && (c.SSLRootCert != "" || c.SSLCert != "") {
+		return errors.New("DB_SSLROOTCERT, DB_SSLCERT and DB_SSLKEY require DB_SSLMODE other than disable")
+	}
+
+	for _, file := range []struct{ name, path string }{
+		{"DB_SSLROOTCERT", c.SSLRootCert},
+		{"DB_SSLCERT", c.SSLCert},
+		{"DB_SSLKEY", c.SSLKey},
+	} {
+		if file.path == "" {
+			continue
+		}
+		info, err := os.Stat(file.path)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", file.name, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("invalid %s %q: is a directory", file.name, file.path)
+		}
+	}
+	return nil
+}
+
+var tablePrefixPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// storageTables are the tables queries refer to as {name}.
+var storageTables = []string{"vk_post_edit_log", "publish_attempt", "auth_tokens", "sync_state", "vk_post", "tg_post"}
+
+// tableNames resolves the {name} placeholders of storage queries to the
+// tables created for prefix.
+func tableNames(prefix string) *strings.Replacer {
+	pairs := make([]string, 0, 2*len(storageTables))
+	for _, table := range storageTables {
+		pairs = append(pairs, "{"+table+"}", prefix+table)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
 type storage struct {
 	db      *sql.DB
 	timeout time.Duration
+	tables  *strings.Replacer
+	stmts   map[string]*sql.Stmt
 }
 
 type vkPostState struct {
-	Published bool
-	Hash      string
+	Published    bool
+	PublishedAt  time.Time
+	Hash         string
+	MediaHash    string
+	DeadLettered bool
+	EditLocked   bool
+}
+
+type deadLetterPost struct {
+	OwnerID        int       `json:"owner_id"`
+	PostID         int       `json:"post_id"`
+	FailureCount   int       `json:"failure_count"`
+	LastError      string    `json:"last_error,omitempty"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+}
+
+type vkPostRecord struct {
+	OwnerID         int
+	PostID          int
+	Hash            string
+	ContentHash     string
+	Text            string
+	AttachmentCount int
+	PhotoCount      int
+	MediaHash       string
+	AttachmentURLs  []string
+}
+
+type vkPostEditSummary struct {
+	OldLen int
+	NewLen int
+	// AttachmentDelta is nil when the previous attachment count is unknown.
+	AttachmentDelta *int
 }
 
 type storedTelegramPost struct {
 	MessageID int64
 	ChannelID string
+	PostID    int
+	HasText   bool
+	Text      string
+	// Step is the publishPost step of the message, or -1 when unknown.
+	Step int
 }
 
+// syncStore is the part of storage used by wallSyncer, so the sync logic
+// can run against another implementation.
+type syncStore interface {
+	EnsureVKPost(ctx context.Context, rec vkPostRecord) (vkPostState, error)
+	UpdateVKPostAfterEdit(ctx context.Context, rec vkPostRecord) (vkPostEditSummary, error)
+	MarkVKPostSeen(ctx context.Context, ownerID, postID int) error
+	NoteVKPostChange(ctx context.Context, ownerID, postID int, hash string, seenAt time.Time) (time.Time, error)
+	RecordEdit(ctx context.Context, ownerID, postID int, summary vkPostEditSummary, editedAt time.Time) error
+	ContentHashPublished(ctx context.Context, contentHash string, ownerID, postID int, channelID string) (bool, error)
+	RetentionCursor(ctx context.Context, ownerID int) (int, error)
+
+	RecordTelegramPosts(ctx context.Context, ownerID, postID int, messages []telegramMessage, channelID string) error
+	RecordPartialTelegramPosts(ctx context.Context, ownerID, postID int, messages []telegramMessage, channelID string) error
+	TelegramPosts(ctx context.Context, ownerID, postID int) ([]storedTelegramPost, error)
+	LatestTelegramPosts(ctx context.Context, ownerID, postID int) ([]storedTelegramPost, error)
+	RecentTelegramPosts(ctx context.Context, ownerID int, channelID string, limit int) ([]storedTelegramPost, error)
+	MaxTelegramMessageID(ctx context.Context, channelID string) (int64, error)
+	UpdateTelegramPostText(ctx context.Context, ownerID, postID int, channelID string, messageID int64, messageText string) error
+	DeleteTelegramPost(ctx context.Context, ownerID, postID int, channelID string, messageID int64) error
+	LastTelegramEdit(ctx context.Context, ownerID, postID int) (time.Time, error)
+
+	BeginPublishAttempt(ctx context.Context, ownerID, postID int, startedAt time.Time) (*time.Time, error)
+	ClearPublishAttempt(ctx context.Context, ownerID, postID int) error
+	IncrementFailure(ctx context.Context, ownerID, postID int, lastError string) (int, error)
+	MarkDeadLetter(ctx context.Context, ownerID, postID int) error
+
+	GetSyncState(ctx context.Context, key string) (string, bool, error)
+	SetSyncState(ctx context.Context, key, value string) error
+	SetLastVKError(ctx context.Context, rec *vkErrorRecord) error
+}
+
+// tokenStore is the part of storage used by tokenManager.
+type tokenStore interface {
+	LoadTokenState(ctx context.Context) (*tokenRecord, error)
+	UpsertTokenState(ctx context.Context, payload authSuccessPayload, updatedAt, expiresAt time.Time) error
+}
+
+var (
+	_ syncStore  = (*storage)(nil)
+	_ tokenStore = (*storage)(nil)
+)
+
 func newStorage(ctx context.Context, logger zerolog.Logger) (*storage, error) {
 	cfg, err := loadDBConfigFromEnv()
 	if err != nil {
@@ -113,6 +372,9 @@ func newStorage(ctx context.Context, logger zerolog.Logger) (*storage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parse postgres config: %w", err)
 	}
+	if baseCfg.TLSConfig, err = cfg.tlsConfig(); err != nil {
+		return nil, err
+	}
 
 	setupDB := stdlib.OpenDB(*baseCfg)
 	defer setupDB.Close()
@@ -139,13 +401,22 @@ func newStorage(ctx context.Context, logger zerolog.Logger) (*storage, error) {
 	migrateCtx, cancelMigrate := context.WithTimeout(ctx, 30*time.Second)
 	defer cancelMigrate()
 
-	goose.SetBaseFS(embeddedMigrations)
+	goose.SetBaseFS(migrationsFS)
+	if cfg.TablePrefix != "" {
+		goose.SetBaseFS(prefixedMigrations{migrationsFS})
+		goose.SetTableName(cfg.TablePrefix + "goose_db_version")
+	}
 	if err := goose.SetDialect("postgres"); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("configure migrations: %w", err)
 	}
 
-	if err := goose.UpContext(migrateCtx, db, "migrations"); err != nil {
+	if err := checkSchemaVersion(migrateCtx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := goose.UpContext(migrateCtx, db, migrationsDir); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("apply migrations: %w", err)
 	}
@@ -153,21 +424,133 @@ func newStorage(ctx context.Context, logger zerolog.Logger) (*storage, error) {
 	logger.Info().
 		Str("schema", cfg.Schema).
 		Str("database", cfg.Database).
+		Str("table_prefix", cfg.TablePrefix).
 		Msg("database migrations applied")
 
-	return &storage{
+	store := &storage{
 		db:      db,
 		timeout: 5 * time.Second,
-	}, nil
+		tables:  tableNames(cfg.TablePrefix),
+	}
+
+	if cfg.PoolWarmup > 0 {
+		if err := warmPool(ctx, db, cfg.PoolWarmup); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("warm up connection pool: %w", err)
+		}
+	}
+
+	if err := store.prepare(ctx, preparedQueries...); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
 }
 
 func (s *storage) Close() error {
 	if s == nil || s.db == nil {
 		return nil
 	}
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
 	return s.db.Close()
 }
 
+func warmPool(ctx context.Context, db *sql.DB, n int) error {
+	db.SetMaxIdleConns(max(n, 2))
+
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for range n {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *storage) prepare(ctx context.Context, queries ...string) error {
+	s.stmts = make(map[string]*sql.Stmt, len(queries))
+	for _, query := range queries {
+		stmt, err := s.db.PrepareContext(ctx, s.sql(query))
+		if err != nil {
+			return fmt.Errorf("prepare statement: %w", err)
+		}
+		s.stmts[query] = stmt
+	}
+	return nil
+}
+
+// scanPrepared and execPrepared run query through its prepared statement and
+// fall back to an ad-hoc query when the server has dropped or invalidated the
+// plan, e.g. after a reconnect to a restarted server or a schema change.
+func (s *storage) scanPrepared(ctx context.Context, query string, args []any, dest ...any) error {
+	if stmt, ok := s.stmts[query]; ok {
+		err := stmt.QueryRowContext(ctx, args...).Scan(dest...)
+		if !isStalePreparedStatement(err) {
+			return err
+		}
+	}
+	return s.db.QueryRowContext(ctx, s.sql(query), args...).Scan(dest...)
+}
+
+func (s *storage) execPrepared(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if stmt, ok := s.stmts[query]; ok {
+		res, err := stmt.ExecContext(ctx, args...)
+		if !isStalePreparedStatement(err) {
+			return res, err
+		}
+	}
+	return s.db.ExecContext(ctx, s.sql(query), args...)
+}
+
+func isStalePreparedStatement(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// 26000: prepared statement does not exist; 0A000: cached plan must not
+	// change result type.
+	return pgErr.Code == "26000" || pgErr.Code == "0A000"
+}
+
+// checkSchemaVersion refuses to run against a database migrated by a newer
+// build: its schema may lack columns this build relies on or carry
+// constraints it doesn't know about.
+func checkSchemaVersion(ctx context.Context, db *sql.DB) error {
+	current, err := goose.GetDBVersionContext(ctx, db)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	migrations, err := goose.CollectMigrations(migrationsDir, 0, goose.MaxVersion)
+	if err != nil {
+		return fmt.Errorf("collect migrations: %w", err)
+	}
+	last, err := migrations.Last()
+	if err != nil {
+		return fmt.Errorf("collect migrations: %w", err)
+	}
+	if current > last.Version {
+		return fmt.Errorf("database schema is at version %d but this build only knows migrations up to %d; it was migrated by a newer vk2tg, run that version or a newer one", current, last.Version)
+	}
+	return nil
+}
+
+func (s *storage) sql(query string) string {
+	return s.tables.Replace(query)
+}
+
 func (s *storage) withContext(ctx context.Context) (context.Context, context.CancelFunc) {
 	if ctx == nil {
 		ctx = context.Background()
@@ -187,7 +570,7 @@ func (s *storage) LoadTokenState(ctx context.Context) (*tokenRecord, error) {
 
 	const query = `
 		SELECT access_token, refresh_token, state, device_id, expires_in, updated_at, expires_at
-		FROM auth_tokens
+		FROM {auth_tokens}
 		WHERE id = 1
 	`
 
@@ -195,7 +578,7 @@ func (s *storage) LoadTokenState(ctx context.Context) (*tokenRecord, error) {
 		rec       tokenRecord
 		expiresIn int
 	)
-	if err := s.db.QueryRowContext(ctx, query).Scan(
+	if err := s.db.QueryRowContext(ctx, s.sql(query)).Scan(
 		&rec.payload.AccessToken,
 		&rec.payload.RefreshToken,
 		&rec.payload.State,
@@ -219,7 +602,7 @@ func (s *storage) UpsertTokenState(ctx context.Context, payload authSuccessPaylo
 	defer cancel()
 
 	const query = `
-		INSERT INTO auth_tokens (
+		INSERT INTO {auth_tokens} (
 			id, access_token, refresh_token, state, device_id, expires_in, updated_at, expires_at
 		) VALUES (
 			1, $1, $2, $3, $4, $5, $6, $7
@@ -234,7 +617,7 @@ func (s *storage) UpsertTokenState(ctx context.Context, payload authSuccessPaylo
 			expires_at = EXCLUDED.expires_at
 	`
 
-	if _, err := s.db.ExecContext(ctx, query,
+	if _, err := s.db.ExecContext(ctx, s.sql(query),
 		payload.AccessToken,
 		payload.RefreshToken,
 		payload.State,
@@ -248,119 +631,575 @@ func (s *storage) UpsertTokenState(ctx context.Context, payload authSuccessPaylo
 	return nil
 }
 
-func (s *storage) EnsureVKPost(ctx context.Context, ownerID, postID int, hash string, postText string) (vkPostState, error) {
+const (
+	ensureVKPostSelectQuery = `
+		SELECT hash, published_at, dead_lettered_at IS NOT NULL, COALESCE(media_hash, ''), edit_locked_at IS NOT NULL
+		FROM {vk_post}
+		WHERE owner_id = $1 AND id = $2
+	`
+	ensureVKPostInsertQuery = `
+		INSERT INTO {vk_post} (owner_id, id, hash, post_text, content_hash, attachment_count, photo_count, media_hash, attachment_urls)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, NULLIF($8, ''), $9::jsonb)
+	`
+	ensureVKPostUpdateQuery = `
+		UPDATE {vk_post}
+		SET post_text = COALESCE({vk_post}.post_text, $3),
+			content_hash = COALESCE({vk_post}.content_hash, NULLIF($4, '')),
+			media_hash = COALESCE({vk_post}.media_hash, NULLIF($5, '')),
+			attachment_urls = COALESCE({vk_post}.attachment_urls, $6::jsonb)
+		WHERE owner_id = $1 AND id = $2
+	`
+)
+
+var preparedQueries = []string{
+	ensureVKPostSelectQuery,
+	ensureVKPostInsertQuery,
+	ensureVKPostUpdateQuery,
+}
+
+func (s *storage) EnsureVKPost(ctx context.Context, rec vkPostRecord) (vkPostState, error) {
 	ctx, cancel := s.withContext(ctx)
 	defer cancel()
 
 	var (
 		existingHash sql.NullString
 		publishedAt  sql.NullTime
+		deadLettered bool
+		mediaHash    string
+		editLocked   bool
 	)
 
-	const selectQuery = `
-		SELECT hash, published_at
-		FROM vk_post
-		WHERE owner_id = $1 AND id = $2
-	`
+	text := nullableText(rec.Text)
+	urls, err := attachmentURLsJSON(rec.AttachmentURLs)
+	if err != nil {
+		return vkPostState{}, err
+	}
 
-	err := s.db.QueryRowContext(ctx, selectQuery, ownerID, postID).Scan(&existingHash, &publishedAt)
+	err = s.scanPrepared(ctx, ensureVKPostSelectQuery, []any{rec.OwnerID, rec.PostID}, &existingHash, &publishedAt, &deadLettered, &mediaHash, &editLocked)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			var text sql.NullString
-			if trimmed := strings.TrimSpace(postText); trimmed != "" {
-				text = sql.NullString{String: trimmed, Valid: true}
-			}
-
-			const insertQuery = `
-				INSERT INTO vk_post (owner_id, id, hash, post_text)
-				VALUES ($1, $2, $3, $4)
-			`
-			if _, err := s.db.ExecContext(ctx, insertQuery, ownerID, postID, hash, text); err != nil {
+			if _, err := s.execPrepared(ctx, ensureVKPostInsertQuery, rec.OwnerID, rec.PostID, rec.Hash, text, rec.ContentHash, rec.AttachmentCount, rec.PhotoCount, rec.MediaHash, urls); err != nil {
 				return vkPostState{}, fmt.Errorf("insert vk post: %w", err)
 			}
 
 			return vkPostState{
 				Published: false,
-				Hash:      hash,
+				Hash:      rec.Hash,
 			}, nil
 		}
 		return vkPostState{}, fmt.Errorf("query vk post: %w", err)
 	}
 
-	if trimmed := strings.TrimSpace(postText); trimmed != "" {
-		const updateTextQuery = `
-			UPDATE vk_post
-			SET post_text = COALESCE(vk_post.post_text, $3)
-			WHERE owner_id = $1 AND id = $2
-		`
-		if _, err := s.db.ExecContext(ctx, updateTextQuery, ownerID, postID, trimmed); err != nil {
+	if text.Valid || rec.ContentHash != "" || rec.MediaHash != "" || urls.Valid {
+		if _, err := s.execPrepared(ctx, ensureVKPostUpdateQuery, rec.OwnerID, rec.PostID, text, rec.ContentHash, rec.MediaHash, urls); err != nil {
 			return vkPostState{}, fmt.Errorf("update vk post text: %w", err)
 		}
 	}
 
 	state := vkPostState{
-		Published: publishedAt.Valid,
-		Hash:      existingHash.String,
+		Published:    publishedAt.Valid,
+		PublishedAt:  publishedAt.Time,
+		Hash:         existingHash.String,
+		MediaHash:    mediaHash,
+		DeadLettered: deadLettered,
+		EditLocked:   editLocked,
 	}
 
 	return state, nil
 }
 
-func (s *storage) UpdateVKPostAfterEdit(ctx context.Context, ownerID, postID int, hash string, postText string) error {
+func (s *storage) UpdateVKPostAfterEdit(ctx context.Context, rec vkPostRecord) (vkPostEditSummary, error) {
 	ctx, cancel := s.withContext(ctx)
 	defer cancel()
 
-	var text sql.NullString
-	if trimmed := strings.TrimSpace(postText); trimmed != "" {
-		text = sql.NullString{String: trimmed, Valid: true}
+	const query = `
+		UPDATE {vk_post}
+		SET hash = $3,
+			post_text = COALESCE($4, {vk_post}.post_text),
+			content_hash = COALESCE(NULLIF($5, ''), {vk_post}.content_hash),
+			attachment_count = $6,
+			photo_count = $7,
+			media_hash = COALESCE(NULLIF($8, ''), {vk_post}.media_hash),
+			attachment_urls = $9::jsonb,
+			pending_hash = NULL
+		FROM (
+			SELECT owner_id, id, post_text, attachment_count
+			FROM {vk_post}
+			WHERE owner_id = $1 AND id = $2
+			FOR UPDATE
+		) AS old
+		WHERE {vk_post}.owner_id = old.owner_id AND {vk_post}.id = old.id
+		RETURNING COALESCE(char_length(old.post_text), 0), old.attachment_count
+	`
+
+	urls, err := attachmentURLsJSON(rec.AttachmentURLs)
+	if err != nil {
+		return vkPostEditSummary{}, err
 	}
 
+	var (
+		oldLen             int
+		oldAttachmentCount sql.NullInt64
+	)
+	err = s.db.QueryRowContext(ctx, s.sql(query), rec.OwnerID, rec.PostID, rec.Hash, nullableText(rec.Text), rec.ContentHash, rec.AttachmentCount, rec.PhotoCount, rec.MediaHash, urls).Scan(&oldLen, &oldAttachmentCount)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return vkPostEditSummary{}, fmt.Errorf("update vk post hash: %w", err)
+	}
+
+	summary := vkPostEditSummary{
+		OldLen: oldLen,
+		NewLen: utf8.RuneCountInString(strings.TrimSpace(rec.Text)),
+	}
+	if oldAttachmentCount.Valid {
+		delta := rec.AttachmentCount - int(oldAttachmentCount.Int64)
+		summary.AttachmentDelta = &delta
+	}
+	return summary, nil
+}
+
+// AttachmentURLs returns the attachment URLs recorded for a post, or nil when
+// the post is unknown or was stored before URLs were tracked.
+func (s *storage) AttachmentURLs(ctx context.Context, ownerID, postID int) ([]string, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
 	const query = `
-		UPDATE vk_post
-		SET hash = $3,
-			post_text = COALESCE($4, post_text)
+		SELECT attachment_urls
+		FROM {vk_post}
+		WHERE owner_id = $1 AND id = $2
+	`
+
+	var raw sql.NullString
+	if err := s.db.QueryRowContext(ctx, s.sql(query), ownerID, postID).Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query attachment urls: %w", err)
+	}
+	if !raw.Valid {
+		return nil, nil
+	}
+
+	var urls []string
+	if err := json.Unmarshal([]byte(raw.String), &urls); err != nil {
+		return nil, fmt.Errorf("decode attachment urls: %w", err)
+	}
+	return urls, nil
+}
+
+func attachmentURLsJSON(urls []string) (sql.NullString, error) {
+	if len(urls) == 0 {
+		return sql.NullString{}, nil
+	}
+	payload, err := json.Marshal(urls)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("encode attachment urls: %w", err)
+	}
+	return sql.NullString{String: string(payload), Valid: true}, nil
+}
+
+func (s *storage) NoteVKPostChange(ctx context.Context, ownerID, postID int, hash string, seenAt time.Time) (time.Time, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		UPDATE {vk_post}
+		SET last_changed_at = CASE
+				WHEN pending_hash IS DISTINCT FROM $3 OR last_changed_at IS NULL THEN $4
+				ELSE last_changed_at
+			END,
+			pending_hash = $3
+		WHERE owner_id = $1 AND id = $2
+		RETURNING last_changed_at
+	`
+
+	var changedAt time.Time
+	if err := s.db.QueryRowContext(ctx, s.sql(query), ownerID, postID, hash, seenAt.UTC()).Scan(&changedAt); err != nil {
+		return time.Time{}, fmt.Errorf("note vk post change: %w", err)
+	}
+	return changedAt, nil
+}
+
+// LastTelegramEdit returns when any Telegram message of the post was last
+// edited, or the zero time if none was.
+func (s *storage) LastTelegramEdit(ctx context.Context, ownerID, postID int) (time.Time, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT MAX(last_edited_at)
+		FROM {tg_post}
+		WHERE vk_owner_id = $1 AND vk_post_id = $2
+	`
+
+	var editedAt sql.NullTime
+	if err := s.db.QueryRowContext(ctx, s.sql(query), ownerID, postID).Scan(&editedAt); err != nil {
+		return time.Time{}, fmt.Errorf("query last tg post edit: %w", err)
+	}
+	return editedAt.Time, nil
+}
+
+func (s *storage) RecordEdit(ctx context.Context, ownerID, postID int, summary vkPostEditSummary, editedAt time.Time) error {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		INSERT INTO {vk_post_edit_log} (vk_owner_id, vk_post_id, edited_at, old_len, new_len, attachment_delta)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	if _, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID, editedAt.UTC(), summary.OldLen, summary.NewLen, summary.AttachmentDelta); err != nil {
+		return fmt.Errorf("insert vk post edit log: %w", err)
+	}
+	return nil
+}
+
+func (s *storage) MarkVKPostSeen(ctx context.Context, ownerID, postID int) error {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		UPDATE {vk_post}
+		SET published_at = COALESCE(published_at, NOW())
+		WHERE owner_id = $1 AND id = $2
+	`
+	if _, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID); err != nil {
+		return fmt.Errorf("mark vk post seen: %w", err)
+	}
+	return nil
+}
+
+func (s *storage) IncrementFailure(ctx context.Context, ownerID, postID int, lastError string) (int, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		UPDATE {vk_post}
+		SET failure_count = failure_count + 1,
+			last_error = $3
+		WHERE owner_id = $1 AND id = $2
+		RETURNING failure_count
+	`
+	var count int
+	if err := s.db.QueryRowContext(ctx, s.sql(query), ownerID, postID, nullableText(lastError)).Scan(&count); err != nil {
+		return 0, fmt.Errorf("increment vk post failure count: %w", err)
+	}
+	return count, nil
+}
+
+func (s *storage) MarkDeadLetter(ctx context.Context, ownerID, postID int) error {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		UPDATE {vk_post}
+		SET dead_lettered_at = COALESCE(dead_lettered_at, NOW())
 		WHERE owner_id = $1 AND id = $2
 	`
-	if _, err := s.db.ExecContext(ctx, query, ownerID, postID, hash, text); err != nil {
-		return fmt.Errorf("update vk post hash: %w", err)
+	if _, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID); err != nil {
+		return fmt.Errorf("mark vk post dead-lettered: %w", err)
 	}
 	return nil
 }
 
-func (s *storage) LatestTelegramPost(ctx context.Context, ownerID, postID int) (*storedTelegramPost, error) {
+func (s *storage) SetEditLock(ctx context.Context, ownerID, postID int, locked bool) (bool, error) {
 	ctx, cancel := s.withContext(ctx)
 	defer cancel()
 
 	const query = `
-		SELECT id, channel_id
-		FROM tg_post
+		UPDATE {vk_post}
+		SET edit_locked_at = CASE WHEN $3 THEN COALESCE(edit_locked_at, NOW()) END
+		WHERE owner_id = $1 AND id = $2
+	`
+	res, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID, locked)
+	if err != nil {
+		return false, fmt.Errorf("set vk post edit lock: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("set vk post edit lock: %w", err)
+	}
+	return affected > 0, nil
+}
+
+func (s *storage) RetryDeadLetter(ctx context.Context, ownerID, postID int) (bool, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		UPDATE {vk_post}
+		SET dead_lettered_at = NULL,
+			failure_count = 0
+		WHERE owner_id = $1 AND id = $2 AND dead_lettered_at IS NOT NULL
+	`
+	res, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID)
+	if err != nil {
+		return false, fmt.Errorf("retry dead-lettered vk post: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("retry dead-lettered vk post: %w", err)
+	}
+	return affected > 0, nil
+}
+
+func (s *storage) DeadLetteredPosts(ctx context.Context) ([]deadLetterPost, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT owner_id, id, failure_count, COALESCE(last_error, ''), dead_lettered_at
+		FROM {vk_post}
+		WHERE dead_lettered_at IS NOT NULL
+		ORDER BY dead_lettered_at DESC
+		LIMIT 100
+	`
+	rows, err := s.db.QueryContext(ctx, s.sql(query))
+	if err != nil {
+		return nil, fmt.Errorf("query dead-lettered vk posts: %w", err)
+	}
+	defer rows.Close()
+
+	var posts []deadLetterPost
+	for rows.Next() {
+		var post deadLetterPost
+		if err := rows.Scan(&post.OwnerID, &post.PostID, &post.FailureCount, &post.LastError, &post.DeadLetteredAt); err != nil {
+			return nil, fmt.Errorf("scan dead-lettered vk post: %w", err)
+		}
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate dead-lettered vk posts: %w", err)
+	}
+	return posts, nil
+}
+
+// ContentHashPublished reports whether another post with the same content
+// was already published to the given channel.
+func (s *storage) ContentHashPublished(ctx context.Context, contentHash string, ownerID, postID int, channelID string) (bool, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT EXISTS (
+			SELECT 1
+			FROM {vk_post} p
+			JOIN {tg_post} t ON t.vk_owner_id = p.owner_id AND t.vk_post_id = p.id
+			WHERE p.content_hash = $1
+				AND p.published_at IS NOT NULL
+				AND NOT (p.owner_id = $2 AND p.id = $3)
+				AND (t.channel_id = $4 OR t.channel_id IS NULL)
+		)
+	`
+
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, s.sql(query), contentHash, ownerID, postID, channelID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("query content hash: %w", err)
+	}
+	return exists, nil
+}
+
+func (s *storage) TelegramPosts(ctx context.Context, ownerID, postID int) ([]storedTelegramPost, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT id, COALESCE(channel_id, ''), post_text IS NOT NULL, COALESCE(publish_step, -1)
+		FROM {tg_post}
 		WHERE vk_owner_id = $1 AND vk_post_id = $2
-		ORDER BY id DESC
-		LIMIT 1
+		ORDER BY id
 	`
+	rows, err := s.db.QueryContext(ctx, s.sql(query), ownerID, postID)
+	if err != nil {
+		return nil, fmt.Errorf("query tg posts: %w", err)
+	}
+	defer rows.Close()
 
-	var (
-		messageID int64
-		channelID sql.NullString
-	)
-	err := s.db.QueryRowContext(ctx, query, ownerID, postID).Scan(&messageID, &channelID)
+	var posts []storedTelegramPost
+	for rows.Next() {
+		var rec storedTelegramPost
+		if err := rows.Scan(&rec.MessageID, &rec.ChannelID, &rec.HasText, &rec.Step); err != nil {
+			return nil, fmt.Errorf("scan tg post: %w", err)
+		}
+		posts = append(posts, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate tg posts: %w", err)
+	}
+	return posts, nil
+}
+
+// RecentTelegramPosts returns the most recently published Telegram messages
+// of the owner in the given channel.
+func (s *storage) RecentTelegramPosts(ctx context.Context, ownerID int, channelID string, limit int) ([]storedTelegramPost, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT id, COALESCE(channel_id, ''), vk_post_id, post_text IS NOT NULL
+		FROM {tg_post}
+		WHERE vk_owner_id = $1 AND (channel_id = $2 OR channel_id IS NULL)
+		ORDER BY published_at DESC, id DESC
+		LIMIT $3
+	`
+	rows, err := s.db.QueryContext(ctx, s.sql(query), ownerID, channelID, limit)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+		return nil, fmt.Errorf("query recent tg posts: %w", err)
+	}
+	defer rows.Close()
+
+	var posts []storedTelegramPost
+	for rows.Next() {
+		var rec storedTelegramPost
+		if err := rows.Scan(&rec.MessageID, &rec.ChannelID, &rec.PostID, &rec.HasText); err != nil {
+			return nil, fmt.Errorf("scan recent tg post: %w", err)
 		}
-		return nil, fmt.Errorf("query latest tg post: %w", err)
+		posts = append(posts, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate recent tg posts: %w", err)
+	}
+	return posts, nil
+}
+
+// MaxTelegramMessageID returns the highest message id recorded for the
+// channel, or 0 when nothing was recorded there yet.
+func (s *storage) MaxTelegramMessageID(ctx context.Context, channelID string) (int64, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT COALESCE(MAX(id), 0)
+		FROM {tg_post}
+		WHERE channel_id = $1 OR channel_id IS NULL
+	`
+	var id int64
+	if err := s.db.QueryRowContext(ctx, s.sql(query), channelID).Scan(&id); err != nil {
+		return 0, fmt.Errorf("query max tg message id: %w", err)
+	}
+	return id, nil
+}
+
+// LatestTelegramChannel returns the channel of the most recently published
+// Telegram message for the owner, ignoring the channels in skip, or "" when
+// nothing was published there yet.
+func (s *storage) LatestTelegramChannel(ctx context.Context, ownerID int, skip []string) (string, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT COALESCE(channel_id, '')
+		FROM {tg_post}
+		WHERE vk_owner_id = $1
+		GROUP BY 1
+		ORDER BY MAX(published_at) DESC
+	`
+	rows, err := s.db.QueryContext(ctx, s.sql(query), ownerID)
+	if err != nil {
+		return "", fmt.Errorf("query latest tg post channel: %w", err)
 	}
+	defer rows.Close()
 
-	rec := &storedTelegramPost{
-		MessageID: messageID,
+	for rows.Next() {
+		var channelID string
+		if err := rows.Scan(&channelID); err != nil {
+			return "", fmt.Errorf("scan latest tg post channel: %w", err)
+		}
+		if !slices.Contains(skip, channelID) {
+			return channelID, nil
+		}
 	}
-	if channelID.Valid {
-		rec.ChannelID = channelID.String
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("iterate latest tg post channels: %w", err)
 	}
-	return rec, nil
+	return "", nil
 }
 
-func (s *storage) UpdateTelegramPostText(ctx context.Context, ownerID, postID int, messageID int64, messageText string) error {
+func (s *storage) RecentPublishedPosts(ctx context.Context, ownerID, limit int) ([]publishedPostRef, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT v.owner_id, v.id
+		FROM {vk_post} v
+		WHERE v.owner_id = $1
+			AND v.published_at IS NOT NULL
+			AND EXISTS (
+				SELECT 1
+				FROM {tg_post} t
+				WHERE t.vk_owner_id = v.owner_id AND t.vk_post_id = v.id
+			)
+		ORDER BY v.published_at DESC, v.id DESC
+		LIMIT $2
+	`
+	rows, err := s.db.QueryContext(ctx, s.sql(query), ownerID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query recent published posts: %w", err)
+	}
+	defer rows.Close()
+
+	var refs []publishedPostRef
+	for rows.Next() {
+		var ref publishedPostRef
+		if err := rows.Scan(&ref.OwnerID, &ref.PostID); err != nil {
+			return nil, fmt.Errorf("scan recent published post: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate recent published posts: %w", err)
+	}
+	slices.Reverse(refs)
+	return refs, nil
+}
+
+func (s *storage) DeleteTelegramPost(ctx context.Context, ownerID, postID int, channelID string, messageID int64) error {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		DELETE FROM {tg_post}
+		WHERE vk_owner_id = $1 AND vk_post_id = $2 AND COALESCE(channel_id, '') = $3 AND id = $4
+	`
+	if _, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID, channelID, messageID); err != nil {
+		return fmt.Errorf("delete tg post: %w", err)
+	}
+	return nil
+}
+
+// LatestTelegramPosts returns, for every channel the post was sent to, the
+// message holding the post text, falling back to the latest message when none
+// was recorded with text.
+func (s *storage) LatestTelegramPosts(ctx context.Context, ownerID, postID int) ([]storedTelegramPost, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT DISTINCT ON (COALESCE(channel_id, '')) id, COALESCE(channel_id, ''), post_text IS NOT NULL, COALESCE(post_text, '')
+		FROM {tg_post}
+		WHERE vk_owner_id = $1 AND vk_post_id = $2
+		ORDER BY COALESCE(channel_id, ''), (post_text IS NOT NULL) DESC, id DESC
+	`
+	rows, err := s.db.QueryContext(ctx, s.sql(query), ownerID, postID)
+	if err != nil {
+		return nil, fmt.Errorf("query latest tg posts: %w", err)
+	}
+	defer rows.Close()
+
+	var posts []storedTelegramPost
+	for rows.Next() {
+		var rec storedTelegramPost
+		if err := rows.Scan(&rec.MessageID, &rec.ChannelID, &rec.HasText, &rec.Text); err != nil {
+			return nil, fmt.Errorf("scan latest tg post: %w", err)
+		}
+		posts = append(posts, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate latest tg posts: %w", err)
+	}
+	return posts, nil
+}
+
+func (s *storage) UpdateTelegramPostText(ctx context.Context, ownerID, postID int, channelID string, messageID int64, messageText string) error {
 	ctx, cancel := s.withContext(ctx)
 	defer cancel()
 
@@ -370,17 +1209,52 @@ func (s *storage) UpdateTelegramPostText(ctx context.Context, ownerID, postID in
 	}
 
 	const query = `
-		UPDATE tg_post
-		SET post_text = $4
-		WHERE vk_owner_id = $1 AND vk_post_id = $2 AND id = $3
+		UPDATE {tg_post}
+		SET post_text = $5, last_edited_at = NOW()
+		WHERE vk_owner_id = $1 AND vk_post_id = $2 AND COALESCE(channel_id, '') = $3 AND id = $4
 	`
-	if _, err := s.db.ExecContext(ctx, query, ownerID, postID, messageID, text); err != nil {
+	if _, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID, channelID, messageID, text); err != nil {
 		return fmt.Errorf("update telegram post text: %w", err)
 	}
 	return nil
 }
 
-func (s *storage) RecordTelegramPost(ctx context.Context, ownerID, postID int, messageID int64, channelID string, messageText string, publishedAt time.Time) error {
+// SetManualTelegramText records text an admin put into the channel messages
+// of the post by hand, so automatic edits can tell whether VK has caught up.
+func (s *storage) SetManualTelegramText(ctx context.Context, ownerID, postID int, text string) error {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		UPDATE {tg_post}
+		SET post_text = $3
+		WHERE vk_owner_id = $1 AND vk_post_id = $2 AND post_text IS NOT NULL
+	`
+	if _, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID, strings.TrimSpace(text)); err != nil {
+		return fmt.Errorf("set manual telegram post text: %w", err)
+	}
+	return nil
+}
+
+// RecordTelegramPosts stores all messages of a published post and marks the
+// VK post as published in one transaction, so a multi-message post is never
+// recorded partially.
+func (s *storage) RecordTelegramPosts(ctx context.Context, ownerID, postID int, messages []telegramMessage, channelID string) error {
+	return s.recordTelegramPosts(ctx, ownerID, postID, messages, channelID, true)
+}
+
+// RecordPartialTelegramPosts stores messages of a post whose publication
+// failed midway, without marking the VK post as published, so the next cycle
+// can continue after them instead of sending them again.
+func (s *storage) RecordPartialTelegramPosts(ctx context.Context, ownerID, postID int, messages []telegramMessage, channelID string) error {
+	return s.recordTelegramPosts(ctx, ownerID, postID, messages, channelID, false)
+}
+
+func (s *storage) recordTelegramPosts(ctx context.Context, ownerID, postID int, messages []telegramMessage, channelID string, published bool) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
 	ctx, cancel := s.withContext(ctx)
 	defer cancel()
 
@@ -394,30 +1268,34 @@ func (s *storage) RecordTelegramPost(ctx context.Context, ownerID, postID int, m
 		}
 	}()
 
-	var text sql.NullString
-	if trimmed := strings.TrimSpace(messageText); trimmed != "" {
-		text = sql.NullString{String: trimmed, Valid: true}
-	}
-
 	const insertTGPost = `
-		INSERT INTO tg_post (vk_owner_id, vk_post_id, id, post_text, published_at, channel_id)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (vk_owner_id, vk_post_id, id) DO UPDATE
-		SET post_text = COALESCE(tg_post.post_text, EXCLUDED.post_text),
-			channel_id = COALESCE(tg_post.channel_id, EXCLUDED.channel_id)
+		INSERT INTO {tg_post} (vk_owner_id, vk_post_id, id, post_text, published_at, channel_id, publish_step)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (vk_owner_id, vk_post_id, (COALESCE(channel_id, '')), id) DO UPDATE
+		SET post_text = COALESCE({tg_post}.post_text, EXCLUDED.post_text)
 	`
-	if _, err = tx.ExecContext(ctx, insertTGPost, ownerID, postID, messageID, text, publishedAt.UTC(), channelID); err != nil {
-		return fmt.Errorf("insert telegram post: %w", err)
+	for _, msg := range messages {
+		var text sql.NullString
+		if trimmed := strings.TrimSpace(msg.Text); trimmed != "" {
+			text = sql.NullString{String: trimmed, Valid: true}
+		}
+		if _, err = tx.ExecContext(ctx, s.sql(insertTGPost), ownerID, postID, msg.ID, text, msg.PublishedAt.UTC(), channelID, msg.Step); err != nil {
+			return fmt.Errorf("insert telegram post %d: %w", msg.ID, err)
+		}
 	}
 
 	const upsertVKPost = `
-		INSERT INTO vk_post (owner_id, id, hash, published_at)
+		INSERT INTO {vk_post} (owner_id, id, hash, published_at)
 		VALUES ($1, $2, '', $3)
 		ON CONFLICT (owner_id, id) DO UPDATE
-		SET published_at = COALESCE(vk_post.published_at, EXCLUDED.published_at)
+		SET published_at = COALESCE({vk_post}.published_at, EXCLUDED.published_at),
+			failure_count = 0,
+			last_error = NULL
 	`
-	if _, err = tx.ExecContext(ctx, upsertVKPost, ownerID, postID, publishedAt.UTC()); err != nil {
-		return fmt.Errorf("update vk post timestamp: %w", err)
+	if published {
+		if _, err = tx.ExecContext(ctx, s.sql(upsertVKPost), ownerID, postID, messages[0].PublishedAt.UTC()); err != nil {
+			return fmt.Errorf("update vk post timestamp: %w", err)
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -426,6 +1304,228 @@ func (s *storage) RecordTelegramPost(ctx context.Context, ownerID, postID int, m
 	return nil
 }
 
+func (s *storage) BeginPublishAttempt(ctx context.Context, ownerID, postID int, startedAt time.Time) (*time.Time, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		WITH inserted AS (
+			INSERT INTO {publish_attempt} (vk_owner_id, vk_post_id, started_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (vk_owner_id, vk_post_id) DO NOTHING
+			RETURNING started_at
+		)
+		SELECT started_at, FALSE FROM inserted
+		UNION ALL
+		SELECT started_at, TRUE FROM {publish_attempt}
+		WHERE vk_owner_id = $1 AND vk_post_id = $2 AND NOT EXISTS (SELECT 1 FROM inserted)
+	`
+
+	var (
+		attemptStartedAt time.Time
+		existing         bool
+	)
+	if err := s.db.QueryRowContext(ctx, s.sql(query), ownerID, postID, startedAt.UTC()).Scan(&attemptStartedAt, &existing); err != nil {
+		return nil, fmt.Errorf("begin publish attempt: %w", err)
+	}
+	if !existing {
+		return nil, nil
+	}
+	return &attemptStartedAt, nil
+}
+
+func (s *storage) ClearPublishAttempt(ctx context.Context, ownerID, postID int) error {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		DELETE FROM {publish_attempt}
+		WHERE vk_owner_id = $1 AND vk_post_id = $2
+	`
+	if _, err := s.db.ExecContext(ctx, s.sql(query), ownerID, postID); err != nil {
+		return fmt.Errorf("clear publish attempt: %w", err)
+	}
+	return nil
+}
+
+func (s *storage) GetSyncState(ctx context.Context, key string) (string, bool, error) {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		SELECT value
+		FROM {sync_state}
+		WHERE key = $1
+	`
+
+	var value string
+	if err := s.db.QueryRowContext(ctx, s.sql(query), key).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("query sync state %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+func (s *storage) SetSyncState(ctx context.Context, key, value string) error {
+	ctx, cancel := s.withContext(ctx)
+	defer cancel()
+
+	const query = `
+		INSERT INTO {sync_state} (key, value, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (key) DO UPDATE
+		SET value = EXCLUDED.value,
+			updated_at = EXCLUDED.updated_at
+	`
+	if _, err := s.db.ExecContext(ctx, s.sql(query), key, value); err != nil {
+		return fmt.Errorf("upsert sync state %s: %w", key, err)
+	}
+	return nil
+}
+
+const syncStateLastVKError = "last_vk_error"
+
+type vkErrorRecord struct {
+	Code    int       `json:"code"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// SetLastVKError stores the latest VK API error for /status; nil clears it.
+func (s *storage) SetLastVKError(ctx context.Context, rec *vkErrorRecord) error {
+	if rec == nil {
+		ctx, cancel := s.withContext(ctx)
+		defer cancel()
+
+		const query = `
+			DELETE FROM {sync_state}
+			WHERE key = $1
+		`
+		if _, err := s.db.ExecContext(ctx, s.sql(query), syncStateLastVKError); err != nil {
+			return fmt.Errorf("clear last vk error: %w", err)
+		}
+		return nil
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode last vk error: %w", err)
+	}
+	return s.SetSyncState(ctx, syncStateLastVKError, string(payload))
+}
+
+func (s *storage) GetLastVKError(ctx context.Context) (*vkErrorRecord, error) {
+	raw, ok, err := s.GetSyncState(ctx, syncStateLastVKError)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var rec vkErrorRecord
+	if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+		return nil, fmt.Errorf("decode last vk error: %w", err)
+	}
+	return &rec, nil
+}
+
+const compactBatchSize = 500
+
+func retentionCursorKey(ownerID int) string {
+	return fmt.Sprintf("retention_cursor:%d", ownerID)
+}
+
+// CompactOlderThan deletes posts published before cutoff together with their
+// Telegram messages, edit log and publish attempts, in batches so each
+// statement holds its locks briefly. The highest deleted post id per owner is
+// kept in sync_state so the syncer doesn't publish those posts again.
+func (s *storage) CompactOlderThan(ctx context.Context, cutoff time.Time) (int64, error) {
+	const query = `
+		WITH doomed AS (
+			SELECT owner_id, id
+			FROM {vk_post}
+			WHERE published_at < $1
+			ORDER BY published_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		), cursors AS (
+			INSERT INTO {sync_state} (key, value, updated_at)
+			SELECT 'retention_cursor:' || owner_id, MAX(id)::text, NOW()
+			FROM doomed
+			GROUP BY owner_id
+			ON CONFLICT (key) DO UPDATE
+			SET value = GREATEST({sync_state}.value::bigint, EXCLUDED.value::bigint)::text,
+				updated_at = EXCLUDED.updated_at
+		), edits AS (
+			DELETE FROM {vk_post_edit_log} l
+			USING doomed d
+			WHERE l.vk_owner_id = d.owner_id AND l.vk_post_id = d.id
+		), messages AS (
+			DELETE FROM {tg_post} t
+			USING doomed d
+			WHERE t.vk_owner_id = d.owner_id AND t.vk_post_id = d.id
+		), attempts AS (
+			DELETE FROM {publish_attempt} a
+			USING doomed d
+			WHERE a.vk_owner_id = d.owner_id AND a.vk_post_id = d.id
+		)
+		DELETE FROM {vk_post} v
+		USING doomed d
+		WHERE v.owner_id = d.owner_id AND v.id = d.id
+	`
+
+	var total int64
+	for {
+		batchCtx, cancel := s.withContext(ctx)
+		res, err := s.db.ExecContext(batchCtx, s.sql(query), cutoff.UTC(), compactBatchSize)
+		cancel()
+		if err != nil {
+			return total, fmt.Errorf("compact old posts: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("compact old posts: %w", err)
+		}
+		total += n
+		if n < compactBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (s *storage) RetentionCursor(ctx context.Context, ownerID int) (int, error) {
+	raw, ok, err := s.GetSyncState(ctx, retentionCursorKey(ownerID))
+	if err != nil || !ok {
+		return 0, err
+	}
+	cursor, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("parse retention cursor %q: %w", raw, err)
+	}
+	return cursor, nil
+}
+
+func nullableText(value string) sql.NullString {
+	if trimmed := strings.TrimSpace(value); trimmed != "" {
+		return sql.NullString{String: trimmed, Valid: true}
+	}
+	return sql.NullString{}
+}
+
 func quoteIdentifier(s string) string {
 	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
 }
+
+func isStorageUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
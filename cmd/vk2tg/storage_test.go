@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pressly/goose/v3"
+	"github.com/rs/zerolog"
+)
+
+func TestIsStorageUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"bad conn", fmt.Errorf("query: %w", driver.ErrBadConn), true},
+		{"conn done", sql.ErrConnDone, true},
+		{"query timeout", fmt.Errorf("query: %w", context.DeadlineExceeded), true},
+		{"no rows", sql.ErrNoRows, false},
+		{"other", errors.New("syntax error"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStorageUnavailable(tt.err); got != tt.want {
+				t.Fatalf("isStorageUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorageDownIgnoresExpiredCycle(t *testing.T) {
+	timeout := fmt.Errorf("query: %w", context.DeadlineExceeded)
+
+	s := &wallSyncer{logger: zerolog.Nop()}
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	if s.storageDown(expired, timeout) {
+		t.Fatal("expired cycle reported as a database outage")
+	}
+	if !s.storageRetryAt.IsZero() {
+		t.Fatal("expired cycle set a storage backoff")
+	}
+
+	if !s.storageDown(context.Background(), timeout) {
+		t.Fatal("query timeout in a live cycle not reported as an outage")
+	}
+	if s.storageRetryAt.IsZero() || s.cycleFailures != 1 {
+		t.Fatalf("retry_at = %v, failures = %d", s.storageRetryAt, s.cycleFailures)
+	}
+}
+
+func TestTableNames(t *testing.T) {
+	query := `SELECT vk_post_id, 'tg_post' FROM {vk_post} JOIN {tg_post} USING (owner_id)`
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", `SELECT vk_post_id, 'tg_post' FROM vk_post JOIN tg_post USING (owner_id)`},
+		{"vk2tg_", `SELECT vk_post_id, 'tg_post' FROM vk2tg_vk_post JOIN vk2tg_tg_post USING (owner_id)`},
+	}
+	for _, tt := range tests {
+		if got := tableNames(tt.prefix).Replace(query); got != tt.want {
+			t.Errorf("tableNames(%q) = %s, want %s", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixedMigrations(t *testing.T) {
+	prefixed, err := fs.Glob(embeddedMigrations, migrationsDir+"/prefixed/*.sql")
+	if err != nil || len(prefixed) == 0 {
+		t.Fatalf("no prefixed migrations: %v", err)
+	}
+	for _, name := range prefixed {
+		original := path.Join(migrationsDir, path.Base(name))
+		plain, err := fs.ReadFile(embeddedMigrations, original)
+		if err != nil {
+			t.Fatalf("%s has no unprefixed counterpart: %v", name, err)
+		}
+		if strings.Contains(string(plain), "DB_TABLE_PREFIX") {
+			t.Errorf("%s must stay unprefixed", original)
+		}
+		got, err := fs.ReadFile(prefixedMigrations{embeddedMigrations}, original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), "${DB_TABLE_PREFIX}") {
+			t.Errorf("%s is not served from migrations/prefixed", original)
+		}
+	}
+}
+
+func TestMigrationsFSOverride(t *testing.T) {
+	const extra = "0099_add_fork_table.sql"
+	overlay := fstest.MapFS{
+		path.Join(migrationsDir, extra): {Data: []byte("-- +goose Up\nCREATE TABLE fork_table (id bigint);\n\n-- +goose Down\nDROP TABLE fork_table;\n")},
+	}
+	embedded, err := fs.Glob(embeddedMigrations, migrationsDir+"/*.sql")
+	if err != nil || len(embedded) == 0 {
+		t.Fatalf("no embedded migrations: %v", err)
+	}
+	for _, name := range embedded {
+		data, err := fs.ReadFile(embeddedMigrations, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		overlay[name] = &fstest.MapFile{Data: data}
+	}
+
+	prev := migrationsFS
+	migrationsFS = overlay
+	t.Cleanup(func() {
+		migrationsFS = prev
+		goose.SetBaseFS(nil)
+	})
+
+	tests := []struct {
+		name string
+		fsys fs.FS
+	}{
+		{"plain", migrationsFS},
+		{"prefixed", prefixedMigrations{migrationsFS}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goose.SetBaseFS(tt.fsys)
+			migrations, err := goose.CollectMigrations(migrationsDir, 0, goose.MaxVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(migrations) != len(embedded)+1 {
+				t.Fatalf("collected %d migrations, want %d", len(migrations), len(embedded)+1)
+			}
+			last, err := migrations.Last()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last.Version != 99 || path.Base(last.Source) != extra {
+				t.Errorf("last migration = %d %s, want 99 %s", last.Version, last.Source, extra)
+			}
+			for i, m := range migrations[:len(embedded)] {
+				if m.Version != int64(i+1) {
+					t.Errorf("migration %s has version %d, want %d", m.Source, m.Version, i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	goose.SetBaseFS(migrationsFS)
+	t.Cleanup(func() { goose.SetBaseFS(nil) })
+	if err := goose.SetDialect("postgres"); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := goose.CollectMigrations(migrationsDir, 0, goose.MaxVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := migrations.Last()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		version int64
+		wantErr bool
+	}{
+		{"up to date", last.Version, false},
+		{"behind", last.Version - 1, false},
+		{"migrated by a newer build", last.Version + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newFakeStorage(t, func(query string, _ []driver.Value) ([]string, [][]driver.Value, error) {
+				if strings.Contains(query, "goose_db_version") {
+					return []string{"version_id", "is_applied"}, [][]driver.Value{{tt.version, true}}, nil
+				}
+				return nil, nil, nil
+			})
+			err := checkSchemaVersion(context.Background(), s.db)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkSchemaVersion error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), fmt.Sprintf("version %d", tt.version)) {
+				t.Fatalf("error = %q, want the database version named", err)
+			}
+		})
+	}
+}
+
+func TestDBTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	bogus := filepath.Join(dir, "bogus.pem")
+	if err := os.WriteFile(bogus, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cfg        dbConfig
+		wantNil    bool
+		wantVerify bool
+		wantHost   bool
+		wantErr    string
+	}{
+		{name: "disable", cfg: dbConfig{SSLMode: "disable"}, wantNil: true},
+		{name: "require", cfg: dbConfig{SSLMode: "require"}},
+		{name: "verify-ca", cfg: dbConfig{SSLMode: "verify-ca", SSLRootCert: certFile}, wantVerify: true},
+		{name: "verify-full", cfg: dbConfig{SSLMode: "verify-full", SSLRootCert: certFile}, wantHost: true},
+		{name: "mutual tls", cfg: dbConfig{SSLMode: "verify-full", SSLRootCert: certFile, SSLCert: certFile, SSLKey: keyFile}, wantHost: true},
+		{name: "bogus root", cfg: dbConfig{SSLMode: "verify-full", SSLRootCert: bogus}, wantErr: "no PEM certificates"},
+		{name: "bogus key", cfg: dbConfig{SSLMode: "require", SSLCert: certFile, SSLKey: bogus}, wantErr: "DB_SSLKEY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Host = "db.example"
+			got, err := tt.cfg.tlsConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("tlsConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tlsConfig(): %v", err)
+			}
+			if got == nil {
+				if !tt.wantNil {
+					t.Fatal("tlsConfig() = nil, want TLS")
+				}
+				return
+			}
+			if tt.wantNil {
+				t.Fatal("tlsConfig() enabled TLS for sslmode=disable")
+			}
+			if got.ServerName != "db.example" {
+				t.Errorf("ServerName = %q", got.ServerName)
+			}
+			if got.InsecureSkipVerify == tt.wantHost {
+				t.Errorf("InsecureSkipVerify = %v, want host name checked: %v", got.InsecureSkipVerify, tt.wantHost)
+			}
+			if (got.VerifyPeerCertificate != nil) != tt.wantVerify {
+				t.Errorf("VerifyPeerCertificate set = %v, want %v", got.VerifyPeerCertificate != nil, tt.wantVerify)
+			}
+			if (tt.cfg.SSLCert != "") != (len(got.Certificates) == 1) {
+				t.Errorf("client certificates = %d", len(got.Certificates))
+			}
+		})
+	}
+}
+
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "db.example"},
+		DNSNames:              []string{"db.example"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestUpdateVKPostAfterEditSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		row       []driver.Value
+		rec       vkPostRecord
+		wantOld   int
+		wantNew   int
+		wantDelta *int
+	}{
+		{
+			name:      "text and attachments grow",
+			row:       []driver.Value{int64(5), int64(1)},
+			rec:       vkPostRecord{OwnerID: -1, PostID: 1, Text: " привет мир ", AttachmentCount: 3},
+			wantOld:   5,
+			wantNew:   10,
+			wantDelta: intPtr(2),
+		},
+		{
+			name:      "attachment removed",
+			row:       []driver.Value{int64(10), int64(2)},
+			rec:       vkPostRecord{OwnerID: -1, PostID: 1, Text: "short", AttachmentCount: 1},
+			wantOld:   10,
+			wantNew:   5,
+			wantDelta: intPtr(-1),
+		},
+		{
+			name:    "attachment count unknown",
+			row:     []driver.Value{int64(4), nil},
+			rec:     vkPostRecord{OwnerID: -1, PostID: 1, Text: "text", AttachmentCount: 2},
+			wantOld: 4,
+			wantNew: 4,
+		},
+		{
+			name:    "unknown post",
+			rec:     vkPostRecord{OwnerID: -1, PostID: 1, Text: "new"},
+			wantNew: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newFakeStorage(t, func(string, []driver.Value) ([]string, [][]driver.Value, error) {
+				if tt.row == nil {
+					return []string{"old_len", "attachment_count"}, nil, nil
+				}
+				return []string{"old_len", "attachment_count"}, [][]driver.Value{tt.row}, nil
+			})
+			got, err := s.UpdateVKPostAfterEdit(context.Background(), tt.rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.OldLen != tt.wantOld || got.NewLen != tt.wantNew {
+				t.Errorf("lengths = %d -> %d, want %d -> %d", got.OldLen, got.NewLen, tt.wantOld, tt.wantNew)
+			}
+			switch {
+			case tt.wantDelta == nil && got.AttachmentDelta != nil:
+				t.Errorf("attachment delta = %d, want unknown", *got.AttachmentDelta)
+			case tt.wantDelta != nil && (got.AttachmentDelta == nil || *got.AttachmentDelta != *tt.wantDelta):
+				t.Errorf("attachment delta = %v, want %d", got.AttachmentDelta, *tt.wantDelta)
+			}
+		})
+	}
+}
+
+func TestRecordEdit(t *testing.T) {
+	s, db := newFakeStorage(t, nil)
+	editedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	if err := s.RecordEdit(context.Background(), -1, 7, vkPostEditSummary{OldLen: 5, NewLen: 12, AttachmentDelta: intPtr(-2)}, editedAt); err != nil {
+		t.Fatal(err)
+	}
+	executed := db.executed()
+	if len(executed) != 1 || !strings.Contains(executed[0].query, "INSERT INTO vk_post_edit_log") {
+		t.Fatalf("executed = %+v", executed)
+	}
+	want := []driver.Value{int64(-1), int64(7), editedAt.UTC(), int64(5), int64(12), int64(-2)}
+	if fmt.Sprint(executed[0].args) != fmt.Sprint(want) {
+		t.Errorf("args = %v, want %v", executed[0].args, want)
+	}
+}
+
+func TestRecordTelegramPostsTransaction(t *testing.T) {
+	messages := make([]telegramMessage, 5)
+	for i := range messages {
+		messages[i] = telegramMessage{ID: int64(100 + i), PublishedAt: time.Now()}
+	}
+
+	s, db := newFakeStorage(t, nil)
+	if err := s.RecordTelegramPosts(context.Background(), -1, 7, messages, "@test_channel"); err != nil {
+		t.Fatal(err)
+	}
+	executed := db.executed()
+	if len(executed) != 6 || !strings.Contains(executed[5].query, "INSERT INTO vk_post") {
+		t.Fatalf("executed = %+v, want five inserts and one vk_post upsert", executed)
+	}
+	if db.commits != 1 || db.rollbacks != 0 {
+		t.Fatalf("commits = %d, rollbacks = %d, want a single committed transaction", db.commits, db.rollbacks)
+	}
+
+	inserts := 0
+	s, db = newFakeStorage(t, func(query string, _ []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "INSERT INTO tg_post") {
+			if inserts++; inserts == 3 {
+				return nil, nil, errors.New("connection reset")
+			}
+		}
+		return nil, nil, nil
+	})
+	if err := s.RecordTelegramPosts(context.Background(), -1, 7, messages, "@test_channel"); err == nil {
+		t.Fatal("RecordTelegramPosts succeeded although an insert failed")
+	}
+	if db.commits != 0 || db.rollbacks != 1 {
+		t.Fatalf("commits = %d, rollbacks = %d, want the transaction rolled back", db.commits, db.rollbacks)
+	}
+	if executed := db.executed(); len(executed) != 3 {
+		t.Fatalf("executed = %+v, want recording stopped at the failed insert", executed)
+	}
+}
+
+func TestCompactOlderThan(t *testing.T) {
+	cutoff := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var published []time.Time
+	for i := 0; i < compactBatchSize+20; i++ {
+		published = append(published, cutoff.Add(-time.Duration(i+1)*time.Hour))
+	}
+	for i := 0; i < 5; i++ {
+		published = append(published, cutoff.Add(time.Duration(i)*time.Hour))
+	}
+
+	s, db := newFakeStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		olderThan, limit := args[0].(time.Time), int(args[1].(int64))
+		var removed [][]driver.Value
+		kept := published[:0]
+		for _, at := range published {
+			if at.Before(olderThan) && len(removed) < limit {
+				removed = append(removed, []driver.Value{})
+				continue
+			}
+			kept = append(kept, at)
+		}
+		published = kept
+		return nil, removed, nil
+	})
+	removed, err := s.CompactOlderThan(context.Background(), cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != compactBatchSize+20 {
+		t.Fatalf("removed = %d, want %d", removed, compactBatchSize+20)
+	}
+	if len(published) != 5 {
+		t.Fatalf("remaining posts = %d, want the 5 newer than the cutoff", len(published))
+	}
+	if executed := db.executed(); len(executed) != 2 || !strings.Contains(executed[0].query, "retention_cursor:") {
+		t.Fatalf("executed = %d statements, want two batches keeping the retention cursor", len(executed))
+	}
+}
+
+func TestAttachmentURLsRoundTrip(t *testing.T) {
+	var stored driver.Value
+	s, _ := newFakeStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SELECT attachment_urls"):
+			return []string{"attachment_urls"}, [][]driver.Value{{stored}}, nil
+		case strings.Contains(query, "attachment_urls = $9::jsonb"):
+			stored = args[8]
+			return []string{"old_len", "attachment_count"}, [][]driver.Value{{int64(0), int64(1)}}, nil
+		case strings.Contains(query, "INSERT INTO vk_post"):
+			stored = args[8]
+		}
+		return nil, [][]driver.Value{}, nil
+	})
+	ctx := context.Background()
+
+	if urls, err := s.AttachmentURLs(ctx, -1, 1); err != nil || urls != nil {
+		t.Fatalf("AttachmentURLs before tracking = %q, %v, want nil", urls, err)
+	}
+
+	published := []string{"https://vk.example/1.jpg", "https://vk.example/2.mp4"}
+	if _, err := s.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1, Hash: "h1", AttachmentURLs: published}); err != nil {
+		t.Fatal(err)
+	}
+	if urls, err := s.AttachmentURLs(ctx, -1, 1); err != nil || !slices.Equal(urls, published) {
+		t.Fatalf("AttachmentURLs = %q, %v, want %q", urls, err, published)
+	}
+
+	edited := []string{"https://vk.example/3.jpg"}
+	if _, err := s.UpdateVKPostAfterEdit(ctx, vkPostRecord{OwnerID: -1, PostID: 1, Hash: "h2", AttachmentURLs: edited}); err != nil {
+		t.Fatal(err)
+	}
+	if urls, err := s.AttachmentURLs(ctx, -1, 1); err != nil || !slices.Equal(urls, edited) {
+		t.Fatalf("AttachmentURLs after edit = %q, %v, want %q", urls, err, edited)
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestLoadDBConfigTablePrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{"", false},
+		{"vk2tg_", false},
+		{"fork1_", false},
+		{"1fork_", true},
+		{"Fork_", true},
+		{"fork-", true},
+		{"fork; DROP TABLE vk_post; --", true},
+		{strings.Repeat("a", 33), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			for name, value := range map[string]string{
+				"DB_HOST": "localhost", "DB_PORT": "5432", "DB_USERNAME": "vk2tg", "DB_PASSWORD": "secret",
+				"DB_DATABASE": "vk2tg", "DB_SCHEMA": "public", "DB_TABLE_PREFIX": tt.prefix,
+			} {
+				t.Setenv(name, value)
+			}
+			_, err := loadDBConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadDBConfigFromEnv error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrefixedStorageQueries(t *testing.T) {
+	s, db := newFakeStorage(t, nil)
+	s.tables = tableNames("fork_")
+	ctx := context.Background()
+	now := time.Now()
+
+	s.LoadTokenState(ctx)
+	s.UpsertTokenState(ctx, authSuccessPayload{AccessToken: "token"}, now, now.Add(time.Hour))
+	s.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1, Hash: "h"})
+	s.UpdateVKPostAfterEdit(ctx, vkPostRecord{OwnerID: -1, PostID: 1, Hash: "h"})
+	s.AttachmentURLs(ctx, -1, 1)
+	s.NoteVKPostChange(ctx, -1, 1, "h", now)
+	s.LastTelegramEdit(ctx, -1, 1)
+	s.RecordEdit(ctx, -1, 1, vkPostEditSummary{}, now)
+	s.MarkVKPostSeen(ctx, -1, 1)
+	s.IncrementFailure(ctx, -1, 1, "boom")
+	s.MarkDeadLetter(ctx, -1, 1)
+	s.SetEditLock(ctx, -1, 1, true)
+	s.RetryDeadLetter(ctx, -1, 1)
+	s.DeadLetteredPosts(ctx)
+	s.ContentHashPublished(ctx, "c", -1, 1, "@channel")
+	s.TelegramPosts(ctx, -1, 1)
+	s.RecentTelegramPosts(ctx, -1, "@channel", 5)
+	s.MaxTelegramMessageID(ctx, "@channel")
+	s.LatestTelegramChannel(ctx, -1, nil)
+	s.RecentPublishedPosts(ctx, -1, 5)
+	s.DeleteTelegramPost(ctx, -1, 1, "@channel", 10)
+	s.LatestTelegramPosts(ctx, -1, 1)
+	s.UpdateTelegramPostText(ctx, -1, 1, "@channel", 10, "text")
+	s.SetManualTelegramText(ctx, -1, 1, "text")
+	s.RecordTelegramPosts(ctx, -1, 1, []telegramMessage{{ID: 10}}, "@channel")
+	s.BeginPublishAttempt(ctx, -1, 1, now)
+	s.ClearPublishAttempt(ctx, -1, 1)
+	s.GetSyncState(ctx, "key")
+	s.SetSyncState(ctx, "key", "value")
+	s.CompactOlderThan(ctx, now)
+	s.RetentionCursor(ctx, -1)
+
+	executed := db.executed()
+	if len(executed) < 25 {
+		t.Fatalf("executed %d queries, want every storage method to reach the database", len(executed))
+	}
+	unprefixed := regexp.MustCompile(`(^|[^a-z_])(` + strings.Join(storageTables, "|") + `)\b`)
+	for _, q := range executed {
+		if strings.Contains(q.query, "{") {
+			t.Errorf("unresolved table placeholder in %s", q.query)
+		}
+		if m := unprefixed.FindStringSubmatch(q.query); m != nil {
+			t.Errorf("unprefixed table %s in %s", m[2], q.query)
+		}
+	}
+}
+
+func TestIsStalePreparedStatement(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"statement gone", &pgconn.PgError{Code: "26000"}, true},
+		{"cached plan changed", fmt.Errorf("query: %w", &pgconn.PgError{Code: "0A000"}), true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"not a postgres error", errors.New("prepared statement does not exist"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStalePreparedStatement(tt.err); got != tt.want {
+				t.Fatalf("isStalePreparedStatement(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureVKPostPrepared(t *testing.T) {
+	tests := []struct {
+		name    string
+		stale   error
+		want    []bool
+		wantErr bool
+	}{
+		{"prepared path", nil, []bool{true, true}, false},
+		{"stale statements fall back", &pgconn.PgError{Code: "26000"}, []bool{true, false, true, false}, false},
+		{"other errors surface", &pgconn.PgError{Code: "42P01"}, []bool{true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newFakeStorage(t, nil)
+			ctx := context.Background()
+			if err := s.prepare(ctx, preparedQueries...); err != nil {
+				t.Fatalf("prepare: %v", err)
+			}
+			db.stalePrepared = tt.stale
+
+			state, err := s.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1, Hash: "h", Text: "text"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EnsureVKPost error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (state.Published || state.Hash != "h") {
+				t.Fatalf("state = %+v, want a new unpublished post", state)
+			}
+			var got []bool
+			for _, q := range db.executed() {
+				got = append(got, q.prepared)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("prepared runs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureVKPostStoresCounts(t *testing.T) {
+	s, db := newFakeStorage(t, nil)
+	rec := vkPostRecord{OwnerID: -1, PostID: 1, Hash: "h", AttachmentCount: 4, PhotoCount: 3}
+	if _, err := s.EnsureVKPost(context.Background(), rec); err != nil {
+		t.Fatal(err)
+	}
+	executed := db.executed()
+	insert := executed[len(executed)-1]
+	if !strings.Contains(insert.query, "INSERT INTO vk_post") || !strings.Contains(insert.query, "attachment_count, photo_count") {
+		t.Fatalf("last query = %s, want the vk_post insert with counts", insert.query)
+	}
+	if insert.args[5] != int64(4) || insert.args[6] != int64(3) {
+		t.Fatalf("counts = %v, %v, want 4, 3", insert.args[5], insert.args[6])
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "fmt"
+
+type vkStory struct {
+	ID        int      `json:"id"`
+	OwnerID   int      `json:"owner_id"`
+	Type      string   `json:"type"`
+	Photo     *vkPhoto `json:"photo"`
+	Video     *vkVideo `json:"video"`
+	IsExpired bool     `json:"is_expired"`
+	IsDeleted bool     `json:"is_deleted"`
+}
+
+// available reports whether the story still has content to show. Expired
+// and deleted stories come without photo or video.
+func (st vkStory) available() bool {
+	return !st.IsExpired && !st.IsDeleted && (st.Photo != nil || st.Video != nil)
+}
+
+func (st vkStory) link() string {
+	return fmt.Sprintf("https://vk.com/story%d_%d", st.OwnerID, st.ID)
+}
+
+// storyMedia returns the story as a Telegram media item: the video file when
+// one fits the URL upload limit, otherwise the photo or the video preview.
+func storyMedia(st vkStory, maxDimension int) (telegramMedia, bool) {
+	if !st.available() {
+		return telegramMedia{}, false
+	}
+	if st.Video != nil {
+		if st.Video.FileURL != "" {
+			return telegramMedia{Type: "video", URL: st.Video.FileURL}, true
+		}
+		if url, ok := selectLargestPhotoURL(st.Video.Image, maxDimension); ok {
+			return telegramMedia{Type: "photo", URL: url}, true
+		}
+		return telegramMedia{}, false
+	}
+	if url, ok := selectLargestPhotoURL(st.Photo.Sizes, maxDimension); ok {
+		return telegramMedia{Type: "photo", URL: url}, true
+	}
+	return telegramMedia{}, false
+}
+
+func storyLinks(post vkPost) []string {
+	var links []string
+	for _, att := range post.Attachments {
+		if att.Type != "story" || att.Story == nil || !att.Story.available() {
+			continue
+		}
+		links = append(links, "Story: "+att.Story.link())
+	}
+	return links
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestStoryMedia(t *testing.T) {
+	photo := &vkPhoto{Sizes: []vkPhotoSize{{URL: "https://vk.example/story.jpg", Width: 720, Height: 1280}}}
+	tests := []struct {
+		name   string
+		story  vkStory
+		want   telegramMedia
+		wantOK bool
+	}{
+		{"photo story", vkStory{ID: 3, OwnerID: -1, Type: "photo", Photo: photo}, telegramMedia{Type: "photo", URL: "https://vk.example/story.jpg"}, true},
+		{"video story with a file", vkStory{ID: 4, OwnerID: -1, Type: "video", Video: &vkVideo{FileURL: "https://vk.example/story.mp4"}}, telegramMedia{Type: "video", URL: "https://vk.example/story.mp4"}, true},
+		{"video story preview", vkStory{ID: 5, OwnerID: -1, Type: "video", Video: &vkVideo{Image: photo.Sizes}}, telegramMedia{Type: "photo", URL: "https://vk.example/story.jpg"}, true},
+		{"expired story", vkStory{ID: 6, OwnerID: -1, IsExpired: true}, telegramMedia{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := storyMedia(tt.story, 0)
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("storyMedia = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestStoryLinks(t *testing.T) {
+	post := vkPost{Attachments: []vkAttachment{
+		{Type: "story", Story: &vkStory{ID: 3, OwnerID: -1, Photo: &vkPhoto{}}},
+		{Type: "story", Story: &vkStory{ID: 4, OwnerID: -1, IsExpired: true}},
+	}}
+	want := []string{"Story: https://vk.com/story-1_3"}
+	if got := storyLinks(post); !slices.Equal(got, want) {
+		t.Fatalf("storyLinks = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+const syncConfigPollInterval = 30 * time.Second
+
+type syncMapping struct {
+	GroupID    string `json:"vk_group_id" yaml:"vk_group_id"`
+	ChannelID  string `json:"tg_channel_id" yaml:"tg_channel_id"`
+	ThreadID   string `json:"tg_thread_id" yaml:"tg_thread_id"`
+	WallFilter string `json:"vk_wall_filter" yaml:"vk_wall_filter"`
+	BotToken   string `json:"tg_bot_token" yaml:"tg_bot_token"`
+}
+
+type syncMappingFile struct {
+	Mappings []syncMapping `json:"mappings" yaml:"mappings"`
+}
+
+// loadSyncMappings reads VK2TG_CONFIG_FILE, JSON or YAML by extension, and
+// expands every mapping into a full wallSyncConfig on top of base, which
+// carries the env-level options.
+func loadSyncMappings(path string, base wallSyncConfig) ([]wallSyncConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read sync config: %w", err)
+	}
+
+	var file syncMappingFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse sync config: %w", err)
+	}
+
+	// vk_post.published_at is shared by all channels of a group, so a second
+	// mapping of the same group would never publish. Several channels of one
+	// group are listed comma-separated in tg_channel_id instead.
+	groups := make(map[string]int, len(file.Mappings))
+	cfgs := make([]wallSyncConfig, 0, len(file.Mappings))
+	for idx, m := range file.Mappings {
+		cfg := base
+		groupID, err := normalizeGroupID(m.GroupID)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %d: invalid vk_group_id: %w", idx, err)
+		}
+		cfg.GroupID = groupID
+		cfg.ChannelID, cfg.MirrorChannelIDs = splitChannelIDs(m.ChannelID)
+		cfg.ThreadID = strings.TrimSpace(m.ThreadID)
+		if m.WallFilter != "" {
+			cfg.WallFilter = m.WallFilter
+		}
+		if m.BotToken != "" {
+			cfg.BotToken = m.BotToken
+		}
+
+		if !cfg.enabled() {
+			return nil, fmt.Errorf("mapping %d: vk_group_id, tg_channel_id and a bot token are required", idx)
+		}
+		if err := validateTelegramTarget("tg_channel_id", cfg.ChannelID, "tg_thread_id", cfg.ThreadID); err != nil {
+			return nil, fmt.Errorf("mapping %d: %w", idx, err)
+		}
+		if err := validateMirrorChannels("tg_channel_id", cfg.MirrorChannelIDs); err != nil {
+			return nil, fmt.Errorf("mapping %d: %w", idx, err)
+		}
+		if !slices.Contains(vkWallFilters, cfg.WallFilter) {
+			return nil, fmt.Errorf("mapping %d: invalid vk_wall_filter %q", idx, cfg.WallFilter)
+		}
+		if prev, ok := groups[cfg.GroupID]; ok {
+			return nil, fmt.Errorf("mapping %d: group %s is already mapped by mapping %d, list all its channels comma-separated in one tg_channel_id", idx, cfg.GroupID, prev)
+		}
+		groups[cfg.GroupID] = idx
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+func (c wallSyncConfig) workerKey() string {
+	key := c.GroupID + "->" + c.ChannelID
+	if c.ThreadID != "" {
+		key += "#" + c.ThreadID
+	}
+	return key
+}
+
+type syncWorker struct {
+	cfg    wallSyncConfig
+	syncer *wallSyncer
+	cancel context.CancelFunc
+}
+
+type syncSupervisor struct {
+	ctx     context.Context
+	logger  zerolog.Logger
+	manager *tokenManager
+	store   syncStore
+	limiter *publishLimiter
+	vkMeter *vkCallMeter
+
+	mu      sync.Mutex
+	workers map[string]*syncWorker
+	paused  bool
+}
+
+func newSyncSupervisor(ctx context.Context, logger zerolog.Logger, manager *tokenManager, store syncStore, limiter *publishLimiter, meter *vkCallMeter) *syncSupervisor {
+	return &syncSupervisor{
+		ctx:     ctx,
+		logger:  logger,
+		manager: manager,
+		store:   store,
+		limiter: limiter,
+		vkMeter: meter,
+		workers: make(map[string]*syncWorker),
+	}
+}
+
+func (s *syncSupervisor) Apply(cfgs []wallSyncConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]wallSyncConfig, len(cfgs))
+	for _, cfg := range cfgs {
+		wanted[cfg.workerKey()] = cfg
+	}
+
+	for key, worker := range s.workers {
+		if cfg, ok := wanted[key]; ok && reflect.DeepEqual(cfg, worker.cfg) {
+			continue
+		}
+		worker.cancel()
+		delete(s.workers, key)
+		s.logger.Info().Str("mapping", key).Msg("stopped sync worker")
+	}
+
+	for key, cfg := range wanted {
+		if _, ok := s.workers[key]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		logger := s.logger.With().Str("mapping", key).Logger()
+		syncer := startWallSync(ctx, logger, s.manager, s.store, s.limiter, s.vkMeter, cfg)
+		syncer.SetPaused(s.paused)
+		s.workers[key] = &syncWorker{cfg: cfg, syncer: syncer, cancel: cancel}
+	}
+}
+
+func (s *syncSupervisor) Watch(path string, base wallSyncConfig) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(syncConfigPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				s.logger.Warn().Err(err).Str("path", path).Msg("failed to stat sync config")
+				continue
+			}
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+
+			cfgs, err := loadSyncMappings(path, base)
+			if err != nil {
+				s.logger.Error().Err(err).Str("path", path).Msg("rejected sync config reload, keeping current workers")
+				continue
+			}
+			s.Apply(cfgs)
+			s.logger.Info().Str("path", path).Int("mappings", len(cfgs)).Msg("reloaded sync config")
+		}
+	}
+}
+
+func (s *syncSupervisor) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.workers) > 0
+}
+
+func (s *syncSupervisor) SetPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+	for _, worker := range s.workers {
+		worker.syncer.SetPaused(paused)
+	}
+}
+
+func (s *syncSupervisor) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+func (s *syncSupervisor) HasGroup(groupID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, worker := range s.workers {
+		if worker.cfg.GroupID == groupID {
+			return true
+		}
+	}
+	return false
+}
+
+var errUnknownGroup = errors.New("no sync worker for group")
+
+// Enqueue hands a pushed post to every worker mirroring groupID. It reports
+// false when at least one worker's queue was full.
+func (s *syncSupervisor) Enqueue(groupID string, post vkPost) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, queued := false, true
+	for _, worker := range s.workers {
+		if worker.cfg.GroupID != groupID {
+			continue
+		}
+		found = true
+		if !worker.syncer.Enqueue(post) {
+			queued = false
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("%w %s", errUnknownGroup, groupID)
+	}
+	return queued, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeSyncConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSyncMappings(t *testing.T) {
+	base := wallSyncConfig{BotToken: "token", WallFilter: "owner"}
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "json",
+			file:    "mappings.json",
+			content: `{"mappings":[{"vk_group_id":"club1","tg_channel_id":"@channel_one"},{"vk_group_id":"-2","tg_channel_id":"@channel_two,@channel_three","vk_wall_filter":"all"}]}`,
+			want:    []string{"1->@channel_one", "2->@channel_two"},
+		},
+		{
+			name:    "yaml",
+			file:    "mappings.yaml",
+			content: "mappings:\n  - vk_group_id: \"1\"\n    tg_channel_id: \"@channel_one\"\n    tg_thread_id: \"5\"\n",
+			want:    []string{"1->@channel_one#5"},
+		},
+		{
+			name:    "same group twice",
+			file:    "mappings.json",
+			content: `{"mappings":[{"vk_group_id":"1","tg_channel_id":"@channel_one"},{"vk_group_id":"club1","tg_channel_id":"@channel_two"}]}`,
+			wantErr: "already mapped",
+		},
+		{
+			name:    "invalid wall filter",
+			file:    "mappings.json",
+			content: `{"mappings":[{"vk_group_id":"1","tg_channel_id":"@channel_one","vk_wall_filter":"nope"}]}`,
+			wantErr: "invalid vk_wall_filter",
+		},
+		{
+			name:    "invalid channel",
+			file:    "mappings.json",
+			content: `{"mappings":[{"vk_group_id":"1","tg_channel_id":"one"}]}`,
+			wantErr: "invalid tg_channel_id",
+		},
+		{
+			name:    "missing channel",
+			file:    "mappings.yml",
+			content: "mappings:\n  - vk_group_id: \"1\"\n",
+			wantErr: "required",
+		},
+		{
+			name:    "malformed",
+			file:    "mappings.json",
+			content: `{"mappings":`,
+			wantErr: "parse sync config",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfgs, err := loadSyncMappings(writeSyncConfig(t, tt.file, tt.content), base)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, cfg := range cfgs {
+				keys = append(keys, cfg.workerKey())
+			}
+			if !slices.Equal(keys, tt.want) {
+				t.Fatalf("mappings = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
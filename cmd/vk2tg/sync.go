@@ -1,362 +1,2460 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
-	"unicode/utf8"
+	"unicode"
 
 	"github.com/rs/zerolog"
 )
 
 const (
-	vkWallGetURL                 = "https://api.vk.com/method/wall.get"
-	vkAPIVersion                 = "5.199"
-	telegramSendURLFmt           = "https://api.telegram.org/bot%s/sendMessage"
-	telegramSendPhotoURLFmt      = "https://api.telegram.org/bot%s/sendPhoto"
-	telegramSendMediaGroupURLFmt = "https://api.telegram.org/bot%s/sendMediaGroup"
-	telegramEditTextURLFmt       = "https://api.telegram.org/bot%s/editMessageText"
-	telegramEditCaptionURLFmt    = "https://api.telegram.org/bot%s/editMessageCaption"
+	vkAPIBaseURL       = "https://api.vk.com"
+	vkAPIVersion       = "5.199"
+	telegramAPIBaseURL = "https://api.telegram.org"
+
+	telegramMediaGroupLimit = 10
+	telegramCaptionLimit    = 1024
+
+	syncStateTelegramSendAfter = "telegram_send_after"
+
+	textPositionCaption = "caption"
+	textPositionBefore  = "before"
+	textPositionAfter   = "after"
+
+	captionOverflowSplit        = "split"
+	captionOverflowTruncateLink = "truncate-link"
+
+	minPublishPause = 15 * time.Minute
+	maxPublishPause = 6 * time.Hour
+
+	maxClockSkew = 5 * time.Minute
+
+	defaultDateFormat = "02 Jan 2006, 15:04"
+
+	storageOutageBackoff = time.Minute
+
+	mirrorPublishTimeout = 20 * time.Second
+	mirrorRetryWindow    = 24 * time.Hour
+)
+
+var (
+	errNoTelegramMessages  = errors.New("no Telegram messages recorded")
+	errTelegramRateLimited = errors.New("telegram sends deferred by flood limit")
+	errTelegramNotSent     = errors.New("telegram request was not sent")
 )
 
+var telegramRejectedMediaPattern = regexp.MustCompile(`message #(\d+)`)
+
+var telegramChatIDPattern = regexp.MustCompile(`^(@[A-Za-z][A-Za-z0-9_]{3,31}|-?[0-9]+)$`)
+
+func validateTelegramTarget(channelName, channelID, threadName, threadID string) error {
+	if channelID != "" && !telegramChatIDPattern.MatchString(channelID) {
+		return fmt.Errorf("invalid %s %q: expected @channelname or a numeric chat id such as -1001234567890", channelName, channelID)
+	}
+	if threadID != "" {
+		if n, err := strconv.ParseInt(threadID, 10, 64); err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s %q: expected a positive integer", threadName, threadID)
+		}
+	}
+	return nil
+}
+
+// normalizeGroupID accepts a VK group as 123, -123, club123 or public123 and
+// returns the bare positive id.
+func normalizeGroupID(raw string) (string, error) {
+	id := strings.ToLower(strings.TrimSpace(raw))
+	if id == "" {
+		return "", nil
+	}
+	for _, prefix := range []string{"-", "club", "public"} {
+		if rest, ok := strings.CutPrefix(id, prefix); ok {
+			id = rest
+			break
+		}
+	}
+	if n, err := strconv.Atoi(id); err != nil || n <= 0 {
+		return "", fmt.Errorf("%q: expected a group id such as 123, -123 or club123", raw)
+	}
+	return id, nil
+}
+
+// splitChannelIDs splits a comma-separated channel list into the primary
+// channel and its mirrors.
+func splitChannelIDs(value string) (string, []string) {
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", nil
+	case 1:
+		return ids[0], nil
+	}
+	return ids[0], ids[1:]
+}
+
+func validateMirrorChannels(name string, ids []string) error {
+	for _, id := range ids {
+		if err := validateTelegramTarget(name, id, "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var vkWallFilters = []string{"owner", "others", "all", "postponed", "suggests", "donut"}
+
+// wallFilterMatches reports whether wall.get with the given filter would
+// return post. Pushed posts bypass wall.get, so they are checked here.
+func wallFilterMatches(filter string, post vkPost) bool {
+	switch filter {
+	case "postponed":
+		return post.PostType == "postpone"
+	case "suggests":
+		return post.PostType == "suggest"
+	}
+	if post.PostType == "postpone" || post.PostType == "suggest" {
+		return false
+	}
+	switch filter {
+	case "owner":
+		return post.FromID == 0 || post.FromID == post.OwnerID
+	case "others":
+		return post.FromID != 0 && post.FromID != post.OwnerID
+	case "donut":
+		return post.Donut.IsDonut
+	}
+	return true
+}
+
 type wallSyncConfig struct {
-	GroupID   string
-	BotToken  string
-	ChannelID string
-	ThreadID  string
+	GroupID     string
+	BotToken    string
+	ChannelID   string
+	ThreadID    string
+	WallFilter  string
+	AdminChatID string
+
+	// MirrorChannelIDs receive a copy of every post published to ChannelID.
+	MirrorChannelIDs []string
+	OpsChatID        string
+	TGAPIBase        string
+	VKAPIBase        string
+	GlobalDedup      bool
+	Order            string
+	LatestOnly       bool
+
+	PhotoMaxDimension   int
+	PhotoOrder          string
+	ReplyThread         bool
+	CaptionSafetyMargin int
+	TextPosition        string
+	CaptionOverflow     string
+
+	DisableNotification bool
+	ProtectContent      bool
+	VKButton            bool
+	PreviewLinksOnly    bool
+
+	DecodeEntities bool
+	StripTracking  []string
+	MaxTextLength  int
+	MediaFallback  bool
+	SourceFormat   string
+	Signature      string
+	EditDebounce   time.Duration
+	EditMinGap     time.Duration
+	MediaOnly      bool
+	MaxFailures    int
+	SeedReaction   string
+
+	RepostOnMediaChange bool
+	RespectManualEdits  bool
+	OnEmptyEdit         string
+
+	MaxMessagesPerPost int
+
+	LinkWhenEmpty bool
+	ShowComments  bool
+	ShowDate      bool
+	DateFormat    string
+
+	// Location is the SYNC_TIMEZONE used for quiet hours and post dates.
+	Location *time.Location
+
+	RunOnStart   bool
+	StartupDelay time.Duration
+	Reconcile    bool
+	VerifyIDs    bool
+
+	AnnounceFirst bool
+	NativePolls   bool
+
+	QuietHours *quietHours
+	QuietEdits bool
+
+	VideoMaxQuality int
+
+	UseTelegraph       bool
+	TelegraphToken     string
+	TelegraphAPIBase   string
+	TelegraphMinLength int
+}
+
+func loadWallSyncConfigFromEnv() (wallSyncConfig, error) {
+	cfg := wallSyncConfig{
+		BotToken:    os.Getenv("TG_BOT_TOKEN"),
+		ThreadID:    strings.TrimSpace(os.Getenv("TG_THREAD_ID")),
+		WallFilter:  os.Getenv("VK_WALL_FILTER"),
+		AdminChatID: strings.TrimSpace(os.Getenv("TG_ADMIN_CHAT_ID")),
+		OpsChatID:   strings.TrimSpace(os.Getenv("TG_OPS_CHAT_ID")),
+		Order:       strings.ToLower(os.Getenv("SYNC_ORDER")),
+		OnEmptyEdit: strings.ToLower(strings.TrimSpace(os.Getenv("SYNC_ON_EMPTY_EDIT"))),
+
+		TextPosition:    strings.ToLower(strings.TrimSpace(os.Getenv("TG_TEXT_POSITION"))),
+		CaptionOverflow: strings.ToLower(strings.TrimSpace(os.Getenv("TG_CAPTION_OVERFLOW"))),
+		PhotoOrder:      strings.ToLower(strings.TrimSpace(os.Getenv("VK_PHOTO_ORDER"))),
+
+		SourceFormat: strings.ReplaceAll(os.Getenv("TG_SOURCE_FORMAT"), `\n`, "\n"),
+		Signature:    strings.TrimSpace(strings.ReplaceAll(os.Getenv("TG_SIGNATURE"), `\n`, "\n")),
+	}
+
+	cfg.ChannelID, cfg.MirrorChannelIDs = splitChannelIDs(os.Getenv("TG_CHANNEL_ID"))
+	if cfg.WallFilter == "" {
+		cfg.WallFilter = "owner"
+	}
+	if !slices.Contains(vkWallFilters, cfg.WallFilter) {
+		return wallSyncConfig{}, fmt.Errorf("invalid VK_WALL_FILTER %q: expected one of %s", cfg.WallFilter, strings.Join(vkWallFilters, ", "))
+	}
+
+	if err := validateTelegramTarget("TG_CHANNEL_ID", cfg.ChannelID, "TG_THREAD_ID", cfg.ThreadID); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if err := validateMirrorChannels("TG_CHANNEL_ID", cfg.MirrorChannelIDs); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.AdminChatID != "" && !telegramChatIDPattern.MatchString(cfg.AdminChatID) {
+		return wallSyncConfig{}, fmt.Errorf("invalid TG_ADMIN_CHAT_ID %q: expected @username or a numeric chat id", cfg.AdminChatID)
+	}
+	if cfg.OpsChatID != "" && !telegramChatIDPattern.MatchString(cfg.OpsChatID) {
+		return wallSyncConfig{}, fmt.Errorf("invalid TG_OPS_CHAT_ID %q: expected @username or a numeric chat id", cfg.OpsChatID)
+	}
+
+	var err error
+	if cfg.GroupID, err = normalizeGroupID(os.Getenv("VK_GROUP_ID")); err != nil {
+		return wallSyncConfig{}, fmt.Errorf("invalid VK_GROUP_ID: %w", err)
+	}
+	if cfg.TGAPIBase, err = envBaseURL("TG_API_BASE_URL", telegramAPIBaseURL); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.VKAPIBase, err = envBaseURL("VK_API_BASE_URL", vkAPIBaseURL); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.GlobalDedup, err = envBool("SYNC_GLOBAL_DEDUP", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	switch cfg.Order {
+	case "":
+		cfg.Order = "asc"
+	case "asc", "desc":
+	default:
+		return wallSyncConfig{}, fmt.Errorf("invalid SYNC_ORDER %q: expected asc or desc", cfg.Order)
+	}
+	if cfg.OnEmptyEdit != "" && !slices.Contains(emptyEditPolicies, cfg.OnEmptyEdit) {
+		return wallSyncConfig{}, fmt.Errorf("invalid SYNC_ON_EMPTY_EDIT %q: expected one of %s", cfg.OnEmptyEdit, strings.Join(emptyEditPolicies, ", "))
+	}
+	if cfg.LatestOnly, err = envBool("SYNC_LATEST_ONLY", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.LatestOnly && cfg.Order != "desc" {
+		return wallSyncConfig{}, errors.New("SYNC_LATEST_ONLY requires SYNC_ORDER=desc")
+	}
+
+	switch cfg.PhotoOrder {
+	case "":
+		cfg.PhotoOrder = photoOrderVK
+	case photoOrderVK, photoOrderID:
+	default:
+		return wallSyncConfig{}, fmt.Errorf("invalid VK_PHOTO_ORDER %q: expected vk or id", cfg.PhotoOrder)
+	}
+	if cfg.PhotoMaxDimension, err = envInt("VK_PHOTO_MAX_DIMENSION", 0); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.PhotoMaxDimension < 0 {
+		return wallSyncConfig{}, fmt.Errorf("invalid VK_PHOTO_MAX_DIMENSION %d: must not be negative", cfg.PhotoMaxDimension)
+	}
+
+	if cfg.ReplyThread, err = envBool("SYNC_REPLY_THREAD", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.DisableNotification, err = envBool("TG_DISABLE_NOTIFICATION", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.ProtectContent, err = envBool("TG_PROTECT_CONTENT", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.VKButton, err = envBool("TG_VK_BUTTON", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.PreviewLinksOnly, err = envBool("TG_PREVIEW_LINKS_ONLY", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	switch cfg.TextPosition {
+	case "":
+		cfg.TextPosition = textPositionCaption
+	case textPositionCaption, textPositionBefore, textPositionAfter:
+	default:
+		return wallSyncConfig{}, fmt.Errorf("invalid TG_TEXT_POSITION %q: expected caption, before or after", cfg.TextPosition)
+	}
+	switch cfg.CaptionOverflow {
+	case "":
+		cfg.CaptionOverflow = captionOverflowSplit
+	case captionOverflowSplit, captionOverflowTruncateLink:
+	default:
+		return wallSyncConfig{}, fmt.Errorf("invalid TG_CAPTION_OVERFLOW %q: expected split or truncate-link", cfg.CaptionOverflow)
+	}
+	if cfg.CaptionSafetyMargin, err = envInt("TG_CAPTION_SAFETY_MARGIN", 32); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.CaptionSafetyMargin < 0 || cfg.CaptionSafetyMargin >= telegramCaptionLimit {
+		return wallSyncConfig{}, fmt.Errorf("invalid TG_CAPTION_SAFETY_MARGIN %d: expected a value between 0 and %d", cfg.CaptionSafetyMargin, telegramCaptionLimit-1)
+	}
+
+	cfg.Location = time.Local
+	if tz := strings.TrimSpace(os.Getenv("SYNC_TIMEZONE")); tz != "" {
+		if cfg.Location, err = time.LoadLocation(tz); err != nil {
+			return wallSyncConfig{}, fmt.Errorf("invalid SYNC_TIMEZONE %q: %w", tz, err)
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("SYNC_QUIET_HOURS")); raw != "" {
+		if cfg.QuietHours, err = parseQuietHours(raw, cfg.Location); err != nil {
+			return wallSyncConfig{}, err
+		}
+	}
+	if cfg.ShowDate, err = envBool("SYNC_SHOW_DATE", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	cfg.DateFormat = os.Getenv("SYNC_DATE_FORMAT")
+	if cfg.DateFormat == "" {
+		cfg.DateFormat = defaultDateFormat
+	}
+	if cfg.LinkWhenEmpty, err = envBool("SYNC_LINK_WHEN_EMPTY", true); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.ShowComments, err = envBool("SYNC_SHOW_COMMENTS", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.Reconcile, err = envBool("SYNC_RECONCILE", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.VerifyIDs, err = envBool("SYNC_VERIFY_MESSAGE_IDS", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.AnnounceFirst, err = envBool("TG_ANNOUNCE_FIRST", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.NativePolls, err = envBool("SYNC_NATIVE_POLLS", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.QuietEdits, err = envBool("SYNC_QUIET_HOURS_EDITS", true); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.DecodeEntities, err = envBool("SYNC_DECODE_ENTITIES", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	stripTracking, err := envBool("SYNC_STRIP_TRACKING", false)
+	if err != nil {
+		return wallSyncConfig{}, err
+	}
+	if stripTracking {
+		cfg.StripTracking = defaultTrackingParams
+		if raw := os.Getenv("SYNC_TRACKING_PARAMS"); strings.TrimSpace(raw) != "" {
+			cfg.StripTracking = nil
+			for _, p := range strings.Split(raw, ",") {
+				if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+					cfg.StripTracking = append(cfg.StripTracking, p)
+				}
+			}
+		}
+	}
+
+	// Bots may set only one reaction on a message, so a list is rejected
+	// instead of failing on every publish.
+	for _, e := range strings.Split(os.Getenv("TG_SEED_REACTIONS"), ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if cfg.SeedReaction != "" {
+			return wallSyncConfig{}, fmt.Errorf("invalid TG_SEED_REACTIONS %q: bots can set only one reaction", os.Getenv("TG_SEED_REACTIONS"))
+		}
+		cfg.SeedReaction = e
+	}
+
+	if cfg.MaxMessagesPerPost, err = envInt("SYNC_MAX_MESSAGES_PER_POST", 0); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.MaxMessagesPerPost < 0 {
+		return wallSyncConfig{}, fmt.Errorf("invalid SYNC_MAX_MESSAGES_PER_POST %d: must not be negative", cfg.MaxMessagesPerPost)
+	}
+
+	if cfg.RunOnStart, err = envBool("SYNC_RUN_ON_START", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.StartupDelay, err = envDuration("SYNC_STARTUP_DELAY", 0); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.StartupDelay < 0 {
+		return wallSyncConfig{}, fmt.Errorf("invalid SYNC_STARTUP_DELAY %s: must not be negative", cfg.StartupDelay)
+	}
+
+	if cfg.RespectManualEdits, err = envBool("SYNC_RESPECT_MANUAL_EDITS", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.RepostOnMediaChange, err = envBool("SYNC_REPOST_ON_MEDIA_CHANGE", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.MaxFailures, err = envInt("SYNC_MAX_FAILURES", 5); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.MediaOnly, err = envBool("SYNC_MEDIA_ONLY", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.EditDebounce, err = envDuration("SYNC_EDIT_DEBOUNCE", 0); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.EditDebounce < 0 {
+		return wallSyncConfig{}, fmt.Errorf("invalid SYNC_EDIT_DEBOUNCE %s: must not be negative", cfg.EditDebounce)
+	}
+	if cfg.EditMinGap, err = envDuration("TG_EDIT_MIN_INTERVAL", 0); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.EditMinGap < 0 {
+		return wallSyncConfig{}, fmt.Errorf("invalid TG_EDIT_MIN_INTERVAL %s: must not be negative", cfg.EditMinGap)
+	}
+
+	if cfg.MediaFallback, err = envBool("TG_MEDIA_FALLBACK", true); err != nil {
+		return wallSyncConfig{}, err
+	}
+
+	if cfg.VideoMaxQuality, err = envInt("VK_VIDEO_MAX_QUALITY", 720); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.VideoMaxQuality < 240 || cfg.VideoMaxQuality > 1080 {
+		return wallSyncConfig{}, fmt.Errorf("invalid VK_VIDEO_MAX_QUALITY %d: expected 240 to 1080", cfg.VideoMaxQuality)
+	}
+
+	if cfg.UseTelegraph, err = envBool("TG_USE_TELEGRAPH", false); err != nil {
+		return wallSyncConfig{}, err
+	}
+	cfg.TelegraphToken = os.Getenv("TELEGRAPH_ACCESS_TOKEN")
+	if cfg.UseTelegraph && cfg.TelegraphToken == "" {
+		return wallSyncConfig{}, errors.New("TG_USE_TELEGRAPH requires TELEGRAPH_ACCESS_TOKEN")
+	}
+	if cfg.TelegraphMinLength, err = envInt("TELEGRAPH_MIN_LENGTH", 3000); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.TelegraphAPIBase, err = envBaseURL("TELEGRAPH_API_BASE_URL", telegraphAPIBaseURL); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.MaxTextLength, err = envInt("SYNC_MAX_TEXT_LENGTH", 0); err != nil {
+		return wallSyncConfig{}, err
+	}
+	if cfg.MaxTextLength < 0 {
+		return wallSyncConfig{}, fmt.Errorf("invalid SYNC_MAX_TEXT_LENGTH %d: must not be negative", cfg.MaxTextLength)
+	}
+
+	return cfg, nil
+}
+
+func (c wallSyncConfig) enabled() bool {
+	return c.GroupID != "" && c.BotToken != "" && c.ChannelID != ""
 }
 
-func startWallSync(ctx context.Context, logger zerolog.Logger, manager *tokenManager, store *storage, cfg wallSyncConfig) {
+// ownerID returns the VK owner id of the configured group, which is the
+// negative group id.
+func (c wallSyncConfig) ownerID() int {
+	id, _ := strconv.Atoi(c.GroupID)
+	return -id
+}
+
+func startWallSync(ctx context.Context, logger zerolog.Logger, manager *tokenManager, store syncStore, limiter *publishLimiter, meter *vkCallMeter, cfg wallSyncConfig) *wallSyncer {
 	logger.Info().
 		Str("vk_group_id", cfg.GroupID).
+		Str("vk_wall_filter", cfg.WallFilter).
 		Msg("starting VK to Telegram sync worker")
 
-	syncer := &wallSyncer{
+	if cfg.OpsChatID != "" {
+		logger = logger.Hook(newOpsAlertHook(ctx, logger, cfg))
+	}
+
+	syncer := newWallSyncer(logger, manager, store, limiter, meter, cfg)
+	go syncer.run(ctx)
+	return syncer
+}
+
+// telegramSendInterval spaces out consecutive sends to Telegram.
+var telegramSendInterval = 5 * time.Second
+
+func newWallSyncer(logger zerolog.Logger, manager *tokenManager, store syncStore, limiter *publishLimiter, meter *vkCallMeter, cfg wallSyncConfig) *wallSyncer {
+	s := &wallSyncer{
 		logger:     logger,
 		manager:    manager,
 		store:      store,
+		limiter:    limiter,
+		vkMeter:    meter,
 		cfg:        cfg,
-		httpClient: &http.Client{Timeout: 10 * time.Second},
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: outboundTransport},
+		incoming:   make(chan vkPost, 16),
+		photoCache: newPhotoURLCache(photoURLCacheSize),
+	}
+	for _, channelID := range cfg.MirrorChannelIDs {
+		mirrorCfg := cfg
+		mirrorCfg.ChannelID = channelID
+		mirrorCfg.ThreadID = ""
+		mirrorCfg.MirrorChannelIDs = nil
+		s.mirrors = append(s.mirrors, newWallSyncer(logger.With().Str("mirror", channelID).Logger(), manager, store, limiter, meter, mirrorCfg))
+	}
+	return s
+}
+
+type wallSyncer struct {
+	logger     zerolog.Logger
+	manager    *tokenManager
+	store      syncStore
+	limiter    *publishLimiter
+	vkMeter    *vkCallMeter
+	cfg        wallSyncConfig
+	httpClient *http.Client
+	mirrors    []*wallSyncer
+
+	pausedUntil  time.Time
+	pauseBackoff time.Duration
+	sendAfter    time.Time
+
+	storageRetryAt time.Time
+
+	groupName  string
+	photoCache *photoURLCache
+	fullTexts  map[string]string
+	videoFiles map[string]vkVideo
+	ownerNames map[int]string
+	emptyPosts map[string]bool
+
+	cycleFailures  int
+	vkErrorCleared bool
+
+	vkDeniedToken   string
+	vkDeniedAlerted bool
+
+	lastMessageID int64
+	announced     bool
+
+	maintenance atomic.Bool
+	incoming    chan vkPost
+	skewChecked bool
+}
+
+func (s *wallSyncer) run(ctx context.Context) {
+	s.restoreSendAfter(ctx)
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	var reconcile <-chan time.Time
+	if s.cfg.Reconcile {
+		reconcileTicker := time.NewTicker(reconcileInterval)
+		defer reconcileTicker.Stop()
+		reconcile = reconcileTicker.C
+	}
+
+	var initial <-chan time.Time
+	if s.cfg.RunOnStart || s.cfg.StartupDelay > 0 {
+		timer := time.NewTimer(s.cfg.StartupDelay)
+		defer timer.Stop()
+		initial = timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info().Msg("VK to Telegram sync worker stopped")
+			return
+		case <-initial:
+			initial = nil
+			if s.maintenance.Load() {
+				s.logger.Info().Msg("sync paused for maintenance, skipping initial sync")
+				continue
+			}
+			s.sync(ctx)
+		case <-ticker.C:
+			if s.maintenance.Load() {
+				s.logger.Info().Msg("sync paused for maintenance, skipping")
+				continue
+			}
+			s.sync(ctx)
+		case <-reconcile:
+			if s.maintenance.Load() {
+				continue
+			}
+			s.reconcile(ctx)
+			for _, mirror := range s.mirrors {
+				mirror.reconcile(ctx)
+			}
+		case post := <-s.incoming:
+			if s.maintenance.Load() {
+				s.logger.Info().
+					Int("post_id", post.ID).
+					Msg("sync paused for maintenance, dropping pushed post until next poll")
+				continue
+			}
+			s.syncPushed(ctx, post)
+		}
+	}
+}
+
+func (s *wallSyncer) Enqueue(post vkPost) bool {
+	select {
+	case s.incoming <- post:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *wallSyncer) SetPaused(paused bool) {
+	if s.maintenance.Swap(paused) != paused {
+		s.logger.Info().
+			Bool("paused", paused).
+			Msg("sync maintenance mode changed")
+	}
+}
+
+func (s *wallSyncer) Paused() bool {
+	return s.maintenance.Load()
+}
+
+// runOnce performs a single sync cycle outside the worker loop and reports
+// whether anything in it failed.
+func (s *wallSyncer) runOnce(ctx context.Context) error {
+	s.restoreSendAfter(ctx)
+	s.cycleFailures = 0
+	s.sync(ctx)
+	if s.cycleFailures > 0 {
+		return fmt.Errorf("sync for group %s had %d failures", s.cfg.GroupID, s.cycleFailures)
+	}
+	return nil
+}
+
+func (s *wallSyncer) sync(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	if time.Now().Before(s.pausedUntil) {
+		s.logger.Debug().
+			Time("paused_until", s.pausedUntil).
+			Msg("publishing to Telegram paused, skipping sync")
+		return
+	}
+
+	accessToken, err := s.manager.RequestAccessToken(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Stack().Msg("failed to get access token for sync")
+		s.cycleFailures++
+		return
+	}
+
+	if accessToken == "" {
+		s.logger.Debug().Msg("access token not yet available, skipping sync")
+		s.cycleFailures++
+		return
+	}
+
+	if s.vkDeniedToken != "" && accessToken == s.vkDeniedToken {
+		s.logger.Debug().Msg("VK denied access to the group, waiting for a new token")
+		return
+	}
+
+	posts, err := s.fetchVKPosts(ctx, accessToken)
+	s.noteVKFetch(ctx, err)
+	if isVKAccessDenied(err) {
+		s.pauseForVKAccess(ctx, accessToken, err)
+		s.cycleFailures++
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Stack().Msg("failed to fetch posts from VK")
+		s.cycleFailures++
+		return
+	}
+	s.vkDeniedToken, s.vkDeniedAlerted = "", false
+
+	if len(posts) == 0 {
+		s.logger.Info().Msg("no posts received from VK")
+		return
+	}
+
+	if !s.skewChecked {
+		s.skewChecked = true
+		s.checkClockSkew(posts, time.Now())
+	}
+
+	s.processPosts(ctx, accessToken, posts)
+}
+
+func (s *wallSyncer) checkClockSkew(posts []vkPost, now time.Time) {
+	var newest int64
+	for _, post := range posts {
+		if post.Date > newest {
+			newest = post.Date
+		}
+	}
+	if newest == 0 {
+		return
+	}
+
+	postedAt := time.Unix(newest, 0)
+	if skew := postedAt.Sub(now); skew > maxClockSkew {
+		s.logger.Warn().
+			Time("post_date", postedAt).
+			Time("local_time", now).
+			Dur("skew", skew).
+			Msg("newest VK post is dated in the future, local clock may be behind; token refresh timing may be wrong")
+	}
+}
+
+func (s *wallSyncer) syncPushed(ctx context.Context, post vkPost) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	if !wallFilterMatches(s.cfg.WallFilter, post) {
+		s.logger.Debug().
+			Int("post_id", post.ID).
+			Str("post_type", post.PostType).
+			Str("filter", s.cfg.WallFilter).
+			Msg("pushed post doesn't match the wall filter, ignoring")
+		return
+	}
+
+	if time.Now().Before(s.pausedUntil) {
+		s.logger.Debug().
+			Time("paused_until", s.pausedUntil).
+			Int("post_id", post.ID).
+			Msg("publishing to Telegram paused, leaving pushed post for the next poll")
+		return
+	}
+
+	accessToken, err := s.manager.RequestAccessToken(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Stack().Msg("failed to get access token for pushed post")
+		return
+	}
+
+	s.processPosts(ctx, accessToken, []vkPost{post})
+}
+
+func (s *wallSyncer) processPosts(ctx context.Context, accessToken string, posts []vkPost) {
+	if time.Now().Before(s.sendAfter) {
+		s.logger.Info().
+			Time("send_after", s.sendAfter).
+			Msg("Telegram flood limit in effect, skipping sync")
+		return
+	}
+	if time.Now().Before(s.storageRetryAt) {
+		s.logger.Debug().
+			Time("retry_at", s.storageRetryAt).
+			Msg("database unavailable, skipping sync")
+		return
+	}
+
+	orderPhotoAttachments(posts, s.cfg.PhotoOrder)
+
+	if accessToken != "" {
+		s.restoreTruncatedTexts(ctx, accessToken, posts)
+		s.expandAlbumAttachments(ctx, accessToken, posts)
+		s.resolveVideoFiles(ctx, accessToken, posts)
+
+		if s.cfg.SourceFormat != "" && s.groupName == "" {
+			name, err := s.resolveGroupName(ctx, accessToken, s.cfg.GroupID)
+			if err != nil {
+				s.logger.Warn().Err(err).Msg("failed to resolve VK group name for attribution")
+			} else {
+				s.groupName = name
+			}
+		}
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		if s.cfg.Order == "desc" {
+			return posts[i].ID > posts[j].ID
+		}
+		return posts[i].ID < posts[j].ID
+	})
+
+	quiet := s.cfg.QuietHours.Contains(time.Now())
+	retentionCursor := -1
+
+	// With SYNC_LATEST_ONLY the newest unpublished post is the candidate;
+	// older posts are marked seen only once it has been published.
+	latestPending, latestPublished := false, false
+	for _, post := range posts {
+		ctx := withPostLog(ctx, post)
+		logger := s.log(ctx)
+		if post.ID == 0 {
+			continue
+		}
+		if post.IsDeleted {
+			logger.Debug().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Msg("post marked deleted by VK, skipping")
+			continue
+		}
+		emptied := false
+		if postLooksIncomplete(post) {
+			if s.cfg.OnEmptyEdit == "" || !s.confirmEmptyPost(post) {
+				logger.Info().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("post has no text or attachments, deferring to the next cycle")
+				continue
+			}
+			emptied = true
+		} else {
+			s.forgetEmptyPost(post)
+		}
+
+		postText := s.normalizePostText(post.Text)
+		photoURLs := s.photoURLs(post)
+		contentHash := postContentHash(postText, contentKeys(post, photoURLs))
+
+		rec := vkPostRecord{
+			OwnerID:         post.OwnerID,
+			PostID:          post.ID,
+			Hash:            post.Hash,
+			ContentHash:     contentHash,
+			Text:            postText,
+			AttachmentCount: len(post.Attachments),
+			PhotoCount:      len(photoURLs),
+			MediaHash:       mediaHash(photoURLs),
+			AttachmentURLs:  attachmentURLs(post, photoURLs),
+		}
+
+		state, err := s.store.EnsureVKPost(ctx, rec)
+		if s.storageDown(ctx, err) {
+			return
+		}
+		if err != nil {
+			logger.Error().
+				Err(err).
+				Stack().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Msg("failed to check published status")
+			continue
+		}
+
+		logger.Debug().
+			Int("owner_id", post.OwnerID).
+			Int("post_id", post.ID).
+			Int("attachment_count", rec.AttachmentCount).
+			Int("photo_count", rec.PhotoCount).
+			Bool("published", state.Published).
+			Msg("checked VK post")
+
+		text := s.composeText(post, postText)
+
+		if state.Published {
+			s.retryMirrors(ctx, post, state, text)
+
+			if state.Hash == post.Hash {
+				logger.Info().
+					Int("postId", post.ID).
+					Msg("post already published and hash unchanged")
+				continue
+			}
+
+			if emptied {
+				if err := s.applyEmptyEditPolicy(ctx, post, rec); err != nil {
+					logger.Error().
+						Err(err).
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Msg("failed to handle emptied post")
+					s.cycleFailures++
+				}
+				continue
+			}
+
+			if quiet && !s.cfg.QuietEdits {
+				logger.Debug().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("quiet hours in effect, deferring edit")
+				continue
+			}
+
+			if s.cfg.EditDebounce > 0 {
+				changedAt, err := s.store.NoteVKPostChange(ctx, post.OwnerID, post.ID, post.Hash, time.Now())
+				if err != nil {
+					if s.storageDown(ctx, err) {
+						return
+					}
+					logger.Error().
+						Err(err).
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Msg("failed to record VK post change")
+					continue
+				}
+				if wait := s.cfg.EditDebounce - time.Since(changedAt); wait > 0 {
+					logger.Debug().
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Dur("wait", wait).
+						Msg("post changed recently, deferring edit")
+					continue
+				}
+			}
+
+			if s.cfg.EditMinGap > 0 {
+				editedAt, err := s.store.LastTelegramEdit(ctx, post.OwnerID, post.ID)
+				if err != nil {
+					if s.storageDown(ctx, err) {
+						return
+					}
+					logger.Error().
+						Err(err).
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Msg("failed to look up last Telegram edit")
+					continue
+				}
+				if wait := s.cfg.EditMinGap - time.Since(editedAt); wait > 0 {
+					logger.Debug().
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Dur("wait", wait).
+						Msg("Telegram message edited recently, deferring edit")
+					continue
+				}
+			}
+
+			var (
+				updated bool
+				err     error
+			)
+			if s.cfg.RespectManualEdits && state.EditLocked {
+				records, err := s.store.LatestTelegramPosts(ctx, post.OwnerID, post.ID)
+				if err != nil {
+					if s.storageDown(ctx, err) {
+						return
+					}
+					logger.Error().
+						Err(err).
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Msg("failed to look up Telegram messages of manually edited post")
+					continue
+				}
+				if manualEditDiverged(records, text) {
+					logger.Warn().
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Msg("post changed on VK but its Telegram message was edited manually and differs, skipping automatic edit")
+					if _, err := s.store.UpdateVKPostAfterEdit(ctx, rec); err != nil {
+						if s.storageDown(ctx, err) {
+							return
+						}
+						logger.Error().
+							Err(err).
+							Stack().
+							Int("owner_id", post.OwnerID).
+							Int("post_id", post.ID).
+							Msg("failed to persist updated VK post hash")
+					}
+					continue
+				}
+			}
+
+			if s.pollOnly(post) {
+				logger.Info().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("post is a native Telegram poll, which can't be edited")
+				updated = true
+			} else if s.cfg.RepostOnMediaChange && state.MediaHash != "" && state.MediaHash != rec.MediaHash && len(photoURLs) > 1 {
+				updated, err = s.repostTelegramPost(ctx, post, text)
+			} else {
+				updated, err = s.updateTelegramPostContent(ctx, post, text)
+			}
+			if errors.Is(err, errNoTelegramMessages) {
+				logger.Debug().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("post changed but was never published to Telegram, updating hash only")
+				updated, err = true, nil
+			}
+			if err != nil {
+				if isTelegramChatUnavailable(err) {
+					s.pausePublishing(ctx, err)
+					return
+				}
+				logger.Error().
+					Err(err).
+					Stack().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("failed to update Telegram post content")
+				s.cycleFailures++
+				continue
+			}
+			if !updated {
+				logger.Warn().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("skipped Telegram post update after edit failure")
+				continue
+			}
+
+			summary, err := s.store.UpdateVKPostAfterEdit(ctx, rec)
+			if err != nil {
+				if s.storageDown(ctx, err) {
+					return
+				}
+				logger.Error().
+					Err(err).
+					Stack().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("failed to persist updated VK post hash")
+				continue
+			}
+
+			logger.Info().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Int("old_len", summary.OldLen).
+				Int("new_len", summary.NewLen).
+				Func(func(e *zerolog.Event) {
+					if summary.AttachmentDelta != nil {
+						e.Int("attachment_delta", *summary.AttachmentDelta)
+					}
+				}).
+				Msg("applied VK post edit")
+			if err := s.store.RecordEdit(ctx, post.OwnerID, post.ID, summary, time.Now()); err != nil {
+				if s.storageDown(ctx, err) {
+					return
+				}
+				logger.Error().
+					Err(err).
+					Stack().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("failed to record VK post edit")
+			}
+			continue
+		}
+
+		if emptied {
+			continue
+		}
+
+		if retentionCursor < 0 {
+			if retentionCursor, err = s.store.RetentionCursor(ctx, post.OwnerID); err != nil {
+				if s.storageDown(ctx, err) {
+					return
+				}
+				logger.Warn().Err(err).Msg("failed to load retention cursor")
+				retentionCursor = 0
+			}
+		}
+		if post.ID <= retentionCursor {
+			logger.Info().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Msg("post predates compacted records, marking as seen")
+			if err := s.store.MarkVKPostSeen(ctx, post.OwnerID, post.ID); err != nil {
+				if s.storageDown(ctx, err) {
+					return
+				}
+				logger.Error().
+					Err(err).
+					Stack().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("failed to mark compacted post as seen")
+			}
+			continue
+		}
+
+		if state.DeadLettered {
+			logger.Debug().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Msg("post is dead-lettered, skipping")
+			continue
+		}
+
+		if s.cfg.MediaOnly && !postHasMedia(post) {
+			logger.Info().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Msg("post has no media, marking as seen")
+			if err := s.store.MarkVKPostSeen(ctx, post.OwnerID, post.ID); err != nil {
+				if s.storageDown(ctx, err) {
+					return
+				}
+				logger.Error().
+					Err(err).
+					Stack().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("failed to mark text-only post as seen")
+			}
+			continue
+		}
+
+		if s.cfg.LatestOnly {
+			if latestPublished {
+				logger.Info().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("newer post already selected, marking older post as seen")
+				if err := s.store.MarkVKPostSeen(ctx, post.OwnerID, post.ID); err != nil {
+					if s.storageDown(ctx, err) {
+						return
+					}
+					logger.Error().
+						Err(err).
+						Stack().
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Msg("failed to mark older post as seen")
+				}
+				continue
+			}
+			if latestPending {
+				logger.Debug().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("newer post not published yet, leaving older post for later")
+				continue
+			}
+			latestPending = true
+		}
+
+		if s.cfg.GlobalDedup && contentHash != "" {
+			duplicate, err := s.store.ContentHashPublished(ctx, contentHash, post.OwnerID, post.ID, s.cfg.ChannelID)
+			if err != nil {
+				if s.storageDown(ctx, err) {
+					return
+				}
+				logger.Error().
+					Err(err).
+					Stack().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Msg("failed to check content hash")
+				continue
+			}
+			if duplicate {
+				logger.Info().
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Str("content_hash", contentHash).
+					Msg("identical content already published, skipping post")
+				if err := s.store.MarkVKPostSeen(ctx, post.OwnerID, post.ID); err != nil {
+					if s.storageDown(ctx, err) {
+						return
+					}
+					logger.Error().
+						Err(err).
+						Stack().
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Msg("failed to mark duplicate post as seen")
+				}
+				continue
+			}
+		}
+
+		if quiet {
+			logger.Info().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Time("publish_after", s.cfg.QuietHours.End(time.Now())).
+				Msg("quiet hours in effect, deferring publication")
+			continue
+		}
+
+		priorAttempt, err := s.store.BeginPublishAttempt(ctx, post.OwnerID, post.ID, time.Now())
+		if err != nil {
+			if s.storageDown(ctx, err) {
+				return
+			}
+			logger.Error().
+				Err(err).
+				Stack().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Msg("failed to record publish attempt")
+			continue
+		}
+		if priorAttempt != nil {
+			delivered, err := s.findUnrecordedDelivery(ctx, text)
+			if err != nil {
+				logger.Warn().
+					Err(err).
+					Time("attempt_started_at", *priorAttempt).
+					Msg("failed to check the channel for a previous publish attempt, retrying next cycle")
+				continue
+			}
+			if delivered {
+				logger.Warn().
+					Time("attempt_started_at", *priorAttempt).
+					Msg("previous publish attempt reached Telegram without being recorded, marking post as seen to avoid a duplicate")
+				if err := s.store.MarkVKPostSeen(ctx, post.OwnerID, post.ID); err != nil {
+					if s.storageDown(ctx, err) {
+						return
+					}
+					logger.Error().
+						Err(err).
+						Stack().
+						Msg("failed to mark post with unresolved publish attempt as seen")
+					continue
+				}
+				s.clearPublishAttempt(ctx, post)
+				latestPublished = s.cfg.LatestOnly
+				continue
+			}
+			logger.Info().
+				Time("attempt_started_at", *priorAttempt).
+				Msg("previous publish attempt not found in the channel, publishing again")
+		}
+
+		sent, err := s.store.TelegramPosts(ctx, post.OwnerID, post.ID)
+		if err != nil {
+			if s.storageDown(ctx, err) {
+				return
+			}
+			logger.Error().
+				Err(err).
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Msg("failed to look up partially published messages")
+			s.clearPublishAttempt(ctx, post)
+			continue
+		}
+		steps := s.completedPublishSteps(sent)
+		if steps > 0 {
+			logger.Info().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Int("sent_messages", len(sent)).
+				Int("sent_steps", steps).
+				Msg("resuming partially published post")
+		}
+
+		if len(sent) == 0 {
+			s.announceFirstPost(ctx, post.OwnerID)
+		}
+		messages, err := s.publishPost(ctx, post, text, steps)
+		if err != nil {
+			if len(messages) > 0 {
+				if err := s.store.RecordPartialTelegramPosts(ctx, post.OwnerID, post.ID, messages, s.cfg.ChannelID); err != nil {
+					if s.storageDown(ctx, err) {
+						return
+					}
+					logger.Error().
+						Err(err).
+						Stack().
+						Int("owner_id", post.OwnerID).
+						Int("post_id", post.ID).
+						Int("messages", len(messages)).
+						Msg("failed to record partially published Telegram post")
+				}
+			}
+			if !isTelegramDeliveryUncertain(err) {
+				s.clearPublishAttempt(ctx, post)
+			}
+			if isTelegramChatUnavailable(err) {
+				s.pausePublishing(ctx, err)
+				return
+			}
+			logger.Error().
+				Err(err).
+				Stack().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Bool("delivery_uncertain", isTelegramDeliveryUncertain(err)).
+				Msg("failed to publish post to Telegram")
+			s.cycleFailures++
+			s.recordPublishFailure(ctx, post, err)
+			continue
+		}
+
+		s.verifyMessageIDs(ctx, post, messages)
+		recordErr := s.store.RecordTelegramPosts(ctx, post.OwnerID, post.ID, messages, s.cfg.ChannelID)
+		if len(messages) == 0 {
+			recordErr = s.store.MarkVKPostSeen(ctx, post.OwnerID, post.ID)
+		}
+		if recordErr != nil {
+			if s.storageDown(ctx, recordErr) {
+				return
+			}
+			logger.Error().
+				Err(recordErr).
+				Stack().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Int("messages", len(messages)).
+				Msg("failed to record Telegram post")
+		}
+		s.clearPublishAttempt(ctx, post)
+		s.pauseBackoff = 0
+		latestPublished = s.cfg.LatestOnly
+		s.publishToMirrors(ctx, post, text)
+
+		if s.cfg.SeedReaction != "" && len(messages) > 0 {
+			if err := s.setTelegramReaction(ctx, s.cfg.ChannelID, messages[0].ID, s.cfg.SeedReaction); err != nil {
+				logger.Warn().
+					Err(err).
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Int64("telegram_message_id", messages[0].ID).
+					Msg("failed to seed reactions")
+			}
+		}
+	}
+}
+
+// storageDown reports whether err means the database is unreachable and, if
+// so, backs off further cycles. When ctx itself has run out the error is the
+// cycle's own deadline, not an outage.
+func (s *wallSyncer) storageDown(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || !isStorageUnavailable(err) {
+		return false
+	}
+	s.storageRetryAt = time.Now().Add(storageOutageBackoff)
+	s.log(ctx).Warn().
+		Err(err).
+		Time("retry_at", s.storageRetryAt).
+		Msg("database unavailable, aborting sync cycle")
+	s.cycleFailures++
+	return true
+}
+
+// verifyMessageIDs warns when Telegram returns message ids that aren't above
+// the last one recorded for the channel. Ids grow within a chat, so a lower
+// one suggests the post went to another chat than configured.
+func (s *wallSyncer) verifyMessageIDs(ctx context.Context, post vkPost, messages []telegramMessage) {
+	if !s.cfg.VerifyIDs || len(messages) == 0 {
+		return
+	}
+	if s.lastMessageID == 0 {
+		// The highest id in the channel, whichever group posted it: ids
+		// grow per chat, and the latest post by date may be a lower id.
+		lastID, err := s.store.MaxTelegramMessageID(ctx, s.cfg.ChannelID)
+		if err != nil {
+			s.log(ctx).Warn().Err(err).Msg("failed to load last Telegram message for verification")
+		} else {
+			s.lastMessageID = lastID
+		}
+	}
+
+	for _, msg := range messages {
+		if msg.ID <= 0 || msg.ID <= s.lastMessageID {
+			s.log(ctx).Warn().
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Str("channel_id", s.cfg.ChannelID).
+				Int64("telegram_message_id", msg.ID).
+				Int64("previous_message_id", s.lastMessageID).
+				Msg("Telegram returned a message id not above the previous one, the post may have been sent to another chat")
+		}
+		s.lastMessageID = max(s.lastMessageID, msg.ID)
+	}
+}
+
+func (s *wallSyncer) recordPublishFailure(ctx context.Context, post vkPost, cause error) {
+	// Only client errors fail permanently; server errors and rate limits
+	// pass, and an unavailable chat pauses publishing instead.
+	var apiErr *telegramAPIError
+	if s.cfg.MaxFailures <= 0 || !errors.As(cause, &apiErr) || apiErr.Code < 400 || apiErr.Code >= 500 ||
+		apiErr.Code == http.StatusTooManyRequests || isTelegramChatUnavailable(cause) {
+		return
+	}
+
+	count, err := s.store.IncrementFailure(ctx, post.OwnerID, post.ID, cause.Error())
+	if err != nil {
+		s.log(ctx).Error().
+			Err(err).
+			Int("owner_id", post.OwnerID).
+			Int("post_id", post.ID).
+			Msg("failed to record publish failure")
+		return
+	}
+	if count < s.cfg.MaxFailures {
+		return
+	}
+
+	if err := s.store.MarkDeadLetter(ctx, post.OwnerID, post.ID); err != nil {
+		s.log(ctx).Error().
+			Err(err).
+			Int("owner_id", post.OwnerID).
+			Int("post_id", post.ID).
+			Msg("failed to dead-letter post")
+		return
+	}
+	s.log(ctx).Warn().
+		Err(cause).
+		Int("owner_id", post.OwnerID).
+		Int("post_id", post.ID).
+		Int("failures", count).
+		Msg("post failed too many times, moved to dead letter")
+	s.sendAdminAlert(ctx, fmt.Sprintf("vk2tg: post %d_%d failed %d times and was moved to dead letter: %v", post.OwnerID, post.ID, count, cause))
+}
+
+func (s *wallSyncer) clearPublishAttempt(ctx context.Context, post vkPost) {
+	if err := s.store.ClearPublishAttempt(ctx, post.OwnerID, post.ID); err != nil {
+		s.log(ctx).Error().
+			Err(err).
+			Stack().
+			Int("owner_id", post.OwnerID).
+			Int("post_id", post.ID).
+			Msg("failed to clear publish attempt")
+	}
+}
+
+func (s *wallSyncer) normalizePostText(text string) string {
+	if s.cfg.DecodeEntities {
+		text = html.UnescapeString(text)
+	}
+	if len(s.cfg.StripTracking) > 0 {
+		text = stripTrackingParams(text, s.cfg.StripTracking)
+	}
+	text = strings.TrimSpace(text)
+	if s.cfg.MaxTextLength > 0 {
+		text = capTextLength(text, s.cfg.MaxTextLength)
+	}
+	return text
+}
+
+const readMoreNotice = "… (read more on VK)"
+
+// capTextLength cuts text longer than limit runes at a word boundary, never
+// inside VK link markup, and appends readMoreNotice.
+func capTextLength(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	cut := string(runes[:limit])
+	if open := strings.LastIndex(cut, "["); open > strings.LastIndex(cut, "]") {
+		cut = cut[:open]
+	}
+	if space := strings.LastIndexFunc(cut, unicode.IsSpace); space > len(cut)/2 {
+		cut = cut[:space]
+	}
+	return strings.TrimRightFunc(cut, unicode.IsSpace) + readMoreNotice
+}
+
+func (s *wallSyncer) pausePublishing(ctx context.Context, cause error) {
+	firstPause := s.pauseBackoff == 0
+	if firstPause {
+		s.pauseBackoff = minPublishPause
+	} else {
+		s.pauseBackoff = min(s.pauseBackoff*2, maxPublishPause)
+	}
+	s.pausedUntil = time.Now().Add(s.pauseBackoff)
+
+	s.logger.Error().
+		Err(cause).
+		Str("channel_id", s.cfg.ChannelID).
+		Time("paused_until", s.pausedUntil).
+		Msg("Telegram channel is unavailable, publishing paused; make sure the bot is still an administrator of the channel")
+
+	if firstPause {
+		s.sendAdminAlert(ctx, fmt.Sprintf(
+			"vk2tg: cannot publish to Telegram channel %s (%v). Publishing is paused until %s; make sure the bot is still an administrator of the channel.",
+			s.cfg.ChannelID, cause, s.pausedUntil.UTC().Format(time.RFC3339),
+		))
+	}
+}
+
+// pauseForVKAccess stops polling the group with a token VK refused access
+// for, e.g. after the account left a private community. Sync resumes once the
+// token changes through re-authorization or a refresh.
+func (s *wallSyncer) pauseForVKAccess(ctx context.Context, accessToken string, cause error) {
+	s.vkDeniedToken = accessToken
+	s.logger.Error().
+		Err(cause).
+		Str("vk_group_id", s.cfg.GroupID).
+		Msg("VK denied access to the group, sync paused until re-authorization; make sure the authorized account can read the group wall")
+
+	if !s.vkDeniedAlerted {
+		s.vkDeniedAlerted = true
+		s.sendAdminAlert(ctx, fmt.Sprintf(
+			"vk2tg: VK denied access to group %s (%v). Sync of this group is paused; make sure the authorized account can read the group wall and authorize again.",
+			s.cfg.GroupID, cause,
+		))
+	}
+}
+
+func (s *wallSyncer) sendAdminAlert(ctx context.Context, text string) {
+	if s.cfg.AdminChatID == "" {
+		return
+	}
+
+	params := url.Values{}
+	params.Set("chat_id", s.cfg.AdminChatID)
+	params.Set("text", text)
+	if _, err := s.callTelegram(ctx, "sendMessage", params); err != nil {
+		s.logger.Warn().
+			Err(err).
+			Str("admin_chat_id", s.cfg.AdminChatID).
+			Msg("failed to send admin alert")
+	}
+}
+
+// noteVKFetch persists the error of a failed wall.get for /status and clears
+// it after the next successful fetch. Transport errors are stored without
+// the request URL.
+func (s *wallSyncer) noteVKFetch(ctx context.Context, fetchErr error) {
+	if fetchErr == nil {
+		if s.vkErrorCleared {
+			return
+		}
+		if err := s.store.SetLastVKError(ctx, nil); err != nil {
+			s.logger.Warn().Err(err).Msg("failed to clear last VK error")
+			return
+		}
+		s.vkErrorCleared = true
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	rec := &vkErrorRecord{Message: fetchErr.Error(), At: time.Now().UTC()}
+	var apiErr *vkAPIError
+	var urlErr *url.Error
+	switch {
+	case errors.As(fetchErr, &apiErr):
+		rec.Code, rec.Message = apiErr.Code, apiErr.Msg
+	case errors.As(fetchErr, &urlErr):
+		// The request URL carries the access token, and /status is public.
+		rec.Message = fmt.Sprintf("request failed: %s: %v", urlErr.Op, urlErr.Err)
+	}
+	if err := s.store.SetLastVKError(ctx, rec); err != nil {
+		s.logger.Warn().Err(err).Msg("failed to store last VK error")
+		return
+	}
+	s.vkErrorCleared = false
+}
+
+func (s *wallSyncer) fetchVKPosts(ctx context.Context, accessToken string) ([]vkPost, error) {
+	params := url.Values{}
+	params.Set("count", "20")
+	params.Set("domain", "club"+s.cfg.GroupID)
+	params.Set("filter", s.cfg.WallFilter)
+	params.Set("extended", "1")
+
+	var result vkWallResponse
+	if err := s.callVK(ctx, "wall.get", accessToken, params, &result); err != nil {
+		return nil, err
+	}
+	s.warnSkippedItems("wall.get", result)
+	s.rememberOwnerNames(result.ownerNames())
+
+	return result.Items, nil
+}
+
+func (s *wallSyncer) composeText(post vkPost, postText string) string {
+	text := s.resolveBareMentions(postText)
+	if repost := s.repostAttribution(post); repost != "" {
+		text = strings.TrimSpace(text + "\n\n" + repost)
+	}
+	if links := videoLinks(post); len(links) > 0 {
+		text = strings.TrimSpace(text + "\n\n" + strings.Join(links, "\n"))
+	}
+	if links := storyLinks(post); len(links) > 0 {
+		text = strings.TrimSpace(text + "\n\n" + strings.Join(links, "\n"))
+	}
+	if cards := marketCards(post); len(cards) > 0 {
+		text = strings.TrimSpace(text + "\n\n" + strings.Join(cards, "\n\n"))
+	}
+	if cards := s.pollCards(post); len(cards) > 0 {
+		text = strings.TrimSpace(text + "\n\n" + strings.Join(cards, "\n\n"))
+	}
+	var footer []string
+	if date := s.postDate(post); date != "" {
+		footer = append(footer, date)
+	}
+	// SYNC_LINK_WHEN_EMPTY=false drops only the wall link of attachment-only
+	// posts. Admins also sometimes paste the post's own link into the text.
+	omitLink := text == "" && !s.cfg.LinkWhenEmpty && (postHasMedia(post) || s.pollOnly(post))
+	if !omitLink && !containsPostLink(text, post) {
+		footer = append(footer, s.sourceAttribution(post))
+	}
+	// The comment count changes all the time, so it only reaches Telegram
+	// with the next publish or edit; it is never part of the content hash.
+	if s.cfg.ShowComments && post.Comments.Count > 0 {
+		footer = append(footer, fmt.Sprintf("💬 %d comments: %s", post.Comments.Count, s.postURL(post)))
+	}
+	link := strings.Join(footer, "\n")
+	// The signature is static, so like the link it stays out of the hash.
+	if s.cfg.Signature != "" {
+		link = strings.TrimSpace(link + "\n\n" + s.cfg.Signature)
+	}
+	if text == "" || link == "" {
+		return text + link
+	}
+	return fmt.Sprintf("%s\n\n%s", text, link)
+}
+
+var vkWallLinkPattern = regexp.MustCompile(`(?i)\bvk\.(?:com|ru)/wall(-?\d+)_(\d+)\b`)
+
+// containsPostLink reports whether text links to the post itself on VK.
+func containsPostLink(text string, post vkPost) bool {
+	for _, m := range vkWallLinkPattern.FindAllStringSubmatch(text, -1) {
+		if m[1] == strconv.Itoa(post.OwnerID) && m[2] == strconv.Itoa(post.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *wallSyncer) resolveGroupName(ctx context.Context, accessToken, groupID string) (string, error) {
+	params := url.Values{}
+	params.Set("group_id", groupID)
+
+	var result struct {
+		Groups []struct {
+			Name string `json:"name"`
+		} `json:"groups"`
+	}
+	if err := s.callVK(ctx, "groups.getById", accessToken, params, &result); err != nil {
+		return "", err
+	}
+	if len(result.Groups) == 0 || result.Groups[0].Name == "" {
+		return "", fmt.Errorf("group %s not found", groupID)
+	}
+	return result.Groups[0].Name, nil
+}
+
+func (s *wallSyncer) postURL(post vkPost) string {
+	ownerID := post.OwnerID
+	if ownerID == 0 {
+		ownerID = s.cfg.ownerID()
+	}
+	return fmt.Sprintf("https://vk.com/wall%d_%d", ownerID, post.ID)
+}
+
+// disablePreview reports whether link previews should be off for the post:
+// with TG_PREVIEW_LINKS_ONLY only posts with a VK link attachment keep them,
+// so URLs mentioned in passing don't expand into large previews.
+func (s *wallSyncer) disablePreview(post vkPost) bool {
+	if !s.cfg.PreviewLinksOnly {
+		return false
+	}
+	for _, att := range post.Attachments {
+		if att.Type == "link" && att.Link != nil && att.Link.URL != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// postDate renders the VK post date for the message footer, or "" when
+// SYNC_SHOW_DATE is off.
+func (s *wallSyncer) postDate(post vkPost) string {
+	if !s.cfg.ShowDate || post.Date == 0 {
+		return ""
+	}
+	loc := s.cfg.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	return "📅 " + time.Unix(post.Date, 0).In(loc).Format(s.cfg.DateFormat)
+}
+
+func (s *wallSyncer) sourceAttribution(post vkPost) string {
+	link := s.postURL(post)
+	if s.cfg.SourceFormat == "" || s.groupName == "" {
+		return link
+	}
+	return strings.NewReplacer("{name}", s.groupName, "{author}", s.postAuthor(post), "{url}", link).Replace(s.cfg.SourceFormat)
+}
+
+func (s *wallSyncer) fetchVKAlbumPhotos(ctx context.Context, accessToken string, ownerID, albumID int) ([]vkPhoto, error) {
+	params := url.Values{}
+	params.Set("owner_id", strconv.Itoa(ownerID))
+	params.Set("album_id", strconv.Itoa(albumID))
+	params.Set("count", strconv.Itoa(telegramMediaGroupLimit))
+
+	var result struct {
+		Items []vkPhoto `json:"items"`
+	}
+	if err := s.callVK(ctx, "photos.get", accessToken, params, &result); err != nil {
+		return nil, err
+	}
+
+	return result.Items, nil
+}
+
+func (s *wallSyncer) expandAlbumAttachments(ctx context.Context, accessToken string, posts []vkPost) {
+	for _, post := range posts {
+		for _, att := range post.Attachments {
+			if att.Type != "album" || att.Album == nil {
+				continue
+			}
+			photos, err := s.fetchVKAlbumPhotos(ctx, accessToken, int(att.Album.OwnerID), int(att.Album.ID))
+			if err != nil {
+				s.logger.Warn().
+					Err(err).
+					Int("owner_id", post.OwnerID).
+					Int("post_id", post.ID).
+					Int("album_id", int(att.Album.ID)).
+					Msg("failed to fetch VK album photos, using album thumbnail")
+				continue
+			}
+			att.Album.Photos = photos
+		}
+	}
+}
+
+func (s *wallSyncer) callVK(ctx context.Context, method, accessToken string, params url.Values, out any) error {
+	params.Set("access_token", accessToken)
+	params.Set("v", vkAPIVersion)
+
+	if err := s.vkMeter.Wait(ctx); err != nil {
+		return fmt.Errorf("wait for VK rate limit: %w", err)
+	}
+	s.vkMeter.Record()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/method/%s?%s", s.cfg.VKAPIBase, method, params.Encode()), nil)
+	if err != nil {
+		return fmt.Errorf("build VK request: %w", err)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("execute VK request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var env struct {
+		Response json.RawMessage `json:"response"`
+		Error    vkAPIError      `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return fmt.Errorf("decode VK response: %w", err)
+	}
+
+	if env.Error.Code != 0 {
+		return &env.Error
+	}
+
+	if err := json.Unmarshal(env.Response, out); err != nil {
+		return fmt.Errorf("decode VK %s response: %w", method, err)
+	}
+	return nil
+}
+
+// publishPost sends the post to Telegram, skipping the first steps (a text
+// message, a media group, a poll) that an earlier, partially failed attempt
+// already delivered. The messages of the steps completed by this call are
+// returned even when a later step fails, tagged with their step.
+func (s *wallSyncer) publishPost(ctx context.Context, post vkPost, text string, sent int) ([]telegramMessage, error) {
+	release, err := s.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	media := postMedia(post, s.cfg.PhotoMaxDimension)
+	if s.cfg.MaxMessagesPerPost > 0 {
+		media, text = capPostMessages(media, text, s.cfg.MaxMessagesPerPost, s.captionMaxLength())
+	}
+
+	if s.usesTelegraph(text) {
+		if sent > 0 {
+			return nil, nil
+		}
+		return s.publishViaTelegraph(ctx, post, text, s.photoURLs(post))
+	}
+
+	var (
+		messages     []telegramMessage
+		replyToMedia bool
+	)
+	opts := func(withButton bool) telegramSendOptions {
+		var o telegramSendOptions
+		if (s.cfg.ReplyThread || replyToMedia) && len(messages) > 0 {
+			o.ReplyToMessageID = messages[0].ID
+		}
+		if s.cfg.VKButton && withButton {
+			o.ButtonURL = s.postURL(post)
+		}
+		o.DisablePreview = s.disablePreview(post)
+		return o
+	}
+
+	step := 0
+	send := func(publish func() ([]telegramMessage, error)) (bool, error) {
+		step++
+		if step <= sent {
+			return true, nil
+		}
+		msgs, err := publish()
+		for i := range msgs {
+			msgs[i].Step = step - 1
+		}
+		messages = append(messages, msgs...)
+		return len(msgs) > 0, err
+	}
+	sendText := func() error {
+		if text == "" {
+			return nil
+		}
+		_, err := send(func() ([]telegramMessage, error) {
+			msg, err := s.publishTextToTelegram(ctx, text, opts(true))
+			if err != nil {
+				return nil, err
+			}
+			return []telegramMessage{msg}, nil
+		})
+		return err
+	}
+
+	switch len(media) {
+	case 0:
+		if err := sendText(); err != nil {
+			return messages, err
+		}
+	default:
+		var caption string
+		caption, replyToMedia = s.mediaCaption(text, len(media))
+		if s.cfg.TextPosition == textPositionBefore {
+			if err := sendText(); err != nil {
+				return messages, err
+			}
+		}
+		captionSent, buttonPending := false, false
+		for _, chunk := range chunkSlice(media, telegramMediaGroupLimit) {
+			chunkCaption := ""
+			if !captionSent {
+				chunkCaption = caption
+			}
+			delivered, err := send(func() ([]telegramMessage, error) {
+				return s.publishMediaWithFallback(ctx, chunk, chunkCaption, opts(chunkCaption != ""))
+			})
+			if err != nil {
+				return messages, err
+			}
+			if delivered && !captionSent {
+				captionSent = true
+				buttonPending = s.cfg.VKButton && chunkCaption != "" && len(chunk) > 1
+			}
+		}
+
+		if s.cfg.TextPosition != textPositionBefore && (caption == "" || replyToMedia || !captionSent) {
+			if err := sendText(); err != nil {
+				return messages, err
+			}
+		} else if buttonPending {
+			// The album caption can't carry the keyboard, so the button
+			// follows the album in a message of its own.
+			_, err := send(func() ([]telegramMessage, error) {
+				o := opts(true)
+				if len(messages) > 0 {
+					o.ReplyToMessageID = messages[0].ID
+				}
+				o.DisablePreview = true
+				msg, err := s.publishTextToTelegram(ctx, s.postURL(post), o)
+				if err != nil {
+					return nil, err
+				}
+				// The post text lives in the caption; edits must target it.
+				msg.Text = ""
+				return []telegramMessage{msg}, nil
+			})
+			if err != nil {
+				return messages, err
+			}
+		}
+	}
+
+	if s.cfg.NativePolls {
+		for _, poll := range postPolls(post) {
+			_, err := send(func() ([]telegramMessage, error) {
+				msg, err := s.publishPollToTelegram(ctx, poll, opts(false))
+				if err != nil {
+					return nil, err
+				}
+				return []telegramMessage{msg}, nil
+			})
+			if err != nil {
+				return messages, err
+			}
+		}
 	}
 
-	go syncer.run(ctx)
+	return messages, nil
 }
 
-type wallSyncer struct {
-	logger     zerolog.Logger
-	manager    *tokenManager
-	store      *storage
-	cfg        wallSyncConfig
-	httpClient *http.Client
+// mediaCaption decides which caption goes on the first media item. Text that
+// fits is used as is. Longer text is left for a follow-up message, except
+// that with TG_CAPTION_OVERFLOW=truncate-link a single media item gets a
+// trimmed caption and the full text replies to it. A media group shows its
+// caption under the whole album, where a cut-off text followed by the same
+// text again reads poorly, so groups always move long text out entirely.
+func (s *wallSyncer) mediaCaption(text string, mediaCount int) (caption string, truncated bool) {
+	if captionLength(text) <= s.captionMaxLength() {
+		return text, false
+	}
+	if s.cfg.TextPosition != textPositionCaption || s.cfg.CaptionOverflow != captionOverflowTruncateLink || mediaCount != 1 {
+		return "", false
+	}
+	return truncateCaption(text, s.captionMaxLength()), true
 }
 
-func (s *wallSyncer) run(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+// captionMaxLength is the caption length, in UTF-16 units, above which the
+// text is sent as a separate message. The safety margin keeps near-limit
+// captions away from Telegram's own counting. It is negative when the text is
+// always sent separately (TG_TEXT_POSITION before or after).
+func (s *wallSyncer) captionMaxLength() int {
+	if s.cfg.TextPosition != textPositionCaption {
+		return -1
+	}
+	return telegramCaptionLimit - s.cfg.CaptionSafetyMargin
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			s.logger.Info().Msg("VK to Telegram sync worker stopped")
-			return
-		case <-ticker.C:
-			s.sync(ctx)
+// truncateCaption shortens text so its rendered caption, ellipsis included,
+// fits max UTF-16 units. It cuts at a word boundary when one is near and
+// never inside VK link markup.
+func truncateCaption(text string, max int) string {
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if captionLength(cutCaption(runes[:mid])) <= max {
+			lo = mid
+		} else {
+			hi = mid - 1
 		}
 	}
+	return cutCaption(runes[:lo])
 }
 
-func (s *wallSyncer) sync(ctx context.Context) {
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
-	defer cancel()
-
-	accessToken, err := s.manager.RequestAccessToken(ctx)
-	if err != nil {
-		s.logger.Error().Err(err).Stack().Msg("failed to get access token for sync")
-		return
+func cutCaption(runes []rune) string {
+	text := string(runes)
+	if open := strings.LastIndex(text, "["); open > strings.LastIndex(text, "]") {
+		text = text[:open]
 	}
-
-	if accessToken == "" {
-		s.logger.Debug().Msg("access token not yet available, skipping sync")
-		return
+	if space := strings.LastIndexAny(text, " \n"); space > len(text)*3/4 {
+		text = text[:space]
 	}
+	return strings.TrimSpace(text) + "…"
+}
 
-	posts, err := s.fetchVKPosts(ctx, accessToken)
-	if err != nil {
-		s.logger.Error().Err(err).Stack().Msg("failed to fetch posts from VK")
-		return
+func capPostMessages(media []telegramMedia, text string, maxMessages, captionMax int) ([]telegramMedia, string) {
+	if postMessageCount(len(media), captionLength(text) <= captionMax) <= maxMessages {
+		return media, text
 	}
 
-	if len(posts) == 0 {
-		s.logger.Info().Msg("no posts received from VK")
-		return
+	capped := text
+	keep := len(media)
+	for range 2 {
+		groups := maxMessages
+		if captionLength(capped) > captionMax {
+			groups--
+		}
+		keep = min(len(media), max(groups, 0)*telegramMediaGroupLimit)
+		capped = fmt.Sprintf("%s\n\n…and %d more on VK", text, len(media)-keep)
 	}
+	return media[:keep], capped
+}
 
-	sort.Slice(posts, func(i, j int) bool {
-		return posts[i].ID < posts[j].ID
-	})
+func postMessageCount(mediaCount int, captionFits bool) int {
+	count := (mediaCount + telegramMediaGroupLimit - 1) / telegramMediaGroupLimit
+	if mediaCount == 0 || !captionFits {
+		count++
+	}
+	return count
+}
 
-	for _, post := range posts {
-		if post.ID == 0 {
-			continue
+// publishMediaWithFallback sends items, dropping the ones Telegram rejects
+// when TG_MEDIA_FALLBACK is on. Messages already delivered are returned along
+// with an error that stops the sending, so they are recorded and not sent
+// again.
+func (s *wallSyncer) publishMediaWithFallback(ctx context.Context, items []telegramMedia, caption string, opts telegramSendOptions) ([]telegramMessage, error) {
+	// Each pass either returns or drops one item of a group of at least two,
+	// so remaining never runs empty.
+	remaining := items
+	for {
+		var (
+			messages []telegramMessage
+			err      error
+		)
+		if len(remaining) == 1 {
+			var msg telegramMessage
+			msg, err = s.publishSingleMedia(ctx, remaining[0], caption, opts)
+			if err == nil {
+				messages = []telegramMessage{msg}
+			}
+		} else {
+			messages, err = s.publishMediaGroupToTelegram(ctx, remaining, caption, opts)
+		}
+		if err == nil {
+			return messages, nil
+		}
+		if !s.cfg.MediaFallback || !isTelegramBadRequest(err) || isTelegramChatUnavailable(err) {
+			return messages, err
 		}
 
-		postText := strings.TrimSpace(post.Text)
-
-		state, err := s.store.EnsureVKPost(ctx, post.OwnerID, post.ID, post.Hash, postText)
-		if err != nil {
-			s.logger.Error().
+		if len(remaining) == 1 {
+			s.log(ctx).Warn().
 				Err(err).
-				Stack().
-				Int("owner_id", post.OwnerID).
-				Int("post_id", post.ID).
-				Msg("failed to check published status")
-			continue
+				Str("media_url", remaining[0].URL).
+				Msg("telegram rejected media, dropping it")
+			return nil, nil
 		}
 
-		text := postText
-		link := fmt.Sprintf("https://vk.com/wall-%s_%d", s.cfg.GroupID, post.ID)
-		if text == "" {
-			text = link
-		} else {
-			text = fmt.Sprintf("%s\n\n%s", text, link)
+		idx, ok := rejectedMediaIndex(err)
+		if !ok || idx >= len(remaining) {
+			s.log(ctx).Warn().
+				Err(err).
+				Int("media_count", len(remaining)).
+				Msg("telegram rejected media group, sending items one by one")
+			return s.publishMediaItemsIndividually(ctx, remaining, caption, opts)
 		}
 
-		if state.Published {
-			if state.Hash == post.Hash {
-				s.logger.Info().
-					Int("postId", post.ID).
-					Msg("post already published and hash unchanged")
-				continue
-			}
-
-			updated, err := s.updateTelegramPostContent(ctx, post, text)
-			if err != nil {
-				s.logger.Error().
-					Err(err).
-					Stack().
-					Int("owner_id", post.OwnerID).
-					Int("post_id", post.ID).
-					Msg("failed to update Telegram post content")
-				continue
-			}
-			if !updated {
-				s.logger.Warn().
-					Int("owner_id", post.OwnerID).
-					Int("post_id", post.ID).
-					Msg("skipped Telegram post update after edit failure")
-				continue
-			}
+		s.log(ctx).Warn().
+			Err(err).
+			Str("media_url", remaining[idx].URL).
+			Msg("telegram rejected media in group, retrying without it")
+		remaining = slices.Delete(slices.Clone(remaining), idx, idx+1)
+	}
+}
 
-			if err := s.store.UpdateVKPostAfterEdit(ctx, post.OwnerID, post.ID, post.Hash, postText); err != nil {
-				s.logger.Error().
-					Err(err).
-					Stack().
-					Int("owner_id", post.OwnerID).
-					Int("post_id", post.ID).
-					Msg("failed to persist updated VK post hash")
-			}
-			continue
+func (s *wallSyncer) publishMediaItemsIndividually(ctx context.Context, items []telegramMedia, caption string, opts telegramSendOptions) ([]telegramMessage, error) {
+	var messages []telegramMessage
+	for _, item := range items {
+		itemCaption := ""
+		if len(messages) == 0 {
+			itemCaption = caption
 		}
-
-		messages, err := s.publishPost(ctx, post, text)
+		msg, err := s.publishSingleMedia(ctx, item, itemCaption, opts)
 		if err != nil {
-			s.logger.Error().
+			if !isTelegramBadRequest(err) || isTelegramChatUnavailable(err) {
+				return messages, err
+			}
+			s.log(ctx).Warn().
 				Err(err).
-				Stack().
-				Int("owner_id", post.OwnerID).
-				Int("post_id", post.ID).
-				Msg("failed to publish post to Telegram")
+				Str("media_url", item.URL).
+				Msg("telegram rejected media, dropping it")
 			continue
 		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
 
-		for _, msg := range messages {
-			if err := s.store.RecordTelegramPost(ctx, post.OwnerID, post.ID, msg.ID, s.cfg.ChannelID, msg.Text, msg.PublishedAt); err != nil {
-				s.logger.Error().
-					Err(err).
-					Stack().
-					Int("owner_id", post.OwnerID).
-					Int("post_id", post.ID).
-					Int64("telegram_message_id", msg.ID).
-					Msg("failed to record Telegram post")
-			}
+func rejectedMediaIndex(err error) (int, bool) {
+	var apiErr *telegramAPIError
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	match := telegramRejectedMediaPattern.FindStringSubmatch(apiErr.Description)
+	if match == nil {
+		return 0, false
+	}
+	n, convErr := strconv.Atoi(match[1])
+	if convErr != nil || n < 1 {
+		return 0, false
+	}
+	return n - 1, true
+}
+
+func (s *wallSyncer) publishSingleMedia(ctx context.Context, item telegramMedia, caption string, opts telegramSendOptions) (telegramMessage, error) {
+	if item.Type == "video" {
+		return s.publishVideoToTelegram(ctx, item.URL, caption, opts)
+	}
+	return s.publishPhotoToTelegram(ctx, item.URL, caption, opts)
+}
+
+// completedPublishSteps returns how many publishPost steps the recorded
+// messages of a partially published post cover in this channel. Messages
+// recorded before steps were tracked only tell their count.
+func (s *wallSyncer) completedPublishSteps(sent []storedTelegramPost) int {
+	var own []storedTelegramPost
+	for _, rec := range sent {
+		if rec.ChannelID == "" || rec.ChannelID == s.cfg.ChannelID {
+			own = append(own, rec)
+		}
+	}
+	steps := 0
+	for _, rec := range own {
+		if rec.Step < 0 {
+			return len(own)
 		}
+		steps = max(steps, rec.Step+1)
 	}
+	return steps
 }
 
-func (s *wallSyncer) fetchVKPosts(ctx context.Context, accessToken string) ([]vkPost, error) {
-	params := url.Values{}
-	params.Set("access_token", accessToken)
-	params.Set("v", vkAPIVersion)
-	params.Set("count", "20")
-	params.Set("domain", "club"+s.cfg.GroupID)
+// manualEditDiverged reports whether a message that was marked as edited by
+// hand still holds text other than what the VK post renders to now. Once VK
+// catches up with the manual edit, automatic edits apply again.
+func manualEditDiverged(records []storedTelegramPost, text string) bool {
+	for _, rec := range records {
+		if rec.HasText && rec.Text != strings.TrimSpace(text) {
+			return true
+		}
+	}
+	return false
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s?%s", vkWallGetURL, params.Encode()), nil)
+func (s *wallSyncer) updateTelegramPostContent(ctx context.Context, post vkPost, text string) (bool, error) {
+	release, err := s.limiter.Acquire(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("build VK request: %w", err)
+		return false, err
 	}
+	defer release()
 
-	resp, err := s.httpClient.Do(req)
+	records, err := s.store.LatestTelegramPosts(ctx, post.OwnerID, post.ID)
 	if err != nil {
-		return nil, fmt.Errorf("execute VK request: %w", err)
+		return false, fmt.Errorf("lookup latest Telegram posts: %w", err)
 	}
-	defer resp.Body.Close()
-
-	var result vkWallResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("decode VK response: %w", err)
+	if len(records) == 0 {
+		return false, fmt.Errorf("%w for vk post %d", errNoTelegramMessages, post.ID)
 	}
 
-	if result.Error.Code != 0 {
-		return nil, fmt.Errorf("vk api error %d: %s", result.Error.Code, result.Error.Msg)
+	opts := telegramSendOptions{DisablePreview: s.disablePreview(post)}
+	if s.cfg.VKButton {
+		// Edits without reply_markup remove the existing keyboard.
+		opts.ButtonURL = s.postURL(post)
 	}
 
-	return result.Response.Items, nil
-}
-
-func (s *wallSyncer) publishPost(ctx context.Context, post vkPost, text string) ([]telegramMessage, error) {
-	photoURLs := photoAttachmentURLs(post)
-	textLen := utf8.RuneCountInString(text)
-
-	var messages []telegramMessage
+	allEdited := true
+	var errs []error
+	for _, rec := range records {
+		chatID := rec.ChannelID
+		if chatID == "" {
+			chatID = s.cfg.ChannelID
+		}
+		if chatID == "" {
+			return false, fmt.Errorf("missing Telegram channel ID for vk post %d", post.ID)
+		}
 
-	switch len(photoURLs) {
-	case 0:
-		msg, err := s.publishTextToTelegram(ctx, text)
+		target := s.channelSyncer(chatID)
+		msgText, msgOpts := text, opts
+		article, err := target.telegraphArticle(ctx, post)
 		if err != nil {
-			return nil, err
+			errs = append(errs, fmt.Errorf("channel %s: lookup Telegraph article: %w", chatID, err))
+			continue
 		}
-		messages = append(messages, msg)
-	case 1:
-		photoURL := photoURLs[0]
-		if textLen < 1024 {
-			msg, err := s.publishPhotoToTelegram(ctx, photoURL, text)
-			if err != nil {
-				return nil, err
+		if article != "" {
+			// The message only links to the article, which takes the edit.
+			if msgText, err = target.editTelegraphArticle(ctx, post, text, article); err != nil {
+				errs = append(errs, fmt.Errorf("channel %s: %w", chatID, err))
+				continue
 			}
-			messages = append(messages, msg)
+			msgOpts = telegramSendOptions{}
 		} else {
-			msg, err := s.publishPhotoToTelegram(ctx, photoURL, "")
+			merged, err := target.mergeTextIntoCaption(ctx, post, text, rec, chatID, opts)
 			if err != nil {
-				return nil, err
+				errs = append(errs, fmt.Errorf("channel %s: %w", chatID, err))
+				continue
 			}
-			messages = append(messages, msg)
-
-			msg, err = s.publishTextToTelegram(ctx, text)
-			if err != nil {
-				return nil, err
+			if merged {
+				continue
 			}
-			messages = append(messages, msg)
-		}
-	default:
-		var (
-			groupMessages []telegramMessage
-			err           error
-		)
-		if textLen < 1024 {
-			groupMessages, err = s.publishMediaGroupToTelegram(ctx, photoURLs, text)
-		} else {
-			groupMessages, err = s.publishMediaGroupToTelegram(ctx, photoURLs, "")
 		}
+
+		edited, err := target.tryEditTelegramMessage(ctx, chatID, rec.MessageID, msgText, msgOpts)
 		if err != nil {
-			return nil, err
+			errs = append(errs, fmt.Errorf("channel %s: %w", chatID, err))
+			continue
+		}
+		if !edited {
+			allEdited = false
+			continue
+		}
+		if err := s.store.UpdateTelegramPostText(ctx, post.OwnerID, post.ID, rec.ChannelID, rec.MessageID, msgText); err != nil {
+			errs = append(errs, fmt.Errorf("update stored Telegram post text: %w", err))
 		}
-		messages = append(messages, groupMessages...)
+	}
+	if len(errs) > 0 {
+		return false, errors.Join(errs...)
+	}
+	return allEdited, nil
+}
 
-		if textLen >= 1024 {
-			msg, err := s.publishTextToTelegram(ctx, text)
-			if err != nil {
-				return nil, err
-			}
-			messages = append(messages, msg)
+// mergeTextIntoCaption handles a post whose text was too long for a caption
+// and now fits one: the text moves into the caption of the first media
+// message and the separate text message is deleted. It only runs with
+// SYNC_REPOST_ON_MEDIA_CHANGE, which already allows deleting messages.
+func (s *wallSyncer) mergeTextIntoCaption(ctx context.Context, post vkPost, text string, rec storedTelegramPost, chatID string, opts telegramSendOptions) (bool, error) {
+	if !s.cfg.RepostOnMediaChange || s.cfg.TextPosition != textPositionCaption || !rec.HasText || !postHasMedia(post) {
+		return false, nil
+	}
+	if caption, _ := s.mediaCaption(text, 1); caption != text {
+		return false, nil
+	}
+
+	records, err := s.store.TelegramPosts(ctx, post.OwnerID, post.ID)
+	if err != nil {
+		return false, fmt.Errorf("lookup Telegram posts: %w", err)
+	}
+	idx := slices.IndexFunc(records, func(r storedTelegramPost) bool { return r.ChannelID == rec.ChannelID })
+	// The media message may already carry the text when an earlier merge
+	// failed to delete the text message; editing it again is harmless.
+	if idx < 0 || records[idx].MessageID == rec.MessageID {
+		return false, nil
+	}
+	media := records[idx]
+
+	edited, err := s.tryEditTelegramMessage(ctx, chatID, media.MessageID, text, opts)
+	if err != nil || !edited {
+		return false, err
+	}
+	if err := s.store.UpdateTelegramPostText(ctx, post.OwnerID, post.ID, media.ChannelID, media.MessageID, text); err != nil {
+		return false, fmt.Errorf("update stored Telegram post text: %w", err)
+	}
+
+	// A bad request means the message is gone or too old to delete; either
+	// way it is dropped from the records so edits target the caption. Other
+	// failures are retried by the next edit.
+	if err := s.deleteTelegramMessage(ctx, chatID, rec.MessageID); err != nil && !isTelegramBadRequest(err) {
+		return true, fmt.Errorf("delete text message merged into caption: %w", err)
+	}
+	if err := s.store.DeleteTelegramPost(ctx, post.OwnerID, post.ID, rec.ChannelID, rec.MessageID); err != nil {
+		return true, fmt.Errorf("remove merged text message record: %w", err)
+	}
+	s.log(ctx).Info().
+		Int("owner_id", post.OwnerID).
+		Int("post_id", post.ID).
+		Int64("telegram_message_id", rec.MessageID).
+		Msg("moved shortened text into the media caption and deleted the separate text message")
+	return true, nil
+}
+
+// channelSyncer returns the mirror publishing to chatID, so edits use that
+// channel's settings, or s itself.
+func (s *wallSyncer) channelSyncer(chatID string) *wallSyncer {
+	for _, mirror := range s.mirrors {
+		if mirror.cfg.ChannelID == chatID {
+			return mirror
 		}
 	}
+	return s
+}
 
-	return messages, nil
+// publishToMirrors sends a post already published to the primary channel to
+// every mirror channel. Failures are logged and don't affect the primary;
+// retryMirrors picks up the channels that got nothing.
+func (s *wallSyncer) publishToMirrors(ctx context.Context, post vkPost, text string) {
+	for _, mirror := range s.mirrors {
+		s.publishToMirror(ctx, mirror, post, text)
+	}
 }
 
-func (s *wallSyncer) updateTelegramPostContent(ctx context.Context, post vkPost, text string) (bool, error) {
-	rec, err := s.store.LatestTelegramPost(ctx, post.OwnerID, post.ID)
+// retryMirrors publishes a post to the mirror channels that have no messages
+// of it yet. Only recent posts are retried, so adding a mirror doesn't
+// back-fill it with the whole wall.
+func (s *wallSyncer) retryMirrors(ctx context.Context, post vkPost, state vkPostState, text string) {
+	if len(s.mirrors) == 0 || time.Since(state.PublishedAt) > mirrorRetryWindow {
+		return
+	}
+	records, err := s.store.TelegramPosts(ctx, post.OwnerID, post.ID)
 	if err != nil {
-		return false, fmt.Errorf("lookup latest Telegram post: %w", err)
+		s.log(ctx).Warn().Err(err).Msg("failed to look up mirrored Telegram posts")
+		return
+	}
+
+	channels := make(map[string]bool, len(records))
+	for _, rec := range records {
+		channels[rec.ChannelID] = true
+	}
+	// Posts marked seen without publishing have nothing to mirror.
+	if !channels[s.cfg.ChannelID] {
+		return
+	}
+	for _, mirror := range s.mirrors {
+		if channels[mirror.cfg.ChannelID] {
+			continue
+		}
+		mirror.log(ctx).Info().Msg("post missing in mirror channel, publishing again")
+		s.publishToMirror(ctx, mirror, post, text)
+	}
+}
+
+// publishToMirror runs with its own deadline: mirrors are sent after the
+// primary, when the cycle's deadline may be nearly used up.
+func (s *wallSyncer) publishToMirror(ctx context.Context, mirror *wallSyncer, post vkPost, text string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mirrorPublishTimeout)
+	defer cancel()
+
+	mirror.groupName = s.groupName
+	mirror.announceFirstPost(ctx, post.OwnerID)
+	messages, err := mirror.publishPost(ctx, post, text, 0)
+	if recErr := s.store.RecordTelegramPosts(ctx, post.OwnerID, post.ID, messages, mirror.cfg.ChannelID); recErr != nil {
+		mirror.log(ctx).Error().
+			Err(recErr).
+			Int("owner_id", post.OwnerID).
+			Int("post_id", post.ID).
+			Msg("failed to record mirrored Telegram post")
 	}
-	if rec == nil {
-		return false, fmt.Errorf("no Telegram messages recorded for vk post %d", post.ID)
+	if err != nil {
+		mirror.log(ctx).Error().
+			Err(err).
+			Int("owner_id", post.OwnerID).
+			Int("post_id", post.ID).
+			Msg("failed to publish post to mirror channel")
 	}
+}
 
-	chatID := rec.ChannelID
-	if chatID == "" {
-		chatID = s.cfg.ChannelID
+// repostTelegramPost replaces a post whose photos changed: Telegram can't
+// swap media inside an existing group, so the post is published again and the
+// old messages are deleted.
+func (s *wallSyncer) repostTelegramPost(ctx context.Context, post vkPost, text string) (bool, error) {
+	old, err := s.store.TelegramPosts(ctx, post.OwnerID, post.ID)
+	if err != nil {
+		return false, fmt.Errorf("lookup Telegram posts: %w", err)
 	}
-	if chatID == "" {
-		return false, fmt.Errorf("missing Telegram channel ID for vk post %d", post.ID)
+	if len(old) == 0 {
+		return false, fmt.Errorf("%w for vk post %d", errNoTelegramMessages, post.ID)
 	}
 
-	edited, err := s.tryEditTelegramMessage(ctx, chatID, rec.MessageID, text)
+	messages, err := s.publishPost(ctx, post, text, 0)
 	if err != nil {
+		if recErr := s.store.RecordTelegramPosts(ctx, post.OwnerID, post.ID, messages, s.cfg.ChannelID); recErr != nil {
+			s.log(ctx).Error().Err(recErr).Int("post_id", post.ID).Msg("failed to record partially reposted Telegram messages")
+		}
 		return false, err
 	}
-	if !edited {
-		return false, nil
+	if err := s.store.RecordTelegramPosts(ctx, post.OwnerID, post.ID, messages, s.cfg.ChannelID); err != nil {
+		return false, fmt.Errorf("record reposted Telegram messages: %w", err)
 	}
+	s.publishToMirrors(ctx, post, text)
 
-	if err := s.store.UpdateTelegramPostText(ctx, post.OwnerID, post.ID, rec.MessageID, text); err != nil {
-		return false, fmt.Errorf("update stored Telegram post text: %w", err)
+	for _, rec := range old {
+		chatID := rec.ChannelID
+		if chatID == "" {
+			chatID = s.cfg.ChannelID
+		}
+		if err := s.deleteTelegramMessage(ctx, chatID, rec.MessageID); err != nil && !isTelegramBadRequest(err) {
+			s.log(ctx).Warn().
+				Err(err).
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Int64("telegram_message_id", rec.MessageID).
+				Msg("failed to delete replaced Telegram message")
+			continue
+		}
+		if err := s.store.DeleteTelegramPost(ctx, post.OwnerID, post.ID, rec.ChannelID, rec.MessageID); err != nil {
+			s.log(ctx).Error().
+				Err(err).
+				Int("owner_id", post.OwnerID).
+				Int("post_id", post.ID).
+				Int64("telegram_message_id", rec.MessageID).
+				Msg("failed to remove replaced Telegram message record")
+		}
 	}
+
+	s.log(ctx).Info().
+		Int("owner_id", post.OwnerID).
+		Int("post_id", post.ID).
+		Int("deleted_messages", len(old)).
+		Int("new_messages", len(messages)).
+		Msg("reposted VK post after media change")
 	return true, nil
 }
 
-func (s *wallSyncer) tryEditTelegramMessage(ctx context.Context, chatID string, messageID int64, text string) (bool, error) {
-	if _, err := s.editTelegramMessageText(ctx, chatID, messageID, text); err == nil {
+func (s *wallSyncer) deleteTelegramMessage(ctx context.Context, chatID string, messageID int64) error {
+	params := url.Values{}
+	params.Set("chat_id", chatID)
+	params.Set("message_id", strconv.FormatInt(messageID, 10))
+
+	_, err := s.callTelegram(ctx, "deleteMessage", params)
+	return err
+}
+
+func (s *wallSyncer) tryEditTelegramMessage(ctx context.Context, chatID string, messageID int64, text string, opts telegramSendOptions) (bool, error) {
+	if _, err := s.editTelegramMessageText(ctx, chatID, messageID, text, opts); err == nil || isTelegramMessageNotModified(err) {
 		return true, nil
 	} else if !isTelegramBadRequest(err) {
 		return false, err
 	}
 
-	if _, err := s.editTelegramMessageCaption(ctx, chatID, messageID, text); err == nil {
+	_, err := s.editTelegramMessageCaption(ctx, chatID, messageID, text, opts)
+	if err != nil && opts.ButtonURL != "" && isTelegramBadRequest(err) {
+		// Captions inside media groups can't carry a keyboard.
+		opts.ButtonURL = ""
+		_, err = s.editTelegramMessageCaption(ctx, chatID, messageID, text, opts)
+	}
+	if err == nil || isTelegramMessageNotModified(err) {
 		return true, nil
 	} else if isTelegramBadRequest(err) {
 		return false, nil
-	} else {
-		return false, err
-	}
-}
-
-func (s *wallSyncer) publishTextToTelegram(ctx context.Context, text string) (telegramMessage, error) {
-	time.Sleep(5 * time.Second)
-	params := url.Values{}
-	params.Set("chat_id", s.cfg.ChannelID)
-	params.Set("text", text)
-	params.Set("disable_web_page_preview", "false")
-	if s.cfg.ThreadID != "" {
-		params.Set("message_thread_id", s.cfg.ThreadID)
+	} else {
+		return false, err
 	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(telegramSendURLFmt, s.cfg.BotToken), strings.NewReader(params.Encode()))
-	if err != nil {
-		return telegramMessage{}, fmt.Errorf("build Telegram request: %w", err)
+func (s *wallSyncer) publishTextToTelegram(ctx context.Context, text string, opts telegramSendOptions) (telegramMessage, error) {
+	if err := s.throttle(ctx); err != nil {
+		return telegramMessage{}, err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := s.httpClient.Do(req)
+	params := s.newSendParams()
+	text, err := setRenderedText(params, "text", "entities", text)
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("execute Telegram request: %w", err)
+		return telegramMessage{}, err
 	}
-	defer resp.Body.Close()
+	params.Set("disable_web_page_preview", strconv.FormatBool(opts.DisablePreview))
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return telegramMessage{}, fmt.Errorf("read Telegram response: %w", err)
+	if err := opts.apply(params); err != nil {
+		return telegramMessage{}, err
 	}
 
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-		return telegramMessage{}, fmt.Errorf("telegram API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	body, err := s.callTelegram(ctx, "sendMessage", params)
+	if err != nil {
+		return telegramMessage{}, err
 	}
 
 	msg, err := parseTelegramSendResponse(body)
@@ -367,37 +2465,26 @@ func (s *wallSyncer) publishTextToTelegram(ctx context.Context, text string) (te
 	return msg, nil
 }
 
-func (s *wallSyncer) publishPhotoToTelegram(ctx context.Context, photoURL, caption string) (telegramMessage, error) {
-	time.Sleep(5 * time.Second)
-	params := url.Values{}
-	params.Set("chat_id", s.cfg.ChannelID)
+func (s *wallSyncer) publishPhotoToTelegram(ctx context.Context, photoURL, caption string, opts telegramSendOptions) (telegramMessage, error) {
+	if err := s.throttle(ctx); err != nil {
+		return telegramMessage{}, err
+	}
+	params := s.newSendParams()
 	params.Set("photo", photoURL)
 	if caption != "" {
-		params.Set("caption", caption)
-	}
-	if s.cfg.ThreadID != "" {
-		params.Set("message_thread_id", s.cfg.ThreadID)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(telegramSendPhotoURLFmt, s.cfg.BotToken), strings.NewReader(params.Encode()))
-	if err != nil {
-		return telegramMessage{}, fmt.Errorf("build Telegram request: %w", err)
+		var err error
+		if caption, err = setRenderedText(params, "caption", "caption_entities", caption); err != nil {
+			return telegramMessage{}, err
+		}
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return telegramMessage{}, fmt.Errorf("execute Telegram request: %w", err)
+	if err := opts.apply(params); err != nil {
+		return telegramMessage{}, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := s.callTelegram(ctx, "sendPhoto", params)
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("read Telegram response: %w", err)
-	}
-
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-		return telegramMessage{}, fmt.Errorf("telegram API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return telegramMessage{}, err
 	}
 
 	msg, err := parseTelegramSendResponse(body)
@@ -408,17 +2495,19 @@ func (s *wallSyncer) publishPhotoToTelegram(ctx context.Context, photoURL, capti
 	return msg, nil
 }
 
-func (s *wallSyncer) publishMediaGroupToTelegram(ctx context.Context, photoURLs []string, caption string) ([]telegramMessage, error) {
-	time.Sleep(5 * time.Second)
+func (s *wallSyncer) publishMediaGroupToTelegram(ctx context.Context, items []telegramMedia, caption string, opts telegramSendOptions) ([]telegramMessage, error) {
+	if err := s.throttle(ctx); err != nil {
+		return nil, err
+	}
 
-	media := make([]telegramInputMediaPhoto, 0, len(photoURLs))
-	for idx, url := range photoURLs {
-		item := telegramInputMediaPhoto{
-			Type:  "photo",
-			Media: url,
+	media := make([]telegramInputMedia, 0, len(items))
+	for idx, mediaItem := range items {
+		item := telegramInputMedia{
+			Type:  mediaItem.Type,
+			Media: mediaItem.URL,
 		}
 		if idx == 0 && caption != "" {
-			item.Caption = caption
+			item.Caption, item.CaptionEntities = renderVKText(caption)
 		}
 		media = append(media, item)
 	}
@@ -432,125 +2521,203 @@ func (s *wallSyncer) publishMediaGroupToTelegram(ctx context.Context, photoURLs
 		return nil, fmt.Errorf("encode media group payload: %w", err)
 	}
 
-	params := url.Values{}
-	params.Set("chat_id", s.cfg.ChannelID)
+	params := s.newSendParams()
 	params.Set("media", string(mediaPayload))
-	if s.cfg.ThreadID != "" {
-		params.Set("message_thread_id", s.cfg.ThreadID)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(telegramSendMediaGroupURLFmt, s.cfg.BotToken), strings.NewReader(params.Encode()))
-	if err != nil {
-		return nil, fmt.Errorf("build Telegram media group request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("execute Telegram media group request: %w", err)
+	opts.ButtonURL = ""
+	if err := opts.apply(params); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := s.callTelegram(ctx, "sendMediaGroup", params)
 	if err != nil {
-		return nil, fmt.Errorf("read Telegram media group response: %w", err)
-	}
-
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-		return nil, fmt.Errorf("telegram API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return nil, err
 	}
 
 	msgs, err := parseTelegramSendMediaGroupResponse(body)
 	if err != nil {
 		return nil, err
 	}
+	if len(msgs) != len(items) {
+		// Every returned id is still recorded; the lowest one is the head
+		// message carrying the caption, which edits look for.
+		s.logger.Warn().
+			Int("media_items", len(items)).
+			Int("messages", len(msgs)).
+			Msg("Telegram returned a different number of messages than media items sent")
+		slices.SortFunc(msgs, func(a, b telegramMessage) int { return cmp.Compare(a.ID, b.ID) })
+	}
 	if caption != "" && len(msgs) > 0 {
 		msgs[0].Text = caption
 	}
 	return msgs, nil
 }
 
-func (s *wallSyncer) editTelegramMessageText(ctx context.Context, chatID string, messageID int64, text string) (telegramMessage, error) {
+func (s *wallSyncer) editTelegramMessageText(ctx context.Context, chatID string, messageID int64, text string, opts telegramSendOptions) (telegramMessage, error) {
 	params := url.Values{}
 	params.Set("chat_id", chatID)
 	params.Set("message_id", fmt.Sprintf("%d", messageID))
-	params.Set("text", text)
-	params.Set("disable_web_page_preview", "false")
+	text, err := setRenderedText(params, "text", "entities", text)
+	if err != nil {
+		return telegramMessage{}, err
+	}
+	params.Set("disable_web_page_preview", strconv.FormatBool(opts.DisablePreview))
 	if s.cfg.ThreadID != "" {
 		params.Set("message_thread_id", s.cfg.ThreadID)
 	}
+	if err := opts.apply(params); err != nil {
+		return telegramMessage{}, err
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(telegramEditTextURLFmt, s.cfg.BotToken), strings.NewReader(params.Encode()))
+	body, err := s.callTelegram(ctx, "editMessageText", params)
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("build Telegram edit text request: %w", err)
+		return telegramMessage{}, err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := s.httpClient.Do(req)
+	msg, err := parseTelegramSendResponse(body)
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("execute Telegram edit text request: %w", err)
+		return telegramMessage{}, err
 	}
-	defer resp.Body.Close()
+	msg.Text = text
+	return msg, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+func (s *wallSyncer) editTelegramMessageCaption(ctx context.Context, chatID string, messageID int64, caption string, opts telegramSendOptions) (telegramMessage, error) {
+	params := url.Values{}
+	params.Set("chat_id", chatID)
+	params.Set("message_id", fmt.Sprintf("%d", messageID))
+	caption, err := setRenderedText(params, "caption", "caption_entities", caption)
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("read Telegram edit text response: %w", err)
+		return telegramMessage{}, err
 	}
-
-	if resp.StatusCode == http.StatusBadRequest {
-		return telegramMessage{}, &telegramAPIError{Code: http.StatusBadRequest, Description: strings.TrimSpace(string(body))}
+	if s.cfg.ThreadID != "" {
+		params.Set("message_thread_id", s.cfg.ThreadID)
 	}
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-		return telegramMessage{}, fmt.Errorf("telegram API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if err := opts.apply(params); err != nil {
+		return telegramMessage{}, err
+	}
+
+	body, err := s.callTelegram(ctx, "editMessageCaption", params)
+	if err != nil {
+		return telegramMessage{}, err
 	}
 
 	msg, err := parseTelegramSendResponse(body)
 	if err != nil {
 		return telegramMessage{}, err
 	}
-	msg.Text = text
+	msg.Text = caption
 	return msg, nil
 }
 
-func (s *wallSyncer) editTelegramMessageCaption(ctx context.Context, chatID string, messageID int64, caption string) (telegramMessage, error) {
+func (s *wallSyncer) setTelegramReaction(ctx context.Context, chatID string, messageID int64, emoji string) error {
+	payload, err := json.Marshal([]map[string]string{{"type": "emoji", "emoji": emoji}})
+	if err != nil {
+		return fmt.Errorf("encode reactions: %w", err)
+	}
+
 	params := url.Values{}
 	params.Set("chat_id", chatID)
-	params.Set("message_id", fmt.Sprintf("%d", messageID))
-	params.Set("caption", caption)
+	params.Set("message_id", strconv.FormatInt(messageID, 10))
+	params.Set("reaction", string(payload))
+
+	_, err = s.callTelegram(ctx, "setMessageReaction", params)
+	return err
+}
+
+func (s *wallSyncer) newSendParams() url.Values {
+	params := url.Values{}
+	params.Set("chat_id", s.cfg.ChannelID)
 	if s.cfg.ThreadID != "" {
 		params.Set("message_thread_id", s.cfg.ThreadID)
 	}
+	if s.cfg.DisableNotification {
+		params.Set("disable_notification", "true")
+	}
+	if s.cfg.ProtectContent {
+		params.Set("protect_content", "true")
+	}
+	return params
+}
+
+type telegramSendOptions struct {
+	ReplyToMessageID int64
+	// ButtonURL adds a "View on VK" inline button. Media groups can't carry
+	// reply markup, so it is dropped there and publishPost sends the button
+	// in a follow-up message.
+	ButtonURL string
+	// DisablePreview turns off the link preview of text messages.
+	DisablePreview bool
+}
+
+func (o telegramSendOptions) apply(params url.Values) error {
+	if o.ReplyToMessageID != 0 {
+		replyParams, err := json.Marshal(map[string]any{
+			"message_id":                  o.ReplyToMessageID,
+			"allow_sending_without_reply": true,
+		})
+		if err != nil {
+			return fmt.Errorf("encode reply parameters: %w", err)
+		}
+		params.Set("reply_parameters", string(replyParams))
+	}
+	if o.ButtonURL != "" {
+		markup, err := json.Marshal(map[string]any{
+			"inline_keyboard": [][]map[string]string{{{"text": "View on VK", "url": o.ButtonURL}}},
+		})
+		if err != nil {
+			return fmt.Errorf("encode reply markup: %w", err)
+		}
+		params.Set("reply_markup", string(markup))
+	}
+	return nil
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(telegramEditCaptionURLFmt, s.cfg.BotToken), strings.NewReader(params.Encode()))
+func (s *wallSyncer) callTelegram(ctx context.Context, method string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/bot%s/%s", s.cfg.TGAPIBase, s.cfg.BotToken, method), strings.NewReader(params.Encode()))
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("build Telegram edit caption request: %w", err)
+		return nil, fmt.Errorf("build Telegram %s request: %w", method, err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
+	var wrote atomic.Bool
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { wrote.Store(true) },
+	}))
+
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("execute Telegram edit caption request: %w", err)
+		if !wrote.Load() {
+			return nil, fmt.Errorf("execute Telegram %s request: %w: %w", method, errTelegramNotSent, err)
+		}
+		return nil, fmt.Errorf("execute Telegram %s request: %w", method, err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return telegramMessage{}, fmt.Errorf("read Telegram edit caption response: %w", err)
+		return nil, fmt.Errorf("read Telegram %s response: %w", method, err)
 	}
 
-	if resp.StatusCode == http.StatusBadRequest {
-		return telegramMessage{}, &telegramAPIError{Code: http.StatusBadRequest, Description: strings.TrimSpace(string(body))}
-	}
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-		return telegramMessage{}, fmt.Errorf("telegram API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		apiErr := &telegramAPIError{
+			Code:        resp.StatusCode,
+			Description: strings.TrimSpace(string(body)),
+		}
+		var env telegramResponseEnvelope
+		if err := json.Unmarshal(body, &env); err == nil {
+			if env.Description != "" {
+				apiErr.Description = env.Description
+			}
+			apiErr.RetryAfter = env.Parameters.RetryAfter
+		}
+		if apiErr.Code == http.StatusTooManyRequests {
+			s.deferSends(ctx, time.Duration(max(apiErr.RetryAfter, 1))*time.Second)
+		}
+		return nil, apiErr
 	}
 
-	msg, err := parseTelegramSendResponse(body)
-	if err != nil {
-		return telegramMessage{}, err
-	}
-	msg.Text = caption
-	return msg, nil
+	return body, nil
 }
 
 func isTelegramBadRequest(err error) bool {
@@ -561,12 +2728,144 @@ func isTelegramBadRequest(err error) bool {
 	return false
 }
 
+func (s *wallSyncer) throttle(ctx context.Context) error {
+	wait := telegramSendInterval
+	if until := time.Until(s.sendAfter); until > wait {
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(until).After(deadline) {
+			return fmt.Errorf("%w until %s", errTelegramRateLimited, s.sendAfter.UTC().Format(time.RFC3339))
+		}
+		wait = until
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", errTelegramRateLimited, ctx.Err())
+	}
+}
+
+func (s *wallSyncer) deferSends(ctx context.Context, delay time.Duration) {
+	sendAfter := time.Now().Add(delay)
+	if !sendAfter.After(s.sendAfter) {
+		return
+	}
+	s.sendAfter = sendAfter
+
+	s.logger.Warn().
+		Dur("retry_after", delay).
+		Time("send_after", sendAfter).
+		Msg("Telegram flood limit hit, deferring sends")
+
+	if err := s.store.SetSyncState(ctx, syncStateTelegramSendAfter, sendAfter.UTC().Format(time.RFC3339)); err != nil {
+		s.logger.Error().
+			Err(err).
+			Msg("failed to persist Telegram send_after")
+	}
+}
+
+func (s *wallSyncer) restoreSendAfter(ctx context.Context) {
+	raw, ok, err := s.store.GetSyncState(ctx, syncStateTelegramSendAfter)
+	if err != nil {
+		s.logger.Error().
+			Err(err).
+			Msg("failed to load Telegram send_after")
+		return
+	}
+	if !ok {
+		return
+	}
+	sendAfter, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		s.logger.Warn().
+			Err(err).
+			Str("value", raw).
+			Msg("ignoring malformed Telegram send_after")
+		return
+	}
+	if sendAfter.After(time.Now()) {
+		s.sendAfter = sendAfter
+		s.logger.Info().
+			Time("send_after", sendAfter).
+			Msg("restored Telegram flood limit, deferring sends")
+	}
+}
+
+func isTelegramMessageNotModified(err error) bool {
+	var apiErr *telegramAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusBadRequest && strings.Contains(apiErr.Description, "message is not modified")
+	}
+	return false
+}
+
+// isTelegramDeliveryUncertain reports whether a failed send may still have
+// reached Telegram. Only errors after the request was written qualify; a
+// deadline hit while waiting or dialing means nothing was sent.
+func isTelegramDeliveryUncertain(err error) bool {
+	var apiErr *telegramAPIError
+	if errors.As(err, &apiErr) || errors.Is(err, errTelegramRateLimited) || errors.Is(err, errTelegramNotSent) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	return true
+}
+
+func isTelegramChatUnavailable(err error) bool {
+	var apiErr *telegramAPIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusForbidden {
+		return true
+	}
+	return apiErr.Code == http.StatusBadRequest && strings.Contains(strings.ToLower(apiErr.Description), "chat not found")
+}
+
 type vkPost struct {
 	ID          int            `json:"id"`
 	OwnerID     int            `json:"owner_id"`
+	FromID      int            `json:"from_id"`
+	PostType    string         `json:"post_type"`
 	Text        string         `json:"text"`
+	Date        int64          `json:"date"`
 	Hash        string         `json:"hash"`
 	Attachments []vkAttachment `json:"attachments"`
+	CopyHistory []vkPost       `json:"copy_history"`
+	IsDeleted   bool           `json:"is_deleted"`
+	Donut       struct {
+		IsDonut bool `json:"is_donut"`
+	} `json:"donut"`
+	Comments struct {
+		Count int `json:"count"`
+	} `json:"comments"`
+}
+
+// UnmarshalJSON accepts the numeric identifiers VK occasionally sends as
+// quoted strings.
+func (p *vkPost) UnmarshalJSON(data []byte) error {
+	type plain vkPost
+	var aux struct {
+		plain
+		ID      vkFlexInt `json:"id"`
+		OwnerID vkFlexInt `json:"owner_id"`
+		FromID  vkFlexInt `json:"from_id"`
+		Date    vkFlexInt `json:"date"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*p = vkPost(aux.plain)
+	p.ID = int(aux.ID)
+	p.OwnerID = int(aux.OwnerID)
+	p.FromID = int(aux.FromID)
+	p.Date = int64(aux.Date)
+	return nil
 }
 
 type telegramMessagePayload struct {
@@ -578,24 +2877,116 @@ type telegramMessage struct {
 	ID          int64
 	Text        string
 	PublishedAt time.Time
+	// Step is the publishPost step that sent the message.
+	Step int
 }
 
 type vkWallResponse struct {
-	Response struct {
-		Items []vkPost `json:"items"`
-	} `json:"response"`
-	Error struct {
-		Code int    `json:"error_code"`
-		Msg  string `json:"error_msg"`
-	} `json:"error"`
+	Items    []vkPost    `json:"items"`
+	Profiles []vkProfile `json:"profiles"`
+	Groups   []vkGroup   `json:"groups"`
+	// Skipped holds decode errors of items that were dropped from Items.
+	Skipped []error `json:"-"`
+}
+
+// UnmarshalJSON decodes items one by one so a single malformed post does not
+// fail the whole response.
+func (r *vkWallResponse) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Items    []json.RawMessage `json:"items"`
+		Profiles []vkProfile       `json:"profiles"`
+		Groups   []vkGroup         `json:"groups"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*r = vkWallResponse{Profiles: raw.Profiles, Groups: raw.Groups}
+	for idx, item := range raw.Items {
+		var post vkPost
+		if err := json.Unmarshal(item, &post); err != nil {
+			r.Skipped = append(r.Skipped, fmt.Errorf("item %d: %w", idx, err))
+			continue
+		}
+		r.Items = append(r.Items, post)
+	}
+	return nil
+}
+
+func (s *wallSyncer) warnSkippedItems(method string, result vkWallResponse) {
+	for _, err := range result.Skipped {
+		s.logger.Warn().Err(err).Str("method", method).Msg("skipping malformed VK post")
+	}
+}
+
+type vkAPIError struct {
+	Code int    `json:"error_code"`
+	Msg  string `json:"error_msg"`
+}
+
+func (e *vkAPIError) Error() string {
+	return fmt.Sprintf("vk api error %d: %s", e.Code, e.Msg)
+}
+
+const (
+	vkErrorAccessDenied  = 15
+	vkErrorGroupNoAccess = 203
+)
+
+func isVKAccessDenied(err error) bool {
+	var apiErr *vkAPIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == vkErrorAccessDenied || apiErr.Code == vkErrorGroupNoAccess
 }
 
 type vkAttachment struct {
-	Type  string   `json:"type"`
-	Photo *vkPhoto `json:"photo"`
+	Type   string    `json:"type"`
+	Photo  *vkPhoto  `json:"photo"`
+	Album  *vkAlbum  `json:"album"`
+	Video  *vkVideo  `json:"video"`
+	Market *vkMarket `json:"market"`
+	Story  *vkStory  `json:"story"`
+	Link   *vkLink   `json:"link"`
+	Poll   *vkPoll   `json:"poll"`
+
+	// Index is the attachment's position in the VK response.
+	Index int `json:"-"`
+}
+
+type vkLink struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
+
+type vkAlbum struct {
+	ID      vkFlexInt `json:"id"`
+	OwnerID vkFlexInt `json:"owner_id"`
+	Size    int       `json:"size"`
+	Thumb   *vkPhoto  `json:"thumb"`
+	Photos  []vkPhoto `json:"-"`
+}
+
+// vkFlexInt decodes integers that VK sometimes sends as quoted strings.
+type vkFlexInt int
+
+func (v *vkFlexInt) UnmarshalJSON(data []byte) error {
+	raw := strings.Trim(string(data), `"`)
+	if raw == "" || raw == "null" {
+		*v = 0
+		return nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return fmt.Errorf("decode VK integer %s: %w", data, err)
+	}
+	*v = vkFlexInt(n)
+	return nil
 }
 
 type vkPhoto struct {
+	ID    int           `json:"id"`
 	Sizes []vkPhotoSize `json:"sizes"`
 }
 
@@ -606,23 +2997,58 @@ type vkPhotoSize struct {
 	Type   string `json:"type"`
 }
 
-func selectLargestPhotoURL(sizes []vkPhotoSize) (string, bool) {
-	if len(sizes) == 0 {
-		return "", false
+var vkPhotoSizeTypeDimensions = map[string]int{
+	"w": 2560,
+	"z": 1280,
+	"y": 807,
+	"x": 604,
+	"r": 510,
+	"q": 320,
+	"p": 200,
+	"m": 130,
+	"o": 130,
+	"s": 75,
+}
+
+func (s vkPhotoSize) dimension() int {
+	if s.Width > 0 && s.Height > 0 {
+		return max(s.Width, s.Height)
 	}
+	return vkPhotoSizeTypeDimensions[s.Type]
+}
 
-	best := sizes[0]
-	bestArea := best.Width * best.Height
+func (s vkPhotoSize) area() int {
+	if s.Width > 0 && s.Height > 0 {
+		return s.Width * s.Height
+	}
+	d := vkPhotoSizeTypeDimensions[s.Type]
+	return d * d
+}
 
-	for _, size := range sizes[1:] {
-		area := size.Width * size.Height
-		if area > bestArea {
+func selectLargestPhotoURL(sizes []vkPhotoSize, maxDimension int) (string, bool) {
+	var (
+		best     *vkPhotoSize
+		smallest *vkPhotoSize
+	)
+	for i := range sizes {
+		size := &sizes[i]
+		if size.URL == "" {
+			continue
+		}
+		if maxDimension > 0 && size.dimension() > maxDimension {
+			if smallest == nil || size.area() < smallest.area() {
+				smallest = size
+			}
+			continue
+		}
+		if best == nil || size.area() > best.area() {
 			best = size
-			bestArea = area
 		}
 	}
-
-	if best.URL == "" {
+	if best == nil {
+		best = smallest
+	}
+	if best == nil {
 		return "", false
 	}
 
@@ -634,17 +3060,27 @@ type telegramResponseEnvelope struct {
 	Result      json.RawMessage `json:"result"`
 	Description string          `json:"description"`
 	ErrorCode   int             `json:"error_code"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+type telegramInputMedia struct {
+	Type            string           `json:"type"`
+	Media           string           `json:"media"`
+	Caption         string           `json:"caption,omitempty"`
+	CaptionEntities []telegramEntity `json:"caption_entities,omitempty"`
 }
 
-type telegramInputMediaPhoto struct {
-	Type    string `json:"type"`
-	Media   string `json:"media"`
-	Caption string `json:"caption,omitempty"`
+type telegramMedia struct {
+	Type string
+	URL  string
 }
 
 type telegramAPIError struct {
 	Code        int
 	Description string
+	RetryAfter  int
 }
 
 func (e *telegramAPIError) Error() string {
@@ -736,15 +3172,150 @@ func telegramMessageFromPayload(payload telegramMessagePayload) (telegramMessage
 	}, nil
 }
 
-func photoAttachmentURLs(post vkPost) []string {
+func photoAttachmentURLs(post vkPost, maxDimension int) []string {
 	urls := make([]string, 0, len(post.Attachments))
 	for _, att := range post.Attachments {
-		if att.Type != "photo" || att.Photo == nil {
-			continue
+		switch {
+		case att.Type == "photo" && att.Photo != nil:
+			if url, ok := selectLargestPhotoURL(att.Photo.Sizes, maxDimension); ok {
+				urls = append(urls, url)
+			}
+		case att.Type == "album" && att.Album != nil:
+			photos := att.Album.Photos
+			if len(photos) == 0 && att.Album.Thumb != nil {
+				photos = []vkPhoto{*att.Album.Thumb}
+			}
+			if len(photos) > telegramMediaGroupLimit {
+				photos = photos[:telegramMediaGroupLimit]
+			}
+			for _, photo := range photos {
+				if url, ok := selectLargestPhotoURL(photo.Sizes, maxDimension); ok {
+					urls = append(urls, url)
+				}
+			}
+		case att.Type == "market" && att.Market != nil:
+			if att.Market.ThumbPhoto != "" {
+				urls = append(urls, att.Market.ThumbPhoto)
+			}
+		case att.Type == "story" && att.Story != nil && att.Story.available() && att.Story.Photo != nil:
+			if url, ok := selectLargestPhotoURL(att.Story.Photo.Sizes, maxDimension); ok {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// postLooksIncomplete reports posts VK returned while they were being edited:
+// a hash but neither text, attachments nor reposted content.
+func postLooksIncomplete(post vkPost) bool {
+	return post.Hash != "" &&
+		strings.TrimSpace(post.Text) == "" &&
+		len(post.Attachments) == 0 &&
+		len(post.CopyHistory) == 0
+}
+
+// postHasMedia reports whether publishPost sends any media for post. Media
+// of reposted posts isn't published, so it doesn't count.
+func postHasMedia(post vkPost) bool {
+	return len(postMedia(post, 0)) > 0
+}
+
+func postMedia(post vkPost, maxDimension int) []telegramMedia {
+	var media []telegramMedia
+	for _, att := range post.Attachments {
+		switch {
+		case att.Type == "video" && att.Video != nil:
+			if att.Video.FileURL != "" {
+				media = append(media, telegramMedia{Type: "video", URL: att.Video.FileURL})
+			}
+		case att.Type == "story" && att.Story != nil:
+			if item, ok := storyMedia(*att.Story, maxDimension); ok {
+				media = append(media, item)
+			}
+		default:
+			for _, photoURL := range photoAttachmentURLs(vkPost{Attachments: []vkAttachment{att}}, maxDimension) {
+				media = append(media, telegramMedia{Type: "photo", URL: photoURL})
+			}
 		}
-		if url, ok := selectLargestPhotoURL(att.Photo.Sizes); ok {
-			urls = append(urls, url)
+	}
+	return media
+}
+
+func chunkSlice[T any](items []T, size int) [][]T {
+	var chunks [][]T
+	for len(items) > size {
+		chunks = append(chunks, items[:size])
+		items = items[size:]
+	}
+	if len(items) > 0 {
+		chunks = append(chunks, items)
+	}
+	return chunks
+}
+
+// attachmentURLs lists what a post links to: its photos, then stable VK links
+// for videos and stories. Video file URLs are signed and expire, so they are
+// not recorded.
+func attachmentURLs(post vkPost, photoURLs []string) []string {
+	urls := slices.Clone(photoURLs)
+	for _, att := range post.Attachments {
+		switch {
+		case att.Type == "video" && att.Video != nil:
+			urls = append(urls, att.Video.link())
+		case att.Type == "story" && att.Story != nil && att.Story.available():
+			urls = append(urls, att.Story.link())
 		}
 	}
 	return urls
 }
+
+func mediaHash(photoURLs []string) string {
+	if len(photoURLs) == 0 {
+		return ""
+	}
+	return postContentHash("", photoURLs)
+}
+
+// contentKeys identifies the attachments of the post for postContentHash:
+// the photo, video and story links plus reposted posts, polls, links,
+// albums and market items.
+func contentKeys(post vkPost, photoURLs []string) []string {
+	keys := attachmentURLs(post, photoURLs)
+	for _, att := range post.Attachments {
+		switch {
+		case att.Type == "link" && att.Link != nil:
+			keys = append(keys, att.Link.URL)
+		case att.Type == "poll" && att.Poll != nil:
+			keys = append(keys, fmt.Sprintf("poll%d_%d", att.Poll.OwnerID, att.Poll.ID))
+		case att.Type == "album" && att.Album != nil:
+			keys = append(keys, fmt.Sprintf("album%d_%d", att.Album.OwnerID, att.Album.ID))
+		case att.Type == "market" && att.Market != nil:
+			keys = append(keys, att.Market.link())
+		}
+	}
+	for _, repost := range post.CopyHistory {
+		keys = append(keys, fmt.Sprintf("wall%d_%d", repost.OwnerID, repost.ID))
+	}
+	return keys
+}
+
+// postContentHash hashes the text and attachment keys of a post, ignoring
+// URL query strings. It returns "" when there is nothing to hash, e.g. for
+// audio-only posts, so such posts are never taken for duplicates.
+func postContentHash(text string, keys []string) string {
+	text = strings.TrimSpace(text)
+	if text == "" && len(keys) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	io.WriteString(h, text)
+	for _, key := range keys {
+		if u, err := url.Parse(key); err == nil && u.Host != "" {
+			key = u.Host + u.Path
+		}
+		io.WriteString(h, "\n")
+		io.WriteString(h, key)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,1992 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeTelegram is a Bot API server that keeps the messages it was sent, so
+// tests can check what ended up in each channel.
+type fakeTelegram struct {
+	mu       sync.Mutex
+	nextID   int64
+	messages map[string]string
+	calls    []string
+	// forms holds the last request form of each "method chat" call.
+	forms map[string]url.Values
+	// media holds the photo or video URL of each message with media.
+	media map[string]string
+	// badMedia lists media URLs Telegram refuses to fetch.
+	badMedia map[string]bool
+	// fail, when set, may answer a call with an error and report true.
+	fail func(w http.ResponseWriter, method, chatID string) bool
+	// dropResponses is the number of sendMessage calls that deliver the
+	// message but lose the response.
+	dropResponses int
+}
+
+func newFakeTelegram(t *testing.T) (*fakeTelegram, *httptest.Server) {
+	tg := &fakeTelegram{
+		messages: make(map[string]string),
+		forms:    make(map[string]url.Values),
+		media:    make(map[string]string),
+		badMedia: make(map[string]bool),
+	}
+	server := httptest.NewServer(http.HandlerFunc(tg.serve))
+	t.Cleanup(server.Close)
+	return tg, server
+}
+
+func (f *fakeTelegram) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	chatID := r.Form.Get("chat_id")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, method+" "+chatID)
+	f.forms[method+" "+chatID] = r.Form
+	if f.fail != nil && f.fail(w, method, chatID) {
+		return
+	}
+
+	switch method {
+	case "sendMessage":
+		f.nextID++
+		f.messages[fmt.Sprintf("%s/%d", chatID, f.nextID)] = r.Form.Get("text")
+		if f.dropResponses > 0 {
+			f.dropResponses--
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		writeFakeMessage(w, f.nextID)
+	case "sendPoll":
+		f.nextID++
+		f.messages[fmt.Sprintf("%s/%d", chatID, f.nextID)] = r.Form.Get("question")
+		writeFakeMessage(w, f.nextID)
+	case "sendPhoto", "sendVideo":
+		media := r.Form.Get("photo") + r.Form.Get("video")
+		if f.badMedia[media] {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: wrong file identifier/HTTP URL specified"}`)
+			return
+		}
+		f.nextID++
+		key := fmt.Sprintf("%s/%d", chatID, f.nextID)
+		f.messages[key] = r.Form.Get("caption")
+		f.media[key] = media
+		writeFakeMessage(w, f.nextID)
+	case "sendMediaGroup":
+		var items []telegramInputMedia
+		if err := json.Unmarshal([]byte(r.Form.Get("media")), &items); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, item := range items {
+			if f.badMedia[item.Media] {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"ok":false,"error_code":400,"description":"Bad Request: failed to send message #%d with the error message \"WEBPAGE_MEDIA_EMPTY\""}`, i+1)
+				return
+			}
+		}
+		result := make([]map[string]int64, 0, len(items))
+		for _, item := range items {
+			f.nextID++
+			key := fmt.Sprintf("%s/%d", chatID, f.nextID)
+			f.messages[key] = item.Caption
+			f.media[key] = item.Media
+			result = append(result, map[string]int64{"message_id": f.nextID, "date": time.Now().Unix()})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+	case "forwardMessage":
+		from := r.Form.Get("from_chat_id") + "/" + r.Form.Get("message_id")
+		text, ok := f.messages[from]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: message to forward not found"}`)
+			return
+		}
+		f.nextID++
+		f.messages[fmt.Sprintf("%s/%d", chatID, f.nextID)] = text
+		field := "text"
+		if f.media[from] != "" {
+			field = "caption"
+		}
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": map[string]any{"message_id": f.nextID, "date": time.Now().Unix(), field: text}})
+	case "editMessageText", "editMessageCaption", "editMessageReplyMarkup":
+		key := chatID + "/" + r.Form.Get("message_id")
+		if _, ok := f.messages[key]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: message to edit not found"}`)
+			return
+		}
+		switch {
+		case method == "editMessageText" && f.media[key] != "":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: there is no text in the message to edit"}`)
+			return
+		case method == "editMessageCaption" && f.media[key] == "":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: there is no caption in the message to edit"}`)
+			return
+		case method == "editMessageText":
+			f.messages[key] = r.Form.Get("text")
+		case method == "editMessageCaption":
+			f.messages[key] = r.Form.Get("caption")
+		}
+		id, _ := strconv.ParseInt(r.Form.Get("message_id"), 10, 64)
+		writeFakeMessage(w, id)
+	default:
+		fmt.Fprint(w, `{"ok":true,"result":true}`)
+	}
+}
+
+func writeFakeMessage(w http.ResponseWriter, id int64) {
+	fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"date":%d}}`, id, time.Now().Unix())
+}
+
+func (f *fakeTelegram) countCalls(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeTelegram) message(chatID string, id int64) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	text, ok := f.messages[fmt.Sprintf("%s/%d", chatID, id)]
+	return text, ok
+}
+
+// fakeVK serves wall.get and wall.getById from posts, video.get from videos
+// and groups.getById from groupName, counting the calls of each method.
+// Extended wall.get answers carry profiles.
+type fakeVK struct {
+	mu    sync.Mutex
+	posts []vkPost
+	// fullPosts, when set, answers wall.getById instead of posts.
+	fullPosts []vkPost
+	profiles  []vkProfile
+	// wallError, when set, fails wall.get with this VK API error.
+	wallError *vkAPIError
+	videos    []vkVideo
+	groupName string
+	calls     map[string]int
+}
+
+func newFakeVK(t *testing.T, posts ...vkPost) (*fakeVK, *httptest.Server) {
+	vk := &fakeVK{posts: posts, calls: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vk.mu.Lock()
+		defer vk.mu.Unlock()
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		vk.calls[method]++
+		switch method {
+		case "wall.get":
+			if vk.wallError != nil {
+				json.NewEncoder(w).Encode(map[string]any{"error": vk.wallError})
+				return
+			}
+			response := map[string]any{"items": vk.posts}
+			if r.FormValue("extended") == "1" {
+				response["profiles"] = vk.profiles
+			}
+			json.NewEncoder(w).Encode(map[string]any{"response": response})
+		case "wall.getById":
+			source := vk.posts
+			if vk.fullPosts != nil {
+				source = vk.fullPosts
+			}
+			var items []vkPost
+			for _, id := range strings.Split(r.FormValue("posts"), ",") {
+				for _, post := range source {
+					if fmt.Sprintf("%d_%d", post.OwnerID, post.ID) == id {
+						items = append(items, post)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"response": map[string]any{"items": items}})
+		case "video.get":
+			json.NewEncoder(w).Encode(map[string]any{"response": map[string]any{"items": vk.videos}})
+		case "groups.getById":
+			json.NewEncoder(w).Encode(map[string]any{"response": map[string]any{"groups": []map[string]string{{"name": vk.groupName}}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return vk, server
+}
+
+func (v *fakeVK) setPosts(posts ...vkPost) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.posts = posts
+}
+
+func newTestPost(id int, text string) vkPost {
+	return vkPost{ID: id, OwnerID: -1, Text: text, Date: time.Now().Unix(), Hash: fmt.Sprintf("%d:%s", id, text)}
+}
+
+// newTestMemStore returns a memStore holding a valid VK access token.
+func newTestMemStore() *memStore {
+	store := newMemStore()
+	now := time.Now()
+	store.token = &tokenRecord{
+		payload:   authSuccessPayload{AccessToken: "vk-token", RefreshToken: "refresh", ExpiresIn: 3600},
+		updatedAt: now,
+		expiresAt: now.Add(time.Hour),
+	}
+	return store
+}
+
+// newTestSyncer builds a syncer from env the way main does, talking to the
+// fake servers and keeping its state in store.
+func newTestSyncer(t *testing.T, store *memStore, tg, vk *httptest.Server, env map[string]string) *wallSyncer {
+	t.Helper()
+	t.Setenv("TG_BOT_TOKEN", "token")
+	t.Setenv("TG_CHANNEL_ID", "@test_channel")
+	t.Setenv("VK_GROUP_ID", "1")
+	t.Setenv("TG_API_BASE_URL", tg.URL)
+	t.Setenv("VK_API_BASE_URL", vk.URL)
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	cfg, err := loadWallSyncConfigFromEnv()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	manager := newTokenManager(zerolog.Nop(), store, "http://127.0.0.1:0", "1", time.Minute)
+	return newWallSyncer(zerolog.Nop(), manager, store, newPublishLimiter(1), &vkCallMeter{}, cfg)
+}
+
+func TestSyncPublishesAndEdits(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first version"))
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 || sent[0].ChannelID != "@test_channel" || !sent[0].HasText {
+		t.Fatalf("recorded messages = %+v, want one text message", sent)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "first version") {
+		t.Fatalf("channel message = %q", text)
+	}
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("unchanged cycle: %v", err)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 1 {
+		t.Fatalf("sendMessage calls = %d after an unchanged cycle, want 1", n)
+	}
+
+	vk.setPosts(newTestPost(1, "second version"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("edit cycle: %v", err)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "second version") {
+		t.Fatalf("channel message after edit = %q", text)
+	}
+	latest, _ := store.LatestTelegramPosts(ctx, -1, 1)
+	if len(latest) != 1 || !strings.Contains(latest[0].Text, "second version") {
+		t.Fatalf("stored message after edit = %+v", latest)
+	}
+	if len(store.edits) != 1 || store.edits[0].OldLen != len("first version") {
+		t.Fatalf("edit log = %+v", store.edits)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 1 {
+		t.Fatalf("sendMessage calls = %d after the edit, want 1", n)
+	}
+}
+
+func TestSyncNoDuplicateAfterLostResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		// foreign is sent to the channel by someone else right before the
+		// attempt, which then doesn't reach Telegram at all.
+		foreign    string
+		wantSends  int
+		wantProbes int
+		// wantCopies counts probes that found a message to compare.
+		wantCopies int
+	}{
+		{"delivered", map[string]string{"TG_ADMIN_CHAT_ID": "@admin_chat"}, "", 2, 1, 1},
+		{"only a foreign message", map[string]string{"TG_ADMIN_CHAT_ID": "@admin_chat", "TG_VK_BUTTON": "true"}, "📢 Now mirroring posts from Other Group", 3, publishProbeWindow, 1},
+		{"no admin chat to compare in", nil, "", 3, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			vk, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+			s := newTestSyncer(t, store, tgServer, vkServer, tt.env)
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("first cycle: %v", err)
+			}
+
+			vk.setPosts(newTestPost(1, "first post"), newTestPost(2, "second post"))
+			tg.mu.Lock()
+			if tt.foreign == "" {
+				tg.dropResponses = 1
+			} else {
+				tg.nextID++
+				tg.messages[fmt.Sprintf("@test_channel/%d", tg.nextID)] = tt.foreign
+				tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+					if method != "sendMessage" {
+						return false
+					}
+					tg.fail = nil
+					if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+						conn.Close()
+					}
+					return true
+				}
+			}
+			tg.mu.Unlock()
+			if err := s.runOnce(ctx); err == nil {
+				t.Fatal("cycle with a lost response succeeded, want a failure")
+			}
+			if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 2}); state.Published {
+				t.Fatal("post marked published although the response was lost")
+			}
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("retry cycle: %v", err)
+			}
+			if n := tg.countCalls("sendMessage @test_channel"); n != tt.wantSends {
+				t.Fatalf("sendMessage calls = %d, want %d", n, tt.wantSends)
+			}
+			if n := tg.countCalls("forwardMessage @admin_chat"); n != tt.wantProbes {
+				t.Fatalf("forwardMessage probes = %d, want %d", n, tt.wantProbes)
+			}
+			if n := tg.countCalls("deleteMessage @admin_chat"); n != tt.wantCopies {
+				t.Fatalf("deleted probe copies = %d, want %d", n, tt.wantCopies)
+			}
+			if n := tg.countCalls("editMessageReplyMarkup @test_channel"); n != 0 {
+				t.Fatalf("editMessageReplyMarkup calls = %d, want no probing by editing", n)
+			}
+			if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 2}); !state.Published {
+				t.Fatal("post not marked published")
+			}
+			if len(store.attempts) != 0 {
+				t.Fatalf("publish attempts left = %v", store.attempts)
+			}
+		})
+	}
+}
+
+func TestSyncDeadLettersOnlyClientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		wantDead bool
+	}{
+		{"bad request", http.StatusBadRequest, true},
+		{"server error", http.StatusBadGateway, false},
+		{"rate limited", http.StatusTooManyRequests, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+				w.WriteHeader(tt.code)
+				fmt.Fprintf(w, `{"ok":false,"error_code":%d,"description":"%s"}`, tt.code, http.StatusText(tt.code))
+				return true
+			}
+			_, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_MAX_FAILURES": "2"})
+			ctx := context.Background()
+
+			for i := 0; i < 3; i++ {
+				s.pausedUntil = time.Time{}
+				s.runOnce(ctx)
+			}
+			state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1})
+			if state.DeadLettered != tt.wantDead {
+				t.Fatalf("dead-lettered = %v, want %v", state.DeadLettered, tt.wantDead)
+			}
+		})
+	}
+}
+
+func TestSyncMirrorChannels(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+		if chatID != "@mirror_channel" {
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"ok":false,"error_code":500,"description":"Internal Server Error"}`)
+		return true
+	}
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first version"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_CHANNEL_ID": "@test_channel,@mirror_channel"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 1 || sent[0].ChannelID != "@test_channel" {
+		t.Fatalf("recorded messages = %+v, want only the primary channel", sent)
+	}
+
+	tg.mu.Lock()
+	tg.fail = nil
+	tg.mu.Unlock()
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("retry cycle: %v", err)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 2 {
+		t.Fatalf("recorded messages = %+v, want one per channel", sent)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 1 {
+		t.Fatalf("primary sendMessage calls = %d, want 1", n)
+	}
+
+	vk.setPosts(newTestPost(1, "second version"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("edit cycle: %v", err)
+	}
+	for _, rec := range sent {
+		if text, _ := tg.message(rec.ChannelID, rec.MessageID); !strings.Contains(text, "second version") {
+			t.Fatalf("message in %s after edit = %q", rec.ChannelID, text)
+		}
+	}
+}
+
+func TestSyncLatestOnly(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	failed := false
+	tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+		if failed {
+			return false
+		}
+		failed = true
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"ok":false,"error_code":500,"description":"Internal Server Error"}`)
+		return true
+	}
+	_, vkServer := newFakeVK(t, newTestPost(1, "oldest"), newTestPost(2, "older"), newTestPost(3, "latest"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_LATEST_ONLY": "true", "SYNC_ORDER": "desc"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err == nil {
+		t.Fatal("cycle with a failed send succeeded")
+	}
+	for id := 1; id <= 3; id++ {
+		if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: id}); state.Published {
+			t.Fatalf("post %d marked seen before the latest post was published", id)
+		}
+	}
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	for id := 1; id <= 3; id++ {
+		if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: id}); !state.Published {
+			t.Fatalf("post %d not marked seen after the latest post was published", id)
+		}
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 3); len(sent) != 1 {
+		t.Fatalf("latest post messages = %+v, want one", sent)
+	}
+	for id := 1; id <= 2; id++ {
+		if sent, _ := store.TelegramPosts(ctx, -1, id); len(sent) != 0 {
+			t.Fatalf("older post %d was published: %+v", id, sent)
+		}
+	}
+}
+
+func TestSyncRespectsManualEdits(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first version"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_RESPECT_MANUAL_EDITS": "true"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	store.SetEditLock(-1, 1, true)
+	// The admin's text as the channel shows it, with the post link.
+	store.mu.Lock()
+	store.messages[0].Text = "fixed by hand\n\nhttps://vk.com/wall-1_1"
+	store.mu.Unlock()
+
+	vk.setPosts(newTestPost(1, "second version"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("diverged edit cycle: %v", err)
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 0 {
+		t.Fatalf("editMessageText calls = %d, want the manually edited message left alone", n)
+	}
+	if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1}); state.Hash != newTestPost(1, "second version").Hash {
+		t.Fatalf("stored hash = %q, want the skipped edit recorded", state.Hash)
+	}
+
+	vk.setPosts(newTestPost(1, "fixed by hand"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("caught up edit cycle: %v", err)
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 1 {
+		t.Fatalf("editMessageText calls = %d, want 1 once VK matches the manual text", n)
+	}
+}
+
+func TestSyncPausesWhenChannelUnavailable(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+		if chatID != "@test_channel" {
+			return false
+		}
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"ok":false,"error_code":403,"description":"Forbidden: bot is not a member of the channel chat"}`)
+		return true
+	}
+	_, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_ADMIN_CHAT_ID": "@admin_chat"})
+	ctx := context.Background()
+
+	s.runOnce(ctx)
+	if !s.pausedUntil.After(time.Now()) {
+		t.Fatal("publishing not paused after the channel refused the bot")
+	}
+	if n := tg.countCalls("sendMessage @admin_chat"); n != 1 {
+		t.Fatalf("admin alerts = %d, want 1", n)
+	}
+
+	s.runOnce(ctx)
+	if n := tg.countCalls("sendMessage @test_channel"); n != 1 {
+		t.Fatalf("channel sends = %d, want no retry while paused", n)
+	}
+	if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1}); state.Published {
+		t.Fatal("post marked published although the channel refused it")
+	}
+}
+
+func TestSyncGlobalDedup(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(1, "same text"), newTestPost(2, "same text"), newTestPost(3, "other text"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_GLOBAL_DEDUP": "true"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 2 {
+		t.Fatalf("sendMessage calls = %d, want 2", n)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 2); len(sent) != 0 {
+		t.Fatalf("duplicate post was published: %+v", sent)
+	}
+	if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 2}); !state.Published {
+		t.Fatal("duplicate post not marked seen")
+	}
+}
+
+func TestSyncGlobalDedupWithoutText(t *testing.T) {
+	video := func(id int) []vkAttachment {
+		return []vkAttachment{{Type: "video", Video: &vkVideo{ID: id, OwnerID: -1, Title: "clip"}}}
+	}
+	tests := []struct {
+		name  string
+		posts func(first, second *vkPost)
+	}{
+		{"video-only posts", func(first, second *vkPost) {
+			first.Attachments = video(5)
+			second.Attachments = video(6)
+		}},
+		{"repost-only posts", func(first, second *vkPost) {
+			first.CopyHistory = []vkPost{{ID: 10, OwnerID: -2, Text: "reposted"}}
+			second.CopyHistory = []vkPost{{ID: 11, OwnerID: -2, Text: "reposted"}}
+		}},
+		{"posts with unhashed attachments", func(first, second *vkPost) {
+			first.Attachments = []vkAttachment{{Type: "audio"}}
+			second.Attachments = []vkAttachment{{Type: "audio"}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemStore()
+			_, tgServer := newFakeTelegram(t)
+			first, second := newTestPost(1, ""), newTestPost(2, "")
+			tt.posts(&first, &second)
+			_, vkServer := newFakeVK(t, first, second)
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_GLOBAL_DEDUP": "true"})
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("cycle: %v", err)
+			}
+			for _, id := range []int{1, 2} {
+				if sent, _ := store.TelegramPosts(ctx, -1, id); len(sent) == 0 {
+					t.Fatalf("post %d was not published", id)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncGlobalDedupPerChannel(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "same text"))
+	ctx := context.Background()
+
+	other := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_CHANNEL_ID": "@other_channel"})
+	if err := other.runOnce(ctx); err != nil {
+		t.Fatalf("other channel cycle: %v", err)
+	}
+	vk.setPosts(newTestPost(1, "same text"), newTestPost(2, "same text"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_GLOBAL_DEDUP": "true"})
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 1 {
+		t.Fatalf("sendMessage calls = %d, want 1: a post published to another channel is not a duplicate", n)
+	}
+}
+
+func TestSyncRestoresFloodLimit(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 60","parameters":{"retry_after":60}}`)
+		return true
+	}
+	_, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	ctx := context.Background()
+
+	newTestSyncer(t, store, tgServer, vkServer, nil).runOnce(ctx)
+	raw, ok, _ := store.GetSyncState(ctx, syncStateTelegramSendAfter)
+	if !ok {
+		t.Fatal("send_after not persisted after a flood limit")
+	}
+	if sendAfter, err := time.Parse(time.RFC3339, raw); err != nil || time.Until(sendAfter) < 50*time.Second {
+		t.Fatalf("send_after = %q, want about a minute ahead", raw)
+	}
+
+	tg.mu.Lock()
+	tg.fail = nil
+	tg.mu.Unlock()
+	calls := tg.countCalls("sendMessage @test_channel")
+	restarted := newTestSyncer(t, store, tgServer, vkServer, nil)
+	restarted.runOnce(ctx)
+	if n := tg.countCalls("sendMessage @test_channel"); n != calls {
+		t.Fatalf("sendMessage calls = %d after restart, want none before send_after", n-calls)
+	}
+
+	store.SetSyncState(ctx, syncStateTelegramSendAfter, time.Now().Add(-time.Second).UTC().Format(time.RFC3339))
+	if err := newTestSyncer(t, store, tgServer, vkServer, nil).runOnce(ctx); err != nil {
+		t.Fatalf("cycle after send_after: %v", err)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v, want the post published once send_after passed", sent)
+	}
+}
+
+func TestSyncDecodesEntitiesBeforeHashing(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(1, "Tom &amp; Jerry"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_DECODE_ENTITIES": "true"})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := s.runOnce(ctx); err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.HasPrefix(text, "Tom & Jerry") {
+		t.Fatalf("channel message = %q, want entities decoded", text)
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 0 {
+		t.Fatalf("editMessageText calls = %d, want no edit churn", n)
+	}
+}
+
+func TestSyncDropsRejectedMedia(t *testing.T) {
+	tests := []struct {
+		name      string
+		bad       []string
+		wantMedia []string
+	}{
+		{"one bad photo", []string{"https://vk.example/2.jpg"}, []string{"https://vk.example/1.jpg", "https://vk.example/3.jpg"}},
+		{"every photo bad", []string{"https://vk.example/1.jpg", "https://vk.example/2.jpg", "https://vk.example/3.jpg"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			for _, url := range tt.bad {
+				tg.badMedia[url] = true
+			}
+			post := newTestPost(1, "photo post")
+			for i := 1; i <= 3; i++ {
+				post.Attachments = append(post.Attachments, testPhotoAttachment(i, fmt.Sprintf("https://vk.example/%d.jpg", i)))
+			}
+			_, vkServer := newFakeVK(t, post)
+			s := newTestSyncer(t, store, tgServer, vkServer, nil)
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			sent, _ := store.TelegramPosts(ctx, -1, 1)
+			var (
+				media   []string
+				hasText bool
+			)
+			for _, msg := range sent {
+				key := fmt.Sprintf("@test_channel/%d", msg.MessageID)
+				if url := tg.media[key]; url != "" {
+					media = append(media, url)
+				}
+				if strings.Contains(tg.messages[key], "photo post") {
+					hasText = true
+				}
+			}
+			if !slices.Equal(media, tt.wantMedia) {
+				t.Fatalf("published media = %q, want %q", media, tt.wantMedia)
+			}
+			if !hasText {
+				t.Fatalf("post text not published, messages = %+v", sent)
+			}
+		})
+	}
+}
+
+func testPhotoAttachment(id int, url string) vkAttachment {
+	return vkAttachment{Type: "photo", Photo: &vkPhoto{ID: id, Sizes: []vkPhotoSize{{URL: url, Width: 800, Height: 600, Type: "x"}}}}
+}
+
+// downStore is a memStore whose database connection is gone.
+type downStore struct {
+	*memStore
+	ensureCalls int
+}
+
+func (d *downStore) EnsureVKPost(context.Context, vkPostRecord) (vkPostState, error) {
+	d.ensureCalls++
+	return vkPostState{}, fmt.Errorf("ensure vk post: %w", driver.ErrBadConn)
+}
+
+func TestSyncAbortsCycleWhenDatabaseDown(t *testing.T) {
+	var posts []vkPost
+	for id := 1; id <= 20; id++ {
+		posts = append(posts, newTestPost(id, fmt.Sprintf("post %d", id)))
+	}
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, posts...)
+	store := &downStore{memStore: newTestMemStore()}
+	s := newTestSyncer(t, store.memStore, tgServer, vkServer, nil)
+	s.store = store
+	var logs bytes.Buffer
+	s.logger = zerolog.New(&logs)
+
+	if err := s.runOnce(context.Background()); err == nil {
+		t.Fatal("cycle with the database down reported success")
+	}
+	if store.ensureCalls != 1 {
+		t.Fatalf("EnsureVKPost calls = %d, want the cycle aborted after the first", store.ensureCalls)
+	}
+	if n := strings.Count(logs.String(), `"level":"warn"`); n != 1 {
+		t.Fatalf("warnings = %d, want 1; log:\n%s", n, logs.String())
+	}
+	if len(tg.calls) != 0 {
+		t.Fatalf("Telegram calls = %q, want none", tg.calls)
+	}
+
+	s.runOnce(context.Background())
+	if store.ensureCalls != 1 {
+		t.Fatalf("EnsureVKPost calls = %d, want the next cycle skipped during the backoff", store.ensureCalls)
+	}
+}
+
+func TestSyncTagsPostLogs(t *testing.T) {
+	store := newTestMemStore()
+	_, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first post"), newTestPost(2, "second post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	var logs bytes.Buffer
+	s.logger = zerolog.New(&logs)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	vk.setPosts(newTestPost(1, "first post, edited"), newTestPost(2, "second post"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("edit cycle: %v", err)
+	}
+
+	tagged := 0
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		postID, ok := entry["post_id"].(float64)
+		if !ok {
+			continue
+		}
+		if want := fmt.Sprintf("-1_%d", int(postID)); entry["post"] != want {
+			t.Fatalf("log line %q has post %v, want %q", line, entry["post"], want)
+		}
+		tagged++
+	}
+	if tagged == 0 {
+		t.Fatalf("no post log lines; log:\n%s", logs.String())
+	}
+}
+
+func TestSyncSourceAttribution(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	vk.groupName = "Test Group"
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_SOURCE_FORMAT": `Источник: {name}\n{url}`})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	vk.setPosts(newTestPost(1, "first post"), newTestPost(2, "second post"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	if n := vk.calls["groups.getById"]; n != 1 {
+		t.Fatalf("groups.getById calls = %d, want the name resolved once", n)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 2)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	want := "second post\n\nИсточник: Test Group\nhttps://vk.com/wall-1_2"
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); text != want {
+		t.Fatalf("channel message = %q, want %q", text, want)
+	}
+}
+
+func TestSyncSignature(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_SIGNATURE": `Примечание редакции\nподписывайтесь`})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := s.runOnce(ctx); err != nil {
+			t.Fatalf("cycle %d: %v", i+1, err)
+		}
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	want := "first post\n\nhttps://vk.com/wall-1_1\n\nПримечание редакции\nподписывайтесь"
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); text != want {
+		t.Fatalf("channel message = %q, want %q", text, want)
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 0 {
+		t.Fatalf("editMessageText calls = %d with an unchanged signature, want 0", n)
+	}
+}
+
+func TestSyncAnnouncesFirstPost(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	vk.groupName = "Test Group"
+	env := map[string]string{"TG_ANNOUNCE_FIRST": "true", "TG_SOURCE_FORMAT": "{name}: {url}"}
+	s := newTestSyncer(t, store, tgServer, vkServer, env)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 2 {
+		t.Fatalf("sendMessage calls = %d, want the announcement and the post", n)
+	}
+	want := "📢 Now mirroring posts from Test Group"
+	if text, _ := tg.message("@test_channel", 1); text != want {
+		t.Fatalf("first channel message = %q, want %q", text, want)
+	}
+
+	vk.setPosts(newTestPost(1, "first post"), newTestPost(2, "second post"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	// A restarted syncer reads the flag from sync_state.
+	vk.setPosts(newTestPost(1, "first post"), newTestPost(2, "second post"), newTestPost(3, "third post"))
+	if err := newTestSyncer(t, store, tgServer, vkServer, env).runOnce(ctx); err != nil {
+		t.Fatalf("restarted cycle: %v", err)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 4 {
+		t.Fatalf("sendMessage calls = %d, want one announcement and three posts", n)
+	}
+}
+
+func TestSyncDebouncesEdits(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first version"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_EDIT_DEBOUNCE": "1h"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	for _, text := range []string{"second version", "third version"} {
+		vk.setPosts(newTestPost(1, text))
+		if err := s.runOnce(ctx); err != nil {
+			t.Fatalf("edit cycle: %v", err)
+		}
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 0 {
+		t.Fatalf("editMessageText calls = %d within the debounce window, want 0", n)
+	}
+
+	store.mu.Lock()
+	post, _ := store.post(-1, 1)
+	post.changedAt = time.Now().Add(-2 * time.Hour)
+	store.mu.Unlock()
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("settled cycle: %v", err)
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 1 {
+		t.Fatalf("editMessageText calls = %d after the window, want a single edit", n)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "third version") {
+		t.Fatalf("channel message = %q, want the latest version", text)
+	}
+}
+
+func TestSyncRecordsMediaSentBeforeFailure(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	photos := 0
+	tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+		switch method {
+		case "sendMediaGroup":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: group send failed"}`)
+			return true
+		case "sendPhoto":
+			if photos++; photos == 2 {
+				w.WriteHeader(http.StatusBadGateway)
+				fmt.Fprint(w, `{"ok":false,"error_code":502,"description":"Bad Gateway"}`)
+				return true
+			}
+		}
+		return false
+	}
+	post := newTestPost(1, "photo post")
+	for i := 1; i <= 3; i++ {
+		post.Attachments = append(post.Attachments, testPhotoAttachment(i, fmt.Sprintf("https://vk.example/%d.jpg", i)))
+	}
+	_, vkServer := newFakeVK(t, post)
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	s.runOnce(ctx)
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v, want the photo sent before the failure", sent)
+	}
+	tg.fail = nil
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("retry cycle: %v", err)
+	}
+	var first int
+	for _, url := range tg.media {
+		if url == "https://vk.example/1.jpg" {
+			first++
+		}
+	}
+	if first != 1 {
+		t.Fatalf("first photo sent %d times, want once", first)
+	}
+}
+
+func TestSyncMediaOnly(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	photoPost := newTestPost(2, "photo post")
+	photoPost.Attachments = []vkAttachment{testPhotoAttachment(1, "https://vk.example/1.jpg")}
+	_, vkServer := newFakeVK(t, newTestPost(1, "text only"), photoPost)
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_MEDIA_ONLY": "true"})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := s.runOnce(ctx); err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 0 {
+		t.Fatalf("text-only post published: %+v", sent)
+	}
+	if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1}); !state.Published {
+		t.Fatal("skipped text-only post not marked seen")
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 2)
+	if len(sent) == 0 {
+		t.Fatal("photo post not published")
+	}
+	if n := tg.countCalls("sendPhoto @test_channel"); n != 1 {
+		t.Fatalf("sendPhoto calls = %d, want 1", n)
+	}
+}
+
+func TestSyncStoresAttachmentCounts(t *testing.T) {
+	store := newTestMemStore()
+	_, tgServer := newFakeTelegram(t)
+	post := newTestPost(1, "gallery")
+	for i := 1; i <= 3; i++ {
+		post.Attachments = append(post.Attachments, testPhotoAttachment(i, fmt.Sprintf("https://vk.example/%d.jpg", i)))
+	}
+	post.Attachments = append(post.Attachments, vkAttachment{Type: "link", Link: &vkLink{URL: "https://example.com"}})
+	_, vkServer := newFakeVK(t, post)
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+
+	if err := s.runOnce(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored, err := store.post(-1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.attachmentCount == nil || *stored.attachmentCount != 4 || stored.photoCount != 3 {
+		t.Fatalf("stored counts = %v attachments, %d photos, want 4 and 3", stored.attachmentCount, stored.photoCount)
+	}
+}
+
+func TestSyncDeadLettersFailingPost(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+		if chatID != "@test_channel" {
+			return false
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: can't parse entities"}`)
+		return true
+	}
+	_, vkServer := newFakeVK(t, newTestPost(1, "broken post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{
+		"SYNC_MAX_FAILURES": "3",
+		"TG_ADMIN_CHAT_ID":  "@admin_chat",
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		s.runOnce(ctx)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 3 {
+		t.Fatalf("sendMessage calls = %d, want 3 attempts before dead-lettering", n)
+	}
+	store.mu.Lock()
+	post, _ := store.post(-1, 1)
+	dead, failures, lastError := post.deadLettered, post.failures, post.lastError
+	store.mu.Unlock()
+	if !dead || failures != 3 || !strings.Contains(lastError, "can't parse entities") {
+		t.Fatalf("post dead-lettered = %v after %d failures (last error %q), want dead-lettered after 3", dead, failures, lastError)
+	}
+	if n := tg.countCalls("sendMessage @admin_chat"); n != 1 {
+		t.Fatalf("admin alerts = %d, want 1", n)
+	}
+}
+
+func TestSyncSeedsReactions(t *testing.T) {
+	tests := []struct {
+		name           string
+		rejectReaction bool
+	}{
+		{"reactions set", false},
+		{"reactions refused", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			if tt.rejectReaction {
+				tg.fail = func(w http.ResponseWriter, method, chatID string) bool {
+					if method != "setMessageReaction" {
+						return false
+					}
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: REACTION_INVALID"}`)
+					return true
+				}
+			}
+			_, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_SEED_REACTIONS": " 👍 "})
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			sent, _ := store.TelegramPosts(ctx, -1, 1)
+			if len(sent) != 1 {
+				t.Fatalf("recorded messages = %+v, want the post published", sent)
+			}
+			if n := tg.countCalls("setMessageReaction @test_channel"); n != 1 {
+				t.Fatalf("setMessageReaction calls = %d, want 1", n)
+			}
+			form := tg.forms["setMessageReaction @test_channel"]
+			if got := form.Get("message_id"); got != strconv.FormatInt(sent[0].MessageID, 10) {
+				t.Fatalf("reaction message_id = %s, want %d", got, sent[0].MessageID)
+			}
+			want := `[{"emoji":"👍","type":"emoji"}]`
+			if got := form.Get("reaction"); got != want {
+				t.Fatalf("reaction = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSyncDefersIncompletePosts(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, ""), newTestPost(2, "published post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 0 {
+		t.Fatalf("empty post published: %+v", sent)
+	}
+
+	vk.setPosts(newTestPost(1, "content arrived"), newTestPost(2, ""))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("second cycle: %v", err)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v, want the post published once it has content", sent)
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 0 {
+		t.Fatalf("editMessageText calls = %d, want the emptied post left alone", n)
+	}
+}
+
+func TestSyncRepostsChangedMediaGroup(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	photoPost := func(urls ...string) vkPost {
+		post := newTestPost(1, "gallery")
+		for i, url := range urls {
+			post.Attachments = append(post.Attachments, testPhotoAttachment(i+1, url))
+		}
+		post.Hash = strings.Join(urls, ",")
+		return post
+	}
+	vk, vkServer := newFakeVK(t, photoPost("https://vk.example/1.jpg", "https://vk.example/2.jpg"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_REPOST_ON_MEDIA_CHANGE": "true"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	old, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(old) == 0 {
+		t.Fatal("media group not published")
+	}
+
+	vk.setPosts(photoPost("https://vk.example/3.jpg", "https://vk.example/4.jpg"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("media change cycle: %v", err)
+	}
+	if n := tg.countCalls("deleteMessage @test_channel"); n != len(old) {
+		t.Fatalf("deleteMessage calls = %d, want %d", n, len(old))
+	}
+	if n := tg.countCalls("sendMediaGroup @test_channel"); n != 2 {
+		t.Fatalf("sendMediaGroup calls = %d, want a fresh media group", n)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	var media []string
+	for _, rec := range sent {
+		for _, o := range old {
+			if rec.MessageID == o.MessageID {
+				t.Fatalf("replaced message %d still recorded", rec.MessageID)
+			}
+		}
+		if url := tg.media[fmt.Sprintf("@test_channel/%d", rec.MessageID)]; url != "" {
+			media = append(media, url)
+		}
+	}
+	if want := []string{"https://vk.example/3.jpg", "https://vk.example/4.jpg"}; !slices.Equal(media, want) {
+		t.Fatalf("recorded media = %q, want %q", media, want)
+	}
+}
+
+func TestSyncMergesShortenedTextIntoCaption(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	photoPost := func(text string) vkPost {
+		post := newTestPost(1, text)
+		post.Attachments = []vkAttachment{testPhotoAttachment(1, "https://vk.example/1.jpg")}
+		return post
+	}
+	vk, vkServer := newFakeVK(t, photoPost(strings.Repeat("длинный текст поста ", 80)))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_REPOST_ON_MEDIA_CHANGE": "true"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	split, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(split) != 2 || split[0].HasText || !split[1].HasText {
+		t.Fatalf("recorded messages = %+v, want the photo and a separate text message", split)
+	}
+
+	vk.setPosts(photoPost("короткий текст"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("edit cycle: %v", err)
+	}
+	if n := tg.countCalls("editMessageCaption @test_channel"); n != 1 {
+		t.Fatalf("editMessageCaption calls = %d, want 1", n)
+	}
+	if n := tg.countCalls("deleteMessage @test_channel"); n != 1 {
+		t.Fatalf("deleteMessage calls = %d, want the text message deleted", n)
+	}
+	merged, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(merged) != 1 || merged[0].MessageID != split[0].MessageID || !merged[0].HasText {
+		t.Fatalf("recorded messages = %+v, want only the captioned photo", merged)
+	}
+	if caption, _ := tg.message("@test_channel", split[0].MessageID); !strings.Contains(caption, "короткий текст") {
+		t.Fatalf("photo caption = %q", caption)
+	}
+}
+
+func TestSyncStartupDelay(t *testing.T) {
+	store := newTestMemStore()
+	_, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_STARTUP_DELAY": "200ms"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := time.Now()
+	go s.run(ctx)
+	wallGets := func() int {
+		vk.mu.Lock()
+		defer vk.mu.Unlock()
+		return vk.calls["wall.get"]
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := wallGets(); n != 0 {
+		t.Fatalf("wall.get calls = %d before the startup delay, want 0", n)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for wallGets() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first sync didn't run after the startup delay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond {
+		t.Fatalf("first sync ran after %s, want at least the 200ms delay", elapsed)
+	}
+}
+
+func TestSyncCapsMessagesPerPost(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	post := newTestPost(1, "big gallery")
+	for i := 1; i <= 25; i++ {
+		post.Attachments = append(post.Attachments, testPhotoAttachment(i, fmt.Sprintf("https://vk.example/%d.jpg", i)))
+	}
+	_, vkServer := newFakeVK(t, post)
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_MAX_MESSAGES_PER_POST": "2"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if n := tg.countCalls("sendMediaGroup @test_channel"); n != 2 {
+		t.Fatalf("sendMediaGroup calls = %d, want 2", n)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 0 {
+		t.Fatalf("sendMessage calls = %d, want the text carried as a caption", n)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 20 {
+		t.Fatalf("recorded messages = %d, want the 20 photos sent", len(sent))
+	}
+	var notice bool
+	for _, rec := range sent {
+		if text, _ := tg.message("@test_channel", rec.MessageID); strings.Contains(text, "…and 5 more on VK") {
+			notice = true
+		}
+	}
+	if !notice {
+		t.Fatal("no caption carries the \"…and 5 more on VK\" notice")
+	}
+}
+
+func TestRepublishToNewChannel(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(3, "third post"), newTestPost(2, "second post"), newTestPost(1, "first post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_CHANNEL_ID": "@new_channel"})
+	ctx := context.Background()
+
+	if err := s.republish(ctx, []publishedPostRef{{OwnerID: -1, PostID: 2}, {OwnerID: -1, PostID: 3}}); err != nil {
+		t.Fatalf("republish: %v", err)
+	}
+	if n := tg.countCalls("sendMessage @new_channel"); n != 2 {
+		t.Fatalf("sendMessage calls = %d, want 2", n)
+	}
+	var prev int64
+	for _, id := range []int{2, 3} {
+		sent, _ := store.TelegramPosts(ctx, -1, id)
+		if len(sent) != 1 || sent[0].ChannelID != "@new_channel" {
+			t.Fatalf("post %d messages = %+v, want one in the new channel", id, sent)
+		}
+		if sent[0].MessageID <= prev {
+			t.Fatalf("post %d sent as message %d after %d, want oldest first", id, sent[0].MessageID, prev)
+		}
+		prev = sent[0].MessageID
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 0 {
+		t.Fatalf("post outside the last N republished: %+v", sent)
+	}
+}
+
+func TestSyncRestoresTruncatedText(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	full := strings.Repeat("длинный текст ", 60) + "и его окончание"
+	truncated := newTestPost(1, string([]rune(full)[:700])+"…")
+	vk, vkServer := newFakeVK(t, truncated)
+	vk.fullPosts = []vkPost{newTestPost(1, full)}
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if n := vk.calls["wall.getById"]; n != 1 {
+		t.Fatalf("wall.getById calls = %d, want 1", n)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "и его окончание") {
+		t.Fatalf("channel message = %q, want the full text", text)
+	}
+}
+
+func TestSyncHoldsPostsDuringQuietHours(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(1, "night post"))
+	now := time.Now().UTC()
+	window := now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_QUIET_HOURS": window, "SYNC_TIMEZONE": "UTC"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("quiet cycle: %v", err)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 0 {
+		t.Fatalf("sendMessage calls = %d during quiet hours, want 0", n)
+	}
+	if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 1}); state.Published {
+		t.Fatal("held post marked published")
+	}
+
+	closed, err := parseQuietHours(now.Add(2*time.Hour).Format("15:04")+"-"+now.Add(3*time.Hour).Format("15:04"), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.QuietHours = closed
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("cycle after quiet hours: %v", err)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v, want the post published once the window closed", sent)
+	}
+}
+
+func TestSyncResolvesMentionsFromProfiles(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "Привет, @id5!"))
+	vk.profiles = []vkProfile{{ID: 5, FirstName: "Павел", LastName: "Дуров"}}
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.HasPrefix(text, "Привет, Павел Дуров!") {
+		t.Fatalf("channel message = %q, want the mention resolved", text)
+	}
+	if entities := tg.forms["sendMessage @test_channel"].Get("entities"); !strings.Contains(entities, "https://vk.com/id5") {
+		t.Fatalf("entities = %s, want a link to the profile", entities)
+	}
+	if n := vk.calls["users.get"]; n != 0 {
+		t.Fatalf("users.get calls = %d, want names taken from the extended response", n)
+	}
+}
+
+func TestSyncPublishesStoryPhoto(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	post := newTestPost(1, "new story")
+	post.Attachments = []vkAttachment{{Type: "story", Story: &vkStory{ID: 3, OwnerID: -1, Type: "photo", Photo: &vkPhoto{Sizes: []vkPhotoSize{{URL: "https://vk.example/story.jpg", Width: 720, Height: 1280}}}}}}
+	_, vkServer := newFakeVK(t, post)
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v, want the story sent as one photo", sent)
+	}
+	key := fmt.Sprintf("@test_channel/%d", sent[0].MessageID)
+	if tg.media[key] != "https://vk.example/story.jpg" {
+		t.Fatalf("published media = %q, want the story photo", tg.media[key])
+	}
+	if !strings.Contains(tg.messages[key], "Story: https://vk.com/story-1_3") {
+		t.Fatalf("caption = %q, want the story marker", tg.messages[key])
+	}
+}
+
+func TestSyncEmptyEditPolicies(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantEdits   int
+		wantDeletes int
+	}{
+		{emptyEditKeep, 0, 0},
+		{emptyEditLink, 1, 0},
+		{emptyEditDelete, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			vk, vkServer := newFakeVK(t, newTestPost(1, "soon gone"))
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_ON_EMPTY_EDIT": tt.policy})
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("first cycle: %v", err)
+			}
+			sent, _ := store.TelegramPosts(ctx, -1, 1)
+			vk.setPosts(newTestPost(1, ""))
+			for i := 0; i < 2; i++ {
+				if err := s.runOnce(ctx); err != nil {
+					t.Fatalf("empty cycle %d: %v", i, err)
+				}
+			}
+
+			if n := tg.countCalls("editMessageText @test_channel"); n != tt.wantEdits {
+				t.Fatalf("editMessageText calls = %d, want %d", n, tt.wantEdits)
+			}
+			if n := tg.countCalls("deleteMessage @test_channel"); n != tt.wantDeletes {
+				t.Fatalf("deleteMessage calls = %d, want %d", n, tt.wantDeletes)
+			}
+			text, _ := tg.message("@test_channel", sent[0].MessageID)
+			switch tt.policy {
+			case emptyEditKeep:
+				if !strings.Contains(text, "soon gone") {
+					t.Fatalf("channel message = %q, want it kept", text)
+				}
+			case emptyEditLink:
+				if text != "https://vk.com/wall-1_1" {
+					t.Fatalf("channel message = %q, want just the link", text)
+				}
+			case emptyEditDelete:
+				if left, _ := store.TelegramPosts(ctx, -1, 1); len(left) != 0 {
+					t.Fatalf("records left = %+v, want the deleted message forgotten", left)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncSkipsCompactedPosts(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(4, "compacted post"), newTestPost(5, "new post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+	store.SetSyncState(ctx, retentionCursorKey(-1), "4")
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 4); len(sent) != 0 {
+		t.Fatalf("post behind the retention cursor published again: %+v", sent)
+	}
+	if state, _ := store.EnsureVKPost(ctx, vkPostRecord{OwnerID: -1, PostID: 4}); !state.Published {
+		t.Fatal("post behind the retention cursor not marked seen")
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 1 {
+		t.Fatalf("sendMessage calls = %d, want only the new post", n)
+	}
+}
+
+func TestSyncTextPosition(t *testing.T) {
+	tests := []struct {
+		position  string
+		wantCalls []string
+	}{
+		{textPositionBefore, []string{"sendMessage @test_channel", "sendMediaGroup @test_channel"}},
+		{textPositionAfter, []string{"sendMediaGroup @test_channel", "sendMessage @test_channel"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			photoPost := func(text string) vkPost {
+				post := newTestPost(1, text)
+				for i := 1; i <= 2; i++ {
+					post.Attachments = append(post.Attachments, testPhotoAttachment(i, fmt.Sprintf("https://vk.example/%d.jpg", i)))
+				}
+				return post
+			}
+			vk, vkServer := newFakeVK(t, photoPost("first version"))
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_TEXT_POSITION": tt.position})
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("first cycle: %v", err)
+			}
+			if !slices.Equal(tg.calls, tt.wantCalls) {
+				t.Fatalf("Telegram calls = %q, want %q", tg.calls, tt.wantCalls)
+			}
+			sent, _ := store.TelegramPosts(ctx, -1, 1)
+			if len(sent) != 3 {
+				t.Fatalf("recorded messages = %+v, want the text and both photos", sent)
+			}
+			for _, rec := range sent {
+				key := fmt.Sprintf("@test_channel/%d", rec.MessageID)
+				if tg.media[key] != "" && tg.messages[key] != "" {
+					t.Fatalf("photo %d captioned %q, want the text kept separate", rec.MessageID, tg.messages[key])
+				}
+			}
+
+			vk.setPosts(photoPost("second version"))
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("edit cycle: %v", err)
+			}
+			if n := tg.countCalls("editMessageText @test_channel"); n != 1 {
+				t.Fatalf("editMessageText calls = %d, want the text message edited", n)
+			}
+			var edited bool
+			for _, rec := range sent {
+				if text, _ := tg.message("@test_channel", rec.MessageID); strings.Contains(text, "second version") {
+					edited = true
+				}
+			}
+			if !edited {
+				t.Fatal("no recorded message carries the edited text")
+			}
+		})
+	}
+}
+
+func TestSyncOrdersPhotosByID(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	post := newTestPost(1, "gallery")
+	for _, id := range []int{3, 1, 2} {
+		post.Attachments = append(post.Attachments, testPhotoAttachment(id, fmt.Sprintf("https://vk.example/%d.jpg", id)))
+	}
+	post.Attachments = slices.Insert(post.Attachments, 1, vkAttachment{Type: "link", Link: &vkLink{URL: "https://example.com"}})
+	_, vkServer := newFakeVK(t, post)
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"VK_PHOTO_ORDER": "id"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	slices.SortFunc(sent, func(a, b storedTelegramPost) int { return int(a.MessageID - b.MessageID) })
+	var media []string
+	for _, rec := range sent {
+		if url := tg.media[fmt.Sprintf("@test_channel/%d", rec.MessageID)]; url != "" {
+			media = append(media, url)
+		}
+	}
+	want := []string{"https://vk.example/1.jpg", "https://vk.example/2.jpg", "https://vk.example/3.jpg"}
+	if !slices.Equal(media, want) {
+		t.Fatalf("album order = %q, want %q", media, want)
+	}
+}
+
+func TestSyncReconcileDropsDeletedMessages(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(1, "kept post"), newTestPost(2, "deleted post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_RECONCILE": "true"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	deleted, _ := store.TelegramPosts(ctx, -1, 2)
+	if len(deleted) != 1 {
+		t.Fatalf("recorded messages = %+v", deleted)
+	}
+	tg.mu.Lock()
+	delete(tg.messages, fmt.Sprintf("@test_channel/%d", deleted[0].MessageID))
+	tg.mu.Unlock()
+
+	s.reconcile(ctx)
+	if n := tg.countCalls("editMessageReplyMarkup @test_channel"); n != 2 {
+		t.Fatalf("editMessageReplyMarkup probes = %d, want 2", n)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 2); len(sent) != 0 {
+		t.Fatalf("record of the deleted message kept: %+v", sent)
+	}
+	if sent, _ := store.TelegramPosts(ctx, -1, 1); len(sent) != 1 {
+		t.Fatalf("record of the existing message removed: %+v", sent)
+	}
+}
+
+func TestSyncLinkWhenEmpty(t *testing.T) {
+	tests := []struct {
+		linkWhenEmpty string
+		wantCaption   string
+	}{
+		{"true", "https://vk.com/wall-1_1"},
+		{"false", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.linkWhenEmpty, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			photoPost := func(text string) vkPost {
+				post := newTestPost(1, text)
+				post.Attachments = []vkAttachment{testPhotoAttachment(1, "https://vk.example/1.jpg")}
+				return post
+			}
+			vk, vkServer := newFakeVK(t, photoPost(""))
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_LINK_WHEN_EMPTY": tt.linkWhenEmpty})
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("first cycle: %v", err)
+			}
+			sent, _ := store.TelegramPosts(ctx, -1, 1)
+			if len(sent) != 1 {
+				t.Fatalf("recorded messages = %+v, want the photo alone", sent)
+			}
+			if caption, _ := tg.message("@test_channel", sent[0].MessageID); caption != tt.wantCaption {
+				t.Fatalf("caption = %q, want %q", caption, tt.wantCaption)
+			}
+
+			vk.setPosts(photoPost("caption added"))
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("edit cycle: %v", err)
+			}
+			if caption, _ := tg.message("@test_channel", sent[0].MessageID); !strings.HasPrefix(caption, "caption added") {
+				t.Fatalf("caption after edit = %q, want the added text", caption)
+			}
+		})
+	}
+}
+
+func TestSyncCommentsFooter(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	withComments := func(count int) vkPost {
+		post := newTestPost(1, "discussed post")
+		post.Comments.Count = count
+		return post
+	}
+	vk, vkServer := newFakeVK(t, withComments(3))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"SYNC_SHOW_COMMENTS": "true"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	want := "discussed post\n\nhttps://vk.com/wall-1_1\n💬 3 comments: https://vk.com/wall-1_1"
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); text != want {
+		t.Fatalf("channel message = %q, want %q", text, want)
+	}
+
+	vk.setPosts(withComments(10))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("comment count cycle: %v", err)
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 0 {
+		t.Fatalf("editMessageText calls = %d after a comment count change, want 0", n)
+	}
+}
+
+func TestSyncEditMinInterval(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first version"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_EDIT_MIN_INTERVAL": "1h"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	for _, text := range []string{"second version", "third version"} {
+		vk.setPosts(newTestPost(1, text))
+		if err := s.runOnce(ctx); err != nil {
+			t.Fatalf("edit cycle: %v", err)
+		}
+	}
+	if n := tg.countCalls("editMessageText @test_channel"); n != 1 {
+		t.Fatalf("editMessageText calls = %d, want the second edit deferred", n)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "second version") {
+		t.Fatalf("channel message = %q, want the first edit only", text)
+	}
+
+	store.mu.Lock()
+	store.messages[0].editedAt = time.Now().Add(-2 * time.Hour)
+	store.mu.Unlock()
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("cycle after the interval: %v", err)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "third version") {
+		t.Fatalf("channel message = %q, want the deferred edit applied", text)
+	}
+}
+
+func TestSyncPreviewLinksOnly(t *testing.T) {
+	linkPost := newTestPost(1, "worth a look")
+	linkPost.Attachments = []vkAttachment{{Type: "link", Link: &vkLink{URL: "https://example.com/article"}}}
+	tests := []struct {
+		name string
+		post vkPost
+		want string
+	}{
+		{"link attachment", linkPost, "false"},
+		{"stray URL in text", newTestPost(1, "as mentioned on https://example.com/faq"), "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			_, vkServer := newFakeVK(t, tt.post)
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_PREVIEW_LINKS_ONLY": "true"})
+
+			if err := s.runOnce(context.Background()); err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			if got := tg.forms["sendMessage @test_channel"].Get("disable_web_page_preview"); got != tt.want {
+				t.Fatalf("disable_web_page_preview = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncRecordsLastVKError(t *testing.T) {
+	store := newTestMemStore()
+	_, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	vk.wallError = &vkAPIError{Code: 10, Msg: "Internal server error"}
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err == nil {
+		t.Fatal("cycle with a failed fetch succeeded")
+	}
+	raw, ok, _ := store.GetSyncState(ctx, syncStateLastVKError)
+	if !ok {
+		t.Fatal("last VK error not recorded")
+	}
+	var rec vkErrorRecord
+	if err := json.Unmarshal([]byte(raw), &rec); err != nil || rec.Code != 10 || rec.Message != "Internal server error" || rec.At.IsZero() {
+		t.Fatalf("last VK error = %s (%v)", raw, err)
+	}
+
+	vk.mu.Lock()
+	vk.wallError = nil
+	vk.mu.Unlock()
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("recovered cycle: %v", err)
+	}
+	if _, ok, _ := store.GetSyncState(ctx, syncStateLastVKError); ok {
+		t.Fatal("last VK error kept after a successful fetch")
+	}
+}
+
+func TestSyncLastVKErrorHidesAccessToken(t *testing.T) {
+	store := newTestMemStore()
+	_, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	vkServer.Close()
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err == nil {
+		t.Fatal("cycle with VK unreachable succeeded")
+	}
+	raw, ok, _ := store.GetSyncState(ctx, syncStateLastVKError)
+	if !ok {
+		t.Fatal("last VK error not recorded")
+	}
+	if strings.Contains(raw, "access_token") || strings.Contains(raw, "vk-token") {
+		t.Fatalf("last VK error = %s, leaks the access token", raw)
+	}
+	if !strings.Contains(raw, "request failed") {
+		t.Fatalf("last VK error = %s, want the transport failure", raw)
+	}
+}
+
+func TestSyncPausesGroupOnVKAccessDenied(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	vk, vkServer := newFakeVK(t, newTestPost(1, "first post"))
+	vk.wallError = &vkAPIError{Code: vkErrorGroupNoAccess, Msg: "Access to group denied"}
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_ADMIN_CHAT_ID": "@admin_chat"})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err == nil {
+		t.Fatal("cycle with denied access succeeded")
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.runOnce(ctx); err != nil {
+			t.Fatalf("paused cycle: %v", err)
+		}
+	}
+	vk.mu.Lock()
+	wallCalls := vk.calls["wall.get"]
+	vk.mu.Unlock()
+	if wallCalls != 1 {
+		t.Fatalf("wall.get calls = %d, want polling paused after the denial", wallCalls)
+	}
+	if n := tg.countCalls("sendMessage @admin_chat"); n != 1 {
+		t.Fatalf("admin alerts = %d, want 1", n)
+	}
+	if n := tg.countCalls("sendMessage @test_channel"); n != 0 {
+		t.Fatalf("channel messages = %d while paused, want 0", n)
+	}
+}
+
+func TestSyncCaptionOverflow(t *testing.T) {
+	long := strings.Repeat("очень длинная подпись ", 60)
+	tests := []struct {
+		overflow    string
+		wantCaption bool
+		wantReplyTo bool
+	}{
+		{captionOverflowSplit, false, false},
+		{captionOverflowTruncateLink, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			post := newTestPost(1, long)
+			post.Attachments = []vkAttachment{testPhotoAttachment(1, "https://vk.example/1.jpg")}
+			_, vkServer := newFakeVK(t, post)
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"TG_CAPTION_OVERFLOW": tt.overflow})
+
+			if err := s.runOnce(context.Background()); err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			if !slices.Equal(tg.calls, []string{"sendPhoto @test_channel", "sendMessage @test_channel"}) {
+				t.Fatalf("Telegram calls = %q, want the photo then the full text", tg.calls)
+			}
+			caption := tg.forms["sendPhoto @test_channel"].Get("caption")
+			if got := caption != ""; got != tt.wantCaption {
+				t.Fatalf("photo caption = %q, want a caption %v", caption, tt.wantCaption)
+			}
+			if tt.wantCaption && (!strings.HasSuffix(caption, "…") || utf16Len(caption) > telegramCaptionLimit) {
+				t.Fatalf("photo caption = %q, want it trimmed with an ellipsis", caption)
+			}
+			text := tg.forms["sendMessage @test_channel"]
+			if !strings.HasPrefix(text.Get("text"), strings.TrimSpace(long)) {
+				t.Fatalf("follow-up text = %q, want the full text", text.Get("text"))
+			}
+			if got := text.Get("reply_parameters") != ""; got != tt.wantReplyTo {
+				t.Fatalf("follow-up replies to the photo = %v, want %v", got, tt.wantReplyTo)
+			}
+		})
+	}
+}
+
+func TestSupervisorStartsWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newTestMemStore()
+	manager := newTokenManager(zerolog.Nop(), store, "http://127.0.0.1:0", "1", time.Minute)
+	supervisor := newSyncSupervisor(ctx, zerolog.Nop(), manager, store, newPublishLimiter(1), &vkCallMeter{})
+
+	cfg := wallSyncConfig{GroupID: "1", ChannelID: "@test_channel", BotToken: "token", WallFilter: "owner"}
+	supervisor.Apply([]wallSyncConfig{cfg})
+	if !supervisor.Enabled() || !supervisor.HasGroup("1") {
+		t.Fatal("adding a mapping didn't start a worker")
+	}
+
+	supervisor.Apply(nil)
+	if supervisor.Enabled() || supervisor.HasGroup("1") {
+		t.Fatal("removing the mapping didn't stop its worker")
+	}
+}
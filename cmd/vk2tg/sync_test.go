@@ -0,0 +1,1092 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestIsTelegramDeliveryUncertain(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"api error", &telegramAPIError{Code: http.StatusBadRequest}, false},
+		{"rate limited", fmt.Errorf("wrap: %w", errTelegramRateLimited), false},
+		{"not sent", fmt.Errorf("execute: %w: %w", errTelegramNotSent, context.DeadlineExceeded), false},
+		{"dial error", &net.OpError{Op: "dial", Err: errors.New("refused")}, false},
+		{"read timeout", &net.OpError{Op: "read", Err: errors.New("timeout")}, true},
+		{"deadline after write", fmt.Errorf("execute: %w", context.DeadlineExceeded), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTelegramDeliveryUncertain(tt.err); got != tt.want {
+				t.Fatalf("isTelegramDeliveryUncertain(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallTelegramDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	s := newWallSyncer(zerolog.Nop(), nil, nil, nil, &vkCallMeter{}, wallSyncConfig{TGAPIBase: server.URL, BotToken: "token"})
+
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.callTelegram(expired, "sendMessage", url.Values{})
+	if err == nil || isTelegramDeliveryUncertain(err) {
+		t.Fatalf("cancelled before sending: err = %v, want certain non-delivery", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = s.callTelegram(ctx, "sendMessage", url.Values{})
+	if err == nil || !isTelegramDeliveryUncertain(err) {
+		t.Fatalf("deadline after sending: err = %v, want uncertain delivery", err)
+	}
+}
+
+func TestPostDate(t *testing.T) {
+	post := vkPost{ID: 1, OwnerID: -1, Date: 1705069800}
+	tests := []struct {
+		name string
+		cfg  wallSyncConfig
+		post vkPost
+		want string
+	}{
+		{"disabled", wallSyncConfig{DateFormat: defaultDateFormat, Location: time.UTC}, post, ""},
+		{"default format", wallSyncConfig{ShowDate: true, DateFormat: defaultDateFormat, Location: time.UTC}, post, "📅 12 Jan 2024, 14:30"},
+		{"custom format", wallSyncConfig{ShowDate: true, DateFormat: "2006-01-02", Location: time.UTC}, post, "📅 2024-01-12"},
+		{"no date", wallSyncConfig{ShowDate: true, DateFormat: defaultDateFormat}, vkPost{ID: 1}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &wallSyncer{cfg: tt.cfg}
+			if got := s.postDate(tt.post); got != tt.want {
+				t.Fatalf("postDate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostContentHash(t *testing.T) {
+	base := postContentHash("text", []string{"https://sun9-1.userapi.com/a.jpg?size=1"})
+	tests := []struct {
+		name   string
+		text   string
+		photos []string
+		same   bool
+	}{
+		{"photo query ignored", " text ", []string{"https://sun9-1.userapi.com/a.jpg?size=2"}, true},
+		{"other text", "other", []string{"https://sun9-1.userapi.com/a.jpg"}, false},
+		{"other photo", "text", []string{"https://sun9-1.userapi.com/b.jpg"}, false},
+		{"no photos", "text", nil, false},
+		{"other repost", "", []string{"wall-1_2"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postContentHash(tt.text, tt.photos) == base; got != tt.same {
+				t.Fatalf("hash equal = %v, want %v", got, tt.same)
+			}
+		})
+	}
+	if got := postContentHash(" ", nil); got != "" {
+		t.Fatalf("hash of a post without content = %q, want empty", got)
+	}
+}
+
+func TestPostHasMedia(t *testing.T) {
+	photo := vkAttachment{Type: "photo", Photo: &vkPhoto{Sizes: []vkPhotoSize{{URL: "https://example.com/a.jpg", Type: "x"}}}}
+	tests := []struct {
+		name string
+		post vkPost
+		want bool
+	}{
+		{"photo", vkPost{Attachments: []vkAttachment{photo}}, true},
+		{"video with file", vkPost{Attachments: []vkAttachment{{Type: "video", Video: &vkVideo{FileURL: "https://example.com/v.mp4"}}}}, true},
+		{"video without file", vkPost{Attachments: []vkAttachment{{Type: "video", Video: &vkVideo{}}}}, false},
+		{"photo without sizes", vkPost{Attachments: []vkAttachment{{Type: "photo", Photo: &vkPhoto{}}}}, false},
+		{"link only", vkPost{Attachments: []vkAttachment{{Type: "link", Link: &vkLink{URL: "https://example.com"}}}}, false},
+		{"media only in repost", vkPost{CopyHistory: []vkPost{{Attachments: []vkAttachment{photo}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postHasMedia(tt.post); got != tt.want {
+				t.Fatalf("postHasMedia = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManualEditDiverged(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []storedTelegramPost
+		text    string
+		want    bool
+	}{
+		{"same text", []storedTelegramPost{{HasText: true, Text: "hello"}}, "hello\n", false},
+		{"edited by hand", []storedTelegramPost{{HasText: true, Text: "hello, edited"}}, "hello", true},
+		{"one channel diverged", []storedTelegramPost{{HasText: true, Text: "hello"}, {ChannelID: "@mirror_channel", HasText: true, Text: "hi"}}, "hello", true},
+		{"media only", []storedTelegramPost{{}}, "hello", false},
+		{"no messages", nil, "hello", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manualEditDiverged(tt.records, tt.text); got != tt.want {
+				t.Fatalf("manualEditDiverged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishPostVKButton(t *testing.T) {
+	photo := func(id int) vkAttachment {
+		return vkAttachment{Type: "photo", Photo: &vkPhoto{ID: id, Sizes: []vkPhotoSize{{URL: fmt.Sprintf("https://vk.example/%d.jpg", id), Width: 800, Height: 600, Type: "x"}}}}
+	}
+	tests := []struct {
+		name        string
+		text        string
+		attachments []vkAttachment
+		want        []string
+	}{
+		{"text", "hello", nil, []string{"sendMessage+button"}},
+		{"photo", "hello", []vkAttachment{photo(1)}, []string{"sendPhoto+button"}},
+		{"captioned album", "hello", []vkAttachment{photo(1), photo(2)}, []string{"sendMediaGroup", "sendMessage+button"}},
+		{"album with long text", strings.Repeat("long text ", 200), []vkAttachment{photo(1), photo(2)}, []string{"sendMediaGroup", "sendMessage+button"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("parse form: %v", err)
+				}
+				method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+				call := method
+				if r.Form.Get("reply_markup") != "" {
+					call += "+button"
+				}
+				calls = append(calls, call)
+				if method == "sendMediaGroup" {
+					fmt.Fprint(w, `{"ok":true,"result":[{"message_id":10,"date":1},{"message_id":11,"date":1}]}`)
+					return
+				}
+				fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"date":1}}`, 20+len(calls))
+			}))
+			defer server.Close()
+
+			s := newWallSyncer(zerolog.Nop(), nil, nil, newPublishLimiter(1), &vkCallMeter{}, wallSyncConfig{
+				TGAPIBase:    server.URL,
+				BotToken:     "token",
+				ChannelID:    "@test_channel",
+				VKButton:     true,
+				TextPosition: textPositionCaption,
+			})
+			post := vkPost{ID: 1, OwnerID: -1, Text: tt.text, Attachments: tt.attachments}
+			if _, err := s.publishPost(context.Background(), post, tt.text, 0); err != nil {
+				t.Fatalf("publishPost: %v", err)
+			}
+			if fmt.Sprint(calls) != fmt.Sprint(tt.want) {
+				t.Fatalf("calls = %v, want %v", calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletedPublishSteps(t *testing.T) {
+	s := newWallSyncer(zerolog.Nop(), nil, nil, nil, &vkCallMeter{}, wallSyncConfig{ChannelID: "@test_channel"})
+	tests := []struct {
+		name string
+		sent []storedTelegramPost
+		want int
+	}{
+		{"nothing sent", nil, 0},
+		{"album with a dropped photo", []storedTelegramPost{{MessageID: 1, ChannelID: "@test_channel"}, {MessageID: 2, ChannelID: "@test_channel"}}, 1},
+		{"album and text", []storedTelegramPost{{MessageID: 1}, {MessageID: 2}, {MessageID: 3, Step: 1}}, 2},
+		{"mirror messages", []storedTelegramPost{{MessageID: 1, ChannelID: "@mirror_channel", Step: 2}}, 0},
+		{"recorded before steps", []storedTelegramPost{{MessageID: 1, Step: -1}, {MessageID: 2, Step: -1}}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.completedPublishSteps(tt.sent); got != tt.want {
+				t.Fatalf("completedPublishSteps() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishPostResume(t *testing.T) {
+	failText := true
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		calls = append(calls, method)
+		switch {
+		case method == "sendMediaGroup":
+			fmt.Fprint(w, `{"ok":true,"result":[{"message_id":10,"date":1},{"message_id":11,"date":1}]}`)
+		case failText:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"ok":false,"error_code":500,"description":"Internal Server Error"}`)
+		default:
+			fmt.Fprint(w, `{"ok":true,"result":{"message_id":12,"date":1}}`)
+		}
+	}))
+	defer server.Close()
+
+	s := newWallSyncer(zerolog.Nop(), nil, nil, newPublishLimiter(1), &vkCallMeter{}, wallSyncConfig{
+		TGAPIBase:    server.URL,
+		BotToken:     "token",
+		ChannelID:    "@test_channel",
+		TextPosition: textPositionAfter,
+	})
+	photo := func(id int) vkAttachment {
+		return vkAttachment{Type: "photo", Photo: &vkPhoto{ID: id, Sizes: []vkPhotoSize{{URL: fmt.Sprintf("https://vk.example/%d.jpg", id), Width: 800, Height: 600, Type: "x"}}}}
+	}
+	post := vkPost{ID: 1, OwnerID: -1, Text: "hello", Attachments: []vkAttachment{photo(1), photo(2)}}
+
+	messages, err := s.publishPost(context.Background(), post, post.Text, 0)
+	if err == nil {
+		t.Fatal("publishPost succeeded, want the text message to fail")
+	}
+	if len(messages) != 2 || messages[0].Step != 0 || messages[1].Step != 0 {
+		t.Fatalf("messages = %+v, want the album as step 0", messages)
+	}
+
+	var sent []storedTelegramPost
+	for _, msg := range messages {
+		sent = append(sent, storedTelegramPost{MessageID: msg.ID, ChannelID: "@test_channel", Step: msg.Step})
+	}
+	failText, calls = false, nil
+	messages, err = s.publishPost(context.Background(), post, post.Text, s.completedPublishSteps(sent))
+	if err != nil {
+		t.Fatalf("resumed publishPost: %v", err)
+	}
+	if fmt.Sprint(calls) != "[sendMessage]" || len(messages) != 1 || messages[0].Step != 1 {
+		t.Fatalf("resume sent %v as %+v, want only the text message as step 1", calls, messages)
+	}
+}
+
+func TestLoadWallSyncConfigWallFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    string
+		wantErr bool
+	}{
+		{"", "owner", false},
+		{"all", "all", false},
+		{"suggests", "suggests", false},
+		{"everything", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			t.Setenv("VK_WALL_FILTER", tt.filter)
+			cfg, err := loadWallSyncConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cfg.WallFilter != tt.want {
+				t.Fatalf("WallFilter = %q, want %q", cfg.WallFilter, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadWallSyncConfigTelegramTarget(t *testing.T) {
+	tests := []struct {
+		name        string
+		channel     string
+		thread      string
+		wantChannel string
+		wantThread  string
+		wantErr     bool
+	}{
+		{"channel name", "@my_channel", "", "@my_channel", "", false},
+		{"numeric channel and thread", "-1001234567890", "42", "-1001234567890", "42", false},
+		{"whitespace-padded channel", "  @my_channel\n", " 7 ", "@my_channel", "7", false},
+		{"malformed channel", "my channel", "", "", "", true},
+		{"non-numeric thread", "@my_channel", "general", "", "", true},
+		{"zero thread", "@my_channel", "0", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TG_CHANNEL_ID", tt.channel)
+			t.Setenv("TG_THREAD_ID", tt.thread)
+			cfg, err := loadWallSyncConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cfg.ChannelID != tt.wantChannel || cfg.ThreadID != tt.wantThread {
+				t.Fatalf("ChannelID, ThreadID = %q, %q, want %q, %q", cfg.ChannelID, cfg.ThreadID, tt.wantChannel, tt.wantThread)
+			}
+		})
+	}
+}
+
+func TestLoadWallSyncConfigSeedReactions(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{" 👍 ", "👍", false},
+		{"👍,", "👍", false},
+		{"👍, 🔥", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			t.Setenv("TG_SEED_REACTIONS", tt.raw)
+			cfg, err := loadWallSyncConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cfg.SeedReaction != tt.want {
+				t.Fatalf("SeedReaction = %q, want %q", cfg.SeedReaction, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaCaptionSafetyMargin(t *testing.T) {
+	s := &wallSyncer{cfg: wallSyncConfig{TextPosition: textPositionCaption, CaptionSafetyMargin: 32}}
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"cyrillic at the margin", strings.Repeat("ж", 992), true},
+		{"cyrillic over the margin", strings.Repeat("ж", 993), false},
+		{"under the limit but inside the margin", strings.Repeat("ж", 1000), false},
+		{"emoji counted as two units", strings.Repeat("ж", 990) + "😀", true},
+		{"emoji pushes over the margin", strings.Repeat("ж", 991) + "😀", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caption, _ := s.mediaCaption(tt.text, 2)
+			if got := caption != ""; got != tt.want {
+				t.Fatalf("caption kept = %v for %d UTF-16 units, want %v", got, utf16Len(tt.text), tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaCaptionGroupBoundary(t *testing.T) {
+	s := &wallSyncer{cfg: wallSyncConfig{TextPosition: textPositionCaption, CaptionOverflow: captionOverflowTruncateLink}}
+	tests := []struct {
+		name          string
+		text          string
+		mediaCount    int
+		wantCaption   bool
+		wantTruncated bool
+	}{
+		{"group at the limit", strings.Repeat("ж", telegramCaptionLimit), 3, true, false},
+		{"group over the limit", strings.Repeat("ж", telegramCaptionLimit+1), 3, false, false},
+		{"group near the message limit", strings.Repeat("ж", 4000), 3, false, false},
+		{"single media over the limit", strings.Repeat("ж", telegramCaptionLimit+1), 1, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caption, truncated := s.mediaCaption(tt.text, tt.mediaCount)
+			if got := caption != ""; got != tt.wantCaption {
+				t.Fatalf("caption kept = %v, want %v", got, tt.wantCaption)
+			}
+			if truncated != tt.wantTruncated {
+				t.Fatalf("truncated = %v, want %v", truncated, tt.wantTruncated)
+			}
+			if tt.wantCaption && !truncated && caption != tt.text {
+				t.Fatal("caption that fits was changed")
+			}
+		})
+	}
+}
+
+func TestLoadWallSyncConfigGroupID(t *testing.T) {
+	tests := []struct {
+		raw     string
+		wantErr bool
+	}{
+		{"123", false},
+		{"-123", false},
+		{"club123", false},
+		{"public123", false},
+		{" Club123 ", false},
+		{"club", true},
+		{"-0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			t.Setenv("VK_GROUP_ID", tt.raw)
+			cfg, err := loadWallSyncConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.GroupID != "123" || cfg.ownerID() != -123 {
+				t.Fatalf("GroupID = %q, ownerID = %d, want 123 and -123", cfg.GroupID, cfg.ownerID())
+			}
+			s := &wallSyncer{cfg: cfg}
+			for _, post := range []vkPost{{ID: 5}, {ID: 5, OwnerID: -123}} {
+				if got := s.postURL(post); got != "https://vk.com/wall-123_5" {
+					t.Fatalf("postURL(%+v) = %q, want https://vk.com/wall-123_5", post, got)
+				}
+			}
+		})
+	}
+}
+
+func TestIsTelegramChatUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"forbidden", &telegramAPIError{Code: http.StatusForbidden, Description: "Forbidden: bot was kicked from the channel chat"}, true},
+		{"chat not found", fmt.Errorf("send: %w", &telegramAPIError{Code: http.StatusBadRequest, Description: "Bad Request: chat not found"}), true},
+		{"other bad request", &telegramAPIError{Code: http.StatusBadRequest, Description: "Bad Request: message text is empty"}, false},
+		{"server error", &telegramAPIError{Code: http.StatusInternalServerError}, false},
+		{"network error", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTelegramChatUnavailable(tt.err); got != tt.want {
+				t.Fatalf("isTelegramChatUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVKFlexInt(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    vkFlexInt
+		wantErr bool
+	}{
+		{`42`, 42, false},
+		{`"-42"`, -42, false},
+		{`null`, 0, false},
+		{`""`, 0, false},
+		{`"abc"`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			var got vkFlexInt
+			err := json.Unmarshal([]byte(tt.raw), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPhotoAttachmentURLsAlbum(t *testing.T) {
+	photo := func(id int) vkPhoto {
+		return vkPhoto{ID: id, Sizes: []vkPhotoSize{{URL: fmt.Sprintf("https://vk.example/%d.jpg", id), Width: 800, Height: 600, Type: "x"}}}
+	}
+	var many []vkPhoto
+	for id := 1; id <= 12; id++ {
+		many = append(many, photo(id))
+	}
+	thumb := photo(100)
+
+	tests := []struct {
+		name  string
+		album vkAlbum
+		want  int
+		first string
+	}{
+		{"expanded", vkAlbum{Photos: []vkPhoto{photo(1), photo(2)}, Thumb: &thumb}, 2, "https://vk.example/1.jpg"},
+		{"thumbnail fallback", vkAlbum{Thumb: &thumb}, 1, "https://vk.example/100.jpg"},
+		{"capped to a media group", vkAlbum{Photos: many}, telegramMediaGroupLimit, "https://vk.example/1.jpg"},
+		{"nothing to show", vkAlbum{}, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			album := tt.album
+			post := vkPost{Attachments: []vkAttachment{{Type: "album", Album: &album}}}
+			urls := photoAttachmentURLs(post, 0)
+			if len(urls) != tt.want {
+				t.Fatalf("urls = %v, want %d", urls, tt.want)
+			}
+			if len(urls) > 0 && urls[0] != tt.first {
+				t.Fatalf("first url = %q, want %q", urls[0], tt.first)
+			}
+		})
+	}
+}
+
+func TestSelectLargestPhotoURLMaxDimension(t *testing.T) {
+	sizes := []vkPhotoSize{
+		{URL: "small", Width: 320, Height: 240},
+		{URL: "medium", Width: 1280, Height: 960},
+		{URL: "large", Width: 2560, Height: 1920},
+	}
+	tests := []struct {
+		name         string
+		sizes        []vkPhotoSize
+		maxDimension int
+		want         string
+		ok           bool
+	}{
+		{"no cap", sizes, 0, "large", true},
+		{"capped", sizes, 1280, "medium", true},
+		{"all above the cap", sizes, 100, "small", true},
+		{"no urls", []vkPhotoSize{{Width: 100, Height: 100}}, 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := selectLargestPhotoURL(tt.sizes, tt.maxDimension)
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("selectLargestPhotoURL = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTelegramSendOptionsApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   telegramSendOptions
+		reply  string
+		markup string
+	}{
+		{"none", telegramSendOptions{}, "", ""},
+		{"reply", telegramSendOptions{ReplyToMessageID: 7}, `{"allow_sending_without_reply":true,"message_id":7}`, ""},
+		{"button", telegramSendOptions{ButtonURL: "https://vk.com/wall-1_1"}, "", `{"inline_keyboard":[[{"text":"View on VK","url":"https://vk.com/wall-1_1"}]]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{}
+			if err := tt.opts.apply(params); err != nil {
+				t.Fatal(err)
+			}
+			if got := params.Get("reply_parameters"); got != tt.reply {
+				t.Fatalf("reply_parameters = %s, want %s", got, tt.reply)
+			}
+			if got := params.Get("reply_markup"); got != tt.markup {
+				t.Fatalf("reply_markup = %s, want %s", got, tt.markup)
+			}
+		})
+	}
+}
+
+func TestPublishPostReplyThread(t *testing.T) {
+	var replies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		replies = append(replies, r.Form.Get("reply_parameters"))
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"date":1}}`, 10+len(replies))
+	}))
+	defer server.Close()
+
+	s := newWallSyncer(zerolog.Nop(), nil, nil, newPublishLimiter(1), &vkCallMeter{}, wallSyncConfig{
+		TGAPIBase:    server.URL,
+		BotToken:     "token",
+		ChannelID:    "@test_channel",
+		ReplyThread:  true,
+		TextPosition: textPositionBefore,
+	})
+	photo := vkAttachment{Type: "photo", Photo: &vkPhoto{ID: 1, Sizes: []vkPhotoSize{{URL: "https://vk.example/1.jpg", Width: 800, Height: 600, Type: "x"}}}}
+	post := vkPost{ID: 1, OwnerID: -1, Text: "hello", Attachments: []vkAttachment{photo}}
+	if _, err := s.publishPost(context.Background(), post, post.Text, 0); err != nil {
+		t.Fatalf("publishPost: %v", err)
+	}
+	if len(replies) != 2 || replies[0] != "" || !strings.Contains(replies[1], `"message_id":11`) {
+		t.Fatalf("reply_parameters = %q, want the photo to reply to the text message", replies)
+	}
+}
+
+func TestSendParamsFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		silent  bool
+		protect bool
+	}{
+		{"disabled", false, false},
+		{"silent", true, false},
+		{"protected", false, true},
+		{"both", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forms := map[string]url.Values{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("parse form: %v", err)
+				}
+				method := path.Base(r.URL.Path)
+				forms[method] = r.Form
+				if method == "sendMediaGroup" {
+					fmt.Fprint(w, `{"ok":true,"result":[{"message_id":1,"date":1},{"message_id":2,"date":1}]}`)
+					return
+				}
+				fmt.Fprint(w, `{"ok":true,"result":{"message_id":1,"date":1}}`)
+			}))
+			defer server.Close()
+
+			s := newWallSyncer(zerolog.Nop(), nil, nil, newPublishLimiter(1), &vkCallMeter{}, wallSyncConfig{
+				TGAPIBase:           server.URL,
+				BotToken:            "token",
+				ChannelID:           "@test_channel",
+				DisableNotification: tt.silent,
+				ProtectContent:      tt.protect,
+			})
+			ctx := context.Background()
+			if _, err := s.publishTextToTelegram(ctx, "text", telegramSendOptions{}); err != nil {
+				t.Fatalf("sendMessage: %v", err)
+			}
+			if _, err := s.publishPhotoToTelegram(ctx, "https://vk.example/1.jpg", "caption", telegramSendOptions{}); err != nil {
+				t.Fatalf("sendPhoto: %v", err)
+			}
+			items := []telegramMedia{{Type: "photo", URL: "https://vk.example/1.jpg"}, {Type: "photo", URL: "https://vk.example/2.jpg"}}
+			if _, err := s.publishMediaGroupToTelegram(ctx, items, "caption", telegramSendOptions{}); err != nil {
+				t.Fatalf("sendMediaGroup: %v", err)
+			}
+
+			for _, method := range []string{"sendMessage", "sendPhoto", "sendMediaGroup"} {
+				form, ok := forms[method]
+				if !ok {
+					t.Fatalf("%s was not called", method)
+				}
+				if got := form.Has("disable_notification"); got != tt.silent {
+					t.Errorf("%s disable_notification present = %v, want %v", method, got, tt.silent)
+				}
+				if got := form.Has("protect_content"); got != tt.protect {
+					t.Errorf("%s protect_content present = %v, want %v", method, got, tt.protect)
+				}
+			}
+			if media := forms["sendMediaGroup"].Get("media"); strings.Contains(media, "disable_notification") || strings.Contains(media, "protect_content") {
+				t.Errorf("flags set per item instead of on the request: %s", media)
+			}
+		})
+	}
+}
+
+func TestSelectLargestPhotoURLTypeFallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		sizes        []vkPhotoSize
+		maxDimension int
+		want         string
+	}{
+		{"all zero dimensions", []vkPhotoSize{{URL: "x", Type: "x"}, {URL: "w", Type: "w"}, {URL: "z", Type: "z"}}, 0, "w"},
+		{"some dimensions missing", []vkPhotoSize{{URL: "sized", Type: "y", Width: 807, Height: 605}, {URL: "z", Type: "z"}}, 0, "z"},
+		{"empty url skipped", []vkPhotoSize{{Type: "w"}, {URL: "y", Type: "y"}}, 0, "y"},
+		{"unknown type loses", []vkPhotoSize{{URL: "unknown", Type: "?"}, {URL: "s", Type: "s"}}, 0, "s"},
+		{"type ranking under cap", []vkPhotoSize{{URL: "w", Type: "w"}, {URL: "z", Type: "z"}, {URL: "x", Type: "x"}}, 1280, "z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := selectLargestPhotoURL(tt.sizes, tt.maxDimension); got != tt.want || !ok {
+				t.Fatalf("selectLargestPhotoURL = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizePostTextEntities(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode bool
+		text   string
+		want   string
+	}{
+		{"ampersand", true, "Tom &amp; Jerry", "Tom & Jerry"},
+		{"numeric", true, "&#8470; 5 &#x1F600;", "№ 5 😀"},
+		{"angle brackets", true, "&lt;b&gt;", "<b>"},
+		{"plain text untouched", true, "обычный текст & 5 < 6", "обычный текст & 5 < 6"},
+		{"disabled", false, "Tom &amp; Jerry", "Tom &amp; Jerry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &wallSyncer{cfg: wallSyncConfig{DecodeEntities: tt.decode}}
+			if got := s.normalizePostText(tt.text); got != tt.want {
+				t.Fatalf("normalizePostText(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizePostTextMaxLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		text  string
+		want  string
+	}{
+		{"under the limit", 20, "короткий текст", "короткий текст"},
+		{"at the limit", 14, "короткий текст", "короткий текст"},
+		{"over the limit", 20, "один два три четыре пять шесть", "один два три четыре" + readMoreNotice},
+		{"inside link markup", 15, "см. [club1|Наша группа] подробнее", "см." + readMoreNotice},
+		{"disabled", 0, "один два три четыре пять шесть", "один два три четыре пять шесть"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &wallSyncer{cfg: wallSyncConfig{MaxTextLength: tt.limit}}
+			if got := s.normalizePostText(tt.text); got != tt.want {
+				t.Fatalf("normalizePostText(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) vkPost { return vkPost{Date: now.Add(d).Unix()} }
+	tests := []struct {
+		name  string
+		posts []vkPost
+		warn  bool
+	}{
+		{"no posts", nil, false},
+		{"posts in the past", []vkPost{at(-time.Hour), at(-time.Minute)}, false},
+		{"within tolerance", []vkPost{at(-time.Hour), at(4 * time.Minute)}, false},
+		{"newest post ahead", []vkPost{at(-time.Hour), at(10 * time.Minute)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			s := &wallSyncer{logger: zerolog.New(&buf)}
+			s.checkClockSkew(tt.posts, now)
+			if got := strings.Contains(buf.String(), "dated in the future"); got != tt.warn {
+				t.Fatalf("warned = %v, want %v; log: %s", got, tt.warn, buf.String())
+			}
+		})
+	}
+}
+
+func TestVerifyMessageIDs(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemStore()
+	if err := store.RecordTelegramPosts(ctx, -1, 1, []telegramMessage{{ID: 10}}, "@test_channel"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	s := &wallSyncer{
+		logger: zerolog.New(&buf),
+		store:  store,
+		cfg:    wallSyncConfig{ChannelID: "@test_channel", VerifyIDs: true},
+	}
+	post := vkPost{OwnerID: -1, ID: 2}
+
+	s.verifyMessageIDs(ctx, post, []telegramMessage{{ID: 11}, {ID: 12}})
+	if buf.Len() != 0 {
+		t.Fatalf("warned about increasing ids; log: %s", buf.String())
+	}
+	s.verifyMessageIDs(ctx, post, []telegramMessage{{ID: 12}})
+	if n := strings.Count(buf.String(), `"level":"warn"`); n != 1 || !strings.Contains(buf.String(), `"previous_message_id":12`) {
+		t.Fatalf("warnings = %d, want 1 for a repeated id; log: %s", n, buf.String())
+	}
+
+	buf.Reset()
+	s.cfg.VerifyIDs = false
+	s.verifyMessageIDs(ctx, post, []telegramMessage{{ID: 1}})
+	if buf.Len() != 0 {
+		t.Fatalf("warned with verification disabled; log: %s", buf.String())
+	}
+}
+
+func TestTelegramAPIBaseURL(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, `{"ok":true,"result":{"message_id":1,"date":1}}`)
+	}))
+	defer server.Close()
+
+	t.Setenv("TG_BOT_TOKEN", "token")
+	t.Setenv("TG_CHANNEL_ID", "@test_channel")
+	t.Setenv("VK_GROUP_ID", "1")
+	t.Setenv("TG_API_BASE_URL", server.URL+"/bot-api/")
+	cfg, err := loadWallSyncConfigFromEnv()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	s := newWallSyncer(zerolog.Nop(), nil, nil, newPublishLimiter(1), &vkCallMeter{}, cfg)
+	if _, err := s.publishTextToTelegram(context.Background(), "hello", telegramSendOptions{}); err != nil {
+		t.Fatalf("sendMessage: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/bot-api/bottoken/sendMessage" {
+		t.Fatalf("requested paths = %q, want the custom Bot API host", paths)
+	}
+}
+
+func TestPublishMediaGroupMessageCount(t *testing.T) {
+	items := []telegramMedia{
+		{Type: "photo", URL: "https://vk.example/1.jpg"},
+		{Type: "photo", URL: "https://vk.example/2.jpg"},
+		{Type: "photo", URL: "https://vk.example/3.jpg"},
+	}
+	tests := []struct {
+		name     string
+		response string
+		wantIDs  []int64
+		warn     bool
+	}{
+		{"one message per item", `[{"message_id":5,"date":1},{"message_id":6,"date":1},{"message_id":7,"date":1}]`, []int64{5, 6, 7}, false},
+		{"grouped into one message", `[{"message_id":9,"date":1}]`, []int64{9}, true},
+		{"fewer messages out of order", `[{"message_id":12,"date":1},{"message_id":11,"date":1}]`, []int64{11, 12}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"ok":true,"result":%s}`, tt.response)
+			}))
+			defer server.Close()
+
+			var buf bytes.Buffer
+			s := newWallSyncer(zerolog.New(&buf), nil, nil, newPublishLimiter(1), &vkCallMeter{}, wallSyncConfig{
+				TGAPIBase: server.URL,
+				BotToken:  "token",
+				ChannelID: "@test_channel",
+			})
+			msgs, err := s.publishMediaGroupToTelegram(context.Background(), items, "caption", telegramSendOptions{})
+			if err != nil {
+				t.Fatalf("sendMediaGroup: %v", err)
+			}
+			var ids []int64
+			for _, msg := range msgs {
+				ids = append(ids, msg.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) {
+				t.Fatalf("recorded ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if msgs[0].Text != "caption" {
+				t.Fatalf("head message text = %q, want the caption", msgs[0].Text)
+			}
+			if got := strings.Contains(buf.String(), `"level":"warn"`); got != tt.warn {
+				t.Fatalf("warned = %v, want %v; log: %s", got, tt.warn, buf.String())
+			}
+		})
+	}
+}
+
+func TestVKWallResponseSkipsMalformedItems(t *testing.T) {
+	raw := `{
+		"items": [
+			{"id": 3, "owner_id": -1, "date": 1705069800, "text": "numbers"},
+			{"id": "4", "owner_id": "-1", "from_id": "42", "date": "1705069900", "text": "quoted numbers"},
+			{"id": 5, "owner_id": -1, "text": {"broken": true}},
+			{"id": 6, "owner_id": -1, "text": "after the broken one"}
+		],
+		"groups": [{"id": 1, "name": "Test Group"}]
+	}`
+	var result vkWallResponse
+	if err := json.Unmarshal([]byte(raw), &result); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	var ids []int
+	for _, post := range result.Items {
+		ids = append(ids, post.ID)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint([]int{3, 4, 6}) {
+		t.Fatalf("decoded ids = %v, want the malformed item skipped", ids)
+	}
+	quoted := result.Items[1]
+	if quoted.OwnerID != -1 || quoted.FromID != 42 || quoted.Date != 1705069900 || quoted.Text != "quoted numbers" {
+		t.Fatalf("quoted item = %+v", quoted)
+	}
+	if len(result.Skipped) != 1 || !strings.Contains(result.Skipped[0].Error(), "item 2") {
+		t.Fatalf("skipped = %v, want item 2", result.Skipped)
+	}
+	if len(result.Groups) != 1 {
+		t.Fatalf("groups = %+v, want them kept", result.Groups)
+	}
+
+	var buf bytes.Buffer
+	s := &wallSyncer{logger: zerolog.New(&buf)}
+	s.warnSkippedItems("wall.get", result)
+	if n := strings.Count(buf.String(), `"level":"warn"`); n != 1 {
+		t.Fatalf("warnings = %d, want 1; log: %s", n, buf.String())
+	}
+}
+
+func TestVKAPIBaseURL(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.URL.Query().Get("access_token"))
+		fmt.Fprint(w, `{"response":{"items":[{"id":3,"owner_id":-1,"text":"hi"}]}}`)
+	}))
+	defer server.Close()
+
+	t.Setenv("TG_BOT_TOKEN", "token")
+	t.Setenv("TG_CHANNEL_ID", "@test_channel")
+	t.Setenv("VK_GROUP_ID", "1")
+	t.Setenv("VK_API_BASE_URL", server.URL+"/vk-proxy")
+	cfg, err := loadWallSyncConfigFromEnv()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	s := newWallSyncer(zerolog.Nop(), nil, nil, newPublishLimiter(1), &vkCallMeter{}, cfg)
+	posts, err := s.fetchVKPosts(context.Background(), "vk-token")
+	if err != nil {
+		t.Fatalf("fetchVKPosts: %v", err)
+	}
+	if len(posts) != 1 || posts[0].ID != 3 {
+		t.Fatalf("posts = %+v", posts)
+	}
+	if len(requests) != 1 || requests[0] != "/vk-proxy/method/wall.get vk-token" {
+		t.Fatalf("requests = %q, want wall.get on the overridden host", requests)
+	}
+}
+
+func TestRejectedMediaIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		want   int
+		wantOK bool
+	}{
+		{"second item", &telegramAPIError{Code: 400, Description: `Bad Request: failed to send message #2 with the error message "WEBPAGE_MEDIA_EMPTY"`}, 1, true},
+		{"first item", &telegramAPIError{Code: 400, Description: "Bad Request: failed to send message #1"}, 0, true},
+		{"wrapped", fmt.Errorf("send media group: %w", &telegramAPIError{Code: 400, Description: "message #3 rejected"}), 2, true},
+		{"zero", &telegramAPIError{Code: 400, Description: "message #0"}, 0, false},
+		{"no index", &telegramAPIError{Code: 400, Description: "Bad Request: wrong file identifier"}, 0, false},
+		{"not an API error", errors.New("message #2"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rejectedMediaIndex(tt.err)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("rejectedMediaIndex = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSourceAttribution(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		groupName string
+		want      string
+	}{
+		{"no format", "", "Test Group", "https://vk.com/wall-1_7"},
+		{"name not resolved", "Источник: {name}", "", "https://vk.com/wall-1_7"},
+		{"name and link", "Источник: {name} ({url})", "Test Group", "Источник: Test Group (https://vk.com/wall-1_7)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &wallSyncer{cfg: wallSyncConfig{GroupID: "1", SourceFormat: tt.format}, groupName: tt.groupName}
+			if got := s.sourceAttribution(vkPost{ID: 7, OwnerID: -1}); got != tt.want {
+				t.Fatalf("sourceAttribution = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributionUsesFromID(t *testing.T) {
+	s := &wallSyncer{
+		cfg:        wallSyncConfig{GroupID: "1", SourceFormat: "{author} in {name}: {url}"},
+		groupName:  "Test Group",
+		ownerNames: map[int]string{-1: "Test Group", 42: "Иван Петров", -5: "Partner Group"},
+	}
+
+	post := vkPost{ID: 7, OwnerID: -1, FromID: 42}
+	if got, want := s.sourceAttribution(post), "Иван Петров in Test Group: https://vk.com/wall-1_7"; got != want {
+		t.Fatalf("sourceAttribution = %q, want %q", got, want)
+	}
+	post.FromID = 0
+	if got, want := s.sourceAttribution(post), "Test Group in Test Group: https://vk.com/wall-1_7"; got != want {
+		t.Fatalf("sourceAttribution without from_id = %q, want %q", got, want)
+	}
+
+	repost := vkPost{ID: 8, OwnerID: -1, CopyHistory: []vkPost{{ID: 3, OwnerID: -5, FromID: 42}}}
+	if got, want := s.repostAttribution(repost), "Repost from [https://vk.com/wall-5_3|Иван Петров]"; got != want {
+		t.Fatalf("repostAttribution = %q, want %q", got, want)
+	}
+}
+
+func TestComposeTextOwnPostLink(t *testing.T) {
+	s := newWallSyncer(zerolog.Nop(), nil, nil, nil, &vkCallMeter{}, wallSyncConfig{GroupID: "1"})
+	post := vkPost{ID: 7, OwnerID: -1}
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"own link", "Подробнее: https://vk.com/wall-1_7", "Подробнее: https://vk.com/wall-1_7"},
+		{"own link on vk.ru", "Подробнее: vk.ru/wall-1_7", "Подробнее: vk.ru/wall-1_7"},
+		{"another post", "Прошлый пост: https://vk.com/wall-1_70", "Прошлый пост: https://vk.com/wall-1_70\n\nhttps://vk.com/wall-1_7"},
+		{"no link", "Новости", "Новости\n\nhttps://vk.com/wall-1_7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.composeText(post, tt.text); got != tt.want {
+				t.Fatalf("composeText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComposeTextLinkWhenEmpty(t *testing.T) {
+	photo := vkAttachment{Type: "photo", Photo: &vkPhoto{Sizes: []vkPhotoSize{{URL: "https://vk.example/1.jpg", Type: "x"}}}}
+	post := vkPost{ID: 7, OwnerID: -1, Date: 1705069800, Attachments: []vkAttachment{photo}}
+	tests := []struct {
+		name string
+		cfg  wallSyncConfig
+		want string
+	}{
+		{"link kept", wallSyncConfig{LinkWhenEmpty: true, Signature: "Редакция"}, "https://vk.com/wall-1_7\n\nРедакция"},
+		{"nothing left", wallSyncConfig{}, ""},
+		{"signature kept", wallSyncConfig{Signature: "Редакция"}, "Редакция"},
+		{"date and signature kept", wallSyncConfig{Signature: "Редакция", ShowDate: true, DateFormat: "2006-01-02", Location: time.UTC}, "📅 2024-01-12\n\nРедакция"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.GroupID = "1"
+			s := newWallSyncer(zerolog.Nop(), nil, nil, nil, &vkCallMeter{}, tt.cfg)
+			if got := s.composeText(post, ""); got != tt.want {
+				t.Fatalf("composeText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostLooksIncomplete(t *testing.T) {
+	photo := vkAttachment{Type: "photo", Photo: &vkPhoto{}}
+	tests := []struct {
+		name string
+		post vkPost
+		want bool
+	}{
+		{"empty with hash", vkPost{Hash: "h", Text: " \n "}, true},
+		{"empty without hash", vkPost{}, false},
+		{"text", vkPost{Hash: "h", Text: "hello"}, false},
+		{"attachments only", vkPost{Hash: "h", Attachments: []vkAttachment{photo}}, false},
+		{"repost only", vkPost{Hash: "h", CopyHistory: []vkPost{{Text: "original"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postLooksIncomplete(tt.post); got != tt.want {
+				t.Fatalf("postLooksIncomplete = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
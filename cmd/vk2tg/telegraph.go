@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	telegraphAPIBaseURL    = "https://api.telegra.ph"
+	telegraphMaxTitleRunes = 256
+)
+
+type telegraphNode struct {
+	Tag      string            `json:"tag"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	Children []any             `json:"children,omitempty"`
+}
+
+type telegraphPage struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+func (s *wallSyncer) usesTelegraph(text string) bool {
+	return s.cfg.UseTelegraph && utf8.RuneCountInString(text) >= s.cfg.TelegraphMinLength
+}
+
+// publishViaTelegraph creates an article for the post and sends its title
+// and link to Telegram. The page path is remembered per channel, so edits of
+// the post update the article rather than the short message.
+func (s *wallSyncer) publishViaTelegraph(ctx context.Context, post vkPost, text string, photoURLs []string) ([]telegramMessage, error) {
+	text, _ = renderVKText(text)
+	title := telegraphTitle(text)
+
+	page, err := s.callTelegraph(ctx, "createPage", title, telegraphContent(text, photoURLs))
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().
+		Str("telegraph_url", page.URL).
+		Msg("created Telegraph article for long post")
+	if err := s.store.SetSyncState(ctx, s.telegraphStateKey(post), page.Path); err != nil {
+		s.logger.Warn().Err(err).Str("telegraph_url", page.URL).Msg("failed to remember Telegraph article of the post")
+	}
+
+	summary := telegraphSummary(title, page)
+	if len(photoURLs) > 0 {
+		msg, err := s.publishPhotoToTelegram(ctx, photoURLs[0], summary, telegramSendOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return []telegramMessage{msg}, nil
+	}
+
+	msg, err := s.publishTextToTelegram(ctx, summary, telegramSendOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return []telegramMessage{msg}, nil
+}
+
+// telegraphArticle returns the path of the article the post was published as
+// in this channel, or "" when it went out as regular messages.
+func (s *wallSyncer) telegraphArticle(ctx context.Context, post vkPost) (string, error) {
+	path, _, err := s.store.GetSyncState(ctx, s.telegraphStateKey(post))
+	return path, err
+}
+
+// editTelegraphArticle rewrites the article at path with the edited text and
+// returns the summary its Telegram message should show.
+func (s *wallSyncer) editTelegraphArticle(ctx context.Context, post vkPost, text, path string) (string, error) {
+	text, _ = renderVKText(text)
+	title := telegraphTitle(text)
+	page, err := s.callTelegraph(ctx, "editPage/"+path, title, telegraphContent(text, s.photoURLs(post)))
+	if err != nil {
+		return "", err
+	}
+	return telegraphSummary(title, page), nil
+}
+
+func (s *wallSyncer) telegraphStateKey(post vkPost) string {
+	return fmt.Sprintf("telegraph:%s:%d_%d", s.cfg.ChannelID, post.OwnerID, post.ID)
+}
+
+func telegraphSummary(title string, page telegraphPage) string {
+	return fmt.Sprintf("%s\n\n%s", title, page.URL)
+}
+
+func (s *wallSyncer) callTelegraph(ctx context.Context, method, title string, content []telegraphNode) (telegraphPage, error) {
+	contentPayload, err := json.Marshal(content)
+	if err != nil {
+		return telegraphPage{}, fmt.Errorf("encode Telegraph content: %w", err)
+	}
+
+	params := url.Values{}
+	params.Set("access_token", s.cfg.TelegraphToken)
+	params.Set("title", title)
+	params.Set("content", string(contentPayload))
+	params.Set("return_content", "false")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.TelegraphAPIBase+"/"+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return telegraphPage{}, fmt.Errorf("build Telegraph request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return telegraphPage{}, fmt.Errorf("execute Telegraph request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return telegraphPage{}, fmt.Errorf("read Telegraph response: %w", err)
+	}
+
+	var env struct {
+		OK     bool          `json:"ok"`
+		Error  string        `json:"error"`
+		Result telegraphPage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &env); err != nil {
+		return telegraphPage{}, fmt.Errorf("decode Telegraph response: %w", err)
+	}
+	if !env.OK {
+		return telegraphPage{}, fmt.Errorf("telegraph API error: %s", env.Error)
+	}
+	if env.Result.URL == "" {
+		return telegraphPage{}, fmt.Errorf("telegraph API response missing page url")
+	}
+	return env.Result, nil
+}
+
+func telegraphTitle(text string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return "VK"
+	}
+	if utf8.RuneCountInString(title) > telegraphMaxTitleRunes {
+		runes := []rune(title)
+		title = string(runes[:telegraphMaxTitleRunes-1]) + "…"
+	}
+	return title
+}
+
+func telegraphContent(text string, photoURLs []string) []telegraphNode {
+	nodes := make([]telegraphNode, 0, len(photoURLs)+8)
+	for _, photoURL := range photoURLs {
+		nodes = append(nodes, telegraphNode{
+			Tag:   "img",
+			Attrs: map[string]string{"src": photoURL},
+		})
+	}
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		var children []any
+		for idx, line := range strings.Split(paragraph, "\n") {
+			if idx > 0 {
+				children = append(children, telegraphNode{Tag: "br"})
+			}
+			children = append(children, line)
+		}
+		nodes = append(nodes, telegraphNode{Tag: "p", Children: children})
+	}
+	return nodes
+}
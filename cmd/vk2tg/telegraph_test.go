@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTelegraphTitle(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"first line", "  Заголовок \nтело поста", "Заголовок"},
+		{"empty", " \n ", "VK"},
+		{"long", strings.Repeat("я", 300), strings.Repeat("я", telegraphMaxTitleRunes-1) + "…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := telegraphTitle(tt.text); got != tt.want {
+				t.Fatalf("telegraphTitle = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTelegraphContent(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		photos []string
+		want   string
+	}{
+		{"paragraphs", "one\n\n\n\ntwo", nil, `[{"tag":"p","children":["one"]},{"tag":"p","children":["two"]}]`},
+		{"line breaks", "a\nb", nil, `[{"tag":"p","children":["a",{"tag":"br"},"b"]}]`},
+		{"photos first", "text", []string{"https://vk.example/1.jpg"}, `[{"tag":"img","attrs":{"src":"https://vk.example/1.jpg"}},{"tag":"p","children":["text"]}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(telegraphContent(tt.text, tt.photos))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("telegraphContent = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncPublishesViaTelegraph(t *testing.T) {
+	var pages []string
+	telegraph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/createPage" || r.FormValue("access_token") != "telegraph-token" {
+			fmt.Fprint(w, `{"ok":false,"error":"unexpected request"}`)
+			return
+		}
+		pages = append(pages, r.FormValue("title"))
+		fmt.Fprint(w, `{"ok":true,"result":{"path":"Long-post-01-01","url":"https://telegra.ph/Long-post-01-01"}}`)
+	}))
+	defer telegraph.Close()
+
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	long := "Long post\n\n" + strings.Repeat("word ", 100)
+	_, vkServer := newFakeVK(t, newTestPost(1, long), newTestPost(2, "short post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{
+		"TG_USE_TELEGRAPH":       "true",
+		"TELEGRAPH_ACCESS_TOKEN": "telegraph-token",
+		"TELEGRAPH_MIN_LENGTH":   "200",
+		"TELEGRAPH_API_BASE_URL": telegraph.URL,
+	})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if len(pages) != 1 || pages[0] != "Long post" {
+		t.Fatalf("created pages = %q, want one for the long post", pages)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "https://telegra.ph/Long-post-01-01") || strings.Contains(text, "word word") {
+		t.Fatalf("channel message = %q, want just the article link", text)
+	}
+	sent, _ = store.TelegramPosts(ctx, -1, 2)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "short post") {
+		t.Fatalf("channel message = %q, want the short post sent directly", text)
+	}
+}
+
+func TestSyncEditsTelegraphArticles(t *testing.T) {
+	var calls []string
+	telegraph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, strings.TrimPrefix(r.URL.Path, "/")+" "+r.FormValue("title"))
+		fmt.Fprint(w, `{"ok":true,"result":{"path":"Long-post-01-01","url":"https://telegra.ph/Long-post-01-01"}}`)
+	}))
+	defer telegraph.Close()
+
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	long := func(title string) string { return title + "\n\n" + strings.Repeat("word ", 100) }
+	vk, vkServer := newFakeVK(t, newTestPost(1, long("Long post")), newTestPost(2, "short post"))
+	s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{
+		"TG_USE_TELEGRAPH":       "true",
+		"TELEGRAPH_ACCESS_TOKEN": "telegraph-token",
+		"TELEGRAPH_MIN_LENGTH":   "200",
+		"TELEGRAPH_API_BASE_URL": telegraph.URL,
+	})
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	vk.setPosts(newTestPost(1, long("Renamed post")), newTestPost(2, long("Grown post")))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("edit cycle: %v", err)
+	}
+
+	want := []string{"createPage Long post", "editPage/Long-post-01-01 Renamed post"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("Telegraph calls = %q, want %q", calls, want)
+	}
+	article, _ := store.LatestTelegramPosts(ctx, -1, 1)
+	if text, _ := tg.message("@test_channel", article[0].MessageID); text != "Renamed post\n\nhttps://telegra.ph/Long-post-01-01" {
+		t.Fatalf("article message = %q, want the new title", text)
+	}
+	grown, _ := store.LatestTelegramPosts(ctx, -1, 2)
+	if text, _ := tg.message("@test_channel", grown[0].MessageID); !strings.HasPrefix(text, "Grown post") {
+		t.Fatalf("message of a post grown past TELEGRAPH_MIN_LENGTH = %q, want it edited in place", text)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	textURLPattern = regexp.MustCompile(`https?://[^\s<>"\[\]]+`)
+
+	defaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "yclid", "ysclid", "_openstat"}
+)
+
+// stripTrackingParams removes tracking query parameters from every URL found
+// in text. Entries ending with "*" match by prefix. VK's "z" overlay parameter
+// is dropped only on vk.com links, where it never changes the target page.
+func stripTrackingParams(text string, params []string) string {
+	return textURLPattern.ReplaceAllStringFunc(text, func(raw string) string {
+		trimmed := strings.TrimRight(raw, ".,;:!?)")
+		return stripURLTracking(trimmed, params) + raw[len(trimmed):]
+	})
+}
+
+func stripURLTracking(raw string, params []string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.RawQuery == "" {
+		return raw
+	}
+
+	host := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(u.Hostname()), "www."), "m.")
+	vkHost := host == "vk.com" || host == "vk.ru"
+
+	query := u.Query()
+	removed := false
+	for name := range query {
+		if (vkHost && name == "z") || isTrackingParam(name, params) {
+			query.Del(name)
+			removed = true
+		}
+	}
+	if !removed {
+		return raw
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func isTrackingParam(name string, params []string) bool {
+	name = strings.ToLower(name)
+	for _, p := range params {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestStripTrackingParams(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			"utm params",
+			"Read https://example.com/news/1?utm_source=vk&utm_medium=social.",
+			"Read https://example.com/news/1.",
+		},
+		{
+			"meaningful query kept",
+			"https://example.com/search?q=go&utm_campaign=spring&page=2",
+			"https://example.com/search?page=2&q=go",
+		},
+		{
+			"untouched without tracking",
+			"https://example.com/item?id=5",
+			"https://example.com/item?id=5",
+		},
+		{
+			"vk overlay",
+			"https://vk.com/club1?z=photo-1_2&w=wall-1_3",
+			"https://vk.com/club1?w=wall-1_3",
+		},
+		{
+			"z kept off vk",
+			"https://example.com/?z=1",
+			"https://example.com/?z=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripTrackingParams(tt.text, defaultTrackingParams); got != tt.want {
+				t.Fatalf("stripTrackingParams(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
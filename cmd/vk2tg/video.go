@@ -0,0 +1,254 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const telegramMaxURLFileBytes = 20 << 20
+
+type vkVideo struct {
+	ID        int           `json:"id"`
+	OwnerID   int           `json:"owner_id"`
+	Title     string        `json:"title"`
+	AccessKey string        `json:"access_key"`
+	Player    string        `json:"player"`
+	Platform  string        `json:"platform"`
+	External  string        `json:"external"`
+	Files     vkVideoFiles  `json:"files"`
+	Image     []vkPhotoSize `json:"image"`
+
+	FileURL string `json:"-"`
+}
+
+type vkVideoFiles struct {
+	MP4240  string `json:"mp4_240"`
+	MP4360  string `json:"mp4_360"`
+	MP4480  string `json:"mp4_480"`
+	MP4720  string `json:"mp4_720"`
+	MP41080 string `json:"mp4_1080"`
+}
+
+func (f vkVideoFiles) byQuality(maxQuality int) []string {
+	candidates := []struct {
+		quality int
+		url     string
+	}{
+		{1080, f.MP41080},
+		{720, f.MP4720},
+		{480, f.MP4480},
+		{360, f.MP4360},
+		{240, f.MP4240},
+	}
+
+	urls := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		if c.url == "" || (maxQuality > 0 && c.quality > maxQuality) {
+			continue
+		}
+		urls = append(urls, c.url)
+	}
+	return urls
+}
+
+func (v vkVideo) key() string {
+	key := fmt.Sprintf("%d_%d", v.OwnerID, v.ID)
+	if v.AccessKey != "" {
+		key += "_" + v.AccessKey
+	}
+	return key
+}
+
+// link points at the video on its own platform for embedded YouTube, Vimeo
+// and similar videos, so Telegram shows that platform's rich preview, and at
+// the VK player otherwise.
+func (v vkVideo) link() string {
+	if external := v.externalURL(); external != "" {
+		return external
+	}
+	return fmt.Sprintf("https://vk.com/video%d_%d", v.OwnerID, v.ID)
+}
+
+var (
+	youtubeEmbedPattern = regexp.MustCompile(`^https?://(?:www\.)?youtube(?:-nocookie)?\.com/embed/([\w-]+)`)
+	vimeoEmbedPattern   = regexp.MustCompile(`^https?://player\.vimeo\.com/video/(\d+)`)
+)
+
+func (v vkVideo) externalURL() string {
+	if v.Platform == "" {
+		return ""
+	}
+	if v.External != "" {
+		return v.External
+	}
+	if m := youtubeEmbedPattern.FindStringSubmatch(v.Player); m != nil {
+		return "https://www.youtube.com/watch?v=" + m[1]
+	}
+	if m := vimeoEmbedPattern.FindStringSubmatch(v.Player); m != nil {
+		return "https://vimeo.com/" + m[1]
+	}
+	if strings.HasPrefix(v.Player, "https://") && !strings.Contains(v.Player, "vk.com/") {
+		return v.Player
+	}
+	return ""
+}
+
+const videoCacheSize = 256
+
+func videoCacheKey(post vkPost, video *vkVideo) string {
+	return fullTextKey(post) + ":" + video.key()
+}
+
+// resolveVideoFiles looks up the files of VK videos and picks one Telegram
+// can fetch. Results are remembered per post hash, like restored texts, so
+// unchanged posts don't cost a video.get call and file probes every cycle.
+func (s *wallSyncer) resolveVideoFiles(ctx context.Context, accessToken string, posts []vkPost) {
+	if s.videoFiles == nil {
+		s.videoFiles = make(map[string]vkVideo)
+	}
+	if len(s.videoFiles) > videoCacheSize {
+		clear(s.videoFiles)
+	}
+
+	var (
+		videos    []*vkVideo
+		cacheKeys []string
+	)
+	for _, post := range posts {
+		for _, att := range post.Attachments {
+			var video *vkVideo
+			switch {
+			case att.Type == "video" && att.Video != nil:
+				video = att.Video
+			case att.Type == "story" && att.Story != nil && att.Story.available() && att.Story.Video != nil:
+				video = att.Story.Video
+			default:
+				continue
+			}
+			key := videoCacheKey(post, video)
+			if cached, ok := s.videoFiles[key]; ok {
+				*video = cached
+				continue
+			}
+			if att.Type == "story" {
+				// Story videos come with their files inline.
+				video.FileURL = s.selectVideoFile(ctx, video.Files)
+				s.videoFiles[key] = *video
+				continue
+			}
+			videos = append(videos, video)
+			cacheKeys = append(cacheKeys, key)
+		}
+	}
+	if len(videos) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(videos))
+	for _, video := range videos {
+		keys = append(keys, video.key())
+	}
+
+	params := url.Values{}
+	params.Set("videos", strings.Join(keys, ","))
+
+	var result struct {
+		Items []vkVideo `json:"items"`
+	}
+	if err := s.callVK(ctx, "video.get", accessToken, params, &result); err != nil {
+		s.logger.Warn().
+			Err(err).
+			Int("videos", len(videos)).
+			Msg("failed to fetch VK video files, falling back to player links")
+		return
+	}
+
+	items := make(map[string]vkVideo, len(result.Items))
+	for _, item := range result.Items {
+		items[fmt.Sprintf("%d_%d", item.OwnerID, item.ID)] = item
+	}
+
+	for i, video := range videos {
+		item, ok := items[fmt.Sprintf("%d_%d", video.OwnerID, video.ID)]
+		if ok {
+			video.Platform = cmp.Or(video.Platform, item.Platform)
+			video.Player = cmp.Or(video.Player, item.Player)
+			video.External = cmp.Or(video.External, item.External)
+			// Embedded videos have no VK files; the link gives a better preview.
+			if video.externalURL() == "" {
+				video.Files = item.Files
+				video.FileURL = s.selectVideoFile(ctx, item.Files)
+			}
+		}
+		s.videoFiles[cacheKeys[i]] = *video
+	}
+}
+
+func (s *wallSyncer) selectVideoFile(ctx context.Context, files vkVideoFiles) string {
+	for _, fileURL := range files.byQuality(s.cfg.VideoMaxQuality) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, fileURL, nil)
+		if err != nil {
+			continue
+		}
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			s.logger.Debug().Err(err).Msg("failed to probe VK video file size")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		if resp.ContentLength > 0 && resp.ContentLength <= telegramMaxURLFileBytes {
+			return fileURL
+		}
+	}
+	return ""
+}
+
+func (s *wallSyncer) publishVideoToTelegram(ctx context.Context, videoURL, caption string, opts telegramSendOptions) (telegramMessage, error) {
+	if err := s.throttle(ctx); err != nil {
+		return telegramMessage{}, err
+	}
+	params := s.newSendParams()
+	params.Set("video", videoURL)
+	params.Set("supports_streaming", "true")
+	if caption != "" {
+		var err error
+		if caption, err = setRenderedText(params, "caption", "caption_entities", caption); err != nil {
+			return telegramMessage{}, err
+		}
+	}
+
+	if err := opts.apply(params); err != nil {
+		return telegramMessage{}, err
+	}
+
+	body, err := s.callTelegram(ctx, "sendVideo", params)
+	if err != nil {
+		return telegramMessage{}, err
+	}
+
+	msg, err := parseTelegramSendResponse(body)
+	if err != nil {
+		return telegramMessage{}, err
+	}
+	msg.Text = caption
+	return msg, nil
+}
+
+func videoLinks(post vkPost) []string {
+	var links []string
+	for _, att := range post.Attachments {
+		if att.Type != "video" || att.Video == nil || att.Video.FileURL != "" {
+			continue
+		}
+		links = append(links, att.Video.link())
+	}
+	return links
+}
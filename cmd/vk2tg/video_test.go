@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVKVideoFilesByQuality(t *testing.T) {
+	files := vkVideoFiles{MP4240: "240", MP4480: "480", MP4720: "720", MP41080: "1080"}
+	tests := []struct {
+		name       string
+		files      vkVideoFiles
+		maxQuality int
+		want       string
+	}{
+		{"no cap", files, 0, "1080 720 480 240"},
+		{"capped at 720", files, 720, "720 480 240"},
+		{"cap between qualities", files, 500, "480 240"},
+		{"below every file", files, 100, ""},
+		{"no files", vkVideoFiles{}, 720, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(tt.files.byQuality(tt.maxQuality), " "); got != tt.want {
+				t.Fatalf("byQuality(%d) = %q, want %q", tt.maxQuality, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSendsNativeVideo(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := "1048576"
+		if strings.HasSuffix(r.URL.Path, "/1080.mp4") {
+			size = "104857600"
+		}
+		w.Header().Set("Content-Length", size)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer files.Close()
+
+	tests := []struct {
+		name      string
+		files     vkVideoFiles
+		wantVideo string
+	}{
+		{"mp4 under the size cap", vkVideoFiles{MP4480: files.URL + "/480.mp4", MP4720: files.URL + "/720.mp4", MP41080: files.URL + "/1080.mp4"}, files.URL + "/720.mp4"},
+		{"only files over the size cap", vkVideoFiles{MP41080: files.URL + "/1080.mp4"}, ""},
+		{"no files", vkVideoFiles{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemStore()
+			tg, tgServer := newFakeTelegram(t)
+			post := newTestPost(1, "video post")
+			post.Attachments = []vkAttachment{{Type: "video", Video: &vkVideo{ID: 5, OwnerID: -1, Title: "clip"}}}
+			vk, vkServer := newFakeVK(t, post)
+			vk.videos = []vkVideo{{ID: 5, OwnerID: -1, Files: tt.files}}
+			s := newTestSyncer(t, store, tgServer, vkServer, map[string]string{"VK_VIDEO_MAX_QUALITY": "1080"})
+			ctx := context.Background()
+
+			if err := s.runOnce(ctx); err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			sent, _ := store.TelegramPosts(ctx, -1, 1)
+			if tt.wantVideo == "" {
+				if n := tg.countCalls("sendVideo @test_channel"); n != 0 {
+					t.Fatalf("sendVideo calls = %d, want the player link instead", n)
+				}
+				if len(sent) != 1 {
+					t.Fatalf("recorded messages = %+v", sent)
+				}
+				if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "https://vk.com/video-1_5") {
+					t.Fatalf("channel message = %q, want the player link", text)
+				}
+				return
+			}
+			if n := tg.countCalls("sendVideo @test_channel"); n != 1 {
+				t.Fatalf("sendVideo calls = %d, want 1", n)
+			}
+			var videos []string
+			for _, msg := range sent {
+				if media := tg.media["@test_channel/"+strconv.FormatInt(msg.MessageID, 10)]; media != "" {
+					videos = append(videos, media)
+				}
+			}
+			if len(videos) != 1 || videos[0] != tt.wantVideo {
+				t.Fatalf("sent videos = %q, want %q", videos, tt.wantVideo)
+			}
+		})
+	}
+}
+
+func TestVKVideoLink(t *testing.T) {
+	tests := []struct {
+		name  string
+		video vkVideo
+		want  string
+	}{
+		{"vk video", vkVideo{ID: 5, OwnerID: -1, Player: "https://vk.com/video_ext.php?oid=-1&id=5"}, "https://vk.com/video-1_5"},
+		{"youtube external url", vkVideo{ID: 5, OwnerID: -1, Platform: "YouTube", External: "https://youtu.be/abc123"}, "https://youtu.be/abc123"},
+		{"youtube player", vkVideo{ID: 5, OwnerID: -1, Platform: "YouTube", Player: "https://www.youtube.com/embed/abc-123?autoplay=0"}, "https://www.youtube.com/watch?v=abc-123"},
+		{"vimeo player", vkVideo{ID: 5, OwnerID: -1, Platform: "Vimeo", Player: "https://player.vimeo.com/video/4242"}, "https://vimeo.com/4242"},
+		{"platform with vk player", vkVideo{ID: 5, OwnerID: -1, Platform: "Coub", Player: "https://vk.com/video_ext.php?oid=-1&id=5"}, "https://vk.com/video-1_5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.video.link(); got != tt.want {
+				t.Fatalf("link = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncLinksExternalVideo(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	post := newTestPost(1, "video post")
+	post.Attachments = []vkAttachment{{Type: "video", Video: &vkVideo{ID: 5, OwnerID: -1, Title: "clip"}}}
+	vk, vkServer := newFakeVK(t, post)
+	vk.videos = []vkVideo{{ID: 5, OwnerID: -1, Platform: "YouTube", Player: "https://www.youtube.com/embed/abc123"}}
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if n := tg.countCalls("sendVideo @test_channel"); n != 0 {
+		t.Fatalf("sendVideo calls = %d, want the external link instead", n)
+	}
+	sent, _ := store.TelegramPosts(ctx, -1, 1)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v", sent)
+	}
+	text, _ := tg.message("@test_channel", sent[0].MessageID)
+	if !strings.Contains(text, "https://www.youtube.com/watch?v=abc123") || strings.Contains(text, "https://vk.com/video-1_5") {
+		t.Fatalf("channel message = %q, want the YouTube link", text)
+	}
+}
+
+func TestSyncResolvesVideoFilesOncePerPostHash(t *testing.T) {
+	var probes atomic.Int32
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		w.Header().Set("Content-Length", "1048576")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer files.Close()
+
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	videoPost := func(hash string) vkPost {
+		post := newTestPost(1, "video post")
+		post.Attachments = []vkAttachment{{Type: "video", Video: &vkVideo{ID: 5, OwnerID: -1, Title: "clip"}}}
+		post.Hash = hash
+		return post
+	}
+	vk, vkServer := newFakeVK(t, videoPost("v1"))
+	vk.videos = []vkVideo{{ID: 5, OwnerID: -1, Files: vkVideoFiles{MP4720: files.URL + "/720.mp4"}}}
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		vk.setPosts(videoPost("v1"))
+		if err := s.runOnce(ctx); err != nil {
+			t.Fatalf("cycle %d: %v", i+1, err)
+		}
+	}
+	if n := vk.calls["video.get"]; n != 1 {
+		t.Fatalf("video.get calls = %d over unchanged cycles, want 1", n)
+	}
+	if n := probes.Load(); n != 1 {
+		t.Fatalf("file probes = %d over unchanged cycles, want 1", n)
+	}
+
+	vk.setPosts(videoPost("v2"))
+	if err := s.runOnce(ctx); err != nil {
+		t.Fatalf("edit cycle: %v", err)
+	}
+	if n := vk.calls["video.get"]; n != 2 {
+		t.Fatalf("video.get calls = %d after an edit, want the files resolved again", n)
+	}
+	if n := tg.countCalls("sendVideo @test_channel"); n != 1 {
+		t.Fatalf("sendVideo calls = %d, want 1", n)
+	}
+}
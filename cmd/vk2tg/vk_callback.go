@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+type vkCallbackEvent struct {
+	Type    string          `json:"type"`
+	GroupID int             `json:"group_id"`
+	Secret  string          `json:"secret"`
+	EventID string          `json:"event_id"`
+	Object  json.RawMessage `json:"object"`
+}
+
+// vkCallbackHandler expects a non-empty secret: without it anyone reaching
+// the endpoint could push arbitrary posts into the channel.
+func vkCallbackHandler(supervisor *syncSupervisor, secret, confirmation string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+
+		var event vkCallbackEvent
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&event); err != nil {
+			zlog.Error().Err(err).Msg("decode VK callback payload failed")
+			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+
+		if secret == "" || subtle.ConstantTimeCompare([]byte(event.Secret), []byte(secret)) != 1 {
+			zlog.Warn().
+				Str("type", event.Type).
+				Int("group_id", event.GroupID).
+				Msg("VK callback rejected: secret mismatch")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		groupID := strconv.Itoa(event.GroupID)
+		if !supervisor.HasGroup(groupID) {
+			zlog.Warn().
+				Str("type", event.Type).
+				Int("group_id", event.GroupID).
+				Msg("VK callback rejected: unexpected group")
+			http.Error(w, "unknown group", http.StatusBadRequest)
+			return
+		}
+
+		switch event.Type {
+		case "confirmation":
+			writeVKCallbackResponse(w, confirmation)
+			return
+		case "wall_post_new":
+			var post vkPost
+			if err := json.Unmarshal(event.Object, &post); err != nil {
+				zlog.Error().Err(err).Str("event_id", event.EventID).Msg("decode VK callback post failed")
+				http.Error(w, "invalid post object", http.StatusBadRequest)
+				return
+			}
+			if queued, err := supervisor.Enqueue(groupID, post); err != nil || !queued {
+				zlog.Warn().
+					Int("post_id", post.ID).
+					Msg("VK callback queue full, post will be picked up by the next poll")
+				break
+			}
+			zlog.Info().
+				Int("post_id", post.ID).
+				Str("event_id", event.EventID).
+				Msg("queued post from VK callback")
+		default:
+			zlog.Debug().
+				Str("type", event.Type).
+				Msg("ignoring VK callback event")
+		}
+
+		writeVKCallbackResponse(w, "ok")
+	}
+}
+
+func writeVKCallbackResponse(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, body); err != nil {
+		zlog.Error().Err(err).Msg("write VK callback response failed")
+	}
+}
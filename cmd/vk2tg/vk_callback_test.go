@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func newCallbackTestSupervisor(filter string) (*syncSupervisor, *wallSyncer) {
+	cfg := wallSyncConfig{GroupID: "42", ChannelID: "@channel", WallFilter: filter}
+	syncer := newWallSyncer(zerolog.Nop(), nil, nil, nil, &vkCallMeter{}, cfg)
+	supervisor := &syncSupervisor{
+		logger:  zerolog.Nop(),
+		workers: map[string]*syncWorker{cfg.workerKey(): {cfg: cfg, syncer: syncer}},
+	}
+	return supervisor, syncer
+}
+
+func TestVKCallbackHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		body     string
+		status   int
+		response string
+		queued   int
+	}{
+		{
+			name:     "confirmation handshake",
+			secret:   "s3cret",
+			body:     `{"type":"confirmation","group_id":42,"secret":"s3cret"}`,
+			status:   http.StatusOK,
+			response: "abc123",
+		},
+		{
+			name:     "wall_post_new is queued",
+			secret:   "s3cret",
+			body:     `{"type":"wall_post_new","group_id":42,"secret":"s3cret","object":{"id":7,"owner_id":-42,"text":"hi"}}`,
+			status:   http.StatusOK,
+			response: "ok",
+			queued:   1,
+		},
+		{
+			name:   "wrong secret",
+			secret: "s3cret",
+			body:   `{"type":"wall_post_new","group_id":42,"secret":"nope","object":{"id":7,"owner_id":-42}}`,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "no secret configured",
+			secret: "",
+			body:   `{"type":"wall_post_new","group_id":42,"secret":"","object":{"id":7,"owner_id":-42}}`,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "unknown group",
+			secret: "s3cret",
+			body:   `{"type":"confirmation","group_id":7,"secret":"s3cret"}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			supervisor, syncer := newCallbackTestSupervisor("all")
+			handler := vkCallbackHandler(supervisor, tt.secret, "abc123")
+
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/vk/callback", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.response != "" && rec.Body.String() != tt.response {
+				t.Fatalf("body = %q, want %q", rec.Body.String(), tt.response)
+			}
+			if got := len(syncer.incoming); got != tt.queued {
+				t.Fatalf("queued = %d, want %d", got, tt.queued)
+			}
+		})
+	}
+}
+
+func TestWallFilterMatches(t *testing.T) {
+	own := vkPost{ID: 1, OwnerID: -42, FromID: -42}
+	guest := vkPost{ID: 2, OwnerID: -42, FromID: 100}
+	suggested := vkPost{ID: 3, OwnerID: -42, FromID: 100, PostType: "suggest"}
+	postponed := vkPost{ID: 4, OwnerID: -42, FromID: -42, PostType: "postpone"}
+	donut := own
+	donut.Donut.IsDonut = true
+
+	tests := []struct {
+		filter string
+		post   vkPost
+		want   bool
+	}{
+		{"all", own, true},
+		{"all", guest, true},
+		{"all", suggested, false},
+		{"all", postponed, false},
+		{"owner", own, true},
+		{"owner", guest, false},
+		{"others", guest, true},
+		{"others", own, false},
+		{"suggests", suggested, true},
+		{"suggests", own, false},
+		{"postponed", postponed, true},
+		{"postponed", own, false},
+		{"donut", donut, true},
+		{"donut", own, false},
+	}
+	for _, tt := range tests {
+		if got := wallFilterMatches(tt.filter, tt.post); got != tt.want {
+			t.Errorf("wallFilterMatches(%q, post %d) = %v, want %v", tt.filter, tt.post.ID, got, tt.want)
+		}
+	}
+}
+
+func TestVKCallbackPublishesPushedPost(t *testing.T) {
+	store := newTestMemStore()
+	tg, tgServer := newFakeTelegram(t)
+	_, vkServer := newFakeVK(t)
+	s := newTestSyncer(t, store, tgServer, vkServer, nil)
+	supervisor := &syncSupervisor{
+		logger:  zerolog.Nop(),
+		workers: map[string]*syncWorker{s.cfg.workerKey(): {cfg: s.cfg, syncer: s}},
+	}
+
+	body := fmt.Sprintf(`{"type":"wall_post_new","group_id":1,"secret":"s3cret","object":{"id":5,"owner_id":-1,"date":%d,"text":"pushed post"}}`, time.Now().Unix())
+	rec := httptest.NewRecorder()
+	vkCallbackHandler(supervisor, "s3cret", "abc123")(rec, httptest.NewRequest(http.MethodPost, "/vk/callback", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	select {
+	case post := <-s.incoming:
+		s.syncPushed(context.Background(), post)
+	default:
+		t.Fatal("wall_post_new was not queued")
+	}
+	sent, _ := store.TelegramPosts(context.Background(), -1, 5)
+	if len(sent) != 1 {
+		t.Fatalf("recorded messages = %+v, want the pushed post published", sent)
+	}
+	if text, _ := tg.message("@test_channel", sent[0].MessageID); !strings.Contains(text, "pushed post") {
+		t.Fatalf("channel message = %q", text)
+	}
+}
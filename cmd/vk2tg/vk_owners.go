@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const ownerNameCacheSize = 1024
+
+var vkBareMentionPattern = regexp.MustCompile(`@((?:id|club|public)(\d+))\b`)
+
+type vkProfile struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type vkGroup struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ownerNames maps VK owner ids to display names using the profiles and groups
+// returned with extended=1. Group ids are negative, as in owner_id.
+func (r vkWallResponse) ownerNames() map[int]string {
+	names := make(map[int]string, len(r.Profiles)+len(r.Groups))
+	for _, p := range r.Profiles {
+		if name := strings.TrimSpace(p.FirstName + " " + p.LastName); name != "" {
+			names[p.ID] = name
+		}
+	}
+	for _, g := range r.Groups {
+		if g.Name != "" {
+			names[-g.ID] = g.Name
+		}
+	}
+	return names
+}
+
+func (s *wallSyncer) rememberOwnerNames(names map[int]string) {
+	if s.ownerNames == nil || len(s.ownerNames)+len(names) > ownerNameCacheSize {
+		s.ownerNames = make(map[int]string, len(names))
+	}
+	for id, name := range names {
+		s.ownerNames[id] = name
+	}
+}
+
+// resolveBareMentions turns plain @id123 and @club123 references into wiki
+// links labelled with the owner's name, so they render as links in Telegram.
+// Unknown owners are left as written.
+func (s *wallSyncer) resolveBareMentions(text string) string {
+	if len(s.ownerNames) == 0 {
+		return text
+	}
+	return vkBareMentionPattern.ReplaceAllStringFunc(text, func(m string) string {
+		sub := vkBareMentionPattern.FindStringSubmatch(m)
+		id, err := strconv.Atoi(sub[2])
+		if err != nil {
+			return m
+		}
+		if !strings.HasPrefix(sub[1], "id") {
+			id = -id
+		}
+		name, ok := s.ownerNames[id]
+		if !ok {
+			return m
+		}
+		return fmt.Sprintf("[%s|%s]", sub[1], name)
+	})
+}
+
+// repostAttribution names the author of the original post for reposts. The
+// link points at the wall the original lives on, which differs from its
+// author when it was posted by another community or a user.
+func (s *wallSyncer) repostAttribution(post vkPost) string {
+	if len(post.CopyHistory) == 0 {
+		return ""
+	}
+	orig := post.CopyHistory[0]
+	name, ok := s.ownerNames[postAuthorID(orig)]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("Repost from [https://vk.com/wall%d_%d|%s]", orig.OwnerID, orig.ID, name)
+}
+
+// postAuthor names who wrote the post, falling back to the group name when
+// the author is unknown.
+func (s *wallSyncer) postAuthor(post vkPost) string {
+	if name, ok := s.ownerNames[postAuthorID(post)]; ok {
+		return name
+	}
+	return s.groupName
+}
+
+func postAuthorID(post vkPost) int {
+	if post.FromID != 0 {
+		return post.FromID
+	}
+	return post.OwnerID
+}
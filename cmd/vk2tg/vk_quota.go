@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// vkCallMeter counts VK API calls across all sync workers. VK limits requests
+// per access token and every worker shares the same token, so main creates one
+// meter, with its optional rate cap, for all of them.
+type vkCallMeter struct {
+	total atomic.Int64
+
+	mu           sync.Mutex
+	interval     time.Duration
+	next         time.Time
+	windowStart  time.Time
+	windowCount  int64
+	lastMinute   int64
+	lastReported int64
+}
+
+func (m *vkCallMeter) SetRate(perSecond int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if perSecond <= 0 {
+		m.interval = 0
+		return
+	}
+	m.interval = time.Second / time.Duration(perSecond)
+}
+
+func (m *vkCallMeter) Wait(ctx context.Context) error {
+	m.mu.Lock()
+	if m.interval == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	slot := m.next
+	if slot.Before(now) {
+		slot = now
+	}
+	m.next = slot.Add(m.interval)
+	m.mu.Unlock()
+
+	wait := time.Until(slot)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (m *vkCallMeter) Record() {
+	m.total.Add(1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate(time.Now())
+	m.windowCount++
+}
+
+func (m *vkCallMeter) rotate(now time.Time) {
+	if now.Sub(m.windowStart) < time.Minute {
+		return
+	}
+	if now.Sub(m.windowStart) < 2*time.Minute {
+		m.lastMinute = m.windowCount
+	} else {
+		m.lastMinute = 0
+	}
+	m.windowStart = now.Truncate(time.Minute)
+	m.windowCount = 0
+}
+
+func (m *vkCallMeter) Snapshot() (total, lastMinute int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate(time.Now())
+	return m.total.Load(), m.lastMinute
+}
+
+func (m *vkCallMeter) Report(ctx context.Context, logger zerolog.Logger) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			total, lastMinute := m.Snapshot()
+			if total == m.lastReported {
+				continue
+			}
+			m.lastReported = total
+			logger.Info().
+				Int64("vk_requests_last_minute", lastMinute).
+				Int64("vk_requests_total", total).
+				Msg("VK API usage")
+		}
+	}
+}